@@ -1,18 +1,44 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
+	"metrics-app/internal/alerting"
 	"metrics-app/internal/domain"
+	"metrics-app/internal/notify"
 	"metrics-app/internal/repository"
+	"metrics-app/internal/retention"
+	"metrics-app/internal/rollup"
 	"metrics-app/internal/router"
+	"metrics-app/internal/telemetry"
 	"metrics-app/internal/util"
 )
 
-const dbPath = "../db/metrics.db"
+var (
+	storageType = flag.String("storage", "sqlite", "metric store backend: sqlite or inmemory")
+	dbPath      = flag.String("db", "../db/metrics.db", "path of the SQLite database file")
+	capacity    = flag.Int("capacity", 0, "maximum number of samples kept by the inmemory store; 0 means unbounded")
+
+	internalAddr = flag.String("internal-addr", "localhost:9091", "listen address of the internal self-instrumentation endpoint; empty disables it")
+
+	retentionPeriod = flag.Duration("retention", 0, "delete samples older than this, e.g. 720h; 0 keeps everything")
+	purgeInterval   = flag.Duration("purge-interval", time.Hour, "how often samples older than -retention are deleted")
+	vacuumInterval  = flag.Duration("vacuum-interval", 24*time.Hour, "minimum time between SQLite vacuums after purging")
+
+	rollupInterval    = flag.Duration("rollup-interval", time.Minute, "how often samples are rolled up into the 1m and 1h tiers; 0 disables rollups")
+	rollupRetention1m = flag.Duration("rollup-retention-1m", 0, "delete 1m rollups older than this; 0 keeps everything")
+	rollupRetention1h = flag.Duration("rollup-retention-1h", 0, "delete 1h rollups older than this; 0 keeps everything")
+
+	alertRules    = flag.String("alert-rules", "", "path of a JSON file of alert rules; empty disables alerting")
+	alertInterval = flag.Duration("alert-interval", 30*time.Second, "how often alert rules are evaluated")
+)
 
 func LoggerInitialize() (util.MetricsLogger, error) {
 
@@ -37,31 +63,108 @@ func LoggerInitialize() (util.MetricsLogger, error) {
 
 func main() {
 
+	flag.Parse()
+
 	logger, err := LoggerInitialize()
 	if err != nil {
 		fmt.Println("Error while initializing the logger..", err)
 		return
 	}
 
-	util.CheckAndCreateLogFolder("../db")
-
-	storageType := "sqlite" // Or "inmemory"
+	// Rules are checked before the store is opened so a typo fails fast.
+	var (
+		rules     []alerting.Rule
+		receivers []notify.Receiver
+	)
+	if *alertRules != "" {
+		if *alertInterval <= 0 {
+			log.Fatalf("-alert-interval must be positive")
+		}
+		if rules, err = alerting.LoadRules(*alertRules); err != nil {
+			log.Fatalf("Failed to load alert rules: %v", err)
+		}
+		if receivers, err = notify.LoadReceivers(*alertRules); err != nil {
+			log.Fatalf("Failed to load alert receivers: %v", err)
+		}
+	}
 
 	var metricStore domain.MetricStore
 
-	switch storageType {
+	switch *storageType {
 	case "sqlite":
-		metricStore = repository.NewSQLiteStore(dbPath)
+		util.CheckAndCreateLogFolder(filepath.Dir(*dbPath))
+		metricStore = repository.NewSQLiteStore(*dbPath)
+	case "inmemory":
+		metricStore = repository.NewInMemoryStore(*capacity)
 	default:
-		log.Fatalf("Unknown storage type: %s", storageType)
+		log.Fatalf("Unknown storage type: %s", *storageType)
 	}
 
+	logger.LogEvent(util.LOG_LEVEL_INFO, "Using metric store - ", *storageType)
+
 	if err := metricStore.Init(); err != nil {
 		log.Fatalf("Failed to initialize metric store: %v", err)
 	}
 	defer metricStore.Close()
 
-	router.Run(metricStore, &logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	var background sync.WaitGroup
+
+	runInBackground := func(run func(ctx context.Context)) {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			run(ctx)
+		}()
+	}
+
+	roller, canRollUp := metricStore.(rollup.Roller)
+	rollupsEnabled := canRollUp && *rollupInterval > 0
+
+	if rollupsEnabled {
+		// Raw samples and 1m buckets must outlive the rollup that reads them.
+		if *retentionPeriod > 0 && *retentionPeriod < *rollupInterval+time.Minute {
+			log.Fatalf("-retention must be at least -rollup-interval plus one minute when rollups are enabled")
+		}
+		if *rollupRetention1m > 0 && *rollupRetention1m < *rollupInterval+time.Hour {
+			log.Fatalf("-rollup-retention-1m must be at least -rollup-interval plus one hour")
+		}
+
+		worker := rollup.NewWorker(roller, &logger, *rollupInterval, map[string]time.Duration{
+			"1m": *rollupRetention1m,
+			"1h": *rollupRetention1h,
+		})
+		runInBackground(worker.Run)
+	}
+
+	if *retentionPeriod > 0 {
+		purger := retention.NewPurger(metricStore, &logger, *retentionPeriod, *purgeInterval, *vacuumInterval)
+		runInBackground(purger.Run)
+	}
+
+	var alerts *alerting.Engine
+	if *alertRules != "" {
+		alerts = alerting.NewEngine(metricStore, &logger, rules, *alertInterval)
+
+		if len(receivers) > 0 {
+			outbox, ok := metricStore.(notify.Outbox)
+			if !ok {
+				outbox = notify.NewMemoryOutbox()
+			}
+			dispatcher := notify.NewDispatcher(outbox, &logger, receivers)
+			alerts.SetNotifier(dispatcher)
+			runInBackground(dispatcher.Run)
+		}
+		runInBackground(alerts.Run)
+	}
+
+	tel := telemetry.New()
+	tel.WatchLogger(&logger)
+
+	router.Run(metricStore, &logger, tel, alerts, *internalAddr)
+
+	cancel()
+	background.Wait()
 }
 
 func ConstructAndCreateLogFolder() {
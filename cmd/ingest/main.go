@@ -2,60 +2,347 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"log"
-	"math/rand"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
 	"time"
 
+	"metrics-app/internal/agent"
+	"metrics-app/internal/collector"
 	"metrics-app/internal/domain"
 	"metrics-app/internal/repository"
+	"metrics-app/internal/synthetic"
 	"metrics-app/internal/util"
 )
 
-const dbPath = "../db/metrics.db"
+var (
+	dbPath   = flag.String("db", "../db/metrics.db", "path of the SQLite database file")
+	source   = flag.String("source", "proc", "where metrics come from: proc samples this host until stopped, synthetic generates the -from to -to range and exits")
+	interval = flag.Duration("interval", 10*time.Second, "how often the host is sampled")
+	jitter   = flag.Duration("jitter", time.Second, "random delay of up to this much before every collection; must be less than -interval")
+	host     = flag.String("host", "", "value of the host label of collected samples; defaults to the hostname")
+
+	flushInterval  = flag.Duration("flush-interval", 30*time.Second, "how often collected samples are written")
+	batchSize      = flag.Int("batch-size", 500, "write as soon as this many samples are pending")
+	maxPending     = flag.Int("max-pending", 100000, "samples kept while writes fail; the oldest are dropped beyond this")
+	healthInterval = flag.Duration("health-interval", time.Minute, "how often the agent logs its health")
+
+	pushURL       = flag.String("push", "", "base URL of an API server to push samples to, e.g. http://metrics:8080, instead of writing to -db")
+	spoolDir      = flag.String("spool", "../spool", "directory samples are spooled in until the -push server takes them")
+	spoolMaxBytes = flag.Int64("spool-max-bytes", 256<<20, "size the spool may grow to; the oldest samples are dropped beyond this")
+
+	profile = flag.String("profile", "diurnal", "comma separated synthetic load profiles: diurnal, burst, step, leak, outage")
+	hosts   = flag.Int("hosts", 1, "number of simulated hosts")
+	from    = flag.String("from", "", "start of the synthetic range, RFC 3339; defaults to 5 minutes before -to")
+	to      = flag.String("to", "", "end of the synthetic range, RFC 3339; defaults to now")
+	step    = flag.Duration("step", 10*time.Second, "time between synthetic metrics")
+	seed    = flag.Int64("seed", 0, "seed of the synthetic load; 0 picks one, which is logged so the run can be repeated")
+)
+
+const (
+	// maxPushBatch is the most samples POST /samples accepts in one request.
+	maxPushBatch = 10000
+	// maxSpooledBatches is how far synthetic generation may run ahead of the
+	// -push server.
+	maxSpooledBatches = 100
+)
+
+func LoggerInitialize() (util.MetricsLogger, error) {
+
+	var metricsLogger util.MetricsLogger
+
+	ConstructAndCreateLogFolder()
+
+	if err := metricsLogger.Init("ingest.log", false); err != nil {
+		fmt.Println("Failed to initialize logger:", err)
+		return util.MetricsLogger{}, err
+	}
+
+	currentTime := time.Now().Format(time.RFC3339)
+
+	fmt.Fprintf(os.Stderr, "\n%s: MetricsApp Ingest Agent started \n", currentTime)
+
+	return metricsLogger, nil
+
+}
 
 func main() {
 
-	util.CheckAndCreateLogFolder("../db")
+	flag.Parse()
+
+	if *batchSize <= 0 || *maxPending < *batchSize {
+		log.Fatalf("-batch-size must be positive and -max-pending at least -batch-size")
+	}
+	if *pushURL != "" {
+		if u, err := url.Parse(*pushURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("-push must be an absolute http or https URL")
+		}
+		if *batchSize > maxPushBatch {
+			log.Fatalf("-batch-size must be at most %d with -push", maxPushBatch)
+		}
+	}
+
+	switch *source {
+	case "proc":
+		collectAndIngest()
+	case "synthetic":
+		generateAndIngest()
+	default:
+		log.Fatalf("Unknown source: %s", *source)
+	}
+}
+
+// output is where samples go: the -db store, or the spool of the -push
+// server, which is replayed in the background until ctx is done.
+type output struct {
+	sink agent.Sink
+	push *agent.PushSink
+
+	wg    sync.WaitGroup
+	close func()
+}
+
+func openOutput(ctx context.Context, logger *util.MetricsLogger) *output {
+	o := &output{}
+	if *pushURL == "" {
+		sqliteStore := openStore()
+		o.sink = agent.NewStoreSink(sqliteStore, logger)
+		o.close = func() { sqliteStore.Close() }
+		return o
+	}
+
+	spool, err := agent.OpenSpool(*spoolDir, *spoolMaxBytes)
+	if err != nil {
+		log.Fatalf("Failed to open the spool: %v", err)
+	}
+	o.push = agent.NewPushSink(*pushURL, spool, logger)
+	o.sink = o.push
+	o.close = func() {}
+
+	o.wg.Add(1)
+	go func() {
+		defer o.wg.Done()
+		o.push.Run(ctx)
+	}()
+	return o
+}
+
+// stop waits for the replay of the spool to end, makes one last attempt and
+// reports how many samples are left in the spool.
+func (o *output) stop() int {
+	defer o.close()
+	if o.push == nil {
+		return 0
+	}
+	o.wg.Wait()
+
+	// Whatever the server does not take stays spooled for the next run.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	o.push.Replay(ctx)
+
+	_, spooled := o.push.Spool().Len()
+	return spooled
+}
 
-	sqliteStore := repository.NewSQLiteStore(dbPath)
+func openStore() *repository.SQLiteStore {
+	util.CheckAndCreateLogFolder(filepath.Dir(*dbPath))
+
+	sqliteStore := repository.NewSQLiteStore(*dbPath)
 	if err := sqliteStore.Init(); err != nil {
 		log.Fatalf("Failed to initialize SQLite store for ingestion: %v", err)
 	}
-	defer sqliteStore.Close()
+	return sqliteStore
+}
+
+// collectAndIngest samples this host and writes the samples to -db or
+// pushes them to -push until SIGINT or SIGTERM, then writes what is still
+// pending.
+func collectAndIngest() {
+	if *interval <= 0 || *flushInterval <= 0 || *healthInterval <= 0 {
+		log.Fatalf("-interval, -flush-interval and -health-interval must be positive")
+	}
+	if *jitter < 0 || *jitter >= *interval {
+		log.Fatalf("-jitter must be at least 0 and less than -interval")
+	}
+
+	hostname := *host
+	if hostname == "" {
+		var err error
+		if hostname, err = os.Hostname(); err != nil {
+			log.Fatalf("Failed to read the hostname, set -host: %v", err)
+		}
+	}
+
+	c, err := collector.New(domain.Labels{"host": hostname})
+	if err != nil {
+		log.Fatalf("Failed to start the collector: %v", err)
+	}
 
-	generateAndIngest(sqliteStore)
+	logger, err := LoggerInitialize()
+	if err != nil {
+		log.Fatalf("Error while initializing the logger: %v", err)
+	}
+	defer logger.DeInit()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	out := openOutput(ctx, &logger)
+
+	a := agent.New(c.Collect, out.sink, &logger, *interval)
+	a.Jitter = *jitter
+	a.FlushInterval = *flushInterval
+	a.BatchSize = *batchSize
+	a.MaxPending = *maxPending
+	a.HealthInterval = *healthInterval
+
+	log.Printf("Collecting metrics of %s every %s...", hostname, *interval)
+	a.Run(ctx)
+
+	h := a.Health()
+	lost := h.Dropped + int64(h.Pending)
+	spooled := out.stop()
+
+	if out.push != nil {
+		lost += out.push.Dropped()
+		log.Printf("Agent stopped after spooling %d samples; %d are left in %s, %d were lost.", h.Written, spooled, *spoolDir, lost)
+		return
+	}
+	log.Printf("Agent stopped after writing %d samples; %d were lost.", h.Written, lost)
 }
 
-func generateAndIngest(s domain.MetricStore) {
-	rand.Seed(time.Now().UnixNano())
+func ConstructAndCreateLogFolder() {
+	logPath := ".." + string(os.PathSeparator) + "log"
+	util.SetLoggerPath(logPath)
+	util.CheckAndCreateLogFolder(logPath)
+	util.SetCommonLoggerAttributes(3)
+}
 
-	endTime := time.Now()
-	startTime := endTime.Add(-5 * time.Minute)
+// generateAndIngest writes the synthetic load of the -from to -to range to
+// -db or pushes it to -push, then exits.
+func generateAndIngest() {
+	config, err := syntheticConfig()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
 
-	log.Printf("Ingesting data from %s to %s (past 5 minutes)...", startTime.Format(time.RFC3339), endTime.Format(time.RFC3339))
+	logger, err := LoggerInitialize()
+	if err != nil {
+		log.Fatalf("Error while initializing the logger: %v", err)
+	}
+	defer logger.DeInit()
 
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	for t := startTime; t.Before(endTime) || t.Equal(endTime); t = t.Add(10 * time.Second) {
+	out := openOutput(ctx, &logger)
 
-		cpuLoad := rand.Float64() * 100.0
+	log.Printf("Generating %v load of %d hosts from %s to %s every %s with -seed %d...", config.Profiles, config.Hosts,
+		time.Unix(config.Start, 0).UTC().Format(time.RFC3339), time.Unix(config.End, 0).UTC().Format(time.RFC3339), *step, config.Seed)
 
-		concurrency := rand.Intn(500001)
+	var (
+		pending []domain.Sample
+		written int
+	)
+	// flush writes the pending samples in batches of at most -batch-size,
+	// since one timestamp of a large fleet can exceed it and the server
+	// refuses larger pushes. Unless all, a last partial batch is left
+	// pending.
+	flush := func(all bool) error {
+		for len(pending) >= *batchSize || (all && len(pending) > 0) {
+			n := min(len(pending), *batchSize)
+			if err := out.sink.Write(ctx, pending[:n]); err != nil {
+				return err
+			}
+			written += n
+			pending = append(pending[:0], pending[n:]...)
 
-		timestamp := t.Unix()
+			// Let the server catch up rather than fill the spool until it
+			// drops samples.
+			for out.push != nil && ctx.Err() == nil {
+				if batches, _ := out.push.Spool().Len(); batches < maxSpooledBatches {
+					break
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 
-		metric := domain.Metric{
-			Timestamp:   timestamp,
-			CPULoad:     cpuLoad,
-			Concurrency: concurrency,
+	err = synthetic.Generate(config, func(metrics []domain.Metric) error {
+		for _, m := range metrics {
+			pending = append(pending, m.Samples()...)
 		}
+		return flush(false)
+	})
+	if err == nil {
+		err = flush(true)
+	}
+	if err != nil {
+		log.Printf("Stopped generating after %d samples: %v", written, err)
+	}
 
-		err := s.StoreMetric(ctx, metric)
-		if err != nil {
-			log.Printf("Error inserting data for timestamp %d: %v", timestamp, err)
-			continue
+	if out.push != nil {
+		// Wait for the spool to drain unless interrupted.
+		for ctx.Err() == nil {
+			if batches, _ := out.push.Spool().Len(); batches == 0 {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
 		}
+		stop()
+		spooled := out.stop()
+		log.Printf("Pushed %d of %d samples; %d are left in %s.", written-spooled, written, spooled, *spoolDir)
+		return
 	}
 
+	out.stop()
+	log.Printf("Stored %d samples.", written)
 	log.Println("Data ingestion complete.")
 }
+
+func syntheticConfig() (synthetic.Config, error) {
+	profiles, err := synthetic.ParseProfiles(*profile)
+	if err != nil {
+		return synthetic.Config{}, err
+	}
+
+	end := time.Now()
+	if *to != "" {
+		if end, err = time.Parse(time.RFC3339, *to); err != nil {
+			return synthetic.Config{}, fmt.Errorf("-to: %w", err)
+		}
+	}
+	start := end.Add(-5 * time.Minute)
+	if *from != "" {
+		if start, err = time.Parse(time.RFC3339, *from); err != nil {
+			return synthetic.Config{}, fmt.Errorf("-from: %w", err)
+		}
+	}
+	if *step < time.Second || *step%time.Second != 0 {
+		return synthetic.Config{}, fmt.Errorf("-step must be a whole number of seconds")
+	}
+
+	config := synthetic.Config{
+		Profiles: profiles,
+		Hosts:    *hosts,
+		Start:    start.Unix(),
+		End:      end.Unix(),
+		Step:     int64(*step / time.Second),
+		Seed:     *seed,
+	}
+	if config.Seed == 0 {
+		config.Seed = time.Now().UnixNano()
+	}
+	return config, config.Validate()
+}
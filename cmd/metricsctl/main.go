@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"metrics-app/internal/domain"
+	"metrics-app/internal/format"
+	"metrics-app/internal/repository"
+	"metrics-app/internal/util"
+)
+
+const usage = `Usage:
+  metricsctl export [flags]        write a time range of samples as CSV or NDJSON
+  metricsctl import [flags] FILE   store the samples of a CSV or NDJSON file; - reads stdin
+
+Run "metricsctl <command> -h" for the flags of a command.
+`
+
+func main() {
+	log.SetFlags(0)
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = runExport(ctx, os.Args[2:])
+	case "import":
+		err = runImport(ctx, os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stdout, usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("metricsctl %s: %v", os.Args[1], err)
+	}
+}
+
+func openStore(path string) (domain.MetricStore, error) {
+	util.CheckAndCreateLogFolder(filepath.Dir(path))
+
+	store := repository.NewSQLiteStore(path)
+	if err := store.Init(); err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	return store, nil
+}
+
+// parseTime reads an RFC 3339 time or unix seconds.
+func parseTime(value string) (int64, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Unix(), nil
+	}
+	var ts int64
+	if _, err := fmt.Sscan(value, &ts); err != nil {
+		return 0, fmt.Errorf("%q is neither RFC 3339 nor unix seconds", value)
+	}
+	return ts, nil
+}
+
+func runExport(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	dbPath := flags.String("db", "../db/metrics.db", "path of the SQLite database file")
+	from := flags.String("from", "", "start of the range, RFC 3339 or unix seconds; defaults to 24 hours before -to")
+	to := flags.String("to", "", "end of the range, RFC 3339 or unix seconds; defaults to now")
+	name := flags.String("name", "", "only export the series of this metric")
+	formatName := flags.String("format", "", "csv or ndjson; defaults to the extension of -o, else ndjson")
+	output := flags.String("o", "-", "file to write; - writes stdout")
+	flags.Parse(args)
+
+	end := time.Now().Unix()
+	var err error
+	if *to != "" {
+		if end, err = parseTime(*to); err != nil {
+			return fmt.Errorf("-to: %w", err)
+		}
+	}
+	start := end - 24*3600
+	if *from != "" {
+		if start, err = parseTime(*from); err != nil {
+			return fmt.Errorf("-from: %w", err)
+		}
+	}
+	if start > end {
+		return fmt.Errorf("-from must not be after -to")
+	}
+
+	f := format.NDJSON
+	switch {
+	case *formatName != "":
+		f, err = format.Parse(*formatName)
+	case *output != "-":
+		if byPath, pathErr := format.FromPath(*output); pathErr == nil {
+			f = byPath
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	store, err := openStore(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	query := domain.Query{Selector: domain.SeriesSelector{Name: *name}, Start: start, End: end}
+	written, err := format.Export(ctx, store, query, w, f)
+	if err != nil {
+		return fmt.Errorf("after %d samples: %w", written, err)
+	}
+	log.Printf("Exported %d samples.", written)
+	return nil
+}
+
+func runImport(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	dbPath := flags.String("db", "../db/metrics.db", "path of the SQLite database file")
+	formatName := flags.String("format", "", "csv or ndjson; defaults to the extension of FILE")
+	batchSize := flags.Int("batch-size", 1000, "samples written per batch")
+	dryRun := flags.Bool("dry-run", false, "validate and count the rows without writing them")
+	maxReports := flags.Int("max-reports", 20, "rejected rows reported individually; the rest are only counted")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected one FILE, got %d", flags.NArg())
+	}
+	path := flags.Arg(0)
+	if *batchSize <= 0 {
+		return fmt.Errorf("-batch-size must be positive")
+	}
+
+	var (
+		f   format.Format
+		err error
+	)
+	switch {
+	case *formatName != "":
+		f, err = format.Parse(*formatName)
+	case path == "-":
+		err = fmt.Errorf("-format is required when reading stdin")
+	default:
+		f, err = format.FromPath(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	// A dry run reads the store to count the rows it already has, without
+	// migrating or creating it; when it is missing every row would be new.
+	var store domain.MetricStore
+	if !*dryRun {
+		if store, err = openStore(*dbPath); err != nil {
+			return err
+		}
+	} else if _, statErr := os.Stat(*dbPath); statErr == nil {
+		readOnly := repository.NewReadOnlySQLiteStore(*dbPath)
+		if err = readOnly.Init(); err != nil {
+			return fmt.Errorf("opening %s: %w", *dbPath, err)
+		}
+		store = readOnly
+	} else {
+		store = repository.NewInMemoryStore(0)
+		if err = store.Init(); err != nil {
+			return err
+		}
+	}
+	defer store.Close()
+
+	reported := 0
+	result, err := format.Import(ctx, store, r, f, format.ImportOptions{
+		BatchSize: *batchSize,
+		DryRun:    *dryRun,
+		OnReject: func(line int, err error) {
+			if reported < *maxReports {
+				log.Printf("line %d: %v", line, err)
+			}
+			reported++
+		},
+	})
+
+	verb := "Stored"
+	if *dryRun {
+		verb = "Would store"
+	}
+	log.Printf("Read %d rows. %s %d; %d invalid, %d duplicates within a batch, %d already stored, %d failed.",
+		result.Read, verb, result.Stored, result.Invalid, result.Duplicates, result.Existing, result.Failed)
+
+	if err != nil {
+		return err
+	}
+	if result.Invalid > 0 || result.Failed > 0 {
+		return fmt.Errorf("%d rows were rejected", result.Invalid+result.Failed)
+	}
+	return nil
+}
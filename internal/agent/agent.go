@@ -0,0 +1,213 @@
+package agent
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"metrics-app/internal/domain"
+	"metrics-app/internal/util"
+)
+
+// CollectFunc returns the samples of one collection at now.
+type CollectFunc func(now time.Time) ([]domain.Sample, error)
+
+// Sink receives the samples an Agent collects. A failed Write is retried
+// with the same samples and those collected since.
+type Sink interface {
+	Write(ctx context.Context, samples []domain.Sample) error
+}
+
+// Health counts what an Agent has done since it started.
+type Health struct {
+	Collections   int64  `json:"collections"`
+	CollectErrors int64  `json:"collect_errors"`
+	Written       int64  `json:"written"`
+	WriteErrors   int64  `json:"write_errors"`
+	Dropped       int64  `json:"dropped"`
+	Pending       int    `json:"pending"`
+	LastFlush     int64  `json:"last_flush,omitempty"`
+	LastError     string `json:"last_error,omitempty"`
+}
+
+// Agent collects samples every Interval, delayed by up to Jitter so agents
+// started together do not collect in step, and writes them to a sink in
+// batches: once BatchSize samples are pending or FlushInterval has passed.
+// Samples the sink fails to take stay pending, up to MaxPending; beyond
+// that the oldest are dropped. When Run stops, pending samples get one more
+// flush of up to ShutdownTimeout.
+type Agent struct {
+	Interval        time.Duration
+	Jitter          time.Duration
+	FlushInterval   time.Duration
+	BatchSize       int
+	MaxPending      int
+	HealthInterval  time.Duration
+	ShutdownTimeout time.Duration
+
+	collect CollectFunc
+	sink    Sink
+	logger  *util.MetricsLogger
+	now     func() time.Time
+
+	mu      sync.Mutex
+	pending []domain.Sample
+	health  Health
+}
+
+func New(collect CollectFunc, sink Sink, logger *util.MetricsLogger, interval time.Duration) *Agent {
+	return &Agent{
+		Interval:        interval,
+		FlushInterval:   30 * time.Second,
+		BatchSize:       500,
+		MaxPending:      100000,
+		HealthInterval:  time.Minute,
+		ShutdownTimeout: 10 * time.Second,
+		collect:         collect,
+		sink:            sink,
+		logger:          logger,
+		now:             time.Now,
+	}
+}
+
+// Run collects and flushes until ctx is done, then flushes what is
+// pending.
+func (a *Agent) Run(ctx context.Context) {
+	a.logger.LogEvent(util.LOG_LEVEL_INFO, "Ingest agent started, collecting every ", a.Interval)
+
+	ticker := time.NewTicker(a.Interval)
+	defer ticker.Stop()
+	flushTicker := time.NewTicker(a.FlushInterval)
+	defer flushTicker.Stop()
+	healthTicker := time.NewTicker(a.HealthInterval)
+	defer healthTicker.Stop()
+
+	collectTimer := time.NewTimer(a.jitter())
+	defer collectTimer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			a.shutdown()
+			return
+		case <-ticker.C:
+			collectTimer.Reset(a.jitter())
+		case <-collectTimer.C:
+			if a.Collect() >= a.BatchSize {
+				a.Flush(ctx)
+			}
+		case <-flushTicker.C:
+			a.Flush(ctx)
+		case <-healthTicker.C:
+			a.reportHealth()
+		}
+	}
+}
+
+func (a *Agent) jitter() time.Duration {
+	if a.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(a.Jitter)))
+}
+
+// Collect runs one collection and reports how many samples are pending.
+func (a *Agent) Collect() int {
+	samples, err := a.collect(a.now())
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.health.Collections++
+	if err != nil {
+		a.health.CollectErrors++
+		a.health.LastError = err.Error()
+		a.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while collecting metrics. Err - ", err)
+	}
+
+	a.pending = append(a.pending, samples...)
+	if excess := len(a.pending) - a.MaxPending; a.MaxPending > 0 && excess > 0 {
+		a.pending = append(a.pending[:0], a.pending[excess:]...)
+		a.health.Dropped += int64(excess)
+		a.logger.LogEvent(util.LOG_LEVEL_WARN, "Dropped ", excess, " of the oldest pending samples")
+	}
+	return len(a.pending)
+}
+
+// Flush writes the pending samples to the sink in batches of BatchSize and
+// keeps those it could not write.
+func (a *Agent) Flush(ctx context.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for len(a.pending) > 0 {
+		batch := a.pending[:min(len(a.pending), max(a.BatchSize, 1))]
+		if err := a.sink.Write(ctx, batch); err != nil {
+			a.health.WriteErrors++
+			a.health.LastError = err.Error()
+			a.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while writing ", len(batch), " samples, ", len(a.pending), " pending. Err - ", err)
+			return err
+		}
+		a.health.Written += int64(len(batch))
+		a.pending = a.pending[len(batch):]
+	}
+	a.pending = nil
+	a.health.LastFlush = a.now().Unix()
+	return nil
+}
+
+// Health returns the counters of the agent.
+func (a *Agent) Health() Health {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	health := a.health
+	health.Pending = len(a.pending)
+	return health
+}
+
+func (a *Agent) reportHealth() {
+	h := a.Health()
+	level := util.LOG_LEVEL_INFO
+	if h.Pending >= a.BatchSize || h.LastFlush < a.now().Add(-2*a.FlushInterval).Unix() {
+		level = util.LOG_LEVEL_WARN
+	}
+	a.logger.LogEvent(level, "Ingest agent health - collections: ", h.Collections, ", collect errors: ", h.CollectErrors,
+		", written: ", h.Written, ", write errors: ", h.WriteErrors, ", dropped: ", h.Dropped, ", pending: ", h.Pending)
+}
+
+func (a *Agent) shutdown() {
+	a.logger.LogEvent(util.LOG_LEVEL_INFO, "Ingest agent stopping, flushing ", a.Health().Pending, " pending samples")
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.ShutdownTimeout)
+	defer cancel()
+
+	if err := a.Flush(ctx); err != nil {
+		a.logger.LogEvent(util.LOG_LEVEL_ERROR, "Lost ", a.Health().Pending, " pending samples on shutdown. Err - ", err)
+	}
+	a.reportHealth()
+}
+
+// StoreSink writes samples straight into a metric store. Samples the store
+// rejects are logged and dropped, as writing them again cannot succeed.
+type StoreSink struct {
+	store  domain.MetricStore
+	logger *util.MetricsLogger
+}
+
+func NewStoreSink(store domain.MetricStore, logger *util.MetricsLogger) *StoreSink {
+	return &StoreSink{store: store, logger: logger}
+}
+
+func (s *StoreSink) Write(ctx context.Context, samples []domain.Sample) error {
+	result, err := s.store.StoreSamples(ctx, samples)
+	if err != nil {
+		return err
+	}
+	for _, rejected := range result.Rejected {
+		sample := samples[rejected.Index]
+		s.logger.LogEvent(util.LOG_LEVEL_WARN, "Store rejected ", sample.Name, " at ", sample.Timestamp, ". Err - ", rejected.Err)
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"metrics-app/internal/domain"
+	"metrics-app/internal/repository"
+	"metrics-app/internal/util"
+)
+
+// sink records written samples and fails while failing is set.
+type sink struct {
+	mu      sync.Mutex
+	failing bool
+	writes  [][]domain.Sample
+}
+
+func (s *sink) Write(ctx context.Context, samples []domain.Sample) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failing {
+		return errors.New("connection refused")
+	}
+	s.writes = append(s.writes, append([]domain.Sample(nil), samples...))
+	return nil
+}
+
+func (s *sink) written() []domain.Sample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var all []domain.Sample
+	for _, w := range s.writes {
+		all = append(all, w...)
+	}
+	return all
+}
+
+// counter collects one sample per call, valued by the number of calls.
+func counter() CollectFunc {
+	var mu sync.Mutex
+	n := 0
+	return func(now time.Time) ([]domain.Sample, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		n++
+		return []domain.Sample{{Name: "ticks", Timestamp: now.Unix(), Value: float64(n)}}, nil
+	}
+}
+
+func TestAgent_FlushRetainsFailedWrites(t *testing.T) {
+	s := &sink{failing: true}
+	a := New(counter(), s, &util.MetricsLogger{}, time.Second)
+	a.BatchSize = 2
+	a.MaxPending = 3
+	ctx := context.Background()
+
+	for i := 0; i < 4; i++ {
+		a.Collect()
+	}
+	assert.Error(t, a.Flush(ctx))
+
+	h := a.Health()
+	assert.Equal(t, int64(4), h.Collections)
+	assert.Equal(t, 3, h.Pending)
+	assert.Equal(t, int64(1), h.Dropped, "The oldest sample should make room")
+	assert.Equal(t, int64(1), h.WriteErrors)
+	assert.Equal(t, "connection refused", h.LastError)
+
+	s.failing = false
+	require.NoError(t, a.Flush(ctx))
+	require.Len(t, s.writes, 2, "Pending samples should be written in batches")
+	assert.Len(t, s.writes[0], 2)
+	var values []float64
+	for _, sample := range s.written() {
+		values = append(values, sample.Value)
+	}
+	assert.Equal(t, []float64{2, 3, 4}, values)
+
+	h = a.Health()
+	assert.Equal(t, 0, h.Pending)
+	assert.Equal(t, int64(3), h.Written)
+}
+
+func TestAgent_RunFlushesOnShutdown(t *testing.T) {
+	s := &sink{}
+	a := New(counter(), s, &util.MetricsLogger{}, 10*time.Millisecond)
+	a.Jitter = 5 * time.Millisecond
+	a.FlushInterval = time.Hour
+	a.HealthInterval = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.Run(ctx)
+	}()
+
+	require.Eventually(t, func() bool { return a.Health().Collections >= 3 }, time.Second, 5*time.Millisecond)
+	assert.Empty(t, s.written(), "Nothing is written before a batch fills or the flush interval passes")
+
+	cancel()
+	<-done
+
+	h := a.Health()
+	assert.Equal(t, 0, h.Pending)
+	assert.Equal(t, h.Collections, h.Written)
+	assert.Len(t, s.written(), int(h.Collections))
+}
+
+func TestStoreSink(t *testing.T) {
+	store := repository.NewInMemoryStore(0)
+	require.NoError(t, store.Init())
+	ctx := context.Background()
+
+	err := NewStoreSink(store, &util.MetricsLogger{}).Write(ctx, []domain.Sample{
+		{Name: "load1", Timestamp: 1722441990, Value: 0.5},
+		{Name: "load1", Timestamp: -1, Value: 0.5},
+	})
+	require.NoError(t, err, "Rejected samples are not worth retrying")
+
+	stored, err := store.QuerySamples(ctx, domain.Query{Start: 0, End: 1722441990})
+	require.NoError(t, err)
+	assert.Len(t, stored, 1)
+}
+
+func batch(from, n int) []domain.Sample {
+	samples := make([]domain.Sample, n)
+	for i := range samples {
+		samples[i] = domain.Sample{Name: "ticks", Timestamp: 1722441990 + int64(from+i), Value: float64(from + i)}
+	}
+	return samples
+}
+
+func TestSpool(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "spool")
+	spool, err := OpenSpool(dir, 0)
+	require.NoError(t, err)
+
+	_, _, err = spool.Oldest()
+	assert.ErrorIs(t, err, ErrSpoolEmpty)
+
+	for i := 0; i < 3; i++ {
+		_, err := spool.Append(batch(i*10, 10))
+		require.NoError(t, err)
+	}
+	seq, data, err := spool.Oldest()
+	require.NoError(t, err)
+	var samples []domain.Sample
+	require.NoError(t, json.Unmarshal(data, &samples))
+	assert.Equal(t, batch(0, 10), samples)
+	require.NoError(t, spool.Remove(seq))
+
+	// A restarted agent picks up where the last one stopped
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "00000000000000000099-5.json.tmp"), []byte("[{"), 0o644))
+	spool, err = OpenSpool(dir, 0)
+	require.NoError(t, err)
+	batches, spooled := spool.Len()
+	assert.Equal(t, 2, batches)
+	assert.Equal(t, 20, spooled)
+	_, data, _ = spool.Oldest()
+	require.NoError(t, json.Unmarshal(data, &samples))
+	assert.Equal(t, batch(10, 10), samples)
+	assert.NoFileExists(t, filepath.Join(dir, "00000000000000000099-5.json.tmp"))
+
+	_, err = spool.Append(batch(30, 10))
+	require.NoError(t, err)
+	entries, _ := os.ReadDir(dir)
+	assert.Equal(t, "00000000000000000003-10.json", entries[len(entries)-1].Name())
+
+	// Beyond MaxBytes the oldest batches make room
+	spool.MaxBytes = spool.Size()
+	dropped, err := spool.Append(batch(40, 10))
+	require.NoError(t, err)
+	assert.Equal(t, 10, dropped)
+	_, data, _ = spool.Oldest()
+	require.NoError(t, json.Unmarshal(data, &samples))
+	assert.Equal(t, batch(20, 10), samples)
+	assert.LessOrEqual(t, spool.Size(), spool.MaxBytes)
+
+	_, err = spool.Append(batch(0, 1000))
+	assert.Error(t, err, "A batch larger than the spool cannot be spooled")
+}
+
+// server is a test API server answering POST /samples with the queued
+// status codes, then 200.
+type server struct {
+	mu       sync.Mutex
+	statuses []int
+	bodies   [][]domain.Sample
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.Method != http.MethodPost || r.URL.Path != "/samples" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if len(s.statuses) > 0 {
+		status := s.statuses[0]
+		s.statuses = s.statuses[1:]
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+	}
+	body, _ := io.ReadAll(r.Body)
+	var samples []domain.Sample
+	json.Unmarshal(body, &samples)
+	s.bodies = append(s.bodies, samples)
+}
+
+func (s *server) received() []domain.Sample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var all []domain.Sample
+	for _, b := range s.bodies {
+		all = append(all, b...)
+	}
+	return all
+}
+
+func TestPushSink_ReplaysInOrderAfterOutage(t *testing.T) {
+	srv := &server{statuses: []int{http.StatusServiceUnavailable, http.StatusBadGateway}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	spool, err := OpenSpool(t.TempDir(), 0)
+	require.NoError(t, err)
+	now := time.Unix(1722441990, 0)
+	p := NewPushSink(ts.URL+"/", spool, &util.MetricsLogger{})
+	p.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	require.NoError(t, p.Write(ctx, batch(0, 5)))
+	require.NoError(t, p.Write(ctx, batch(5, 5)), "Writes succeed while the server is down")
+
+	delivered, err := p.Replay(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, 0, delivered)
+
+	delivered, _ = p.Replay(ctx)
+	assert.Equal(t, 0, delivered, "Nothing is sent before the backoff has passed")
+
+	now = now.Add(time.Second)
+	p.Replay(ctx)
+	now = now.Add(time.Second)
+	delivered, _ = p.Replay(ctx)
+	assert.Equal(t, 0, delivered, "The backoff should double")
+
+	now = now.Add(time.Second)
+	delivered, err = p.Replay(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, delivered)
+	assert.Equal(t, batch(0, 10), srv.received())
+
+	batches, _ := spool.Len()
+	assert.Equal(t, 0, batches)
+}
+
+func TestPushSink_DropsRejectedBatches(t *testing.T) {
+	srv := &server{statuses: []int{http.StatusBadRequest}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	spool, err := OpenSpool(t.TempDir(), 0)
+	require.NoError(t, err)
+	p := NewPushSink(ts.URL, spool, &util.MetricsLogger{})
+	ctx := context.Background()
+
+	p.Write(ctx, batch(0, 5))
+	p.Write(ctx, batch(5, 5))
+	delivered, err := p.Replay(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, delivered)
+	assert.Equal(t, batch(5, 5), srv.received())
+}
+
+func TestAgent_PushesThroughSpool(t *testing.T) {
+	srv := &server{}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	spool, err := OpenSpool(t.TempDir(), 0)
+	require.NoError(t, err)
+	p := NewPushSink(ts.URL, spool, &util.MetricsLogger{})
+	p.Interval = 10 * time.Millisecond
+
+	a := New(counter(), p, &util.MetricsLogger{}, 5*time.Millisecond)
+	a.FlushInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); p.Run(ctx) }()
+	go func() { defer wg.Done(); a.Run(ctx) }()
+
+	require.Eventually(t, func() bool { return len(srv.received()) >= 5 }, 2*time.Second, 5*time.Millisecond)
+	cancel()
+	wg.Wait()
+	p.Replay(context.Background())
+
+	received := srv.received()
+	assert.Len(t, received, int(a.Health().Collections))
+	for i, sample := range received {
+		assert.Equal(t, float64(i+1), sample.Value, "Samples should arrive in the order they were collected")
+	}
+}
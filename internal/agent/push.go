@@ -0,0 +1,183 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"metrics-app/internal/domain"
+	"metrics-app/internal/util"
+)
+
+// PushSink sends samples to the POST /samples endpoint of an API server.
+// Write only spools them; Run replays the spool in order and retries
+// failures with exponential backoff, starting at InitialBackoff and
+// doubling up to MaxBackoff, so samples survive outages of the server and
+// restarts of the agent. A batch the server rejects as a whole with a 4xx
+// status other than 408 and 429 is dropped, as resending cannot succeed.
+type PushSink struct {
+	Interval       time.Duration
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	url    string
+	spool  *Spool
+	client *http.Client
+	logger *util.MetricsLogger
+	now    func() time.Time
+	wake   chan struct{}
+
+	mu          sync.Mutex
+	failures    int
+	nextAttempt time.Time
+	dropped     int64
+}
+
+// NewPushSink pushes to the server at baseURL, e.g. http://metrics:8080.
+func NewPushSink(baseURL string, spool *Spool, logger *util.MetricsLogger) *PushSink {
+	return &PushSink{
+		Interval:       time.Second,
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Minute,
+		url:            strings.TrimSuffix(baseURL, "/") + "/samples",
+		spool:          spool,
+		client:         &http.Client{Timeout: 30 * time.Second},
+		logger:         logger,
+		now:            time.Now,
+		wake:           make(chan struct{}, 1),
+	}
+}
+
+// Write spools samples and wakes Run to send them.
+func (p *PushSink) Write(ctx context.Context, samples []domain.Sample) error {
+	dropped, err := p.spool.Append(samples)
+	if err != nil {
+		return err
+	}
+	if dropped > 0 {
+		p.mu.Lock()
+		p.dropped += int64(dropped)
+		p.mu.Unlock()
+		p.logger.LogEvent(util.LOG_LEVEL_WARN, "Spool is full, dropped ", dropped, " of the oldest spooled samples")
+	}
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run replays the spool immediately, including batches left over from
+// before a restart, and then whenever Write spools new ones or Interval
+// passes, until ctx is done.
+func (p *PushSink) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	for {
+		p.Replay(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.wake:
+		}
+	}
+}
+
+// Replay sends spooled batches, oldest first, until the spool is empty or
+// a batch fails, and reports how many batches were delivered. Nothing is
+// sent while the backoff of the last failure has not passed.
+func (p *PushSink) Replay(ctx context.Context) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delivered := 0
+	for !p.now().Before(p.nextAttempt) {
+		seq, body, err := p.spool.Oldest()
+		if errors.Is(err, ErrSpoolEmpty) {
+			return delivered, nil
+		}
+		if err != nil {
+			p.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while reading the spool. Err - ", err)
+			return delivered, err
+		}
+
+		retry, err := p.post(ctx, body)
+		if err != nil && retry {
+			p.failures++
+			p.nextAttempt = p.now().Add(p.backoff(p.failures))
+			p.logger.LogEvent(util.LOG_LEVEL_WARN, "Push to ", p.url, " failed, retrying at ", p.nextAttempt.Format(time.RFC3339), ". Err - ", err)
+			return delivered, err
+		}
+		if err != nil {
+			p.logger.LogEvent(util.LOG_LEVEL_ERROR, "Dropping spooled batch ", seq, ". Err - ", err)
+		} else {
+			delivered++
+		}
+
+		p.failures = 0
+		if err := p.spool.Remove(seq); err != nil {
+			p.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while removing spooled batch ", seq, ". Err - ", err)
+			return delivered, err
+		}
+	}
+	return delivered, nil
+}
+
+// Dropped reports how many samples were dropped to keep the spool within
+// its size.
+func (p *PushSink) Dropped() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dropped
+}
+
+// Spool returns the spool the sink replays.
+func (p *PushSink) Spool() *Spool {
+	return p.spool
+}
+
+// backoff is the delay after the given number of consecutive failures.
+func (p *PushSink) backoff(failures int) time.Duration {
+	delay := p.InitialBackoff
+	for i := 1; i < failures && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, p.MaxBackoff)
+}
+
+// post sends body. It reports whether a failure is worth retrying. A
+// partially stored batch (207) counts as delivered: the samples the server
+// rejected are invalid or already stored.
+func (p *PushSink) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "metrics-app-ingest")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return true, fmt.Errorf("server responded %s", resp.Status)
+	}
+	return false, fmt.Errorf("server rejected the batch with %s", resp.Status)
+}
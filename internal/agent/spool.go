@@ -0,0 +1,192 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"metrics-app/internal/domain"
+)
+
+var ErrSpoolEmpty = errors.New("spool is empty")
+
+// Spool is an on-disk queue of sample batches. Every batch is a file named
+// after its sequence number and sample count, holding the JSON array that
+// is posted to /samples, so batches are replayed in the order they were
+// spooled, across restarts. The files take at most MaxBytes; the oldest
+// batches are dropped to make room.
+type Spool struct {
+	MaxBytes int64
+
+	dir string
+
+	mu       sync.Mutex
+	segments []segment
+	size     int64
+	next     uint64
+}
+
+type segment struct {
+	seq     uint64
+	samples int
+	size    int64
+}
+
+func (s segment) name() string {
+	return fmt.Sprintf("%020d-%d.json", s.seq, s.samples)
+}
+
+// OpenSpool opens the spool in dir, creating dir if needed, and picks up
+// the batches left from an earlier run.
+func OpenSpool(dir string, maxBytes int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spool{MaxBytes: maxBytes, dir: dir}
+	for _, entry := range entries {
+		seg, ok := parseSegment(entry.Name())
+		if !ok || entry.IsDir() {
+			// Leftovers of a write interrupted before its rename
+			if strings.HasSuffix(entry.Name(), ".tmp") {
+				os.Remove(filepath.Join(dir, entry.Name()))
+			}
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		seg.size = info.Size()
+		s.segments = append(s.segments, seg)
+		s.size += seg.size
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+	if n := len(s.segments); n > 0 {
+		s.next = s.segments[n-1].seq + 1
+	}
+	return s, nil
+}
+
+func parseSegment(name string) (segment, bool) {
+	base, ok := strings.CutSuffix(name, ".json")
+	if !ok {
+		return segment{}, false
+	}
+	seq, count, ok := strings.Cut(base, "-")
+	if !ok {
+		return segment{}, false
+	}
+	var (
+		seg segment
+		err error
+	)
+	if seg.seq, err = strconv.ParseUint(seq, 10, 64); err != nil {
+		return segment{}, false
+	}
+	if seg.samples, err = strconv.Atoi(count); err != nil {
+		return segment{}, false
+	}
+	return seg, true
+}
+
+// Append writes samples as the newest batch and reports how many samples
+// of older batches were dropped to stay within MaxBytes.
+func (s *Spool) Append(samples []domain.Sample) (int, error) {
+	data, err := json.Marshal(samples)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.MaxBytes > 0 && int64(len(data)) > s.MaxBytes {
+		return 0, fmt.Errorf("a batch of %d bytes does not fit in a spool of %d bytes", len(data), s.MaxBytes)
+	}
+
+	seg := segment{seq: s.next, samples: len(samples), size: int64(len(data))}
+	path := filepath.Join(s.dir, seg.name())
+	// The rename makes a batch appear whole or not at all.
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return 0, err
+	}
+	s.next++
+	s.segments = append(s.segments, seg)
+	s.size += seg.size
+
+	dropped := 0
+	for s.MaxBytes > 0 && s.size > s.MaxBytes {
+		dropped += s.segments[0].samples
+		s.removeOldest()
+	}
+	return dropped, nil
+}
+
+// Oldest returns the sequence number and the contents of the oldest batch.
+func (s *Spool) Oldest() (uint64, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.segments) == 0 {
+		return 0, nil, ErrSpoolEmpty
+	}
+	seg := s.segments[0]
+	data, err := os.ReadFile(filepath.Join(s.dir, seg.name()))
+	return seg.seq, data, err
+}
+
+// Remove deletes the batch seq once it is delivered. It is a no-op when the
+// batch has been dropped meanwhile.
+func (s *Spool) Remove(seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.segments) == 0 || s.segments[0].seq != seq {
+		return nil
+	}
+	return s.removeOldest()
+}
+
+func (s *Spool) removeOldest() error {
+	seg := s.segments[0]
+	s.segments = s.segments[1:]
+	s.size -= seg.size
+	err := os.Remove(filepath.Join(s.dir, seg.name()))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Len reports how many batches and samples are spooled.
+func (s *Spool) Len() (batches, samples int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, seg := range s.segments {
+		samples += seg.samples
+	}
+	return len(s.segments), samples
+}
+
+// Size reports how many bytes the spooled batches take.
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
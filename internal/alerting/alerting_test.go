@@ -0,0 +1,185 @@
+package alerting
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"metrics-app/internal/domain"
+	"metrics-app/internal/repository"
+	"metrics-app/internal/util"
+)
+
+func TestParseExpr(t *testing.T) {
+	e, err := ParseExpr("avg cpu_load over 5m > 85")
+	require.NoError(t, err)
+	assert.Equal(t, domain.AggregateAvg, e.Func)
+	assert.Equal(t, 5*time.Minute, e.Window)
+	assert.Equal(t, "cpu_load", e.Condition.Field)
+	assert.Equal(t, ">", e.Condition.Op)
+	assert.Equal(t, 85.0, e.Condition.Value)
+	assert.Equal(t, "avg cpu_load over 5m > 85", e.String())
+
+	e, err = ParseExpr("max  concurrency over 1m >= 400000")
+	require.NoError(t, err)
+	assert.Equal(t, 400000.0, e.Reduce(domain.Statistics{Max: 400000}))
+	assert.True(t, e.Condition.Compare(e.Reduce(domain.Statistics{Max: 400000})))
+
+	e, err = ParseExpr("zscore cpu_load over 1h < -3")
+	require.NoError(t, err)
+	assert.Equal(t, FuncZScore, e.Func)
+
+	for _, expr := range []string{
+		"zscore cpu_load over 1m > 3",
+		"cpu_load > 85",
+		"median cpu_load over 5m > 85",
+		"avg cpu_load over 5 > 85",
+		"avg cpu_load over 500ms > 85",
+		"avg memory over 5m > 85",
+		"avg cpu_load over 5m",
+	} {
+		_, err := ParseExpr(expr)
+		assert.ErrorIs(t, err, ErrInvalidExpr, expr)
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules([]byte(`{"rules": [
+		{"name": "HighCPU", "expr": "avg cpu_load over 5m > 85", "for": "2m", "labels": {"severity": "page"}},
+		{"name": "Busy", "expr": "max concurrency over 1m > 400000", "matchers": [{"name": "host", "type": "=~", "value": "web-.*"}]}
+	]}`))
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	assert.Equal(t, 2*time.Minute, rules[0].For)
+	assert.Equal(t, domain.Labels{"severity": "page"}, rules[0].Labels)
+	assert.Equal(t, time.Duration(0), rules[1].For)
+
+	for _, data := range []string{
+		`{"rules": [{"expr": "avg cpu_load over 5m > 85"}]}`,
+		`{"rules": [{"name": "a", "expr": "avg cpu_load over 5m > 85"}, {"name": "a", "expr": "avg cpu_load over 5m > 85"}]}`,
+		`{"rules": [{"name": "a", "expr": "avg cpu_load over 5m > 85", "for": "soon"}]}`,
+		`{"rules": [{"name": "a", "expr": "avg cpu_load over 5m > 85", "matchers": [{"name": "host", "type": "~", "value": "x"}]}]}`,
+		`{"rules": [{"name": "a", "expr": "avg cpu_load"}]}`,
+		`{"rules": {}}`,
+	} {
+		_, err := ParseRules([]byte(data))
+		assert.ErrorIs(t, err, ErrInvalidRule, data)
+	}
+}
+
+type recordingNotifier struct {
+	notified [][]Alert
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, alerts []Alert) {
+	n.notified = append(n.notified, alerts)
+}
+
+func TestEngine_Lifecycle(t *testing.T) {
+	now := time.Unix(1722441990, 0)
+
+	store := repository.NewInMemoryStore(0)
+	require.NoError(t, store.Init())
+	ctx := context.Background()
+
+	rules, err := ParseRules([]byte(`{"rules": [
+		{"name": "HighCPU", "expr": "avg cpu_load over 5m > 85", "for": "2m", "labels": {"severity": "page"}}
+	]}`))
+	require.NoError(t, err)
+
+	engine := NewEngine(store, &util.MetricsLogger{}, rules, time.Minute)
+	engine.now = func() time.Time { return now }
+	notifier := &recordingNotifier{}
+	engine.SetNotifier(notifier)
+
+	web1 := domain.Labels{"host": "web-1"}
+	web2 := domain.Labels{"host": "web-2"}
+	store1 := func(labels domain.Labels, cpuLoad float64) {
+		require.NoError(t, store.StoreMetric(ctx, domain.Metric{Timestamp: now.Unix(), CPULoad: cpuLoad, Concurrency: 1, Labels: labels}))
+	}
+
+	// Above the threshold, but not yet for 2m
+	store1(web1, 90)
+	store1(web2, 40)
+	engine.Evaluate(ctx)
+	alerts := engine.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, Alert{
+		Rule:     "HighCPU",
+		Expr:     "avg cpu_load over 5m > 85",
+		Labels:   domain.Labels{"host": "web-1", "severity": "page"},
+		State:    StatePending,
+		Value:    90,
+		ActiveAt: now.Unix(),
+	}, alerts[0])
+
+	// Held for the whole for duration
+	now = now.Add(time.Minute)
+	store1(web1, 96)
+	engine.Evaluate(ctx)
+	assert.Equal(t, StatePending, engine.Alerts()[0].State)
+	assert.Empty(t, notifier.notified, "Pending alerts are not notified")
+
+	now = now.Add(time.Minute)
+	store1(web1, 90)
+	engine.Evaluate(ctx)
+	alerts = engine.Alerts(StateFiring)
+	require.Len(t, alerts, 1)
+	assert.Equal(t, 92.0, alerts[0].Value)
+	assert.Equal(t, now.Unix(), alerts[0].FiredAt)
+	assert.Empty(t, engine.Alerts(StatePending, StateResolved))
+	require.Len(t, notifier.notified, 1)
+	assert.Equal(t, alerts, notifier.notified[0])
+
+	// The average falls below the threshold
+	now = now.Add(time.Minute)
+	store1(web1, 10)
+	engine.Evaluate(ctx)
+	alerts = engine.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, StateResolved, alerts[0].State)
+	assert.Equal(t, now.Unix(), alerts[0].ResolvedAt)
+	require.Len(t, notifier.notified, 2)
+	assert.Equal(t, alerts, notifier.notified[1])
+
+	// A pending alert that stops holding is dropped
+	store1(domain.Labels{"host": "web-3"}, 100)
+	engine.Evaluate(ctx)
+	assert.Len(t, engine.Alerts(StatePending), 1)
+
+	now = now.Add(5*time.Minute + time.Second)
+	engine.Evaluate(ctx)
+	assert.Empty(t, engine.Alerts(StatePending), "Series without samples in the window do not hold")
+
+	// Resolved alerts are forgotten after ResolvedRetention
+	now = now.Add(engine.ResolvedRetention)
+	engine.Evaluate(ctx)
+	assert.Empty(t, engine.Alerts())
+	assert.Len(t, notifier.notified, 2, "Dropped pending and forgotten resolved alerts are not notified")
+}
+
+func TestEngine_ZScore(t *testing.T) {
+	now := time.Unix(1722441990, 0)
+
+	store := repository.NewInMemoryStore(0)
+	require.NoError(t, store.Init())
+	ctx := context.Background()
+
+	for i := 30; i > 0; i-- {
+		require.NoError(t, store.StoreMetric(ctx, domain.Metric{Timestamp: now.Add(-time.Duration(i) * time.Minute).Unix(), CPULoad: 20 + float64(i%2), Concurrency: 1}))
+	}
+	require.NoError(t, store.StoreMetric(ctx, domain.Metric{Timestamp: now.Unix(), CPULoad: 70, Concurrency: 1}))
+
+	rules, err := ParseRules([]byte(`{"rules": [{"name": "CPUSpike", "expr": "zscore cpu_load over 30m > 3"}]}`))
+	require.NoError(t, err)
+	engine := NewEngine(store, &util.MetricsLogger{}, rules, time.Minute)
+	engine.now = func() time.Time { return now }
+
+	engine.Evaluate(ctx)
+	alerts := engine.Alerts(StateFiring)
+	require.Len(t, alerts, 1)
+	assert.Greater(t, alerts[0].Value, 3.0, "The value of a zscore alert is the score")
+}
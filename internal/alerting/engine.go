@@ -0,0 +1,264 @@
+package alerting
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"metrics-app/internal/anomaly"
+	"metrics-app/internal/domain"
+	"metrics-app/internal/util"
+)
+
+type State string
+
+// An alert is pending while its expression holds for less than the For of
+// its rule, then firing. A firing alert whose expression stops holding is
+// resolved and forgotten after ResolvedRetention; a pending one is dropped.
+const (
+	StatePending  State = "pending"
+	StateFiring   State = "firing"
+	StateResolved State = "resolved"
+)
+
+func (s State) Validate() error {
+	switch s {
+	case StatePending, StateFiring, StateResolved:
+		return nil
+	}
+	return fmt.Errorf("%w: %q", ErrInvalidState, s)
+}
+
+// Alert is the state of one rule for one series. Times are Unix seconds.
+type Alert struct {
+	Rule       string        `json:"rule"`
+	Expr       string        `json:"expr"`
+	Labels     domain.Labels `json:"labels,omitempty"`
+	State      State         `json:"state"`
+	Value      float64       `json:"value"`
+	ActiveAt   int64         `json:"active_at"`
+	FiredAt    int64         `json:"fired_at,omitempty"`
+	ResolvedAt int64         `json:"resolved_at,omitempty"`
+}
+
+// Notifier is told about alerts that started firing or were resolved.
+type Notifier interface {
+	Notify(ctx context.Context, alerts []Alert)
+}
+
+// zscoreStep is the bucket width of FuncZScore rules.
+const zscoreStep = time.Minute
+
+type alertKey struct {
+	rule   string
+	series string
+}
+
+// Engine evaluates rules against the store every Interval and keeps the
+// resulting alerts in memory.
+type Engine struct {
+	Interval          time.Duration
+	ResolvedRetention time.Duration
+
+	rules    []Rule
+	store    domain.MetricStore
+	logger   *util.MetricsLogger
+	now      func() time.Time
+	notifier Notifier
+
+	mu     sync.Mutex
+	alerts map[alertKey]*Alert
+}
+
+func NewEngine(store domain.MetricStore, logger *util.MetricsLogger, rules []Rule, interval time.Duration) *Engine {
+	return &Engine{
+		Interval:          interval,
+		ResolvedRetention: 15 * time.Minute,
+		rules:             rules,
+		store:             store,
+		logger:            logger,
+		now:               time.Now,
+		alerts:            make(map[alertKey]*Alert),
+	}
+}
+
+// SetNotifier sends the alerts that change to firing or resolved in an
+// evaluation to n.
+func (e *Engine) SetNotifier(n Notifier) {
+	e.notifier = n
+}
+
+// Run evaluates once immediately and then every Interval until ctx is done.
+func (e *Engine) Run(ctx context.Context) {
+	e.logger.LogEvent(util.LOG_LEVEL_INFO, "Alerting enabled. Evaluating ", len(e.rules), " rules every ", e.Interval)
+
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+
+	for {
+		e.Evaluate(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Evaluate runs every rule once. A rule whose query fails keeps its alerts
+// as they were.
+func (e *Engine) Evaluate(ctx context.Context) {
+	now := e.now()
+	var changed []Alert
+	for _, rule := range e.rules {
+		values, err := e.values(ctx, rule, now)
+		if err != nil {
+			e.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while evaluating alert rule ", rule.Name, ". Err - ", err)
+			continue
+		}
+		changed = append(changed, e.apply(rule, values, now)...)
+	}
+
+	if e.notifier != nil && len(changed) > 0 {
+		e.notifier.Notify(ctx, changed)
+	}
+}
+
+// seriesValue is the value of a rule expression for one series.
+type seriesValue struct {
+	labels domain.Labels
+	value  float64
+}
+
+// values evaluates the expression of rule for every selected series.
+func (e *Engine) values(ctx context.Context, rule Rule, now time.Time) ([]seriesValue, error) {
+	if rule.Expr.Func == FuncZScore {
+		config := anomaly.DefaultConfig()
+		config.Step = int64(zscoreStep / time.Second)
+		config.Warmup = int(rule.Expr.Window / zscoreStep)
+		points, err := anomaly.Latest(ctx, e.store, rule.selector(), now.Unix(), config)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]seriesValue, 0, len(points))
+		for _, p := range points {
+			values = append(values, seriesValue{labels: p.Labels, value: p.Score})
+		}
+		return values, nil
+	}
+
+	stats, err := e.store.SummarizeSamples(ctx, domain.Query{
+		Selector: rule.selector(),
+		Start:    now.Add(-rule.Expr.Window).Unix(),
+		End:      now.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	values := make([]seriesValue, 0, len(stats))
+	for _, series := range stats {
+		values = append(values, seriesValue{labels: series.Labels, value: rule.Expr.Reduce(series.Statistics)})
+	}
+	return values, nil
+}
+
+// apply updates the alerts of rule and returns those that started firing or
+// were resolved.
+func (e *Engine) apply(rule Rule, values []seriesValue, now time.Time) []Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var changed []Alert
+	active := make(map[alertKey]bool, len(values))
+	for _, series := range values {
+		value := series.value
+		if !rule.Expr.Condition.Compare(value) {
+			continue
+		}
+
+		key := alertKey{rule: rule.Name, series: series.labels.Key()}
+		active[key] = true
+
+		alert, ok := e.alerts[key]
+		if !ok || alert.State == StateResolved {
+			alert = &Alert{
+				Rule:     rule.Name,
+				Expr:     rule.Expr.String(),
+				Labels:   mergeLabels(series.labels, rule.Labels),
+				State:    StatePending,
+				ActiveAt: now.Unix(),
+			}
+			e.alerts[key] = alert
+		}
+		alert.Value = value
+
+		if alert.State == StatePending && now.Sub(time.Unix(alert.ActiveAt, 0)) >= rule.For {
+			alert.State = StateFiring
+			alert.FiredAt = now.Unix()
+			e.logger.LogEvent(util.LOG_LEVEL_WARN, "Alert ", rule.Name, " firing for ", alert.Labels.String(), " with value ", value)
+			changed = append(changed, *alert)
+		}
+	}
+
+	for key, alert := range e.alerts {
+		if key.rule != rule.Name || active[key] {
+			continue
+		}
+		switch alert.State {
+		case StatePending:
+			delete(e.alerts, key)
+		case StateFiring:
+			alert.State = StateResolved
+			alert.ResolvedAt = now.Unix()
+			e.logger.LogEvent(util.LOG_LEVEL_INFO, "Alert ", rule.Name, " resolved for ", alert.Labels.String())
+			changed = append(changed, *alert)
+		case StateResolved:
+			if now.Sub(time.Unix(alert.ResolvedAt, 0)) >= e.ResolvedRetention {
+				delete(e.alerts, key)
+			}
+		}
+	}
+	return changed
+}
+
+// Alerts returns the current alerts ordered by rule and labels. With states
+// given, only alerts in one of them are returned.
+func (e *Engine) Alerts(states ...State) []Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	alerts := make([]Alert, 0, len(e.alerts))
+	for _, alert := range e.alerts {
+		if len(states) > 0 && !slices.Contains(states, alert.State) {
+			continue
+		}
+		alerts = append(alerts, *alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].Rule != alerts[j].Rule {
+			return alerts[i].Rule < alerts[j].Rule
+		}
+		return alerts[i].Labels.Key() < alerts[j].Labels.Key()
+	})
+	return alerts
+}
+
+// mergeLabels adds the labels of a rule to those of a series. The rule wins
+// when both set a label.
+func mergeLabels(series, rule domain.Labels) domain.Labels {
+	if len(rule) == 0 {
+		return series
+	}
+	merged := make(domain.Labels, len(series)+len(rule))
+	for name, value := range series {
+		merged[name] = value
+	}
+	for name, value := range rule {
+		merged[name] = value
+	}
+	return merged
+}
@@ -0,0 +1,163 @@
+package alerting
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"metrics-app/internal/domain"
+	"metrics-app/internal/subscription"
+)
+
+var (
+	ErrInvalidExpr  = errors.New(`expression must look like "avg cpu_load over 5m > 85"`)
+	ErrInvalidRule  = errors.New("invalid alert rule")
+	ErrInvalidState = errors.New("alert state must be pending, firing or resolved")
+)
+
+// FuncZScore is the EWMA z-score of the current minute against the
+// trailing Window, as computed by the anomaly package.
+const FuncZScore domain.AggregateFunc = "zscore"
+
+// Expr reduces every selected series over the trailing Window with Func and
+// compares the result with Condition.
+type Expr struct {
+	Func      domain.AggregateFunc
+	Window    time.Duration
+	Condition subscription.Condition
+
+	text string
+}
+
+// ParseExpr reads "<func> <field> over <window> <op> <threshold>", e.g.
+// "max concurrency over 1m > 400000". Window is a Go duration of whole
+// seconds. With the zscore function, e.g. "zscore cpu_load over 1h > 3",
+// Window is the history the baseline is computed from.
+func ParseExpr(expr string) (Expr, error) {
+	reduction, comparison, found := strings.Cut(expr, " over ")
+	fields := strings.Fields(reduction)
+	if !found || len(fields) != 2 {
+		return Expr{}, fmt.Errorf("%w: %q", ErrInvalidExpr, expr)
+	}
+
+	e := Expr{Func: domain.AggregateFunc(fields[0]), text: strings.Join(strings.Fields(expr), " ")}
+	if err := e.Func.Validate(); err != nil && e.Func != FuncZScore {
+		return Expr{}, fmt.Errorf("%w: %v", ErrInvalidExpr, err)
+	}
+
+	window, threshold, _ := strings.Cut(strings.TrimSpace(comparison), " ")
+	d, err := time.ParseDuration(window)
+	if err != nil || d < time.Second || d%time.Second != 0 {
+		return Expr{}, fmt.Errorf("%w: invalid window %q", ErrInvalidExpr, window)
+	}
+	e.Window = d
+	if e.Func == FuncZScore && d < 2*zscoreStep {
+		return Expr{}, fmt.Errorf("%w: the window of zscore must be at least %s", ErrInvalidExpr, 2*zscoreStep)
+	}
+
+	e.Condition, err = subscription.ParseCondition(fields[1] + " " + threshold)
+	if err != nil {
+		return Expr{}, fmt.Errorf("%w: %v", ErrInvalidExpr, err)
+	}
+	return e, nil
+}
+
+func (e Expr) String() string {
+	return e.text
+}
+
+// Reduce picks the value of e.Func from the statistics of a series.
+func (e Expr) Reduce(stats domain.Statistics) float64 {
+	switch e.Func {
+	case domain.AggregateMin:
+		return stats.Min
+	case domain.AggregateMax:
+		return stats.Max
+	case domain.AggregateSum:
+		return stats.Mean * float64(stats.Count)
+	case domain.AggregateCount:
+		return float64(stats.Count)
+	case domain.AggregateP50:
+		return stats.P50
+	case domain.AggregateP95:
+		return stats.P95
+	case domain.AggregateP99:
+		return stats.P99
+	}
+	return stats.Mean
+}
+
+// Rule raises an alert for every series selected by Matchers whose Expr
+// has held for at least For. Labels are added to the labels of the series.
+type Rule struct {
+	Name     string
+	Expr     Expr
+	For      time.Duration
+	Matchers []domain.LabelMatcher
+	Labels   domain.Labels
+}
+
+// ruleFile is the JSON layout of a rules file:
+//
+//	{"rules": [{"name": "HighCPU", "expr": "avg cpu_load over 5m > 85", "for": "2m"}]}
+type ruleFile struct {
+	Rules []struct {
+		Name     string                `json:"name"`
+		Expr     string                `json:"expr"`
+		For      string                `json:"for"`
+		Matchers []domain.LabelMatcher `json:"matchers"`
+		Labels   domain.Labels         `json:"labels"`
+	} `json:"rules"`
+}
+
+// LoadRules reads and validates a rules file.
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRules(data)
+}
+
+// ParseRules validates the rules of a rules file. Rule names must be unique.
+func ParseRules(data []byte) ([]Rule, error) {
+	var file ruleFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRule, err)
+	}
+
+	var err error
+	rules := make([]Rule, 0, len(file.Rules))
+	names := make(map[string]bool, len(file.Rules))
+	for i, r := range file.Rules {
+		if r.Name == "" || names[r.Name] {
+			return nil, fmt.Errorf("%w: rule %d needs a unique name", ErrInvalidRule, i)
+		}
+		names[r.Name] = true
+
+		rule := Rule{Name: r.Name, Matchers: r.Matchers, Labels: r.Labels}
+		if rule.Expr, err = ParseExpr(r.Expr); err != nil {
+			return nil, fmt.Errorf("%w %q: %v", ErrInvalidRule, r.Name, err)
+		}
+		if r.For != "" {
+			if rule.For, err = time.ParseDuration(r.For); err != nil || rule.For < 0 {
+				return nil, fmt.Errorf("%w %q: invalid for %q", ErrInvalidRule, r.Name, r.For)
+			}
+		}
+		if _, err := rule.selector().Compile(); err != nil {
+			return nil, fmt.Errorf("%w %q: %v", ErrInvalidRule, r.Name, err)
+		}
+		if err := rule.Labels.Validate(); err != nil {
+			return nil, fmt.Errorf("%w %q: %v", ErrInvalidRule, r.Name, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (r Rule) selector() domain.SeriesSelector {
+	return domain.SeriesSelector{Name: r.Expr.Condition.Field, Matchers: r.Matchers}
+}
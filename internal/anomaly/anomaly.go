@@ -0,0 +1,286 @@
+package anomaly
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"metrics-app/internal/domain"
+)
+
+type Method string
+
+const (
+	// MethodEWMA scores a point against the exponentially weighted moving
+	// average and standard deviation of the points before it.
+	MethodEWMA Method = "ewma"
+	// MethodSeasonal scores a point against the median of the same time of
+	// day on previous days, scaled by their median absolute deviation.
+	MethodSeasonal Method = "seasonal"
+)
+
+const day = 86400
+
+// minSeasonalHistory is how many previous days must have a value before a
+// point is scored by MethodSeasonal.
+const minSeasonalHistory = 3
+
+var ErrInvalidConfig = errors.New("invalid anomaly detection")
+
+// Config selects a method and its parameters. Series are averaged into
+// buckets of Step seconds before they are scored.
+type Config struct {
+	Method    Method
+	Step      int64
+	Threshold float64
+	// Alpha is the smoothing factor of MethodEWMA. It defaults to
+	// 2/(Warmup+1), so the average spans the warm-up.
+	Alpha float64
+	// Warmup is how many buckets before the range seed MethodEWMA; those
+	// and the first Warmup buckets of a new series are not scored.
+	Warmup int
+	// Days is how many previous days MethodSeasonal compares with.
+	Days int
+}
+
+// DefaultConfig scores 5 minute averages with MethodEWMA and reports
+// scores of 3 standard deviations or more.
+func DefaultConfig() Config {
+	return Config{Method: MethodEWMA, Step: 300, Threshold: 3, Warmup: 12, Days: 7}
+}
+
+func (c Config) Validate() error {
+	switch c.Method {
+	case MethodEWMA:
+		if c.Warmup < 1 {
+			return fmt.Errorf("%w: warmup must be at least 1", ErrInvalidConfig)
+		}
+		if c.Alpha < 0 || c.Alpha > 1 {
+			return fmt.Errorf("%w: alpha must be between 0 and 1", ErrInvalidConfig)
+		}
+	case MethodSeasonal:
+		if c.Days < minSeasonalHistory || c.Days > 28 {
+			return fmt.Errorf("%w: days must be between %d and 28", ErrInvalidConfig, minSeasonalHistory)
+		}
+		if c.Step > 0 && day%c.Step != 0 {
+			return fmt.Errorf("%w: step must divide a day", ErrInvalidConfig)
+		}
+	default:
+		return fmt.Errorf("%w: method must be %q or %q", ErrInvalidConfig, MethodEWMA, MethodSeasonal)
+	}
+	if c.Step <= 0 {
+		return domain.ErrInvalidStep
+	}
+	if c.Threshold <= 0 || math.IsNaN(c.Threshold) {
+		return fmt.Errorf("%w: threshold must be positive", ErrInvalidConfig)
+	}
+	return nil
+}
+
+func (c Config) alpha() float64 {
+	if c.Alpha > 0 {
+		return c.Alpha
+	}
+	return 2 / float64(c.Warmup+1)
+}
+
+// Point is a scored bucket. Score is the distance from Baseline in units of
+// the spread of the baseline; its sign tells the direction.
+type Point struct {
+	Name      string        `json:"name"`
+	Labels    domain.Labels `json:"labels,omitempty"`
+	Timestamp int64         `json:"timestamp"`
+	Value     float64       `json:"value"`
+	Baseline  float64       `json:"baseline"`
+	Score     float64       `json:"score"`
+}
+
+// Detect returns the points of the selected series in [start, end] whose
+// absolute score reaches the threshold, ordered by name, label set and
+// timestamp.
+func Detect(ctx context.Context, store domain.MetricStore, selector domain.SeriesSelector, start, end int64, c Config) ([]Point, error) {
+	scored, err := score(ctx, store, selector, start, end, c)
+	if err != nil {
+		return nil, err
+	}
+
+	var anomalies []Point
+	for _, series := range scored {
+		for _, p := range series {
+			if math.Abs(p.Score) >= c.Threshold {
+				anomalies = append(anomalies, p)
+			}
+		}
+	}
+	return anomalies, nil
+}
+
+// Latest scores the bucket holding now for every selected series that has
+// one, whatever the threshold.
+func Latest(ctx context.Context, store domain.MetricStore, selector domain.SeriesSelector, now int64, c Config) ([]Point, error) {
+	start := now - now%c.Step
+	scored, err := score(ctx, store, selector, start, now, c)
+	if err != nil {
+		return nil, err
+	}
+
+	var latest []Point
+	for _, series := range scored {
+		if n := len(series); n > 0 && series[n-1].Timestamp == start {
+			latest = append(latest, series[n-1])
+		}
+	}
+	return latest, nil
+}
+
+// score returns the scored points of every series in [start, end], one
+// slice per series.
+func score(ctx context.Context, store domain.MetricStore, selector domain.SeriesSelector, start, end int64, c Config) ([][]Point, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	start -= start % c.Step
+
+	if c.Method == MethodSeasonal {
+		return scoreSeasonal(ctx, store, selector, start, end, c)
+	}
+
+	series, err := aggregate(ctx, store, selector, start-int64(c.Warmup)*c.Step, end, c.Step)
+	if err != nil {
+		return nil, err
+	}
+
+	scored := make([][]Point, 0, len(series))
+	for _, s := range series {
+		scored = append(scored, scoreEWMA(s, start, c))
+	}
+	return scored, nil
+}
+
+func aggregate(ctx context.Context, store domain.MetricStore, selector domain.SeriesSelector, start, end, step int64) ([]domain.Series, error) {
+	return store.AggregateSamples(ctx, domain.AggregateQuery{
+		Selector: selector,
+		Start:    start,
+		End:      end,
+		Step:     step,
+		Func:     domain.AggregateAvg,
+	})
+}
+
+// minScale keeps a flat baseline from turning every change into an
+// infinite score: the spread is taken to be at least 1% of the baseline.
+func minScale(baseline float64) float64 {
+	return 0.01 * math.Max(math.Abs(baseline), 1)
+}
+
+func scoreEWMA(s domain.Series, start int64, c Config) []Point {
+	alpha := c.alpha()
+
+	var (
+		scored   []Point
+		mean     float64
+		variance float64
+	)
+	for i, p := range s.Points {
+		if i == 0 {
+			mean = p.Value
+			continue
+		}
+
+		if i >= c.Warmup && p.Timestamp >= start {
+			scale := math.Max(math.Sqrt(variance), minScale(mean))
+			scored = append(scored, Point{
+				Name:      s.Name,
+				Labels:    s.Labels,
+				Timestamp: p.Timestamp,
+				Value:     p.Value,
+				Baseline:  mean,
+				Score:     (p.Value - mean) / scale,
+			})
+		}
+
+		diff := p.Value - mean
+		increment := alpha * diff
+		mean += increment
+		variance = (1 - alpha) * (variance + diff*increment)
+	}
+	return scored
+}
+
+func scoreSeasonal(ctx context.Context, store domain.MetricStore, selector domain.SeriesSelector, start, end int64, c Config) ([][]Point, error) {
+	current, err := aggregate(ctx, store, selector, start, end, c.Step)
+	if err != nil {
+		return nil, err
+	}
+
+	// history maps a series and a bucket of the range to the values of the
+	// same bucket on previous days.
+	type bucket struct {
+		series    string
+		timestamp int64
+	}
+	history := make(map[bucket][]float64)
+	for k := int64(1); k <= int64(c.Days); k++ {
+		previous, err := aggregate(ctx, store, selector, start-k*day, end-k*day, c.Step)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range previous {
+			key := s.Name + s.Labels.Key()
+			for _, p := range s.Points {
+				b := bucket{series: key, timestamp: p.Timestamp + k*day}
+				history[b] = append(history[b], p.Value)
+			}
+		}
+	}
+
+	scored := make([][]Point, 0, len(current))
+	for _, s := range current {
+		key := s.Name + s.Labels.Key()
+		var points []Point
+		for _, p := range s.Points {
+			values := history[bucket{series: key, timestamp: p.Timestamp}]
+			if len(values) < minSeasonalHistory {
+				continue
+			}
+			median, spread := robustSpread(values)
+			scale := math.Max(spread, minScale(median))
+			points = append(points, Point{
+				Name:      s.Name,
+				Labels:    s.Labels,
+				Timestamp: p.Timestamp,
+				Value:     p.Value,
+				Baseline:  median,
+				Score:     (p.Value - median) / scale,
+			})
+		}
+		scored = append(scored, points)
+	}
+	return scored, nil
+}
+
+// robustSpread returns the median of values and an estimate of their
+// standard deviation from the median absolute deviation. When more than
+// half of the values equal the median, as with integer series, the mean
+// absolute deviation is used instead. values is sorted in place.
+func robustSpread(values []float64) (float64, float64) {
+	sort.Float64s(values)
+	median := domain.Quantile(values, 0.5)
+
+	deviations := make([]float64, len(values))
+	var sum float64
+	for i, v := range values {
+		deviations[i] = math.Abs(v - median)
+		sum += deviations[i]
+	}
+	sort.Float64s(deviations)
+
+	// The constants scale both estimates to the standard deviation of
+	// normally distributed values.
+	if mad := domain.Quantile(deviations, 0.5); mad > 0 {
+		return median, 1.4826 * mad
+	}
+	return median, 1.2533 * sum / float64(len(values))
+}
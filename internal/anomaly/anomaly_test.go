@@ -0,0 +1,105 @@
+package anomaly
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"metrics-app/internal/domain"
+	"metrics-app/internal/repository"
+)
+
+const base int64 = 1722384000 // midnight UTC
+
+func newStore(t *testing.T, metrics []domain.Metric) domain.MetricStore {
+	store := repository.NewInMemoryStore(0)
+	require.NoError(t, store.Init())
+	_, err := store.StoreMetrics(context.Background(), metrics)
+	require.NoError(t, err)
+	return store
+}
+
+func TestConfig_Validate(t *testing.T) {
+	assert.NoError(t, DefaultConfig().Validate())
+
+	for _, c := range []Config{
+		{Method: "median", Step: 60, Threshold: 3, Warmup: 12},
+		{Method: MethodEWMA, Step: 60, Threshold: 3},
+		{Method: MethodEWMA, Step: 60, Threshold: 3, Warmup: 12, Alpha: 2},
+		{Method: MethodEWMA, Step: 60, Threshold: 0, Warmup: 12},
+		{Method: MethodSeasonal, Step: 60, Threshold: 3, Days: 2},
+		{Method: MethodSeasonal, Step: 7000, Threshold: 3, Days: 7},
+	} {
+		assert.ErrorIs(t, c.Validate(), ErrInvalidConfig, c)
+	}
+	assert.ErrorIs(t, Config{Method: MethodEWMA, Threshold: 3, Warmup: 12}.Validate(), domain.ErrInvalidStep)
+}
+
+func TestDetect_EWMA(t *testing.T) {
+	var metrics []domain.Metric
+	for i := int64(0); i < 60; i++ {
+		load := 50 + float64(i%3) // 50, 51, 52, ...
+		if i == 45 {
+			load = 95
+		}
+		metrics = append(metrics, domain.Metric{Timestamp: base + i*60, CPULoad: load, Concurrency: 10})
+	}
+	store := newStore(t, metrics)
+
+	c := Config{Method: MethodEWMA, Step: 60, Threshold: 3, Warmup: 10}
+	selector := domain.SeriesSelector{Name: domain.MetricCPULoad}
+	anomalies, err := Detect(context.Background(), store, selector, base+30*60, base+59*60, c)
+	require.NoError(t, err)
+
+	require.Len(t, anomalies, 1, "Only the spike should stand out")
+	assert.Equal(t, base+45*60, anomalies[0].Timestamp)
+	assert.Equal(t, 95.0, anomalies[0].Value)
+	assert.InDelta(t, 51, anomalies[0].Baseline, 1)
+	assert.Greater(t, anomalies[0].Score, 10.0)
+
+	// A flat series has no anomalies
+	anomalies, err = Detect(context.Background(), store, domain.SeriesSelector{Name: domain.MetricConcurrency}, base, base+59*60, c)
+	require.NoError(t, err)
+	assert.Empty(t, anomalies)
+
+	latest, err := Latest(context.Background(), store, selector, base+45*60+30, c)
+	require.NoError(t, err)
+	require.Len(t, latest, 1)
+	assert.Equal(t, base+45*60, latest[0].Timestamp, "Latest should score the bucket holding now")
+	assert.Greater(t, latest[0].Score, 10.0)
+}
+
+func TestDetect_Seasonal(t *testing.T) {
+	web := domain.Labels{"host": "web-1"}
+	var metrics []domain.Metric
+	for d := int64(0); d < 8; d++ {
+		for h := int64(0); h < 24; h++ {
+			// Busy at 9:00, quiet otherwise
+			load := 10.0 + float64(d%2)
+			if h == 9 {
+				load = 80 + float64(d%3)
+			}
+			if d == 7 && h == 3 {
+				load = 60
+			}
+			metrics = append(metrics, domain.Metric{Timestamp: base + d*day + h*3600, CPULoad: load, Concurrency: 1, Labels: web})
+		}
+	}
+	store := newStore(t, metrics)
+
+	c := Config{Method: MethodSeasonal, Step: 3600, Threshold: 3, Days: 7}
+	anomalies, err := Detect(context.Background(), store, domain.SeriesSelector{Name: domain.MetricCPULoad}, base+7*day, base+8*day-1, c)
+	require.NoError(t, err)
+
+	require.Len(t, anomalies, 1, "The daily peak at 9:00 is not an anomaly")
+	assert.Equal(t, base+7*day+3*3600, anomalies[0].Timestamp)
+	assert.Equal(t, web, anomalies[0].Labels)
+	assert.Equal(t, 10.0, anomalies[0].Baseline)
+
+	// Days without history are not scored
+	anomalies, err = Detect(context.Background(), store, domain.SeriesSelector{Name: domain.MetricCPULoad}, base, base+day-1, c)
+	require.NoError(t, err)
+	assert.Empty(t, anomalies)
+}
@@ -0,0 +1,355 @@
+package broadcast
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"metrics-app/internal/domain"
+)
+
+var (
+	// ErrSlowConsumer ends a subscription whose buffer was full when a
+	// metric was published.
+	ErrSlowConsumer = errors.New("subscriber fell behind and was dropped")
+	// ErrClosed ends every subscription when the broadcaster is closed.
+	ErrClosed = errors.New("broadcaster closed")
+)
+
+// defaultHistory is how many of the latest events a broadcaster keeps for
+// SubscribeAfter.
+const defaultHistory = 4096
+
+// Event is a published metric with its sequence number. Sequence numbers
+// count publications from 1 in the order they happened, whatever the
+// timestamps of the metrics, and are only meaningful together with the
+// Epoch of the broadcaster that assigned them.
+type Event struct {
+	Seq    uint64
+	Metric domain.Metric
+}
+
+// Broadcaster fans stored metrics out to subscribers. Publishing never
+// blocks: a subscriber that falls more than its buffer behind is dropped,
+// so a slow client cannot hold up the write path.
+type Broadcaster struct {
+	mu          sync.Mutex
+	subscribers map[*Subscription]struct{}
+	closed      bool
+	// held counts subscriptions their owners have not closed yet.
+	held sync.WaitGroup
+
+	epoch int64
+	seq   uint64
+	// history is a ring of the latest events; next is where the following
+	// one goes once it is full.
+	history     []Event
+	historySize int
+	next        int
+}
+
+func New() *Broadcaster {
+	return &Broadcaster{
+		subscribers: make(map[*Subscription]struct{}),
+		epoch:       time.Now().UnixNano(),
+		historySize: defaultHistory,
+	}
+}
+
+// Epoch identifies this broadcaster, and so the sequence its events are
+// numbered in. It changes when the process restarts.
+func (b *Broadcaster) Epoch() int64 {
+	return b.epoch
+}
+
+// Subscription receives the events published after it was made. C is
+// closed when the subscription ends; Err then tells why.
+type Subscription struct {
+	C <-chan Event
+
+	ch          chan Event
+	broadcaster *Broadcaster
+	err         error
+	released    bool
+}
+
+// Subscribe registers a subscriber that may fall up to buffer metrics
+// behind.
+func (b *Broadcaster) Subscribe(buffer int) *Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.subscribe(buffer)
+}
+
+// SubscribeAfter is Subscribe for a client that already received the
+// events up to seq of epoch. It also returns the events published since,
+// with nothing missing between them and the subscription. ok is false when
+// they are no longer all kept, or epoch is not this broadcaster's; the
+// subscription is made either way.
+func (b *Broadcaster) SubscribeAfter(buffer int, epoch int64, seq uint64) (sub *Subscription, missed []Event, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub = b.subscribe(buffer)
+	if epoch != b.epoch || seq > b.seq {
+		return sub, nil, false
+	}
+	kept := uint64(len(b.history))
+	if b.seq-seq > kept {
+		return sub, nil, false
+	}
+
+	missed = make([]Event, 0, b.seq-seq)
+	for i := kept - (b.seq - seq); i < kept; i++ {
+		missed = append(missed, b.history[(b.next+int(i))%len(b.history)])
+	}
+	return sub, missed, true
+}
+
+// subscribe registers a subscription. The caller holds b.mu.
+func (b *Broadcaster) subscribe(buffer int) *Subscription {
+	ch := make(chan Event, buffer)
+	sub := &Subscription{C: ch, ch: ch, broadcaster: b}
+
+	if b.closed {
+		sub.err = ErrClosed
+		sub.released = true
+		close(ch)
+		return sub
+	}
+	b.subscribers[sub] = struct{}{}
+	b.held.Add(1)
+	return sub
+}
+
+// Err is nil while the subscription is active or after it was closed by
+// its owner.
+func (s *Subscription) Err() error {
+	s.broadcaster.mu.Lock()
+	defer s.broadcaster.mu.Unlock()
+	return s.err
+}
+
+// Close ends the subscription. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.broadcaster.mu.Lock()
+	defer s.broadcaster.mu.Unlock()
+	s.broadcaster.remove(s, nil)
+	if !s.released {
+		s.released = true
+		s.broadcaster.held.Done()
+	}
+}
+
+// Publish numbers metrics and delivers them to every subscriber in order.
+func (b *Broadcaster) Publish(metrics ...domain.Metric) {
+	if len(metrics) == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	events := make([]Event, len(metrics))
+	for i, metric := range metrics {
+		b.seq++
+		events[i] = Event{Seq: b.seq, Metric: metric}
+		b.remember(events[i])
+	}
+
+	for sub := range b.subscribers {
+	deliver:
+		for _, event := range events {
+			select {
+			case sub.ch <- event:
+			default:
+				b.remove(sub, ErrSlowConsumer)
+				break deliver
+			}
+		}
+	}
+}
+
+// Subscribers reports how many subscriptions are active.
+func (b *Broadcaster) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers)
+}
+
+// Close ends every subscription with ErrClosed and refuses new ones.
+func (b *Broadcaster) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for sub := range b.subscribers {
+		b.remove(sub, ErrClosed)
+	}
+}
+
+// Wait blocks until the owners of all subscriptions have closed them, or
+// until ctx is done. Together with Close it lets connections the HTTP
+// server no longer tracks, such as WebSockets, finish before shutdown.
+func (b *Broadcaster) Wait(ctx context.Context) error {
+	released := make(chan struct{})
+	go func() {
+		b.held.Wait()
+		close(released)
+	}()
+
+	select {
+	case <-released:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// remember keeps event in the history, evicting the oldest once it is full.
+// The caller holds b.mu.
+func (b *Broadcaster) remember(event Event) {
+	if len(b.history) < b.historySize {
+		b.history = append(b.history, event)
+		return
+	}
+	b.history[b.next] = event
+	b.next = (b.next + 1) % len(b.history)
+}
+
+// remove ends sub with err. The caller holds b.mu.
+func (b *Broadcaster) remove(sub *Subscription, err error) {
+	if _, ok := b.subscribers[sub]; !ok {
+		return
+	}
+	delete(b.subscribers, sub)
+	sub.err = err
+	close(sub.ch)
+}
+
+// WrapStore publishes every metric that is stored through the returned
+// store once its write has succeeded. That includes metrics stored as their
+// cpu_load and concurrency samples; other samples are not published.
+func (b *Broadcaster) WrapStore(store domain.MetricStore) domain.MetricStore {
+	return &publishingStore{MetricStore: store, broadcaster: b}
+}
+
+type publishingStore struct {
+	domain.MetricStore
+	broadcaster *Broadcaster
+}
+
+func (s *publishingStore) StoreMetric(ctx context.Context, metric domain.Metric) error {
+	if err := s.MetricStore.StoreMetric(ctx, metric); err != nil {
+		return err
+	}
+	s.broadcaster.Publish(metric)
+	return nil
+}
+
+func (s *publishingStore) StoreMetrics(ctx context.Context, metrics []domain.Metric) (domain.BatchResult, error) {
+	result, err := s.MetricStore.StoreMetrics(ctx, metrics)
+	if err != nil {
+		return result, err
+	}
+
+	rejected := make(map[int]bool, len(result.Rejected))
+	for _, rejection := range result.Rejected {
+		rejected[rejection.Index] = true
+	}
+	stored := make([]domain.Metric, 0, result.Stored)
+	for i, metric := range metrics {
+		if !rejected[i] {
+			stored = append(stored, metric)
+		}
+	}
+	s.broadcaster.Publish(stored...)
+	return result, nil
+}
+
+func (s *publishingStore) StoreSamples(ctx context.Context, samples []domain.Sample) (domain.BatchResult, error) {
+	result, err := s.MetricStore.StoreSamples(ctx, samples)
+	if err != nil {
+		return result, err
+	}
+	s.broadcaster.Publish(s.metricsOf(ctx, samples, result)...)
+	return result, nil
+}
+
+// metricsOf folds the stored cpu_load and concurrency samples of a batch
+// into their metrics, in the order they first appear. A metric with only
+// one of the two in the batch is read back from the store, so it is
+// published as the Metric view shows it.
+func (s *publishingStore) metricsOf(ctx context.Context, samples []domain.Sample, result domain.BatchResult) []domain.Metric {
+	rejected := make(map[int]bool, len(result.Rejected))
+	for _, rejection := range result.Rejected {
+		rejected[rejection.Index] = true
+	}
+
+	type position struct {
+		timestamp int64
+		labels    string
+	}
+	type row struct {
+		metric      domain.Metric
+		cpuLoad     bool
+		concurrency bool
+	}
+	index := make(map[position]int)
+	var rows []row
+
+	for i, sample := range samples {
+		if rejected[i] || (sample.Name != domain.MetricCPULoad && sample.Name != domain.MetricConcurrency) {
+			continue
+		}
+		key := position{sample.Timestamp, sample.Labels.Key()}
+		n, ok := index[key]
+		if !ok {
+			n = len(rows)
+			index[key] = n
+			rows = append(rows, row{metric: domain.Metric{Timestamp: sample.Timestamp, Labels: sample.Labels}})
+		}
+		if sample.Name == domain.MetricCPULoad {
+			rows[n].metric.CPULoad, rows[n].cpuLoad = sample.Value, true
+		} else {
+			rows[n].metric.Concurrency, rows[n].concurrency = int(math.Round(sample.Value)), true
+		}
+	}
+
+	metrics := make([]domain.Metric, 0, len(rows))
+	for _, r := range rows {
+		if !r.cpuLoad || !r.concurrency {
+			if stored, ok := s.storedMetric(ctx, r.metric); ok {
+				r.metric = stored
+			}
+		}
+		metrics = append(metrics, r.metric)
+	}
+	return metrics
+}
+
+// storedMetric reads the row of the Metric view at the timestamp and label
+// set of m.
+func (s *publishingStore) storedMetric(ctx context.Context, m domain.Metric) (domain.Metric, bool) {
+	matchers := make([]domain.LabelMatcher, 0, len(m.Labels))
+	for name, value := range m.Labels {
+		matchers = append(matchers, domain.LabelMatcher{Name: name, Type: domain.MatchEqual, Value: value})
+	}
+	rows, err := s.MetricStore.QueryMetrics(ctx, domain.Query{
+		Selector: domain.SeriesSelector{Matchers: matchers},
+		Start:    m.Timestamp,
+		End:      m.Timestamp,
+	})
+	if err != nil {
+		return m, false
+	}
+	key := m.Labels.Key()
+	for _, row := range rows {
+		if row.Labels.Key() == key {
+			return row, true
+		}
+	}
+	return m, false
+}
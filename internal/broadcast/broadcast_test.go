@@ -0,0 +1,183 @@
+package broadcast
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"metrics-app/internal/domain"
+	"metrics-app/internal/repository"
+)
+
+func metric(ts int64) domain.Metric {
+	return domain.Metric{Timestamp: ts, CPULoad: 10, Concurrency: 1}
+}
+
+func drain(sub *Subscription) []int64 {
+	var timestamps []int64
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				return timestamps
+			}
+			timestamps = append(timestamps, event.Metric.Timestamp)
+		default:
+			return timestamps
+		}
+	}
+}
+
+func TestBroadcaster_FanOut(t *testing.T) {
+	b := New()
+	first := b.Subscribe(4)
+	second := b.Subscribe(4)
+
+	b.Publish(metric(1), metric(2))
+	assert.Equal(t, []int64{1, 2}, drain(first))
+	assert.Equal(t, []int64{1, 2}, drain(second))
+
+	second.Close()
+	second.Close()
+	assert.NoError(t, second.Err(), "Closing a subscription is not an error")
+	assert.Equal(t, 1, b.Subscribers())
+
+	b.Publish(metric(3))
+	assert.Equal(t, []int64{3}, drain(first))
+}
+
+func TestBroadcaster_SubscribeAfter(t *testing.T) {
+	b := New()
+	b.historySize = 3
+
+	// Publication order, not timestamp order, decides what follows an event
+	b.Publish(metric(50), metric(10), metric(40))
+	sub, missed, ok := b.SubscribeAfter(4, b.Epoch(), 1)
+	require.True(t, ok)
+	require.Len(t, missed, 2)
+	assert.Equal(t, Event{Seq: 2, Metric: metric(10)}, missed[0])
+	assert.Equal(t, uint64(3), missed[1].Seq)
+
+	b.Publish(metric(20))
+	assert.Equal(t, []int64{20}, drain(sub), "Events after the subscription should not repeat the missed ones")
+	sub.Close()
+
+	_, missed, ok = b.SubscribeAfter(4, b.Epoch(), 4)
+	assert.True(t, ok)
+	assert.Empty(t, missed)
+
+	_, _, ok = b.SubscribeAfter(4, b.Epoch(), 0)
+	assert.False(t, ok, "Events evicted from the history cannot be replayed")
+	_, _, ok = b.SubscribeAfter(4, b.Epoch()+1, 3)
+	assert.False(t, ok, "Sequence numbers of another broadcaster mean nothing")
+	_, _, ok = b.SubscribeAfter(4, b.Epoch(), 5)
+	assert.False(t, ok)
+	assert.Equal(t, 4, b.Subscribers(), "Every call should subscribe")
+}
+
+func TestBroadcaster_DropsSlowConsumer(t *testing.T) {
+	b := New()
+	slow := b.Subscribe(2)
+	fast := b.Subscribe(8)
+
+	b.Publish(metric(1), metric(2), metric(3))
+
+	assert.Equal(t, []int64{1, 2}, drain(slow), "The buffered metrics should still be delivered")
+	_, open := <-slow.C
+	assert.False(t, open)
+	assert.ErrorIs(t, slow.Err(), ErrSlowConsumer)
+
+	assert.Equal(t, []int64{1, 2, 3}, drain(fast), "Other subscribers should not be affected")
+	assert.NoError(t, fast.Err())
+}
+
+func TestBroadcaster_Close(t *testing.T) {
+	b := New()
+	sub := b.Subscribe(1)
+
+	b.Close()
+	_, open := <-sub.C
+	assert.False(t, open)
+	assert.ErrorIs(t, sub.Err(), ErrClosed)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, b.Wait(ctx), context.DeadlineExceeded, "Wait should block until the owner closes the subscription")
+	sub.Close()
+	assert.NoError(t, b.Wait(context.Background()))
+
+	late := b.Subscribe(1)
+	_, open = <-late.C
+	assert.False(t, open, "Subscriptions after Close should end immediately")
+	assert.ErrorIs(t, late.Err(), ErrClosed)
+}
+
+func TestBroadcaster_WrapStore(t *testing.T) {
+	inMemoryStore := repository.NewInMemoryStore(0)
+	require.NoError(t, inMemoryStore.Init())
+
+	b := New()
+	sub := b.Subscribe(8)
+	store := b.WrapStore(inMemoryStore)
+	ctx := context.Background()
+
+	require.NoError(t, store.StoreMetric(ctx, metric(10)))
+	assert.Error(t, store.StoreMetric(ctx, metric(10)), "Duplicates are rejected by the store")
+
+	result, err := store.StoreMetrics(ctx, []domain.Metric{metric(20), {Timestamp: 30, CPULoad: 101}, metric(40)})
+	require.NoError(t, err)
+	require.Len(t, result.Rejected, 1)
+
+	_, err = store.StoreSamples(ctx, []domain.Sample{{Name: "load1", Timestamp: 50, Value: 1}})
+	require.NoError(t, err)
+
+	assert.Equal(t, []int64{10, 20, 40}, drain(sub), "Only stored metrics should be published")
+}
+
+func TestBroadcaster_WrapStoreSamples(t *testing.T) {
+	inMemoryStore := repository.NewInMemoryStore(0)
+	require.NoError(t, inMemoryStore.Init())
+
+	b := New()
+	sub := b.Subscribe(8)
+	store := b.WrapStore(inMemoryStore)
+	ctx := context.Background()
+	web1 := domain.Labels{"host": "web-1"}
+
+	// A pushed batch: both halves of a metric, a rejected sample, and a
+	// sample that is not part of the Metric view
+	result, err := store.StoreSamples(ctx, []domain.Sample{
+		{Name: domain.MetricCPULoad, Labels: web1, Timestamp: 10, Value: 42.5},
+		{Name: "load1", Labels: web1, Timestamp: 10, Value: 0.7},
+		{Name: domain.MetricConcurrency, Labels: web1, Timestamp: 10, Value: 7},
+		{Name: domain.MetricCPULoad, Labels: web1, Timestamp: -1, Value: 1},
+		{Name: domain.MetricConcurrency, Labels: web1, Timestamp: 20, Value: 3},
+	})
+	require.NoError(t, err)
+	require.Len(t, result.Rejected, 1)
+
+	assert.Equal(t, []domain.Metric{
+		{Timestamp: 10, CPULoad: 42.5, Concurrency: 7, Labels: web1},
+		{Timestamp: 20, Concurrency: 3, Labels: web1},
+	}, drainMetrics(sub))
+
+	// The other half of a metric arriving later completes it from the store
+	_, err = store.StoreSamples(ctx, []domain.Sample{{Name: domain.MetricCPULoad, Labels: web1, Timestamp: 20, Value: 12}})
+	require.NoError(t, err)
+	assert.Equal(t, []domain.Metric{{Timestamp: 20, CPULoad: 12, Concurrency: 3, Labels: web1}}, drainMetrics(sub))
+}
+
+func drainMetrics(sub *Subscription) []domain.Metric {
+	var metrics []domain.Metric
+	for {
+		select {
+		case event := <-sub.C:
+			metrics = append(metrics, event.Metric)
+		default:
+			return metrics
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package collector
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"metrics-app/internal/domain"
+)
+
+// Names of the samples a Collector reports besides cpu_load and
+// concurrency, which it fills with the CPU utilisation and the number of
+// runnable threads.
+const (
+	MetricLoad1                = "load1"
+	MetricLoad5                = "load5"
+	MetricLoad15               = "load15"
+	MetricMemoryTotalBytes     = "memory_total_bytes"
+	MetricMemoryAvailableBytes = "memory_available_bytes"
+	MetricMemoryUsedBytes      = "memory_used_bytes"
+	MetricProcesses            = "processes"
+	MetricThreads              = "threads"
+	MetricProcsBlocked         = "procs_blocked"
+)
+
+// DefaultRoot is where procfs is mounted.
+const DefaultRoot = "/proc"
+
+var ErrUnsupported = errors.New("host metrics can only be collected on Linux")
+
+// Collector samples CPU, load, memory and process counts of the host from
+// procfs. CPU utilisation is measured between two calls of Collect, so the
+// first call reports no cpu_load.
+type Collector struct {
+	Root   string
+	Labels domain.Labels
+
+	prev *cpuTimes
+}
+
+// New returns a Collector of the host that labels its samples with labels.
+func New(labels domain.Labels) (*Collector, error) {
+	if !supported {
+		return nil, ErrUnsupported
+	}
+	return &Collector{Root: DefaultRoot, Labels: labels}, nil
+}
+
+// Collect reads the host once and returns its samples at now.
+func (c *Collector) Collect(now time.Time) ([]domain.Sample, error) {
+	ts := now.Unix()
+	var samples []domain.Sample
+	add := func(name string, value float64) {
+		samples = append(samples, domain.Sample{Name: name, Labels: c.Labels, Timestamp: ts, Value: value})
+	}
+
+	stat, err := readStat(filepath.Join(c.Root, "stat"))
+	if err != nil {
+		return nil, err
+	}
+	if c.prev != nil {
+		if load, ok := stat.cpu.utilisation(*c.prev); ok {
+			add(domain.MetricCPULoad, load)
+		}
+	}
+	c.prev = &stat.cpu
+	add(domain.MetricConcurrency, stat.procsRunning)
+	add(MetricProcsBlocked, stat.procsBlocked)
+
+	load, err := readLoadavg(filepath.Join(c.Root, "loadavg"))
+	if err != nil {
+		return nil, err
+	}
+	add(MetricLoad1, load.load1)
+	add(MetricLoad5, load.load5)
+	add(MetricLoad15, load.load15)
+	add(MetricThreads, load.threads)
+
+	mem, err := readMeminfo(filepath.Join(c.Root, "meminfo"))
+	if err != nil {
+		return nil, err
+	}
+	add(MetricMemoryTotalBytes, mem.total)
+	add(MetricMemoryAvailableBytes, mem.available)
+	add(MetricMemoryUsedBytes, mem.total-mem.available)
+
+	processes, err := countProcesses(c.Root)
+	if err != nil {
+		return nil, err
+	}
+	add(MetricProcesses, processes)
+
+	return samples, nil
+}
+
+// cpuTimes are the cumulative jiffies of the "cpu" line of /proc/stat.
+type cpuTimes struct {
+	idle  uint64
+	total uint64
+}
+
+// utilisation is the busy percentage of all CPUs since prev. It is not
+// defined when no time has passed or the counters went back.
+func (t cpuTimes) utilisation(prev cpuTimes) (float64, bool) {
+	if t.total <= prev.total || t.idle < prev.idle {
+		return 0, false
+	}
+	total := float64(t.total - prev.total)
+	idle := float64(t.idle - prev.idle)
+	return min(max(100*(total-idle)/total, 0), 100), true
+}
+
+type stat struct {
+	cpu          cpuTimes
+	procsRunning float64
+	procsBlocked float64
+}
+
+func readStat(path string) (stat, error) {
+	var s stat
+	seenCPU := false
+	err := scanLines(path, func(fields []string) error {
+		switch fields[0] {
+		case "cpu":
+			// user nice system idle iowait irq softirq steal; guest time is
+			// already part of user and nice.
+			if len(fields) < 5 {
+				return fmt.Errorf("cpu line has %d fields", len(fields))
+			}
+			for i, field := range fields[1:min(len(fields), 9)] {
+				v, err := strconv.ParseUint(field, 10, 64)
+				if err != nil {
+					return err
+				}
+				s.cpu.total += v
+				if i == 3 || i == 4 {
+					s.cpu.idle += v
+				}
+			}
+			seenCPU = true
+		case "procs_running", "procs_blocked":
+			if len(fields) != 2 {
+				return fmt.Errorf("%s line has %d fields", fields[0], len(fields))
+			}
+			v, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return err
+			}
+			if fields[0] == "procs_running" {
+				s.procsRunning = v
+			} else {
+				s.procsBlocked = v
+			}
+		}
+		return nil
+	})
+	if err == nil && !seenCPU {
+		err = fmt.Errorf("%s: no cpu line", path)
+	}
+	return s, err
+}
+
+type loadavg struct {
+	load1, load5, load15 float64
+	threads              float64
+}
+
+// readLoadavg parses "0.20 0.18 0.12 1/80 11206": the load averages, the
+// runnable and total scheduling entities and the last PID.
+func readLoadavg(path string) (loadavg, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return loadavg{}, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 4 {
+		return loadavg{}, fmt.Errorf("%s: expected at least 4 fields, got %d", path, len(fields))
+	}
+
+	var l loadavg
+	for i, dst := range []*float64{&l.load1, &l.load5, &l.load15} {
+		if *dst, err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return loadavg{}, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	_, total, ok := strings.Cut(fields[3], "/")
+	if !ok {
+		return loadavg{}, fmt.Errorf("%s: malformed task counts %q", path, fields[3])
+	}
+	if l.threads, err = strconv.ParseFloat(total, 64); err != nil {
+		return loadavg{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return l, nil
+}
+
+type meminfo struct {
+	total, available float64
+}
+
+// readMeminfo reads MemTotal and MemAvailable, in bytes. Kernels before
+// 3.14 have no MemAvailable; it is estimated from the free memory and the
+// page cache there.
+func readMeminfo(path string) (meminfo, error) {
+	values := make(map[string]float64)
+	err := scanLines(path, func(fields []string) error {
+		if len(fields) < 2 {
+			return nil
+		}
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return err
+		}
+		if len(fields) == 3 && fields[2] == "kB" {
+			v *= 1024
+		}
+		values[strings.TrimSuffix(fields[0], ":")] = v
+		return nil
+	})
+	if err != nil {
+		return meminfo{}, err
+	}
+
+	total, ok := values["MemTotal"]
+	if !ok {
+		return meminfo{}, fmt.Errorf("%s: no MemTotal", path)
+	}
+	available, ok := values["MemAvailable"]
+	if !ok {
+		available = values["MemFree"] + values["Buffers"] + values["Cached"]
+	}
+	return meminfo{total: total, available: min(available, total)}, nil
+}
+
+// countProcesses counts the numeric directories of root, one per process.
+func countProcesses(root string) (float64, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := strconv.Atoi(entry.Name()); err == nil {
+			n++
+		}
+	}
+	return float64(n), nil
+}
+
+// scanLines calls fn with the fields of every non-empty line of path.
+func scanLines(path string, fn func(fields []string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if err := fn(fields); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return scanner.Err()
+}
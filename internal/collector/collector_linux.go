@@ -0,0 +1,5 @@
+//go:build linux
+
+package collector
+
+const supported = true
@@ -0,0 +1,119 @@
+package collector
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"metrics-app/internal/domain"
+)
+
+// writeProc lays out a procfs tree with the given /proc/stat and three
+// processes.
+func writeProc(t *testing.T, root, stat string) {
+	files := map[string]string{
+		"stat":    stat,
+		"loadavg": "0.52 0.38 0.27 3/412 11206\n",
+		"meminfo": "MemTotal:        8000000 kB\nMemFree:         1000000 kB\nMemAvailable:    6000000 kB\nHugePages_Total:       0\n",
+	}
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(root, name), []byte(content), 0o644))
+	}
+	for _, dir := range []string{"1", "42", "11206", "self", "sys"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0o755))
+	}
+}
+
+func values(samples []domain.Sample) map[string]float64 {
+	byName := make(map[string]float64, len(samples))
+	for _, s := range samples {
+		byName[s.Name] = s.Value
+	}
+	return byName
+}
+
+func TestCollector_Collect(t *testing.T) {
+	root := t.TempDir()
+	writeProc(t, root, "cpu  100 0 100 700 100 0 0 0 0 0\ncpu0 100 0 100 700 100 0 0 0 0 0\nprocs_running 3\nprocs_blocked 1\n")
+
+	labels := domain.Labels{"host": "web-1"}
+	c := &Collector{Root: root, Labels: labels}
+	now := time.Unix(1722441990, 0)
+
+	samples, err := c.Collect(now)
+	require.NoError(t, err)
+	for _, s := range samples {
+		assert.Equal(t, now.Unix(), s.Timestamp)
+		assert.Equal(t, labels, s.Labels)
+		assert.NoError(t, s.Validate(), s.Name)
+	}
+
+	got := values(samples)
+	assert.NotContains(t, got, domain.MetricCPULoad, "The first collection has no interval to measure CPU over")
+	assert.Equal(t, map[string]float64{
+		domain.MetricConcurrency:   3,
+		MetricProcsBlocked:         1,
+		MetricLoad1:                0.52,
+		MetricLoad5:                0.38,
+		MetricLoad15:               0.27,
+		MetricThreads:              412,
+		MetricMemoryTotalBytes:     8000000 * 1024,
+		MetricMemoryAvailableBytes: 6000000 * 1024,
+		MetricMemoryUsedBytes:      2000000 * 1024,
+		MetricProcesses:            3,
+	}, got)
+
+	// 1000 more jiffies of which 250 idle and iowait: 75% busy
+	writeProc(t, root, "cpu  500 100 200 850 200 150 0 0 0 0\nprocs_running 5\nprocs_blocked 0\n")
+	samples, err = c.Collect(now.Add(10 * time.Second))
+	require.NoError(t, err)
+	got = values(samples)
+	assert.InDelta(t, 75.0, got[domain.MetricCPULoad], 0.001)
+	assert.Equal(t, 5.0, got[domain.MetricConcurrency])
+
+	// Counters that went back, e.g. after a restore, are skipped
+	writeProc(t, root, "cpu  1 1 1 1 1 0 0 0\n")
+	samples, err = c.Collect(now.Add(20 * time.Second))
+	require.NoError(t, err)
+	assert.NotContains(t, values(samples), domain.MetricCPULoad)
+}
+
+func TestCollector_MalformedProc(t *testing.T) {
+	root := t.TempDir()
+	writeProc(t, root, "intr 1 2 3\n")
+	_, err := (&Collector{Root: root}).Collect(time.Now())
+	assert.ErrorContains(t, err, "no cpu line")
+
+	writeProc(t, root, "cpu  100 0 100 700 100\n")
+	require.NoError(t, os.WriteFile(filepath.Join(root, "loadavg"), []byte("0.52 0.38\n"), 0o644))
+	_, err = (&Collector{Root: root}).Collect(time.Now())
+	assert.Error(t, err)
+
+	// Without MemAvailable, free memory and the page cache count as available
+	writeProc(t, root, "cpu  100 0 100 700 100\n")
+	require.NoError(t, os.WriteFile(filepath.Join(root, "meminfo"), []byte("MemTotal: 1000 kB\nMemFree: 200 kB\nBuffers: 100 kB\nCached: 300 kB\n"), 0o644))
+	samples, err := (&Collector{Root: root}).Collect(time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 600.0*1024, values(samples)[MetricMemoryAvailableBytes])
+}
+
+func TestNew(t *testing.T) {
+	c, err := New(domain.Labels{"host": "test"})
+	if !supported {
+		assert.ErrorIs(t, err, ErrUnsupported)
+		return
+	}
+	require.NoError(t, err)
+
+	_, err = c.Collect(time.Now())
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	samples, err := c.Collect(time.Now())
+	require.NoError(t, err)
+	assert.Greater(t, values(samples)[MetricProcesses], 0.0)
+	assert.Greater(t, values(samples)[MetricMemoryTotalBytes], 0.0)
+}
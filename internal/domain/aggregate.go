@@ -0,0 +1,188 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+type AggregateFunc string
+
+const (
+	AggregateAvg   AggregateFunc = "avg"
+	AggregateMin   AggregateFunc = "min"
+	AggregateMax   AggregateFunc = "max"
+	AggregateSum   AggregateFunc = "sum"
+	AggregateCount AggregateFunc = "count"
+	AggregateP50   AggregateFunc = "p50"
+	AggregateP95   AggregateFunc = "p95"
+	AggregateP99   AggregateFunc = "p99"
+)
+
+// MaxAggregateBuckets bounds the number of buckets a single series may be
+// split into.
+const MaxAggregateBuckets = 11000
+
+var (
+	ErrInvalidAggregateFunc = errors.New("unknown aggregation function")
+	ErrInvalidStep          = errors.New("step must be a positive number of seconds")
+	ErrTooManyBuckets       = fmt.Errorf("time range divided by step exceeds %d buckets", MaxAggregateBuckets)
+)
+
+// Quantile returns the quantile in [0, 1] that a percentile function
+// computes and whether fn is a percentile at all.
+func (fn AggregateFunc) Quantile() (float64, bool) {
+	switch fn {
+	case AggregateP50:
+		return 0.50, true
+	case AggregateP95:
+		return 0.95, true
+	case AggregateP99:
+		return 0.99, true
+	}
+	return 0, false
+}
+
+func (fn AggregateFunc) Validate() error {
+	switch fn {
+	case AggregateAvg, AggregateMin, AggregateMax, AggregateSum, AggregateCount, AggregateP50, AggregateP95, AggregateP99:
+		return nil
+	}
+	return fmt.Errorf("%w: %q", ErrInvalidAggregateFunc, fn)
+}
+
+// AggregateQuery splits the selected series into buckets of Step seconds.
+// Buckets are aligned to multiples of Step since the Unix epoch and are
+// labelled with their start time.
+type AggregateQuery struct {
+	Selector SeriesSelector
+	Start    int64
+	End      int64
+	Step     int64
+	Func     AggregateFunc
+}
+
+func (q AggregateQuery) Validate() error {
+	if q.Step <= 0 {
+		return ErrInvalidStep
+	}
+	if (q.End-q.Start)/q.Step >= MaxAggregateBuckets {
+		return ErrTooManyBuckets
+	}
+	return q.Func.Validate()
+}
+
+// Bucket returns the start of the bucket holding timestamp.
+func (q AggregateQuery) Bucket(timestamp int64) int64 {
+	return timestamp - timestamp%q.Step
+}
+
+type Point struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+// Series is a sequence of points of one named, labelled series.
+type Series struct {
+	Name   string  `json:"name"`
+	Labels Labels  `json:"labels,omitempty"`
+	Points []Point `json:"points"`
+}
+
+// Aggregate reduces values with fn. Percentiles interpolate linearly
+// between the closest ranks and sort values in place.
+func Aggregate(fn AggregateFunc, values []float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+
+	if q, ok := fn.Quantile(); ok {
+		sort.Float64s(values)
+		return Quantile(values, q)
+	}
+
+	result := values[0]
+	switch fn {
+	case AggregateCount:
+		return float64(len(values))
+	case AggregateMin:
+		for _, v := range values[1:] {
+			result = math.Min(result, v)
+		}
+	case AggregateMax:
+		for _, v := range values[1:] {
+			result = math.Max(result, v)
+		}
+	case AggregateSum, AggregateAvg:
+		for _, v := range values[1:] {
+			result += v
+		}
+		if fn == AggregateAvg {
+			result /= float64(len(values))
+		}
+	}
+	return result
+}
+
+// Quantile returns the q-quantile of ascending sorted values.
+func Quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	rank := q * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	if lower == upper {
+		return sorted[lower]
+	}
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+// BucketSamples aggregates samples in memory. Samples outside the query
+// range or not selected by matcher are skipped. The result is ordered by
+// name and label set.
+func BucketSamples(samples []Sample, matcher *SeriesMatcher, q AggregateQuery) []Series {
+	type bucketKey struct {
+		series string
+		bucket int64
+	}
+
+	seriesByKey := make(map[string]*Series)
+	values := make(map[bucketKey][]float64)
+
+	for _, sample := range samples {
+		if sample.Timestamp < q.Start || sample.Timestamp > q.End || !matcher.Matches(sample.Name, sample.Labels) {
+			continue
+		}
+		key := sample.Name + sample.Labels.Key()
+		if _, ok := seriesByKey[key]; !ok {
+			seriesByKey[key] = &Series{Name: sample.Name, Labels: sample.Labels}
+		}
+		bk := bucketKey{series: key, bucket: q.Bucket(sample.Timestamp)}
+		values[bk] = append(values[bk], sample.Value)
+	}
+
+	for bk, bucketValues := range values {
+		s := seriesByKey[bk.series]
+		s.Points = append(s.Points, Point{Timestamp: bk.bucket, Value: Aggregate(q.Func, bucketValues)})
+	}
+
+	result := make([]Series, 0, len(seriesByKey))
+	for _, s := range seriesByKey {
+		sort.Slice(s.Points, func(i, j int) bool { return s.Points[i].Timestamp < s.Points[j].Timestamp })
+		result = append(result, *s)
+	}
+	SortSeries(result)
+	return result
+}
+
+// SortSeries orders series by name and then label set.
+func SortSeries(series []Series) {
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].Name != series[j].Name {
+			return series[i].Name < series[j].Name
+		}
+		return series[i].Labels.Key() < series[j].Labels.Key()
+	})
+}
@@ -1,16 +1,95 @@
 package domain
 
-import "context"
+import (
+	"context"
+	"errors"
+	"math"
+)
 
+var (
+	ErrInvalidTimestamp   = errors.New("timestamp must be a positive unix time in seconds")
+	ErrInvalidCPULoad     = errors.New("cpu_load must be between 0 and 100")
+	ErrInvalidConcurrency = errors.New("concurrency cannot be negative")
+	ErrDuplicateMetric    = errors.New("a metric with the same series and timestamp is already stored")
+)
+
+// Metric is the compatibility view over the cpu_load and concurrency series
+// that share a label set.
 type Metric struct {
 	Timestamp   int64   `json:"timestamp"`
 	CPULoad     float64 `json:"cpu_load"`
 	Concurrency int     `json:"concurrency"`
+	Labels      Labels  `json:"labels,omitempty"`
+}
+
+// Validate reports the first field of the metric that cannot be stored.
+func (m Metric) Validate() error {
+	if m.Timestamp <= 0 {
+		return ErrInvalidTimestamp
+	}
+	if math.IsNaN(m.CPULoad) || m.CPULoad < 0 || m.CPULoad > 100 {
+		return ErrInvalidCPULoad
+	}
+	if m.Concurrency < 0 {
+		return ErrInvalidConcurrency
+	}
+	return m.Labels.Validate()
+}
+
+// Samples splits the metric into its cpu_load and concurrency samples.
+func (m Metric) Samples() []Sample {
+	return []Sample{
+		{Name: MetricCPULoad, Labels: m.Labels, Timestamp: m.Timestamp, Value: m.CPULoad},
+		{Name: MetricConcurrency, Labels: m.Labels, Timestamp: m.Timestamp, Value: float64(m.Concurrency)},
+	}
+}
+
+// Rejection identifies an item of a batch write that was not stored. Index
+// refers to the position of the item in the submitted slice.
+type Rejection struct {
+	Index int
+	Err   error
+}
+
+// BatchResult summarises a batch write. Items that are not listed in
+// Rejected were stored.
+type BatchResult struct {
+	Stored   int
+	Rejected []Rejection
 }
 
 type MetricStore interface {
 	Init() error
 	StoreMetric(ctx context.Context, metric Metric) error
+	// StoreMetrics writes a batch atomically: individual items may be
+	// rejected, but any other failure leaves none of the batch stored.
+	StoreMetrics(ctx context.Context, metrics []Metric) (BatchResult, error)
+	// StoreSamples has the same batch semantics as StoreMetrics.
+	StoreSamples(ctx context.Context, samples []Sample) (BatchResult, error)
 	GetMetrics(ctx context.Context, startTime, endTime int64, limit, offset int) ([]Metric, error)
+	// QueryMetrics reads the Metric view ordered by timestamp and label set.
+	// Only the label matchers of the selector apply.
+	QueryMetrics(ctx context.Context, query Query) ([]Metric, error)
+	// CountMetrics reports how many rows QueryMetrics returns for query
+	// when Limit, Offset and Cursor are ignored.
+	CountMetrics(ctx context.Context, query Query) (int64, error)
+	// QuerySamples reads samples ordered by timestamp, label set and name.
+	QuerySamples(ctx context.Context, query Query) ([]Sample, error)
+	// CountSamples is the counterpart of CountMetrics for QuerySamples.
+	CountSamples(ctx context.Context, query Query) (int64, error)
+	// AggregateSamples downsamples the selected series, ordered by name and
+	// label set. Buckets without samples are omitted.
+	AggregateSamples(ctx context.Context, query AggregateQuery) ([]Series, error)
+	// SummarizeSamples computes Statistics for each selected series over the
+	// query range, ordered by name and label set. Limit and Offset are
+	// ignored; series without samples are omitted.
+	SummarizeSamples(ctx context.Context, query Query) ([]SeriesStatistics, error)
+	// LatestSamples returns the most recent sample of every selected series,
+	// ordered by name and label set.
+	LatestSamples(ctx context.Context, selector SeriesSelector) ([]Sample, error)
+	// DeleteBefore removes every sample with a timestamp before ts and
+	// reports how many were removed. Series left without samples are
+	// forgotten.
+	DeleteBefore(ctx context.Context, ts int64) (int64, error)
 	Close() error
 }
@@ -0,0 +1,13 @@
+package domain
+
+// Notification is a rendered webhook request waiting in the outbox. Times
+// are Unix seconds; NextAttempt is when it is due again.
+type Notification struct {
+	ID          int64
+	Receiver    string
+	Payload     []byte
+	Attempts    int
+	CreatedAt   int64
+	NextAttempt int64
+	LastError   string
+}
@@ -0,0 +1,15 @@
+package domain
+
+// RollupTier is a resolution raw samples are pre-aggregated into, so long
+// ranges can still be served after the raw samples were purged.
+type RollupTier struct {
+	Name       string
+	Resolution int64
+}
+
+// RollupTiers are ordered from the finest resolution to the coarsest. Each
+// tier is built from the one before it.
+var RollupTiers = []RollupTier{
+	{Name: "1m", Resolution: 60},
+	{Name: "1h", Resolution: 3600},
+}
@@ -0,0 +1,282 @@
+package domain
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Names of the samples that make up the Metric compatibility view.
+const (
+	MetricCPULoad     = "cpu_load"
+	MetricConcurrency = "concurrency"
+)
+
+var (
+	ErrInvalidMetricName = errors.New("metric name must match [a-zA-Z_:][a-zA-Z0-9_:]*")
+	ErrInvalidLabelName  = errors.New("label name must match [a-zA-Z_][a-zA-Z0-9_]*")
+	ErrInvalidValue      = errors.New("sample value must be a finite number")
+	ErrInvalidMatcher    = errors.New("invalid label matcher")
+)
+
+var (
+	metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// Labels identify a series together with its metric name, e.g.
+// {"host": "web-1", "region": "eu"}.
+type Labels map[string]string
+
+// Key is the canonical encoding of the label set. Two label sets are equal
+// exactly when their keys are equal, and stores order series by it.
+func (l Labels) Key() string {
+	if len(l) == 0 {
+		return "{}"
+	}
+	// encoding/json sorts map keys, which makes the output canonical.
+	key, _ := json.Marshal(map[string]string(l))
+	return string(key)
+}
+
+// String renders the label set in the Prometheus text style.
+func (l Labels) String() string {
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(l[name]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func (l Labels) Validate() error {
+	for name := range l {
+		if !labelNameRE.MatchString(name) {
+			return fmt.Errorf("%w: %q", ErrInvalidLabelName, name)
+		}
+	}
+	return nil
+}
+
+// ParseLabelsKey decodes a key produced by Labels.Key. The empty label set
+// decodes to nil.
+func ParseLabelsKey(key string) (Labels, error) {
+	var labels Labels
+	if err := json.Unmarshal([]byte(key), &labels); err != nil {
+		return nil, err
+	}
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	return labels, nil
+}
+
+// Sample is a single value of a named, labelled series.
+type Sample struct {
+	Name      string  `json:"name"`
+	Labels    Labels  `json:"labels,omitempty"`
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+func (s Sample) Validate() error {
+	if !metricNameRE.MatchString(s.Name) {
+		return fmt.Errorf("%w: %q", ErrInvalidMetricName, s.Name)
+	}
+	if err := s.Labels.Validate(); err != nil {
+		return err
+	}
+	if s.Timestamp <= 0 {
+		return ErrInvalidTimestamp
+	}
+	if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+		return ErrInvalidValue
+	}
+	return nil
+}
+
+// SortSamplesBySeries orders samples by name and then label set.
+func SortSamplesBySeries(samples []Sample) {
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].Name != samples[j].Name {
+			return samples[i].Name < samples[j].Name
+		}
+		return samples[i].Labels.Key() < samples[j].Labels.Key()
+	})
+}
+
+type MatchType string
+
+const (
+	MatchEqual     MatchType = "="
+	MatchNotEqual  MatchType = "!="
+	MatchRegexp    MatchType = "=~"
+	MatchNotRegexp MatchType = "!~"
+)
+
+// LabelMatcher follows Prometheus semantics: a label that is not set
+// matches as the empty string and regular expressions are fully anchored.
+type LabelMatcher struct {
+	Name  string    `json:"name"`
+	Type  MatchType `json:"type"`
+	Value string    `json:"value"`
+}
+
+// SeriesSelector picks series by metric name and label matchers. An empty
+// name selects every metric name.
+type SeriesSelector struct {
+	Name     string         `json:"name,omitempty"`
+	Matchers []LabelMatcher `json:"matchers,omitempty"`
+}
+
+// Query describes a time range of series. Limit <= 0 means no limit and a
+// negative offset is treated as zero. Descending reverses the result order,
+// so the newest rows come first. A Cursor restricts the result to the rows
+// that follow it in that order; Offset then counts from the cursor.
+type Query struct {
+	Selector   SeriesSelector
+	Start      int64
+	End        int64
+	Limit      int
+	Offset     int
+	Descending bool
+	Cursor     *Cursor
+}
+
+// Cursor is the position of a row in query order: by timestamp, then label
+// set and, for samples, metric name. Labels holds the Labels.Key of the row
+// and Name is empty for the Metric view.
+type Cursor struct {
+	Timestamp int64  `json:"t"`
+	Labels    string `json:"l"`
+	Name      string `json:"n,omitempty"`
+}
+
+// MetricCursor is the position of m in the Metric view.
+func MetricCursor(m Metric) Cursor {
+	return Cursor{Timestamp: m.Timestamp, Labels: m.Labels.Key()}
+}
+
+// SampleCursor is the position of s among samples.
+func SampleCursor(s Sample) Cursor {
+	return Cursor{Timestamp: s.Timestamp, Labels: s.Labels.Key(), Name: s.Name}
+}
+
+func (c Cursor) compare(o Cursor) int {
+	switch {
+	case c.Timestamp != o.Timestamp:
+		return cmp.Compare(c.Timestamp, o.Timestamp)
+	case c.Labels != o.Labels:
+		return cmp.Compare(c.Labels, o.Labels)
+	default:
+		return cmp.Compare(c.Name, o.Name)
+	}
+}
+
+// Continues reports whether the row at position row follows the cursor of q
+// in the order of q. Every row continues a query without a cursor.
+func (q Query) Continues(row Cursor) bool {
+	if q.Cursor == nil {
+		return true
+	}
+	if q.Descending {
+		return row.compare(*q.Cursor) < 0
+	}
+	return row.compare(*q.Cursor) > 0
+}
+
+type compiledMatcher struct {
+	LabelMatcher
+	re *regexp.Regexp
+}
+
+// SeriesMatcher is the compiled form of a SeriesSelector.
+type SeriesMatcher struct {
+	name     string
+	matchers []compiledMatcher
+}
+
+func (s SeriesSelector) Compile() (*SeriesMatcher, error) {
+	if s.Name != "" && !metricNameRE.MatchString(s.Name) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidMetricName, s.Name)
+	}
+
+	m := &SeriesMatcher{name: s.Name, matchers: make([]compiledMatcher, 0, len(s.Matchers))}
+	for _, lm := range s.Matchers {
+		cm := compiledMatcher{LabelMatcher: lm}
+		if !labelNameRE.MatchString(lm.Name) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidLabelName, lm.Name)
+		}
+		switch lm.Type {
+		case MatchEqual, MatchNotEqual:
+		case MatchRegexp, MatchNotRegexp:
+			re, err := regexp.Compile("^(?:" + lm.Value + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidMatcher, err)
+			}
+			cm.re = re
+		default:
+			return nil, fmt.Errorf("%w: unknown match type %q", ErrInvalidMatcher, lm.Type)
+		}
+		m.matchers = append(m.matchers, cm)
+	}
+	return m, nil
+}
+
+// Matches reports whether the series identified by name and labels is
+// selected.
+func (m *SeriesMatcher) Matches(name string, labels Labels) bool {
+	if m.name != "" && m.name != name {
+		return false
+	}
+	return m.MatchesLabels(labels)
+}
+
+// MatchesLabels applies only the label matchers, ignoring the metric name.
+func (m *SeriesMatcher) MatchesLabels(labels Labels) bool {
+	for _, cm := range m.matchers {
+		value := labels[cm.Name]
+		switch cm.Type {
+		case MatchEqual:
+			if value != cm.Value {
+				return false
+			}
+		case MatchNotEqual:
+			if value == cm.Value {
+				return false
+			}
+		case MatchRegexp:
+			if !cm.re.MatchString(value) {
+				return false
+			}
+		case MatchNotRegexp:
+			if cm.re.MatchString(value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Filtered reports whether the matcher narrows the selection at all.
+func (m *SeriesMatcher) Filtered() bool {
+	return m.name != "" || len(m.matchers) > 0
+}
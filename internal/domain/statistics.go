@@ -0,0 +1,149 @@
+package domain
+
+import (
+	"math"
+	"sort"
+)
+
+// Statistics summarise the values of one series over a time range. StdDev
+// is the population standard deviation; percentiles interpolate linearly
+// between the closest ranks, like Quantile.
+type Statistics struct {
+	Count  int64   `json:"count"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"stddev"`
+	P50    float64 `json:"p50"`
+	P90    float64 `json:"p90"`
+	P95    float64 `json:"p95"`
+	P99    float64 `json:"p99"`
+}
+
+type SeriesStatistics struct {
+	Name   string `json:"name"`
+	Labels Labels `json:"labels,omitempty"`
+	Statistics
+}
+
+// SetPercentiles fills the percentile fields from a quantile function.
+func (s *Statistics) SetPercentiles(quantile func(q float64) float64) {
+	s.P50 = quantile(0.50)
+	s.P90 = quantile(0.90)
+	s.P95 = quantile(0.95)
+	s.P99 = quantile(0.99)
+}
+
+// ComputeStatistics summarises values in memory. values is sorted in place.
+func ComputeStatistics(values []float64) Statistics {
+	var stats Statistics
+	if len(values) == 0 {
+		return stats
+	}
+
+	sort.Float64s(values)
+
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	stats.Count = int64(len(values))
+	stats.Min = values[0]
+	stats.Max = values[len(values)-1]
+	stats.Mean = sum / float64(len(values))
+
+	var squares float64
+	for _, v := range values {
+		squares += (v - stats.Mean) * (v - stats.Mean)
+	}
+	stats.StdDev = math.Sqrt(squares / float64(len(values)))
+
+	stats.SetPercentiles(func(q float64) float64 { return Quantile(values, q) })
+	return stats
+}
+
+// SummarizeSeries computes statistics in memory. Samples outside the query
+// range or not selected by matcher are skipped. The result is ordered by
+// name and label set.
+func SummarizeSeries(samples []Sample, matcher *SeriesMatcher, q Query) []SeriesStatistics {
+	type series struct {
+		name   string
+		labels Labels
+		values []float64
+	}
+
+	byKey := make(map[string]*series)
+	for _, sample := range samples {
+		if sample.Timestamp < q.Start || sample.Timestamp > q.End || !matcher.Matches(sample.Name, sample.Labels) {
+			continue
+		}
+		key := sample.Name + sample.Labels.Key()
+		s, ok := byKey[key]
+		if !ok {
+			s = &series{name: sample.Name, labels: sample.Labels}
+			byKey[key] = s
+		}
+		s.values = append(s.values, sample.Value)
+	}
+
+	result := make([]SeriesStatistics, 0, len(byKey))
+	for _, s := range byKey {
+		result = append(result, SeriesStatistics{Name: s.name, Labels: s.labels, Statistics: ComputeStatistics(s.values)})
+	}
+	SortSeriesStatistics(result)
+	return result
+}
+
+// SortSeriesStatistics orders statistics by name and then label set.
+func SortSeriesStatistics(stats []SeriesStatistics) {
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Name != stats[j].Name {
+			return stats[i].Name < stats[j].Name
+		}
+		return stats[i].Labels.Key() < stats[j].Labels.Key()
+	})
+}
+
+// QuantileStream computes quantiles of n ascending values that are observed
+// one at a time, keeping only the values at the ranks it needs.
+type QuantileStream struct {
+	n      int64
+	seen   int64
+	ranked map[int64]float64
+}
+
+// statisticsQuantiles are the quantiles Statistics reports.
+var statisticsQuantiles = []float64{0.50, 0.90, 0.95, 0.99}
+
+func NewQuantileStream(n int64) *QuantileStream {
+	qs := &QuantileStream{n: n, ranked: make(map[int64]float64)}
+	for _, q := range statisticsQuantiles {
+		lower, upper, _ := qs.ranks(q)
+		qs.ranked[lower] = math.NaN()
+		qs.ranked[upper] = math.NaN()
+	}
+	return qs
+}
+
+func (qs *QuantileStream) ranks(q float64) (int64, int64, float64) {
+	rank := q * float64(qs.n-1)
+	return int64(math.Floor(rank)), int64(math.Ceil(rank)), rank - math.Floor(rank)
+}
+
+func (qs *QuantileStream) Observe(v float64) {
+	if _, wanted := qs.ranked[qs.seen]; wanted {
+		qs.ranked[qs.seen] = v
+	}
+	qs.seen++
+}
+
+// Quantile must be called with one of the quantiles Statistics reports,
+// after all n values were observed.
+func (qs *QuantileStream) Quantile(q float64) float64 {
+	if qs.n == 0 {
+		return math.NaN()
+	}
+	lower, upper, fraction := qs.ranks(q)
+	lv, uv := qs.ranked[lower], qs.ranked[upper]
+	return lv + (uv-lv)*fraction
+}
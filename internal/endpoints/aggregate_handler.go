@@ -0,0 +1,106 @@
+package endpoints
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"metrics-app/internal/domain"
+	"metrics-app/internal/util"
+)
+
+type AggregateRequest struct {
+	Start    int64                 `json:"start"`
+	End      int64                 `json:"end"`
+	Step     string                `json:"step"`
+	Func     string                `json:"func"`
+	Names    []string              `json:"names,omitempty"`
+	Matchers []domain.LabelMatcher `json:"matchers,omitempty"`
+}
+
+// defaultAggregateNames are downsampled when a request does not name any
+// series.
+var defaultAggregateNames = []string{domain.MetricCPULoad, domain.MetricConcurrency}
+
+// GetAggregateHandler buckets the requested series by step and reduces every
+// bucket with the requested function.
+func (m *Metrics) GetAggregateHandler(w http.ResponseWriter, r *http.Request) {
+
+	var reqBody AggregateRequest
+
+	if !m.decodeRequest(w, r, &reqBody,
+		timestampParam("start", &reqBody.Start),
+		timestampParam("end", &reqBody.End),
+		stringParam("step", &reqBody.Step),
+		stringParam("func", &reqBody.Func),
+		listParam("names", &reqBody.Names),
+	) {
+		return
+	}
+
+	startTime, endTime, ok := m.timeRange(w, reqBody.Start, reqBody.End)
+	if !ok {
+		return
+	}
+
+	step, err := parseStep(reqBody.Step)
+	if err != nil {
+		m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Invalid step - ", reqBody.Step, " Err - ", err)
+		m.Response.WriteErrorResponseWithStatusCode(w, fmt.Errorf("%w: %v", ErrInvalidAggregation, err), http.StatusBadRequest)
+		return
+	}
+
+	fn := domain.AggregateFunc(reqBody.Func)
+	if fn == "" {
+		fn = domain.AggregateAvg
+	}
+
+	names := reqBody.Names
+	if len(names) == 0 {
+		names = defaultAggregateNames
+	}
+
+	result := make([]domain.Series, 0)
+
+	for _, name := range names {
+		series, err := m.store.AggregateSamples(r.Context(), domain.AggregateQuery{
+			Selector: domain.SeriesSelector{Name: name, Matchers: reqBody.Matchers},
+			Start:    startTime,
+			End:      endTime,
+			Step:     step,
+			Func:     fn,
+		})
+		if err != nil {
+			if errors.Is(err, domain.ErrInvalidAggregateFunc) || errors.Is(err, domain.ErrInvalidStep) || errors.Is(err, domain.ErrTooManyBuckets) {
+				m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Invalid aggregation. Err - ", err)
+				m.Response.WriteErrorResponseWithStatusCode(w, fmt.Errorf("%w: %v", ErrInvalidAggregation, err), http.StatusBadRequest)
+				return
+			}
+			m.writeQueryError(w, "AggregateSamples()", err)
+			return
+		}
+		result = append(result, series...)
+	}
+
+	if len(result) == 0 {
+		m.logger.LogEvent(util.LOG_LEVEL_WARN, "Insufficient Metrics Data")
+		m.Response.WriteErrorResponseWithStatusCode(w, ErrNoMetricsAvailable, http.StatusNotFound)
+		return
+	}
+
+	m.Response.WriteResultResponse(w, result)
+}
+
+// parseStep converts a duration such as "30s", "5m" or "1h" into whole
+// seconds.
+func parseStep(step string) (int64, error) {
+	d, err := time.ParseDuration(step)
+	if err != nil {
+		return 0, err
+	}
+	if d < time.Second || d%time.Second != 0 {
+		return 0, domain.ErrInvalidStep
+	}
+	return int64(d / time.Second), nil
+}
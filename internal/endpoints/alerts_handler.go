@@ -0,0 +1,45 @@
+package endpoints
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"metrics-app/internal/alerting"
+	"metrics-app/internal/util"
+)
+
+// SetAlerting enables GetAlertsHandler.
+func (m *Metrics) SetAlerting(engine *alerting.Engine) {
+	m.alerts = engine
+}
+
+// GetAlertsHandler lists the pending, firing and recently resolved alerts
+// of the alerting engine. The state query parameter takes a comma separated
+// list of states to keep.
+func (m *Metrics) GetAlertsHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Method Not Allowed. Only GET requests are supported", http.StatusMethodNotAllowed)
+		m.Response.WriteErrorResponseWithStatusCode(w, errors.New("method Not Allowed. Only GET requests are supported"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var states []alerting.State
+	if param := r.URL.Query().Get("state"); param != "" {
+		for _, name := range strings.Split(param, ",") {
+			state := alerting.State(strings.TrimSpace(name))
+			if err := state.Validate(); err != nil {
+				m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Invalid query parameter state=", param)
+				m.Response.WriteErrorResponseWithStatusCode(w,
+					fmt.Errorf("%w: state=%q %v", ErrInvalidQueryParameter, param, err),
+					http.StatusBadRequest)
+				return
+			}
+			states = append(states, state)
+		}
+	}
+
+	m.Response.WriteResultResponse(w, m.alerts.Alerts(states...))
+}
@@ -0,0 +1,105 @@
+package endpoints
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"metrics-app/internal/anomaly"
+	"metrics-app/internal/domain"
+	"metrics-app/internal/util"
+)
+
+// AnomalyRequest selects series and a detection method. Zero values take
+// the defaults of anomaly.DefaultConfig.
+type AnomalyRequest struct {
+	Start     int64                 `json:"start"`
+	End       int64                 `json:"end"`
+	Method    string                `json:"method,omitempty"`
+	Step      string                `json:"step,omitempty"`
+	Threshold float64               `json:"threshold,omitempty"`
+	Alpha     float64               `json:"alpha,omitempty"`
+	Warmup    int                   `json:"warmup,omitempty"`
+	Days      int                   `json:"days,omitempty"`
+	Names     []string              `json:"names,omitempty"`
+	Matchers  []domain.LabelMatcher `json:"matchers,omitempty"`
+}
+
+// GetAnomaliesHandler scores the requested series against a rolling
+// baseline and returns the points that stand out from it.
+func (m *Metrics) GetAnomaliesHandler(w http.ResponseWriter, r *http.Request) {
+
+	var reqBody AnomalyRequest
+
+	if !m.decodeRequest(w, r, &reqBody,
+		timestampParam("start", &reqBody.Start),
+		timestampParam("end", &reqBody.End),
+		stringParam("method", &reqBody.Method),
+		stringParam("step", &reqBody.Step),
+		floatParam("threshold", &reqBody.Threshold),
+		floatParam("alpha", &reqBody.Alpha),
+		intParam("warmup", &reqBody.Warmup),
+		intParam("days", &reqBody.Days),
+		listParam("names", &reqBody.Names),
+	) {
+		return
+	}
+
+	startTime, endTime, ok := m.timeRange(w, reqBody.Start, reqBody.End)
+	if !ok {
+		return
+	}
+
+	config := anomaly.DefaultConfig()
+	if reqBody.Method != "" {
+		config.Method = anomaly.Method(reqBody.Method)
+	}
+	if reqBody.Step != "" {
+		var err error
+		if config.Step, err = parseStep(reqBody.Step); err != nil {
+			m.writeAnomalyError(w, err)
+			return
+		}
+	}
+	if reqBody.Threshold != 0 {
+		config.Threshold = reqBody.Threshold
+	}
+	if reqBody.Warmup != 0 {
+		config.Warmup = reqBody.Warmup
+	}
+	if reqBody.Days != 0 {
+		config.Days = reqBody.Days
+	}
+	config.Alpha = reqBody.Alpha
+	if err := config.Validate(); err != nil {
+		m.writeAnomalyError(w, err)
+		return
+	}
+
+	names := reqBody.Names
+	if len(names) == 0 {
+		names = defaultAggregateNames
+	}
+
+	result := make([]anomaly.Point, 0)
+
+	for _, name := range names {
+		points, err := anomaly.Detect(r.Context(), m.store, domain.SeriesSelector{Name: name, Matchers: reqBody.Matchers}, startTime, endTime, config)
+		if err != nil {
+			if errors.Is(err, domain.ErrTooManyBuckets) {
+				m.writeAnomalyError(w, err)
+				return
+			}
+			m.writeQueryError(w, "Detect()", err)
+			return
+		}
+		result = append(result, points...)
+	}
+
+	m.Response.WriteResultResponse(w, result)
+}
+
+func (m *Metrics) writeAnomalyError(w http.ResponseWriter, err error) {
+	m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Invalid anomaly detection. Err - ", err)
+	m.Response.WriteErrorResponseWithStatusCode(w, fmt.Errorf("%w: %v", ErrInvalidAnomalyDetection, err), http.StatusBadRequest)
+}
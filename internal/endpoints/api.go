@@ -10,14 +10,35 @@ type APIResponse struct {
 	Value     interface{} `json:"value,omitempty"`
 	Error     string      `json:"error,omitempty"`
 	ErrorCode int         `json:"error_code"`
+	*Page
 }
 
-func (res APIResponse) WriteErrorResponse(w http.ResponseWriter, err error) {
+// Page describes where a paged result stands in the whole listing. Total is
+// only reported when the client asks for it.
+type Page struct {
+	NextCursor string `json:"next_cursor,omitempty"`
+	HasMore    bool   `json:"has_more"`
+	Total      *int64 `json:"total,omitempty"`
+}
+
+// Success and Failure build the envelopes of WriteResultResponse and
+// WriteErrorResponse, for transports other than an HTTP response.
+func (res APIResponse) Success(result interface{}) APIResponse {
+	res.Status = true
+	res.Value = result
+	res.ErrorCode = GetErrorCode(nil)
+	return res
+}
+
+func (res APIResponse) Failure(err error) APIResponse {
 	res.Status = false
 	res.Error = err.Error()
 	res.ErrorCode = GetErrorCode(err)
+	return res
+}
 
-	errJson, _ := json.Marshal(res)
+func (res APIResponse) WriteErrorResponse(w http.ResponseWriter, err error) {
+	errJson, _ := json.Marshal(res.Failure(err))
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Cache-Control", "no-cache")
@@ -41,12 +62,13 @@ func (res APIResponse) WriteErrorResponseWithStatusCode(w http.ResponseWriter, e
 }
 
 func (res APIResponse) WriteResultResponse(w http.ResponseWriter, result interface{}) {
-	res.Status = true
-	res.Value = result
-	res.ErrorCode = GetErrorCode(nil)
-
-	errJson, _ := json.Marshal(res)
+	errJson, _ := json.Marshal(res.Success(result))
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Write(errJson)
 }
+
+func (res APIResponse) WritePageResponse(w http.ResponseWriter, result interface{}, page Page) {
+	res.Page = &page
+	res.WriteResultResponse(w, result)
+}
@@ -1,24 +1,35 @@
 package endpoints
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
+	"metrics-app/internal/alerting"
+	"metrics-app/internal/anomaly"
+	"metrics-app/internal/broadcast"
 	"metrics-app/internal/domain"
+	"metrics-app/internal/forecast"
 	"metrics-app/internal/util"
 )
 
 type MockMetricStore struct {
 	Metrics []domain.Metric
+	Samples []domain.Sample
 	Err     error
 }
 
@@ -34,10 +45,50 @@ func (m *MockMetricStore) StoreMetric(ctx context.Context, metric domain.Metric)
 	return nil
 }
 
+func (m *MockMetricStore) StoreMetrics(ctx context.Context, metrics []domain.Metric) (domain.BatchResult, error) {
+	if m.Err != nil {
+		return domain.BatchResult{}, m.Err
+	}
+	var result domain.BatchResult
+	for i, metric := range metrics {
+		if err := metric.Validate(); err != nil {
+			result.Rejected = append(result.Rejected, domain.Rejection{Index: i, Err: err})
+			continue
+		}
+		m.Metrics = append(m.Metrics, metric)
+		result.Stored++
+	}
+	return result, nil
+}
+
+func (m *MockMetricStore) StoreSamples(ctx context.Context, samples []domain.Sample) (domain.BatchResult, error) {
+	if m.Err != nil {
+		return domain.BatchResult{}, m.Err
+	}
+	var result domain.BatchResult
+	for i, sample := range samples {
+		if err := sample.Validate(); err != nil {
+			result.Rejected = append(result.Rejected, domain.Rejection{Index: i, Err: err})
+			continue
+		}
+		m.Samples = append(m.Samples, sample)
+		result.Stored++
+	}
+	return result, nil
+}
+
 func (m *MockMetricStore) GetMetrics(ctx context.Context, startTime, endTime int64, limit, offset int) ([]domain.Metric, error) {
+	return m.QueryMetrics(ctx, domain.Query{Start: startTime, End: endTime, Limit: limit, Offset: offset})
+}
+
+func (m *MockMetricStore) QueryMetrics(ctx context.Context, q domain.Query) ([]domain.Metric, error) {
 	if m.Err != nil {
 		return nil, m.Err
 	}
+	matcher, err := q.Selector.Compile()
+	if err != nil {
+		return nil, err
+	}
 
 	var filtered []domain.Metric
 	for _, metric := range m.Metrics {
@@ -46,23 +97,127 @@ func (m *MockMetricStore) GetMetrics(ctx context.Context, startTime, endTime int
 			return nil, ctx.Err()
 		default:
 		}
-		if metric.Timestamp >= startTime && metric.Timestamp <= endTime {
+		if metric.Timestamp >= q.Start && metric.Timestamp <= q.End && matcher.MatchesLabels(metric.Labels) {
 			filtered = append(filtered, metric)
 		}
 	}
+	if q.Descending {
+		reverse(filtered)
+	}
+	return paginate(afterCursor(filtered, q, domain.MetricCursor), q.Limit, q.Offset), nil
+}
+
+func (m *MockMetricStore) CountMetrics(ctx context.Context, q domain.Query) (int64, error) {
+	metrics, err := m.QueryMetrics(ctx, domain.Query{Selector: q.Selector, Start: q.Start, End: q.End})
+	return int64(len(metrics)), err
+}
+
+func (m *MockMetricStore) QuerySamples(ctx context.Context, q domain.Query) ([]domain.Sample, error) {
+	if m.Err != nil {
+		return nil, m.Err
+	}
+	matcher, err := q.Selector.Compile()
+	if err != nil {
+		return nil, err
+	}
+
+	var filtered []domain.Sample
+	for _, sample := range m.Samples {
+		if sample.Timestamp >= q.Start && sample.Timestamp <= q.End && matcher.Matches(sample.Name, sample.Labels) {
+			filtered = append(filtered, sample)
+		}
+	}
+	if q.Descending {
+		reverse(filtered)
+	}
+	return paginate(afterCursor(filtered, q, domain.SampleCursor), q.Limit, q.Offset), nil
+}
+
+func (m *MockMetricStore) CountSamples(ctx context.Context, q domain.Query) (int64, error) {
+	samples, err := m.QuerySamples(ctx, domain.Query{Selector: q.Selector, Start: q.Start, End: q.End})
+	return int64(len(samples)), err
+}
+
+func (m *MockMetricStore) AggregateSamples(ctx context.Context, q domain.AggregateQuery) ([]domain.Series, error) {
+	if m.Err != nil {
+		return nil, m.Err
+	}
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	matcher, err := q.Selector.Compile()
+	if err != nil {
+		return nil, err
+	}
+	return domain.BucketSamples(m.Samples, matcher, q), nil
+}
+
+func (m *MockMetricStore) SummarizeSamples(ctx context.Context, q domain.Query) ([]domain.SeriesStatistics, error) {
+	if m.Err != nil {
+		return nil, m.Err
+	}
+	matcher, err := q.Selector.Compile()
+	if err != nil {
+		return nil, err
+	}
+	return domain.SummarizeSeries(m.Samples, matcher, q), nil
+}
+
+func (m *MockMetricStore) LatestSamples(ctx context.Context, selector domain.SeriesSelector) ([]domain.Sample, error) {
+	if m.Err != nil {
+		return nil, m.Err
+	}
+	matcher, err := selector.Compile()
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]domain.Sample)
+	for _, sample := range m.Samples {
+		key := sample.Name + sample.Labels.Key()
+		if matcher.Matches(sample.Name, sample.Labels) && sample.Timestamp >= latest[key].Timestamp {
+			latest[key] = sample
+		}
+	}
+	result := make([]domain.Sample, 0, len(latest))
+	for _, sample := range latest {
+		result = append(result, sample)
+	}
+	domain.SortSamplesBySeries(result)
+	return result, nil
+}
+
+func (m *MockMetricStore) DeleteBefore(ctx context.Context, ts int64) (int64, error) {
+	return 0, m.Err
+}
+
+func reverse[T any](items []T) {
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+}
+
+func afterCursor[T any](items []T, q domain.Query, position func(T) domain.Cursor) []T {
+	for i, item := range items {
+		if q.Continues(position(item)) {
+			return items[i:]
+		}
+	}
+	return nil
+}
 
-	if offset >= len(filtered) {
-		return []domain.Metric{}, nil
+func paginate[T any](items []T, limit, offset int) []T {
+	if offset >= len(items) {
+		return []T{}
 	}
 	if offset > 0 {
-		filtered = filtered[offset:]
+		items = items[offset:]
 	}
 
-	if limit > 0 && limit < len(filtered) {
-		filtered = filtered[:limit]
+	if limit > 0 && limit < len(items) {
+		items = items[:limit]
 	}
 
-	return filtered, nil
+	return items
 }
 
 func (m *MockMetricStore) Close() error {
@@ -417,3 +572,1165 @@ func TestGetMetricsHandler(t *testing.T) {
 	assert.Equal(t, METRICS_NOT_AVAILABLE, apiResponse.ErrorCode)
 	assert.Contains(t, apiResponse.Error, ErrNoMetricsAvailable.Error(), "Expected specific error message for no metrics")
 }
+
+func TestGetMetricsHandler_QueryParameters(t *testing.T) {
+	mockStore := &MockMetricStore{
+		Metrics: make([]domain.Metric, 0),
+	}
+	mockStore.Init()
+
+	now := time.Now().Unix()
+
+	for i := 0; i < 10; i++ {
+		mockStore.StoreMetric(context.Background(), domain.Metric{Timestamp: now - int64(9-i)*10, CPULoad: float64(i * 10), Concurrency: i * 100})
+	}
+
+	metricsHandler := &Metrics{}
+	metricsHandler.Init(mockStore, &util.MetricsLogger{})
+
+	get := func(target string, body []byte, vars map[string]string) (*httptest.ResponseRecorder, APIResponse, []domain.Metric) {
+		req := httptest.NewRequest("GET", target, bytes.NewReader(body))
+		if vars != nil {
+			req = mux.SetURLVars(req, vars)
+		}
+		rr := httptest.NewRecorder()
+		metricsHandler.GetMetricsHandler(rr, req)
+
+		var apiResponse APIResponse
+		json.Unmarshal(rr.Body.Bytes(), &apiResponse)
+		var metrics []domain.Metric
+		valueBytes, _ := json.Marshal(apiResponse.Value)
+		json.Unmarshal(valueBytes, &metrics)
+		return rr, apiResponse, metrics
+	}
+
+	// case 1: No body; everything comes from the query string
+	rr, apiResponse, metrics := get(fmt.Sprintf("/metrics?start=%d&end=%d&limit=3&offset=2", now-100, now+10), nil, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, apiResponse.Status)
+	require.Len(t, metrics, 3)
+	assert.Equal(t, mockStore.Metrics[2].Timestamp, metrics[0].Timestamp)
+
+	// case 2: RFC 3339 bounds and descending order
+	start := time.Unix(now-25, 0).UTC().Format(time.RFC3339)
+	end := time.Unix(now, 0).UTC().Format(time.RFC3339)
+	rr, _, metrics = get("/metrics?start="+start+"&end="+end+"&order=desc", nil, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	require.Len(t, metrics, 3)
+	assert.Equal(t, now, metrics[0].Timestamp, "Expected the newest metric first")
+	assert.Equal(t, now-20, metrics[2].Timestamp)
+
+	// case 3: Query parameters override the route variables and the body
+	jsonBody, _ := json.Marshal(MetricsRequest{Start: now - 5, End: now + 10})
+	rr, _, metrics = get(fmt.Sprintf("/metrics/1/0?start=%d&limit=4", now-100), jsonBody, map[string]string{"limit": "1", "offset": "0"})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Len(t, metrics, 4, "Expected the limit query parameter to win over the route variable")
+	assert.Equal(t, mockStore.Metrics[0].Timestamp, metrics[0].Timestamp, "Expected the start query parameter to win over the body")
+
+	// case 4: The body still applies where no query parameter is given
+	jsonBody, _ = json.Marshal(MetricsRequest{Start: now - 5, End: now + 10})
+	rr, _, metrics = get("/metrics", jsonBody, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, now, metrics[0].Timestamp)
+
+	// case 5: Invalid query parameters are rejected with the precedence rules
+	for _, query := range []string{"start=yesterday", "end=2024-13-01T00:00:00Z", "limit=ten", "offset=-x", "order=newest"} {
+		rr, apiResponse, _ = get("/metrics?"+query, nil, nil)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+		assert.False(t, apiResponse.Status, query)
+		assert.Equal(t, INVALID_QUERY_PARAMETER, apiResponse.ErrorCode, query)
+		assert.Contains(t, apiResponse.Error, ErrInvalidQueryParameter.Error(), query)
+		assert.Contains(t, apiResponse.Error, queryPrecedence, query)
+	}
+
+	// case 6: Invalid route variables and bodies state the precedence rules too
+	rr, apiResponse, _ = get("/metrics/ten/0", nil, map[string]string{"limit": "ten", "offset": "0"})
+	assert.Equal(t, INVALID_PARAMETERS, apiResponse.ErrorCode)
+	assert.Contains(t, apiResponse.Error, queryPrecedence)
+	rr, apiResponse, _ = get("/metrics", []byte("{"), nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, INVALID_REQUEST_BODY, apiResponse.ErrorCode)
+	assert.Contains(t, apiResponse.Error, queryPrecedence)
+}
+
+func TestGetMetricsHandler_Cursor(t *testing.T) {
+	mockStore := &MockMetricStore{
+		Metrics: make([]domain.Metric, 0),
+	}
+	mockStore.Init()
+
+	now := time.Now().Unix()
+
+	for i := 0; i < 10; i++ {
+		mockStore.StoreMetric(context.Background(), domain.Metric{Timestamp: now - int64(9-i)*10, CPULoad: float64(i * 10), Concurrency: i * 100})
+	}
+
+	metricsHandler := &Metrics{}
+	metricsHandler.Init(mockStore, &util.MetricsLogger{})
+
+	get := func(query string) (*httptest.ResponseRecorder, APIResponse, []domain.Metric) {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/metrics?start=%d&end=%d&", now-100, now)+query, nil)
+		rr := httptest.NewRecorder()
+		metricsHandler.GetMetricsHandler(rr, req)
+
+		var apiResponse APIResponse
+		json.Unmarshal(rr.Body.Bytes(), &apiResponse)
+		var metrics []domain.Metric
+		valueBytes, _ := json.Marshal(apiResponse.Value)
+		json.Unmarshal(valueBytes, &metrics)
+		return rr, apiResponse, metrics
+	}
+
+	// case 1: Following next_cursor visits every metric exactly once
+	var (
+		visited []int64
+		pages   int
+	)
+	query := "limit=4&total=true"
+	for {
+		rr, apiResponse, metrics := get(query)
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.NotNil(t, apiResponse.Page, "Expected paging metadata")
+		require.NotNil(t, apiResponse.Total)
+		assert.Equal(t, int64(10+pages), *apiResponse.Total, "Expected the total to include rows written behind the cursor")
+		for _, metric := range metrics {
+			visited = append(visited, metric.Timestamp)
+		}
+		pages++
+
+		if !apiResponse.HasMore {
+			assert.Empty(t, apiResponse.NextCursor, "Expected no cursor on the last page")
+			break
+		}
+		require.NotEmpty(t, apiResponse.NextCursor)
+		query = "limit=4&total=true&cursor=" + apiResponse.NextCursor
+
+		// Metrics written behind the cursor must not shift the next page.
+		mockStore.Metrics = append([]domain.Metric{{Timestamp: now - 95 - int64(pages), CPULoad: 1, Concurrency: 1}}, mockStore.Metrics...)
+	}
+	assert.Equal(t, 3, pages)
+	require.Len(t, visited, 10)
+	for i, ts := range visited {
+		assert.Equal(t, now-int64(9-i)*10, ts)
+	}
+
+	// case 2: A descending cursor keeps its order and total is opt-in
+	rr, apiResponse, metrics := get("limit=2&order=desc")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, apiResponse.HasMore)
+	assert.Nil(t, apiResponse.Total, "Expected no total unless asked for")
+	require.Len(t, metrics, 2)
+
+	rr, _, metrics = get("limit=2&cursor=" + apiResponse.NextCursor)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Len(t, metrics, 2)
+	assert.Equal(t, now-20, metrics[0].Timestamp)
+	assert.Equal(t, now-30, metrics[1].Timestamp)
+
+	// case 3: Cursors that cannot be decoded or contradict the order
+	for _, query := range []string{"cursor=not-a-cursor", "order=asc&cursor=" + apiResponse.NextCursor, "total=maybe"} {
+		rr, apiResponse, _ = get(query)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+		assert.Equal(t, INVALID_QUERY_PARAMETER, apiResponse.ErrorCode, query)
+	}
+}
+
+func TestGetMetricsHandler_Formats(t *testing.T) {
+	mockStore := &MockMetricStore{
+		Metrics: make([]domain.Metric, 0),
+	}
+	mockStore.Init()
+
+	now := time.Now().Unix()
+
+	for i := 0; i < 2500; i++ {
+		mockStore.StoreMetric(context.Background(), domain.Metric{Timestamp: now - int64(2499-i), CPULoad: float64(i%100) + 0.5, Concurrency: i})
+	}
+	mockStore.Samples = []domain.Sample{{Name: "load1", Timestamp: now, Value: 1.5, Labels: domain.Labels{"host": "web-1"}}}
+
+	metricsHandler := &Metrics{}
+	metricsHandler.Init(mockStore, &util.MetricsLogger{})
+
+	get := func(query, accept string) (*httptest.ResponseRecorder, []string) {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/metrics?start=%d&end=%d&", now-2499, now)+query, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rr := httptest.NewRecorder()
+		metricsHandler.GetMetricsHandler(rr, req)
+		return rr, strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	}
+
+	// case 1: The format parameter streams every row of the range, not one page
+	rr, lines := get("format=csv", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "no-cache", rr.Header().Get("Cache-Control"))
+	require.Len(t, lines, 2501)
+	assert.Equal(t, "timestamp,cpu_load,concurrency,labels", lines[0])
+	assert.Equal(t, fmt.Sprintf("%d,0.5,0,", now-2499), lines[1])
+	assert.Equal(t, fmt.Sprintf("%d,99.5,2499,", now), lines[2500])
+	assert.True(t, rr.Flushed, "Expected rows to be flushed while streaming")
+
+	// case 2: Accept negotiates NDJSON; an explicit limit and the order still apply
+	rr, lines = get("limit=3&order=desc&total=true", "application/x-ndjson")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/x-ndjson", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "2500", rr.Header().Get("X-Total-Count"))
+	require.Len(t, lines, 3)
+	var newest domain.Metric
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &newest))
+	assert.Equal(t, now, newest.Timestamp)
+
+	// case 3: The format parameter wins over Accept, and JSON keeps the envelope
+	rr, _ = get("format=json", "text/csv")
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+	// case 4: The preferred acceptable type wins; unknown types get JSON
+	for accept, want := range map[string]string{
+		"text/csv;q=0.5, application/json": "application/json",
+		"application/json;q=0.1, text/csv": "text/csv; charset=utf-8",
+		"text/html, application/xhtml+xml": "application/json",
+		"application/x-ndjson;q=0, text/*": "text/csv; charset=utf-8",
+		"*/*;q=0.8, application/x-ndjson":  "application/x-ndjson",
+	} {
+		rr, _ = get("limit=1", accept)
+		assert.Equal(t, want, rr.Header().Get("Content-Type"), accept)
+	}
+
+	// case 5: An empty range is a 404 in any format
+	req := httptest.NewRequest("GET", "/metrics?start=1&end=2&format=ndjson", nil)
+	rr = httptest.NewRecorder()
+	metricsHandler.GetMetricsHandler(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+	// case 6: An unknown format is rejected
+	rr, _ = get("format=xml", "")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	var apiResponse APIResponse
+	json.Unmarshal(rr.Body.Bytes(), &apiResponse)
+	assert.Equal(t, INVALID_QUERY_PARAMETER, apiResponse.ErrorCode)
+
+	// case 7: Samples stream the same way
+	req = httptest.NewRequest("GET", fmt.Sprintf("/samples?start=%d&end=%d&format=csv", now-10, now), nil)
+	rr = httptest.NewRecorder()
+	metricsHandler.GetSamplesHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, fmt.Sprintf("timestamp,name,value,labels\n%d,load1,1.5,\"{\"\"host\"\":\"\"web-1\"\"}\"\n", now), rr.Body.String())
+}
+
+func TestStoreMetricsHandler(t *testing.T) {
+	mockStore := &MockMetricStore{
+		Metrics: make([]domain.Metric, 0),
+	}
+	mockStore.Init()
+
+	metricsHandler := &Metrics{}
+	metricsHandler.Init(mockStore, &util.MetricsLogger{})
+
+	now := time.Now().Unix()
+
+	// case 1: Single metric object
+	jsonBody, _ := json.Marshal(domain.Metric{Timestamp: now, CPULoad: 12.5, Concurrency: 10})
+	req, _ := http.NewRequest("POST", "/metrics", bytes.NewBuffer(jsonBody))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	metricsHandler.StoreMetricsHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code, "Expected status OK for a single valid metric")
+
+	var apiResponse APIResponse
+	json.Unmarshal(rr.Body.Bytes(), &apiResponse)
+	assert.True(t, apiResponse.Status)
+	assert.Equal(t, API_SUCCESS, apiResponse.ErrorCode)
+
+	var result IngestResult
+	valueBytes, _ := json.Marshal(apiResponse.Value)
+	json.Unmarshal(valueBytes, &result)
+	assert.Equal(t, 1, result.Accepted)
+	assert.Equal(t, 0, result.Rejected)
+	assert.Len(t, mockStore.Metrics, 1, "Metric should reach the store")
+
+	// case 2: Array of metrics
+	jsonBody, _ = json.Marshal([]domain.Metric{
+		{Timestamp: now + 10, CPULoad: 20, Concurrency: 20},
+		{Timestamp: now + 20, CPULoad: 30, Concurrency: 30},
+	})
+	req, _ = http.NewRequest("POST", "/metrics", bytes.NewBuffer(jsonBody))
+	rr = httptest.NewRecorder()
+	metricsHandler.StoreMetricsHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code, "Expected status OK for a valid batch")
+	assert.Len(t, mockStore.Metrics, 3, "Both metrics should reach the store")
+
+	// case 3: Partially invalid batch
+	jsonBody, _ = json.Marshal([]domain.Metric{
+		{Timestamp: now + 30, CPULoad: 40, Concurrency: 40},
+		{Timestamp: now + 40, CPULoad: 140, Concurrency: 40},
+	})
+	req, _ = http.NewRequest("POST", "/metrics", bytes.NewBuffer(jsonBody))
+	rr = httptest.NewRecorder()
+	metricsHandler.StoreMetricsHandler(rr, req)
+	assert.Equal(t, http.StatusMultiStatus, rr.Code, "Expected Multi-Status for a partially stored batch")
+
+	apiResponse = APIResponse{}
+	json.Unmarshal(rr.Body.Bytes(), &apiResponse)
+	assert.False(t, apiResponse.Status)
+	assert.Equal(t, METRICS_REJECTED, apiResponse.ErrorCode)
+
+	result = IngestResult{}
+	valueBytes, _ = json.Marshal(apiResponse.Value)
+	json.Unmarshal(valueBytes, &result)
+	assert.Equal(t, 1, result.Accepted)
+	assert.Equal(t, 1, result.Rejected)
+	assert.True(t, result.Results[0].Stored)
+	assert.False(t, result.Results[1].Stored)
+	assert.Equal(t, INVALID_METRIC, result.Results[1].ErrorCode)
+	assert.Contains(t, result.Results[1].Error, domain.ErrInvalidCPULoad.Error())
+	assert.Len(t, mockStore.Metrics, 4, "Only the valid metric should reach the store")
+
+	// case 4: Every metric invalid
+	jsonBody, _ = json.Marshal([]domain.Metric{{Timestamp: 0, CPULoad: 10, Concurrency: 1}})
+	req, _ = http.NewRequest("POST", "/metrics", bytes.NewBuffer(jsonBody))
+	rr = httptest.NewRecorder()
+	metricsHandler.StoreMetricsHandler(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "Expected Bad Request when nothing was stored")
+
+	// case 5: Invalid JSON body
+	req, _ = http.NewRequest("POST", "/metrics", bytes.NewBuffer([]byte("invalid json")))
+	rr = httptest.NewRecorder()
+	metricsHandler.StoreMetricsHandler(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "Expected Bad Request for invalid JSON body")
+	apiResponse = APIResponse{}
+	json.Unmarshal(rr.Body.Bytes(), &apiResponse)
+	assert.Equal(t, INVALID_REQUEST_BODY, apiResponse.ErrorCode)
+
+	// case 6: Empty array
+	req, _ = http.NewRequest("POST", "/metrics", bytes.NewBuffer([]byte("[]")))
+	rr = httptest.NewRecorder()
+	metricsHandler.StoreMetricsHandler(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "Expected Bad Request for an empty array")
+
+	// case 7: Store failure
+	failingStore := &MockMetricStore{Err: errors.New("disk full")}
+	failingHandler := &Metrics{}
+	failingHandler.Init(failingStore, &util.MetricsLogger{})
+
+	jsonBody, _ = json.Marshal(domain.Metric{Timestamp: now, CPULoad: 1, Concurrency: 1})
+	req, _ = http.NewRequest("POST", "/metrics", bytes.NewBuffer(jsonBody))
+	rr = httptest.NewRecorder()
+	failingHandler.StoreMetricsHandler(rr, req)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code, "Expected Internal Server Error when the store fails")
+	apiResponse = APIResponse{}
+	json.Unmarshal(rr.Body.Bytes(), &apiResponse)
+	result = IngestResult{}
+	valueBytes, _ = json.Marshal(apiResponse.Value)
+	json.Unmarshal(valueBytes, &result)
+	assert.Equal(t, METRIC_STORE_FAILED, result.Results[0].ErrorCode)
+
+	// case 8: Context cancellation while storing
+	cancelStore := &MockMetricStore{Err: context.Canceled}
+	cancelHandler := &Metrics{}
+	cancelHandler.Init(cancelStore, &util.MetricsLogger{})
+	req, _ = http.NewRequest("POST", "/metrics", bytes.NewBuffer(jsonBody))
+	rr = httptest.NewRecorder()
+	cancelHandler.StoreMetricsHandler(rr, req)
+	assert.Equal(t, http.StatusRequestTimeout, rr.Code, "Expected Request Timeout for cancelled context")
+
+	// case 9: GET request is rejected
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	rr = httptest.NewRecorder()
+	metricsHandler.StoreMetricsHandler(rr, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code, "Expected Method Not Allowed for GET request")
+}
+
+func TestSamplesHandlers(t *testing.T) {
+	mockStore := &MockMetricStore{}
+	mockStore.Init()
+
+	metricsHandler := &Metrics{}
+	metricsHandler.Init(mockStore, &util.MetricsLogger{})
+
+	now := time.Now().Unix()
+
+	// case 1: Store labelled samples
+	jsonBody, _ := json.Marshal([]domain.Sample{
+		{Name: "load1", Labels: domain.Labels{"host": "web-1"}, Timestamp: now - 10, Value: 0.5},
+		{Name: "load1", Labels: domain.Labels{"host": "web-2"}, Timestamp: now - 10, Value: 1.5},
+		{Name: "bad name", Timestamp: now - 10, Value: 1},
+	})
+	req, _ := http.NewRequest("POST", "/samples", bytes.NewBuffer(jsonBody))
+	rr := httptest.NewRecorder()
+	metricsHandler.StoreSamplesHandler(rr, req)
+	assert.Equal(t, http.StatusMultiStatus, rr.Code, "Invalid sample name should be rejected")
+	assert.Len(t, mockStore.Samples, 2)
+
+	// case 2: Query samples by name and label matcher
+	jsonBody, _ = json.Marshal(SamplesRequest{
+		Start:    now - 100,
+		End:      now,
+		Name:     "load1",
+		Matchers: []domain.LabelMatcher{{Name: "host", Type: domain.MatchRegexp, Value: ".*-2"}},
+	})
+	req, _ = http.NewRequest("GET", "/samples/10/0", bytes.NewBuffer(jsonBody))
+	req = mux.SetURLVars(req, map[string]string{"limit": "10", "offset": "0"})
+	rr = httptest.NewRecorder()
+	metricsHandler.GetSamplesHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var apiResponse APIResponse
+	json.Unmarshal(rr.Body.Bytes(), &apiResponse)
+	var returnedSamples []domain.Sample
+	valueBytes, _ := json.Marshal(apiResponse.Value)
+	json.Unmarshal(valueBytes, &returnedSamples)
+	assert.Equal(t, []domain.Sample{{Name: "load1", Labels: domain.Labels{"host": "web-2"}, Timestamp: now - 10, Value: 1.5}}, returnedSamples)
+
+	// case 3: Invalid matcher
+	jsonBody, _ = json.Marshal(SamplesRequest{
+		Start:    now - 100,
+		End:      now,
+		Matchers: []domain.LabelMatcher{{Name: "host", Type: "~~", Value: "x"}},
+	})
+	req, _ = http.NewRequest("GET", "/samples/10/0", bytes.NewBuffer(jsonBody))
+	req = mux.SetURLVars(req, map[string]string{"limit": "10", "offset": "0"})
+	rr = httptest.NewRecorder()
+	metricsHandler.GetSamplesHandler(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "Expected Bad Request for an invalid matcher")
+	apiResponse = APIResponse{}
+	json.Unmarshal(rr.Body.Bytes(), &apiResponse)
+	assert.Equal(t, INVALID_SERIES_SELECTOR, apiResponse.ErrorCode)
+
+	// case 4: Label matchers on the metrics view
+	mockStore.Metrics = []domain.Metric{
+		{Timestamp: now - 10, CPULoad: 10, Concurrency: 1, Labels: domain.Labels{"host": "web-1"}},
+		{Timestamp: now - 10, CPULoad: 20, Concurrency: 2, Labels: domain.Labels{"host": "web-2"}},
+	}
+	jsonBody, _ = json.Marshal(MetricsRequest{
+		Start:    now - 100,
+		End:      now,
+		Matchers: []domain.LabelMatcher{{Name: "host", Type: domain.MatchEqual, Value: "web-1"}},
+	})
+	req, _ = http.NewRequest("GET", "/metrics/10/0", bytes.NewBuffer(jsonBody))
+	req = mux.SetURLVars(req, map[string]string{"limit": "10", "offset": "0"})
+	rr = httptest.NewRecorder()
+	metricsHandler.GetMetricsHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	apiResponse = APIResponse{}
+	json.Unmarshal(rr.Body.Bytes(), &apiResponse)
+	var returnedMetrics []domain.Metric
+	valueBytes, _ = json.Marshal(apiResponse.Value)
+	json.Unmarshal(valueBytes, &returnedMetrics)
+	assert.Equal(t, mockStore.Metrics[:1], returnedMetrics)
+}
+
+func TestGetAggregateHandler(t *testing.T) {
+	now := time.Now().Unix()
+	bucket := now - now%60 - 60
+
+	mockStore := &MockMetricStore{
+		Samples: []domain.Sample{
+			{Name: domain.MetricCPULoad, Timestamp: bucket, Value: 10},
+			{Name: domain.MetricCPULoad, Timestamp: bucket + 30, Value: 30},
+			{Name: domain.MetricConcurrency, Timestamp: bucket + 10, Value: 5},
+			{Name: "load1", Timestamp: bucket + 10, Value: 0.5},
+		},
+	}
+	mockStore.Init()
+
+	metricsHandler := &Metrics{}
+	metricsHandler.Init(mockStore, &util.MetricsLogger{})
+
+	aggregate := func(body AggregateRequest) (*httptest.ResponseRecorder, APIResponse) {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest("GET", "/metrics/aggregate", bytes.NewBuffer(jsonBody))
+		rr := httptest.NewRecorder()
+		metricsHandler.GetAggregateHandler(rr, req)
+
+		var apiResponse APIResponse
+		json.Unmarshal(rr.Body.Bytes(), &apiResponse)
+		return rr, apiResponse
+	}
+
+	// case 1: Default names are cpu_load and concurrency
+	rr, apiResponse := aggregate(AggregateRequest{Start: bucket, End: now, Step: "1m", Func: "avg"})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var series []domain.Series
+	valueBytes, _ := json.Marshal(apiResponse.Value)
+	json.Unmarshal(valueBytes, &series)
+	assert.Equal(t, []domain.Series{
+		{Name: domain.MetricCPULoad, Points: []domain.Point{{Timestamp: bucket, Value: 20}}},
+		{Name: domain.MetricConcurrency, Points: []domain.Point{{Timestamp: bucket, Value: 5}}},
+	}, series)
+
+	// case 2: Explicit name and percentile
+	rr, apiResponse = aggregate(AggregateRequest{Start: bucket, End: now, Step: "5m", Func: "p50", Names: []string{"load1"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	series = nil
+	valueBytes, _ = json.Marshal(apiResponse.Value)
+	json.Unmarshal(valueBytes, &series)
+	assert.Len(t, series, 1)
+
+	// case 3: Invalid step
+	rr, apiResponse = aggregate(AggregateRequest{Start: bucket, End: now, Step: "1500ms", Func: "avg"})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, INVALID_AGGREGATION, apiResponse.ErrorCode)
+
+	// case 4: Unknown aggregation function
+	rr, apiResponse = aggregate(AggregateRequest{Start: bucket, End: now, Step: "1m", Func: "median"})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, INVALID_AGGREGATION, apiResponse.ErrorCode)
+
+	// case 5: Too many buckets
+	rr, apiResponse = aggregate(AggregateRequest{Start: 1, End: now, Step: "1s", Func: "avg"})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, INVALID_AGGREGATION, apiResponse.ErrorCode)
+
+	// case 6: No data in range
+	rr, apiResponse = aggregate(AggregateRequest{Start: bucket - 600, End: bucket - 300, Step: "1m"})
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, METRICS_NOT_AVAILABLE, apiResponse.ErrorCode)
+
+	// case 7: No body; query parameters take precedence over a body
+	jsonBody, _ := json.Marshal(AggregateRequest{Start: bucket - 600, End: bucket - 300, Step: "1h"})
+	for _, body := range [][]byte{nil, jsonBody} {
+		target := fmt.Sprintf("/metrics/aggregate?start=%d&end=%d&step=1m&func=max&names=cpu_load,load1", bucket, now)
+		rr = httptest.NewRecorder()
+		metricsHandler.GetAggregateHandler(rr, httptest.NewRequest("GET", target, bytes.NewReader(body)))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		json.Unmarshal(rr.Body.Bytes(), &apiResponse)
+		series = nil
+		valueBytes, _ = json.Marshal(apiResponse.Value)
+		json.Unmarshal(valueBytes, &series)
+		assert.Equal(t, []domain.Series{
+			{Name: domain.MetricCPULoad, Points: []domain.Point{{Timestamp: bucket, Value: 30}}},
+			{Name: "load1", Points: []domain.Point{{Timestamp: bucket, Value: 0.5}}},
+		}, series)
+	}
+
+	rr = httptest.NewRecorder()
+	metricsHandler.GetAggregateHandler(rr, httptest.NewRequest("GET", "/metrics/aggregate?start=yesterday&step=1m", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	json.Unmarshal(rr.Body.Bytes(), &apiResponse)
+	assert.Equal(t, INVALID_QUERY_PARAMETER, apiResponse.ErrorCode)
+	assert.Contains(t, apiResponse.Error, bodyPrecedence)
+
+	rr = httptest.NewRecorder()
+	metricsHandler.GetAggregateHandler(rr, httptest.NewRequest("GET", "/metrics/aggregate?step=1m", strings.NewReader("{")))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	json.Unmarshal(rr.Body.Bytes(), &apiResponse)
+	assert.Equal(t, INVALID_REQUEST_BODY, apiResponse.ErrorCode)
+	assert.Contains(t, apiResponse.Error, bodyPrecedence, "An invalid body should state the precedence rules too")
+}
+
+func TestGetStatisticsHandler(t *testing.T) {
+	now := time.Now().Unix()
+
+	mockStore := &MockMetricStore{
+		Samples: []domain.Sample{
+			{Name: domain.MetricCPULoad, Timestamp: now - 30, Value: 10},
+			{Name: domain.MetricCPULoad, Timestamp: now - 20, Value: 20},
+			{Name: domain.MetricCPULoad, Timestamp: now - 10, Value: 30},
+			{Name: domain.MetricConcurrency, Timestamp: now - 10, Value: 4},
+			{Name: domain.MetricCPULoad, Labels: domain.Labels{"host": "b"}, Timestamp: now - 10, Value: 50},
+			{Name: "load1", Timestamp: now - 10, Value: 0.5},
+		},
+	}
+	mockStore.Init()
+
+	metricsHandler := &Metrics{}
+	metricsHandler.Init(mockStore, &util.MetricsLogger{})
+
+	statistics := func(body MetricsRequest) (*httptest.ResponseRecorder, APIResponse) {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest("GET", "/metrics/stats", bytes.NewBuffer(jsonBody))
+		rr := httptest.NewRecorder()
+		metricsHandler.GetStatisticsHandler(rr, req)
+
+		var apiResponse APIResponse
+		json.Unmarshal(rr.Body.Bytes(), &apiResponse)
+		return rr, apiResponse
+	}
+
+	// case 1: cpu_load and concurrency of the selected label set
+	rr, apiResponse := statistics(MetricsRequest{
+		Start:    now - 60,
+		End:      now,
+		Matchers: []domain.LabelMatcher{{Name: "host", Type: domain.MatchEqual, Value: ""}},
+	})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var stats []domain.SeriesStatistics
+	valueBytes, _ := json.Marshal(apiResponse.Value)
+	json.Unmarshal(valueBytes, &stats)
+	assert.Len(t, stats, 2)
+	assert.Equal(t, domain.MetricCPULoad, stats[0].Name)
+	assert.Equal(t, int64(3), stats[0].Count)
+	assert.Equal(t, 20.0, stats[0].Mean)
+	assert.InDelta(t, 8.165, stats[0].StdDev, 0.001)
+	assert.Equal(t, 20.0, stats[0].P50)
+	assert.InDelta(t, 29.8, stats[0].P99, 0.001)
+	assert.Equal(t, domain.MetricConcurrency, stats[1].Name)
+	assert.Equal(t, 4.0, stats[1].Max)
+
+	// case 2: Invalid matcher
+	rr, apiResponse = statistics(MetricsRequest{
+		Start:    now - 60,
+		End:      now,
+		Matchers: []domain.LabelMatcher{{Name: "host", Type: "~", Value: "a"}},
+	})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, INVALID_SERIES_SELECTOR, apiResponse.ErrorCode)
+
+	// case 3: Inverted time range
+	rr, apiResponse = statistics(MetricsRequest{Start: now, End: now - 60})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, INVALID_TIME_RANGE, apiResponse.ErrorCode)
+
+	// case 4: No data in range
+	rr, apiResponse = statistics(MetricsRequest{Start: now - 600, End: now - 300})
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, METRICS_NOT_AVAILABLE, apiResponse.ErrorCode)
+
+	// case 5: No body, the range in RFC 3339
+	target := "/metrics/stats?start=" + time.Unix(now-15, 0).UTC().Format(time.RFC3339) + fmt.Sprintf("&end=%d", now)
+	rr = httptest.NewRecorder()
+	metricsHandler.GetStatisticsHandler(rr, httptest.NewRequest("GET", target, nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	json.Unmarshal(rr.Body.Bytes(), &apiResponse)
+	stats = nil
+	valueBytes, _ = json.Marshal(apiResponse.Value)
+	json.Unmarshal(valueBytes, &stats)
+	require.Len(t, stats, 3)
+	assert.Equal(t, int64(1), stats[0].Count, "Only the samples after start should be summarised")
+}
+
+func TestGetPrometheusHandler(t *testing.T) {
+	mockStore := &MockMetricStore{
+		Samples: []domain.Sample{
+			{Name: domain.MetricCPULoad, Labels: domain.Labels{"host": "a"}, Timestamp: 1722441980, Value: 40},
+			{Name: domain.MetricCPULoad, Labels: domain.Labels{"host": "a"}, Timestamp: 1722441990, Value: 45.75},
+			{Name: domain.MetricConcurrency, Labels: domain.Labels{"host": "a"}, Timestamp: 1722441990, Value: 100},
+			{Name: "load1", Timestamp: 1722441990, Value: 0.5},
+		},
+	}
+	mockStore.Init()
+
+	metricsHandler := &Metrics{}
+	metricsHandler.Init(mockStore, &util.MetricsLogger{})
+
+	// case 1: Prometheus text format
+	req, _ := http.NewRequest("GET", "/metrics/prometheus", nil)
+	rr := httptest.NewRecorder()
+	metricsHandler.GetPrometheusHandler(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.Equal(t, `# HELP concurrency Concurrency of the most recent reading.
+# TYPE concurrency gauge
+concurrency{host="a"} 100 1722441990000
+# HELP cpu_load CPU load of the most recent reading in percent.
+# TYPE cpu_load gauge
+cpu_load{host="a"} 45.75 1722441990000
+# HELP load1 Most recent load1 sample.
+# TYPE load1 gauge
+load1 0.5 1722441990000
+`, rr.Body.String())
+
+	// case 2: OpenMetrics when the scraper asks for it
+	req, _ = http.NewRequest("GET", "/metrics/prometheus", nil)
+	req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5")
+	rr = httptest.NewRecorder()
+	metricsHandler.GetPrometheusHandler(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/openmetrics-text; version=1.0.0; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.True(t, strings.HasSuffix(rr.Body.String(), "load1 0.5 1722441990\n# EOF\n"))
+
+	// case 3: Store failure
+	mockStore.Err = errors.New("database is locked")
+	req, _ = http.NewRequest("GET", "/metrics/prometheus", nil)
+	rr = httptest.NewRecorder()
+	metricsHandler.GetPrometheusHandler(rr, req)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code, "A failed scrape should not look successful")
+}
+
+func TestStreamMetricsHandler(t *testing.T) {
+	mockStore := &MockMetricStore{
+		Metrics: make([]domain.Metric, 0),
+	}
+	mockStore.Init()
+
+	now := time.Now().Unix()
+	broadcaster := broadcast.New()
+	store := broadcaster.WrapStore(mockStore)
+
+	metricsHandler := &Metrics{}
+	metricsHandler.Init(store, &util.MetricsLogger{})
+	metricsHandler.SetBroadcaster(broadcaster)
+
+	server := httptest.NewServer(http.HandlerFunc(metricsHandler.StreamMetricsHandler))
+	defer server.Close()
+	defer broadcaster.Close()
+
+	connect := func(lastEventID string) (*http.Response, *bufio.Reader) {
+		req, err := http.NewRequest("GET", server.URL, nil)
+		require.NoError(t, err)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp, bufio.NewReader(resp.Body)
+	}
+
+	type event struct {
+		name   string
+		id     string
+		data   string
+		metric domain.Metric
+	}
+	readEvent := func(reader *bufio.Reader) event {
+		var e event
+		for {
+			line, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "" && e.name != "":
+				if e.name == "metric" {
+					require.NoError(t, json.Unmarshal([]byte(e.data), &e.metric))
+				}
+				return e
+			case strings.HasPrefix(line, "event: "):
+				e.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "id: "):
+				e.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				e.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}
+	waitForSubscribers := func(n int) {
+		require.Eventually(t, func() bool { return broadcaster.Subscribers() == n }, time.Second, time.Millisecond)
+	}
+
+	// case 1: Newly stored metrics are pushed as they are written
+	resp, reader := connect("")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	waitForSubscribers(1)
+
+	require.NoError(t, store.StoreMetric(context.Background(), domain.Metric{Timestamp: now, CPULoad: 10, Concurrency: 1}))
+	first := readEvent(reader)
+	assert.Equal(t, now, first.metric.Timestamp)
+	assert.Equal(t, 10.0, first.metric.CPULoad)
+
+	// case 2: Reconnecting with Last-Event-ID replays what was missed
+	resp.Body.Close()
+	waitForSubscribers(0)
+
+	_, err := store.StoreMetrics(context.Background(), []domain.Metric{
+		{Timestamp: now + 10, CPULoad: 20, Concurrency: 2},
+		{Timestamp: now + 20, CPULoad: 30, Concurrency: 3},
+	})
+	require.NoError(t, err)
+
+	resp, reader = connect(first.id)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, now+10, readEvent(reader).metric.Timestamp)
+	assert.Equal(t, now+20, readEvent(reader).metric.Timestamp)
+
+	waitForSubscribers(1)
+	require.NoError(t, store.StoreMetric(context.Background(), domain.Metric{Timestamp: now + 30, CPULoad: 40, Concurrency: 4}))
+	live := readEvent(reader)
+	assert.Equal(t, now+30, live.metric.Timestamp, "Live metrics should follow the replay")
+
+	// case 3: Last-Event-ID that is not an event id
+	badResp, _ := connect("not-an-id")
+	defer badResp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, badResp.StatusCode)
+	var apiResponse APIResponse
+	require.NoError(t, json.NewDecoder(badResp.Body).Decode(&apiResponse))
+	assert.Equal(t, INVALID_LAST_EVENT_ID, apiResponse.ErrorCode)
+
+	// case 4: A metric backfilled while the client was away is caught up on,
+	// and resuming after it does not repeat the newer metrics
+	resp.Body.Close()
+	waitForSubscribers(0)
+	require.NoError(t, store.StoreMetric(context.Background(), domain.Metric{Timestamp: now - 100, CPULoad: 5, Concurrency: 1}))
+
+	resp, reader = connect(live.id)
+	backfilled := readEvent(reader)
+	assert.Equal(t, now-100, backfilled.metric.Timestamp)
+	resp.Body.Close()
+	waitForSubscribers(0)
+
+	require.NoError(t, store.StoreMetric(context.Background(), domain.Metric{Timestamp: now + 40, CPULoad: 50, Concurrency: 5}))
+	resp, reader = connect(backfilled.id)
+	assert.Equal(t, now+40, readEvent(reader).metric.Timestamp)
+	resp.Body.Close()
+	waitForSubscribers(0)
+
+	// case 5: Past the history of the broadcaster, as after a restart, the
+	// store is read after the latest metric the client received, so older
+	// backfills are not caught up on, which a gap event announces
+	_, err = store.StoreMetrics(context.Background(), []domain.Metric{
+		{Timestamp: now - 200, CPULoad: 5, Concurrency: 1},
+		{Timestamp: now + 50, CPULoad: 60, Concurrency: 6},
+	})
+	require.NoError(t, err)
+
+	restarted := encodeEventID(eventID{Epoch: broadcaster.Epoch() - 1, Seq: 7, Cursor: domain.MetricCursor(domain.Metric{Timestamp: now + 40})})
+	resp, reader = connect(restarted)
+	gap := readEvent(reader)
+	assert.Equal(t, "gap", gap.name)
+	assert.Empty(t, gap.id, "A gap should not move Last-Event-ID")
+	assert.JSONEq(t, fmt.Sprintf(`{"after": %d}`, now+40), gap.data)
+	replayed := readEvent(reader)
+	assert.Equal(t, now+50, replayed.metric.Timestamp)
+	id, err := decodeEventID(replayed.id)
+	require.NoError(t, err)
+	assert.Zero(t, id.Seq, "Resuming from a metric read from the store should read the store again")
+}
+
+func TestSubscribeHandler(t *testing.T) {
+	mockStore := &MockMetricStore{
+		Metrics: make([]domain.Metric, 0),
+	}
+	mockStore.Init()
+
+	defer func(tick time.Duration) { subscriptionTick = tick }(subscriptionTick)
+	subscriptionTick = 10 * time.Millisecond
+
+	broadcaster := broadcast.New()
+	store := broadcaster.WrapStore(mockStore)
+
+	metricsHandler := &Metrics{}
+	metricsHandler.Init(store, &util.MetricsLogger{})
+	metricsHandler.SetBroadcaster(broadcaster)
+
+	server := httptest.NewServer(http.HandlerFunc(metricsHandler.SubscribeHandler))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// Browsers may only connect from pages of the same host
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"https://elsewhere.example"}})
+	require.ErrorIs(t, err, websocket.ErrBadHandshake)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {server.URL}})
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	type message struct {
+		Status    bool               `json:"status"`
+		Value     SubscriptionUpdate `json:"value"`
+		ErrorCode int                `json:"error_code"`
+	}
+	send := func(request string) {
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(request)))
+	}
+	receive := func() message {
+		_, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		var msg message
+		require.NoError(t, json.Unmarshal(data, &msg))
+		return msg
+	}
+	storeMetrics := func(metrics ...domain.Metric) {
+		_, err := store.StoreMetrics(context.Background(), metrics)
+		require.NoError(t, err)
+	}
+
+	now := time.Now().Unix()
+	web1 := domain.Labels{"host": "web-1"}
+
+	// case 1: Raw subscription filtered by labels and a condition
+	send(`{"type": "subscribe", "id": "hot", "matchers": [{"name": "host", "type": "=", "value": "web-1"}], "where": "cpu_load > 90"}`)
+	assert.Equal(t, message{Status: true, Value: SubscriptionUpdate{Type: SubscribedMessage, ID: "hot"}, ErrorCode: API_SUCCESS}, receive())
+
+	storeMetrics(
+		domain.Metric{Timestamp: now, CPULoad: 50, Concurrency: 1, Labels: web1},
+		domain.Metric{Timestamp: now, CPULoad: 95, Concurrency: 1, Labels: domain.Labels{"host": "web-2"}},
+		domain.Metric{Timestamp: now + 1, CPULoad: 95, Concurrency: 2, Labels: web1},
+	)
+	update := receive()
+	assert.True(t, update.Status)
+	assert.Equal(t, UpdateMessage, update.Value.Type)
+	assert.Equal(t, "hot", update.Value.ID)
+	assert.Equal(t, []domain.Metric{{Timestamp: now + 1, CPULoad: 95, Concurrency: 2, Labels: web1}}, update.Value.Metrics)
+
+	// case 2: Invalid and duplicate subscriptions are rejected on the socket
+	for _, request := range []string{
+		`{"type": "subscribe", "id": "bad", "where": "memory > 1"}`,
+		`{"type": "subscribe", "id": "bad", "interval": "1ms"}`,
+		`{"type": "subscribe", "id": "hot"}`,
+		`{"type": "unsubscribe", "id": "missing"}`,
+		`{"type": "replay", "id": "bad"}`,
+		`not json`,
+	} {
+		send(request)
+		msg := receive()
+		assert.False(t, msg.Status, request)
+		assert.Equal(t, INVALID_SUBSCRIPTION, msg.ErrorCode, request)
+		assert.Equal(t, ErrorMessage, msg.Value.Type, request)
+	}
+
+	// case 3: Downsampled subscription reports each ended bucket once
+	send(`{"type": "unsubscribe", "id": "hot"}`)
+	assert.Equal(t, message{Status: true, Value: SubscriptionUpdate{Type: UnsubscribedMessage, ID: "hot"}, ErrorCode: API_SUCCESS}, receive())
+	send(`{"type": "subscribe", "id": "avg", "interval": "1m", "func": "max"}`)
+	assert.Equal(t, message{Status: true, Value: SubscriptionUpdate{Type: SubscribedMessage, ID: "avg"}, ErrorCode: API_SUCCESS}, receive())
+
+	bucket := now - now%60 - 120
+	storeMetrics(
+		domain.Metric{Timestamp: bucket, CPULoad: 20, Concurrency: 1, Labels: web1},
+		domain.Metric{Timestamp: bucket + 30, CPULoad: 99, Concurrency: 4, Labels: web1},
+	)
+	update = receive()
+	assert.Equal(t, "avg", update.Value.ID, "Unsubscribed metrics should no longer be sent")
+	assert.Equal(t, []domain.Metric{{Timestamp: bucket, CPULoad: 99, Concurrency: 4, Labels: web1}}, update.Value.Metrics)
+
+	// case 4: Text that is not UTF-8 fails the connection
+	invalid, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	require.NoError(t, err)
+	defer invalid.Close()
+	require.NoError(t, invalid.WriteMessage(websocket.TextMessage, []byte{'{', 0xff, '}'}))
+	invalid.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = invalid.ReadMessage()
+	var closeErr *websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, websocket.CloseInvalidFramePayloadData, closeErr.Code)
+
+	// case 5: Closing the broadcaster closes the socket with going away
+	broadcaster.Close()
+	_, _, err = conn.ReadMessage()
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, websocket.CloseGoingAway, closeErr.Code)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, broadcaster.Wait(ctx), "The handler should release its subscription")
+}
+
+func TestGetAlertsHandler(t *testing.T) {
+	now := time.Now().Unix()
+
+	mockStore := &MockMetricStore{
+		Samples: []domain.Sample{
+			{Name: domain.MetricCPULoad, Labels: domain.Labels{"host": "a"}, Timestamp: now - 10, Value: 95},
+			{Name: domain.MetricCPULoad, Labels: domain.Labels{"host": "b"}, Timestamp: now - 10, Value: 20},
+			{Name: domain.MetricConcurrency, Labels: domain.Labels{"host": "b"}, Timestamp: now - 10, Value: 500},
+		},
+	}
+	mockStore.Init()
+
+	rules, err := alerting.ParseRules([]byte(`{"rules": [
+		{"name": "HighCPU", "expr": "max cpu_load over 5m > 90"},
+		{"name": "Busy", "expr": "max concurrency over 5m > 100", "for": "1h"}
+	]}`))
+	require.NoError(t, err)
+	engine := alerting.NewEngine(mockStore, &util.MetricsLogger{}, rules, time.Minute)
+	engine.Evaluate(context.Background())
+
+	metricsHandler := &Metrics{}
+	metricsHandler.Init(mockStore, &util.MetricsLogger{})
+	metricsHandler.SetAlerting(engine)
+
+	list := func(target string) (*httptest.ResponseRecorder, []alerting.Alert) {
+		rr := httptest.NewRecorder()
+		metricsHandler.GetAlertsHandler(rr, httptest.NewRequest("GET", target, nil))
+
+		var response struct {
+			Value []alerting.Alert `json:"value"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		return rr, response.Value
+	}
+
+	// case 1: Every alert, ordered by rule
+	rr, alerts := list("/alerts")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	require.Len(t, alerts, 2)
+	assert.Equal(t, "Busy", alerts[0].Rule)
+	assert.Equal(t, alerting.StatePending, alerts[0].State)
+	assert.Equal(t, "HighCPU", alerts[1].Rule)
+	assert.Equal(t, alerting.StateFiring, alerts[1].State)
+	assert.Equal(t, domain.Labels{"host": "a"}, alerts[1].Labels)
+	assert.Equal(t, 95.0, alerts[1].Value)
+
+	// case 2: Filtered by state
+	_, alerts = list("/alerts?state=firing,resolved")
+	require.Len(t, alerts, 1)
+	assert.Equal(t, "HighCPU", alerts[0].Rule)
+
+	// case 3: Unknown state
+	rr, _ = list("/alerts?state=silenced")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	var apiResponse APIResponse
+	json.Unmarshal(rr.Body.Bytes(), &apiResponse)
+	assert.Equal(t, INVALID_QUERY_PARAMETER, apiResponse.ErrorCode)
+}
+
+func TestGetAnomaliesHandler(t *testing.T) {
+	now := time.Now().Unix()
+	now -= now % 60
+
+	mockStore := &MockMetricStore{}
+	for i := int64(60); i > 0; i-- {
+		value := 40 + float64(i%2)
+		if i == 10 {
+			value = 90
+		}
+		mockStore.Samples = append(mockStore.Samples, domain.Sample{Name: domain.MetricCPULoad, Timestamp: now - i*60, Value: value})
+	}
+	mockStore.Init()
+
+	metricsHandler := &Metrics{}
+	metricsHandler.Init(mockStore, &util.MetricsLogger{})
+
+	detect := func(body AnomalyRequest) (*httptest.ResponseRecorder, APIResponse) {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest("GET", "/metrics/anomalies", bytes.NewBuffer(jsonBody))
+		rr := httptest.NewRecorder()
+		metricsHandler.GetAnomaliesHandler(rr, req)
+
+		var apiResponse APIResponse
+		json.Unmarshal(rr.Body.Bytes(), &apiResponse)
+		return rr, apiResponse
+	}
+
+	// case 1: The spike stands out from the EWMA baseline
+	rr, apiResponse := detect(AnomalyRequest{Start: now - 40*60, End: now, Step: "1m"})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var points []anomaly.Point
+	valueBytes, _ := json.Marshal(apiResponse.Value)
+	json.Unmarshal(valueBytes, &points)
+	require.Len(t, points, 1)
+	assert.Equal(t, domain.MetricCPULoad, points[0].Name)
+	assert.Equal(t, now-10*60, points[0].Timestamp)
+	assert.Equal(t, 90.0, points[0].Value)
+	assert.Greater(t, points[0].Score, 3.0)
+
+	// case 2: Nothing stands out above a high threshold
+	rr, apiResponse = detect(AnomalyRequest{Start: now - 40*60, End: now, Step: "1m", Threshold: 1000})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, []interface{}{}, apiResponse.Value)
+
+	// case 3: Unusable parameters
+	for _, body := range []AnomalyRequest{
+		{Method: "median"},
+		{Step: "1ms"},
+		{Method: "seasonal", Step: "7m"},
+		{Method: "seasonal", Days: 1},
+		{Threshold: -1},
+		{Start: now - 365*86400, End: now, Step: "1s"},
+	} {
+		rr, apiResponse = detect(body)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+		assert.Equal(t, INVALID_ANOMALY_DETECTION, apiResponse.ErrorCode, body)
+	}
+
+	// case 4: Settings as query parameters, without a body
+	target := fmt.Sprintf("/metrics/anomalies?start=%d&end=%d&step=1m&threshold=1000&names=cpu_load", now-40*60, now)
+	rr = httptest.NewRecorder()
+	metricsHandler.GetAnomaliesHandler(rr, httptest.NewRequest("GET", target, nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	json.Unmarshal(rr.Body.Bytes(), &apiResponse)
+	assert.Equal(t, []interface{}{}, apiResponse.Value, "The threshold query parameter should apply")
+
+	for _, query := range []string{"threshold=high", "warmup=1.5", "end=soon"} {
+		rr = httptest.NewRecorder()
+		metricsHandler.GetAnomaliesHandler(rr, httptest.NewRequest("GET", "/metrics/anomalies?"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+		json.Unmarshal(rr.Body.Bytes(), &apiResponse)
+		assert.Equal(t, INVALID_QUERY_PARAMETER, apiResponse.ErrorCode, query)
+	}
+}
+
+func TestGetForecastHandler(t *testing.T) {
+	now := time.Now().Unix()
+	now -= now % 60
+
+	mockStore := &MockMetricStore{}
+	for i := int64(30); i > 0; i-- {
+		mockStore.Samples = append(mockStore.Samples, domain.Sample{Name: domain.MetricConcurrency, Timestamp: now - i*60, Value: float64(200 - 2*i)})
+	}
+	mockStore.Init()
+
+	metricsHandler := &Metrics{}
+	metricsHandler.Init(mockStore, &util.MetricsLogger{})
+
+	predict := func(body ForecastRequest) (*httptest.ResponseRecorder, APIResponse) {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest("GET", "/metrics/forecast", bytes.NewBuffer(jsonBody))
+		rr := httptest.NewRecorder()
+		metricsHandler.GetForecastHandler(rr, req)
+
+		var apiResponse APIResponse
+		json.Unmarshal(rr.Body.Bytes(), &apiResponse)
+		return rr, apiResponse
+	}
+
+	// case 1: The linear trend is extended, and reaches the threshold in
+	// 25 minutes
+	threshold := 250.0
+	rr, apiResponse := predict(ForecastRequest{Start: now - 3600, End: now, Step: "1m", Horizon: "10m", Threshold: &threshold})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var results []forecast.Result
+	valueBytes, _ := json.Marshal(apiResponse.Value)
+	json.Unmarshal(valueBytes, &results)
+	require.Len(t, results, 1)
+	assert.Equal(t, domain.MetricConcurrency, results[0].Name)
+	require.Len(t, results[0].Predictions, 10)
+	assert.Equal(t, now, results[0].Predictions[0].Timestamp)
+	assert.InDelta(t, 200, results[0].Predictions[0].Value, 0.001)
+	require.NotNil(t, results[0].ThresholdAt)
+	assert.Equal(t, now+25*60, *results[0].ThresholdAt)
+
+	// case 2: No history to forecast from
+	rr, apiResponse = predict(ForecastRequest{Start: now - 3600, End: now, Names: []string{"queue_depth"}})
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, METRICS_NOT_AVAILABLE, apiResponse.ErrorCode)
+
+	// case 3: Unusable parameters
+	for _, body := range []ForecastRequest{
+		{Method: "arima"},
+		{Step: "1ms"},
+		{Horizon: "soon"},
+		{Method: "holt-winters", Step: "1h", Season: "90m"},
+		{Confidence: 1.5},
+		{Step: "1s", Horizon: "24h"},
+	} {
+		rr, apiResponse = predict(body)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+		assert.Equal(t, INVALID_FORECAST, apiResponse.ErrorCode, body)
+	}
+
+	// case 4: The same forecast from query parameters, without a body
+	target := fmt.Sprintf("/metrics/forecast?start=%d&end=%d&step=1m&horizon=10m&threshold=250", now-3600, now)
+	rr = httptest.NewRecorder()
+	metricsHandler.GetForecastHandler(rr, httptest.NewRequest("GET", target, nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	json.Unmarshal(rr.Body.Bytes(), &apiResponse)
+	results = nil
+	valueBytes, _ = json.Marshal(apiResponse.Value)
+	json.Unmarshal(valueBytes, &results)
+	require.Len(t, results, 1)
+	assert.Len(t, results[0].Predictions, 10)
+	require.NotNil(t, results[0].ThresholdAt)
+	assert.Equal(t, now+25*60, *results[0].ThresholdAt)
+
+	rr = httptest.NewRecorder()
+	metricsHandler.GetForecastHandler(rr, httptest.NewRequest("GET", "/metrics/forecast?threshold=lots", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	json.Unmarshal(rr.Body.Bytes(), &apiResponse)
+	assert.Equal(t, INVALID_QUERY_PARAMETER, apiResponse.ErrorCode)
+}
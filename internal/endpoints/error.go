@@ -11,19 +11,39 @@ const (
 )
 
 const (
-	METRICS_NOT_AVAILABLE = iota + 101 // 101 - No metrics found for the given criteria
-	INVALID_REQUEST_BODY               // 102 - Error parsing request body
-	INVALID_PARAMETERS                 // 103 - Invalid URL parameters (e.g., non-integer limit/offset)
-	INVALID_TIME_RANGE                 // 104 - Start time is after end time
-	REQUEST_CANCELLED                  // 105 - Request was cancelled by client or server timeout
+	METRICS_NOT_AVAILABLE     = iota + 101 // 101 - No metrics found for the given criteria
+	INVALID_REQUEST_BODY                   // 102 - Error parsing request body
+	INVALID_PARAMETERS                     // 103 - Invalid URL parameters (e.g., non-integer limit/offset)
+	INVALID_TIME_RANGE                     // 104 - Start time is after end time
+	REQUEST_CANCELLED                      // 105 - Request was cancelled by client or server timeout
+	INVALID_METRIC                         // 106 - Metric failed validation
+	METRIC_STORE_FAILED                    // 107 - Store rejected or failed to persist the metric
+	METRICS_REJECTED                       // 108 - One or more metrics in the request were not stored
+	INVALID_SERIES_SELECTOR                // 109 - Metric name or label matchers cannot be used
+	INVALID_AGGREGATION                    // 110 - Unknown aggregation function or unusable step
+	INVALID_QUERY_PARAMETER                // 111 - URL query parameter cannot be parsed
+	INVALID_LAST_EVENT_ID                  // 112 - Last-Event-ID of a stream cannot be resumed from
+	INVALID_SUBSCRIPTION                   // 113 - WebSocket subscription message cannot be used
+	INVALID_ANOMALY_DETECTION              // 114 - Unknown detection method or unusable parameters
+	INVALID_FORECAST                       // 115 - Unknown forecast method or unusable horizon
 )
 
 var (
-	ErrNoMetricsAvailable = errors.New("no metrics available for the specified criteria")
-	ErrInvalidRequestBody = errors.New("invalid request body format or missing fields")
-	ErrInvalidParameters  = errors.New("invalid limit or offset parameter; must be integers")
-	ErrInvalidTimeRange   = errors.New("start timestamp cannot be after end timestamp")
-	ErrRequestCancelled   = errors.New("request cancelled by client or server timeout")
+	ErrNoMetricsAvailable      = errors.New("no metrics available for the specified criteria")
+	ErrInvalidRequestBody      = errors.New("invalid request body format or missing fields")
+	ErrInvalidParameters       = errors.New("invalid limit or offset parameter; must be integers")
+	ErrInvalidTimeRange        = errors.New("start timestamp cannot be after end timestamp")
+	ErrRequestCancelled        = errors.New("request cancelled by client or server timeout")
+	ErrInvalidMetric           = errors.New("invalid metric")
+	ErrMetricStoreFailed       = errors.New("failed to store metric")
+	ErrMetricsRejected         = errors.New("one or more metrics were not stored")
+	ErrInvalidSeriesSelector   = errors.New("invalid series selector")
+	ErrInvalidAggregation      = errors.New("invalid aggregation")
+	ErrInvalidQueryParameter   = errors.New("invalid query parameter")
+	ErrInvalidLastEventID      = errors.New("invalid Last-Event-ID; must be the id of an earlier event")
+	ErrInvalidSubscription     = errors.New("invalid subscription")
+	ErrInvalidAnomalyDetection = errors.New("invalid anomaly detection")
+	ErrInvalidForecast         = errors.New("invalid forecast")
 )
 
 func GetErrorCode(err error) int {
@@ -42,6 +62,26 @@ func GetErrorCode(err error) int {
 		return INVALID_TIME_RANGE
 	case errors.Is(err, ErrRequestCancelled):
 		return REQUEST_CANCELLED
+	case errors.Is(err, ErrInvalidMetric):
+		return INVALID_METRIC
+	case errors.Is(err, ErrMetricStoreFailed):
+		return METRIC_STORE_FAILED
+	case errors.Is(err, ErrMetricsRejected):
+		return METRICS_REJECTED
+	case errors.Is(err, ErrInvalidSeriesSelector):
+		return INVALID_SERIES_SELECTOR
+	case errors.Is(err, ErrInvalidAggregation):
+		return INVALID_AGGREGATION
+	case errors.Is(err, ErrInvalidQueryParameter):
+		return INVALID_QUERY_PARAMETER
+	case errors.Is(err, ErrInvalidLastEventID):
+		return INVALID_LAST_EVENT_ID
+	case errors.Is(err, ErrInvalidSubscription):
+		return INVALID_SUBSCRIPTION
+	case errors.Is(err, ErrInvalidAnomalyDetection):
+		return INVALID_ANOMALY_DETECTION
+	case errors.Is(err, ErrInvalidForecast):
+		return INVALID_FORECAST
 	default:
 		return API_FAILURE // Default for any unhandled error
 	}
@@ -0,0 +1,66 @@
+package endpoints
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"metrics-app/internal/domain"
+	"metrics-app/internal/exposition"
+	"metrics-app/internal/util"
+)
+
+// seriesHelp is the HELP text of the built-in series. Other series are
+// described generically.
+var seriesHelp = map[string]string{
+	domain.MetricCPULoad:     "CPU load of the most recent reading in percent.",
+	domain.MetricConcurrency: "Concurrency of the most recent reading.",
+}
+
+// GetPrometheusHandler exposes the latest sample of every series as a
+// Prometheus gauge, in the OpenMetrics format when the scraper asks for it.
+func (m *Metrics) GetPrometheusHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Method Not Allowed. Only GET requests are supported", http.StatusMethodNotAllowed)
+		m.Response.WriteErrorResponseWithStatusCode(w, errors.New("method Not Allowed. Only GET requests are supported"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	latest, err := m.store.LatestSamples(r.Context(), domain.SeriesSelector{})
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			m.writeQueryError(w, "LatestSamples()", err)
+			return
+		}
+		// Scrapers only notice a failure by its status code.
+		m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while LatestSamples(). Err - ", err)
+		m.Response.WriteErrorResponseWithStatusCode(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// Latest samples are ordered by name, so every family is a run.
+	var families []exposition.Family
+	for _, sample := range latest {
+		if len(families) == 0 || families[len(families)-1].Name != sample.Name {
+			help, ok := seriesHelp[sample.Name]
+			if !ok {
+				help = "Most recent " + sample.Name + " sample."
+			}
+			families = append(families, exposition.Family{Name: sample.Name, Help: help, Type: exposition.Gauge})
+		}
+		family := &families[len(families)-1]
+		family.Samples = append(family.Samples, exposition.Sample{
+			Name:      sample.Name,
+			Labels:    sample.Labels,
+			Value:     sample.Value,
+			Timestamp: sample.Timestamp,
+		})
+	}
+
+	contentType := exposition.Negotiate(r.Header.Get("Accept"))
+	w.Header().Set("Content-Type", contentType)
+	if err := exposition.Write(w, contentType, families); err != nil {
+		m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while writing the exposition. Err - ", err)
+	}
+}
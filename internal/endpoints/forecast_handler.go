@@ -0,0 +1,116 @@
+package endpoints
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"metrics-app/internal/domain"
+	"metrics-app/internal/forecast"
+	"metrics-app/internal/util"
+)
+
+// ForecastRequest selects the history to forecast from and how far ahead
+// to predict. Zero values take the defaults of forecast.DefaultConfig.
+// Threshold, when set, asks when the trend of each series reaches it.
+type ForecastRequest struct {
+	Start      int64                 `json:"start"`
+	End        int64                 `json:"end"`
+	Method     string                `json:"method,omitempty"`
+	Step       string                `json:"step,omitempty"`
+	Horizon    string                `json:"horizon,omitempty"`
+	Season     string                `json:"season,omitempty"`
+	Confidence float64               `json:"confidence,omitempty"`
+	Threshold  *float64              `json:"threshold,omitempty"`
+	Names      []string              `json:"names,omitempty"`
+	Matchers   []domain.LabelMatcher `json:"matchers,omitempty"`
+}
+
+// GetForecastHandler predicts the requested series past the end of their
+// history, with prediction intervals.
+func (m *Metrics) GetForecastHandler(w http.ResponseWriter, r *http.Request) {
+
+	var reqBody ForecastRequest
+
+	if !m.decodeRequest(w, r, &reqBody,
+		timestampParam("start", &reqBody.Start),
+		timestampParam("end", &reqBody.End),
+		stringParam("method", &reqBody.Method),
+		stringParam("step", &reqBody.Step),
+		stringParam("horizon", &reqBody.Horizon),
+		stringParam("season", &reqBody.Season),
+		floatParam("confidence", &reqBody.Confidence),
+		optionalFloatParam("threshold", &reqBody.Threshold),
+		listParam("names", &reqBody.Names),
+	) {
+		return
+	}
+
+	startTime, endTime, ok := m.timeRange(w, reqBody.Start, reqBody.End)
+	if !ok {
+		return
+	}
+
+	config := forecast.DefaultConfig()
+	if reqBody.Method != "" {
+		config.Method = forecast.Method(reqBody.Method)
+	}
+	for _, d := range []struct {
+		value string
+		dst   *int64
+	}{
+		{reqBody.Step, &config.Step},
+		{reqBody.Horizon, &config.Horizon},
+		{reqBody.Season, &config.Season},
+	} {
+		if d.value == "" {
+			continue
+		}
+		var err error
+		if *d.dst, err = parseStep(d.value); err != nil {
+			m.writeForecastError(w, err)
+			return
+		}
+	}
+	if reqBody.Confidence != 0 {
+		config.Confidence = reqBody.Confidence
+	}
+	config.Threshold = reqBody.Threshold
+	if err := config.Validate(); err != nil {
+		m.writeForecastError(w, err)
+		return
+	}
+
+	names := reqBody.Names
+	if len(names) == 0 {
+		names = defaultAggregateNames
+	}
+
+	result := make([]forecast.Result, 0)
+
+	for _, name := range names {
+		forecasts, err := forecast.Forecast(r.Context(), m.store, domain.SeriesSelector{Name: name, Matchers: reqBody.Matchers}, startTime, endTime, config)
+		if err != nil {
+			if errors.Is(err, domain.ErrTooManyBuckets) {
+				m.writeForecastError(w, err)
+				return
+			}
+			m.writeQueryError(w, "Forecast()", err)
+			return
+		}
+		result = append(result, forecasts...)
+	}
+
+	if len(result) == 0 {
+		m.logger.LogEvent(util.LOG_LEVEL_WARN, "Insufficient Metrics Data")
+		m.Response.WriteErrorResponseWithStatusCode(w, ErrNoMetricsAvailable, http.StatusNotFound)
+		return
+	}
+
+	m.Response.WriteResultResponse(w, result)
+}
+
+func (m *Metrics) writeForecastError(w http.ResponseWriter, err error) {
+	m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Invalid forecast. Err - ", err)
+	m.Response.WriteErrorResponseWithStatusCode(w, fmt.Errorf("%w: %v", ErrInvalidForecast, err), http.StatusBadRequest)
+}
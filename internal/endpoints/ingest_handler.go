@@ -0,0 +1,163 @@
+package endpoints
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"metrics-app/internal/domain"
+	"metrics-app/internal/util"
+)
+
+const (
+	maxIngestBodyBytes = 4 << 20
+	maxIngestBatchSize = 10000
+)
+
+type IngestItemResult struct {
+	Index     int    `json:"index"`
+	Timestamp int64  `json:"timestamp"`
+	Stored    bool   `json:"stored"`
+	Error     string `json:"error,omitempty"`
+	ErrorCode int    `json:"error_code"`
+}
+
+type IngestResult struct {
+	Accepted int                `json:"accepted"`
+	Rejected int                `json:"rejected"`
+	Results  []IngestItemResult `json:"results"`
+}
+
+// StoreMetricsHandler accepts either a single metric object or an array of
+// metrics and reports the outcome of every item in the response value.
+func (m *Metrics) StoreMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	ingest(m, w, r, func(metric domain.Metric) int64 { return metric.Timestamp }, m.store.StoreMetrics)
+}
+
+// StoreSamplesHandler is the StoreMetricsHandler counterpart for named,
+// labelled samples.
+func (m *Metrics) StoreSamplesHandler(w http.ResponseWriter, r *http.Request) {
+	ingest(m, w, r, func(sample domain.Sample) int64 { return sample.Timestamp }, m.store.StoreSamples)
+}
+
+type ingestible interface {
+	Validate() error
+}
+
+func ingest[T ingestible](m *Metrics, w http.ResponseWriter, r *http.Request, timestampOf func(T) int64,
+	store func(context.Context, []T) (domain.BatchResult, error)) {
+
+	if r.Method != http.MethodPost {
+		m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Method Not Allowed. Only POST requests are supported", http.StatusMethodNotAllowed)
+		m.Response.WriteErrorResponseWithStatusCode(w, errors.New("method Not Allowed. Only POST requests are supported"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	items, err := decodeBatch[T](http.MaxBytesReader(w, r.Body, maxIngestBodyBytes))
+	if err != nil {
+		m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while unmarshalling JSON Body. Err -", err)
+		m.Response.WriteErrorResponseWithStatusCode(w, ErrInvalidRequestBody, http.StatusBadRequest)
+		return
+	}
+
+	if len(items) > maxIngestBatchSize {
+		m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Batch size exceeds the limit. size - ", len(items))
+		m.Response.WriteErrorResponseWithStatusCode(w, fmt.Errorf("%w: at most %d items per request", ErrInvalidRequestBody, maxIngestBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	result := IngestResult{Results: make([]IngestItemResult, len(items))}
+	valid := make([]T, 0, len(items))
+	validIndex := make([]int, 0, len(items))
+
+	for i, item := range items {
+		result.Results[i] = IngestItemResult{Index: i, Timestamp: timestampOf(item)}
+
+		if err := item.Validate(); err != nil {
+			result.reject(i, fmt.Errorf("%w: %v", ErrInvalidMetric, err))
+			continue
+		}
+		valid = append(valid, item)
+		validIndex = append(validIndex, i)
+	}
+
+	storeFailed := false
+
+	if len(valid) > 0 {
+		batch, err := store(r.Context(), valid)
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				m.logger.LogEvent(util.LOG_LEVEL_WARN, "Context cancelled")
+				m.Response.WriteErrorResponseWithStatusCode(w, ErrRequestCancelled, http.StatusRequestTimeout)
+				return
+			}
+			m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while storing batch. Err - ", err)
+			storeFailed = true
+			for _, i := range validIndex {
+				result.reject(i, fmt.Errorf("%w: %v", ErrMetricStoreFailed, err))
+			}
+		} else {
+			rejected := make(map[int]bool, len(batch.Rejected))
+			for _, item := range batch.Rejected {
+				rejected[validIndex[item.Index]] = true
+				result.reject(validIndex[item.Index], fmt.Errorf("%w: %v", ErrMetricStoreFailed, item.Err))
+			}
+			for _, i := range validIndex {
+				if !rejected[i] {
+					result.Results[i].Stored = true
+					result.Results[i].ErrorCode = GetErrorCode(nil)
+					result.Accepted++
+				}
+			}
+		}
+	}
+
+	switch {
+	case result.Rejected == 0:
+		m.Response.WriteResultResponse(w, result)
+	case result.Accepted > 0:
+		m.logger.LogEvent(util.LOG_LEVEL_WARN, "Partially stored batch. accepted - ", result.Accepted, " rejected - ", result.Rejected)
+		APIResponse{Value: result}.WriteErrorResponseWithStatusCode(w, ErrMetricsRejected, http.StatusMultiStatus)
+	case storeFailed:
+		APIResponse{Value: result}.WriteErrorResponseWithStatusCode(w, ErrMetricsRejected, http.StatusInternalServerError)
+	default:
+		APIResponse{Value: result}.WriteErrorResponseWithStatusCode(w, ErrMetricsRejected, http.StatusBadRequest)
+	}
+}
+
+func (res *IngestResult) reject(index int, err error) {
+	res.Results[index].Error = err.Error()
+	res.Results[index].ErrorCode = GetErrorCode(err)
+	res.Rejected++
+}
+
+// decodeBatch reads a request body holding one JSON object or an array of
+// them.
+func decodeBatch[T any](body io.Reader) ([]T, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var items []T
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil, err
+		}
+		if len(items) == 0 {
+			return nil, errors.New("empty array")
+		}
+		return items, nil
+	}
+
+	var item T
+	if err := json.Unmarshal(trimmed, &item); err != nil {
+		return nil, err
+	}
+	return []T{item}, nil
+}
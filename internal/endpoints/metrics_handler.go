@@ -4,25 +4,41 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
+	"metrics-app/internal/alerting"
+	"metrics-app/internal/broadcast"
 	"metrics-app/internal/domain"
+	"metrics-app/internal/format"
 	"metrics-app/internal/util"
 
 	"github.com/gorilla/mux"
 )
 
 type MetricsRequest struct {
-	Start int64 `json:"start"`
-	End   int64 `json:"end"`
+	Start    int64                 `json:"start"`
+	End      int64                 `json:"end"`
+	Matchers []domain.LabelMatcher `json:"matchers,omitempty"`
+}
+
+type SamplesRequest struct {
+	Start    int64                 `json:"start"`
+	End      int64                 `json:"end"`
+	Name     string                `json:"name,omitempty"`
+	Matchers []domain.LabelMatcher `json:"matchers,omitempty"`
 }
 
 type Metrics struct {
-	Response APIResponse
-	logger   *util.MetricsLogger
-	store    domain.MetricStore
+	Response    APIResponse
+	logger      *util.MetricsLogger
+	store       domain.MetricStore
+	broadcaster *broadcast.Broadcaster
+	alerts      *alerting.Engine
 }
 
 func (m *Metrics) Init(store domain.MetricStore, webSlogger *util.MetricsLogger) {
@@ -32,41 +48,417 @@ func (m *Metrics) Init(store domain.MetricStore, webSlogger *util.MetricsLogger)
 
 func (m *Metrics) GetMetricsHandler(w http.ResponseWriter, r *http.Request) {
 
-	if r.Method != http.MethodGet {
-		m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Method Not Allowed. Only GET requests are supported", http.StatusMethodNotAllowed)
-		m.Response.WriteErrorResponseWithStatusCode(w, errors.New("method Not Allowed. Only GET requests are supported"), http.StatusMethodNotAllowed)
+	var reqBody MetricsRequest
+
+	page, ok := m.decodeQuery(w, r, &reqBody)
+	if !ok {
 		return
 	}
 
-	routeParamValue := mux.Vars(r)
+	startTime, endTime, ok := m.timeRange(w, reqBody.Start, reqBody.End)
+	if !ok {
+		return
+	}
 
-	limitStr := routeParamValue["limit"]
-	limit, err := strconv.Atoi(limitStr)
-	if err != nil {
-		m.logger.LogEvent(util.LOG_LEVEL_ERROR, "While getting limit from URL. Err - ", err)
-		m.Response.WriteErrorResponseWithStatusCode(w, ErrInvalidParameters, http.StatusBadRequest)
+	selector := domain.SeriesSelector{Matchers: reqBody.Matchers}
+	if page.format.streamed {
+		query := page.streamQuery(selector, startTime, endTime)
+		total, ok := m.streamTotal(w, page, "CountMetrics()", func() (int64, error) { return m.store.CountMetrics(r.Context(), query) })
+		if ok {
+			streamRows(m, w, r, "QueryMetrics()", query, total, page.format.rows, format.EachMetric, format.NewMetricWriter)
+		}
 		return
 	}
 
-	offsetStr := routeParamValue["offset"]
-	offset, err := strconv.Atoi(offsetStr)
+	query := page.query(selector, startTime, endTime)
+	fetchedMetrics, err := m.store.QueryMetrics(r.Context(), query)
 	if err != nil {
-		m.logger.LogEvent(util.LOG_LEVEL_ERROR, "While getting offset from URL. Err - ", err)
-		m.Response.WriteErrorResponseWithStatusCode(w, ErrInvalidParameters, http.StatusBadRequest)
+		m.writeQueryError(w, "GetMetrics()", err)
 		return
 	}
 
-	var reqBody MetricsRequest
+	if len(fetchedMetrics) == 0 {
+		m.logger.LogEvent(util.LOG_LEVEL_WARN, "Insufficient Metrics Data")
+		m.Response.WriteErrorResponseWithStatusCode(w, ErrNoMetricsAvailable, http.StatusNotFound)
+		return
+	}
+
+	fetchedMetrics, next := nextPage(fetchedMetrics, page, domain.MetricCursor)
+	if page.total {
+		total, err := m.store.CountMetrics(r.Context(), query)
+		if err != nil {
+			m.writeQueryError(w, "CountMetrics()", err)
+			return
+		}
+		next.Total = &total
+	}
+
+	m.Response.WritePageResponse(w, fetchedMetrics, next)
+}
+
+func (m *Metrics) GetSamplesHandler(w http.ResponseWriter, r *http.Request) {
+
+	var reqBody SamplesRequest
+
+	page, ok := m.decodeQuery(w, r, &reqBody)
+	if !ok {
+		return
+	}
+
+	startTime, endTime, ok := m.timeRange(w, reqBody.Start, reqBody.End)
+	if !ok {
+		return
+	}
+
+	selector := domain.SeriesSelector{Name: reqBody.Name, Matchers: reqBody.Matchers}
+	if page.format.streamed {
+		query := page.streamQuery(selector, startTime, endTime)
+		total, ok := m.streamTotal(w, page, "CountSamples()", func() (int64, error) { return m.store.CountSamples(r.Context(), query) })
+		if ok {
+			streamRows(m, w, r, "QuerySamples()", query, total, page.format.rows, format.EachSample, format.NewSampleWriter)
+		}
+		return
+	}
 
-	err = json.NewDecoder(r.Body).Decode(&reqBody)
+	query := page.query(selector, startTime, endTime)
+	fetchedSamples, err := m.store.QuerySamples(r.Context(), query)
 	if err != nil {
-		m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while unmarshalling JSON Body. Err -", err)
-		m.Response.WriteErrorResponseWithStatusCode(w, ErrInvalidRequestBody, http.StatusBadRequest)
+		m.writeQueryError(w, "QuerySamples()", err)
+		return
+	}
+
+	if len(fetchedSamples) == 0 {
+		m.logger.LogEvent(util.LOG_LEVEL_WARN, "Insufficient Samples Data")
+		m.Response.WriteErrorResponseWithStatusCode(w, ErrNoMetricsAvailable, http.StatusNotFound)
 		return
 	}
 
-	startTime := reqBody.Start
-	endTime := reqBody.End
+	fetchedSamples, next := nextPage(fetchedSamples, page, domain.SampleCursor)
+	if page.total {
+		total, err := m.store.CountSamples(r.Context(), query)
+		if err != nil {
+			m.writeQueryError(w, "CountSamples()", err)
+			return
+		}
+		next.Total = &total
+	}
+
+	m.Response.WritePageResponse(w, fetchedSamples, next)
+}
+
+// queryPrecedence is part of every error in a query parameter, route
+// variable or body of decodeQuery so clients know which of several sources
+// of a value was used. bodyPrecedence is its counterpart for decodeRequest.
+const (
+	queryPrecedence = "query parameters take precedence over the {limit}/{offset} route variables, which take precedence over the JSON body"
+	bodyPrecedence  = "query parameters take precedence over the JSON body"
+)
+
+// rangeRequest is a request body whose time range can be overridden by the
+// start and end query parameters.
+type rangeRequest interface {
+	bounds() (start, end *int64)
+}
+
+func (r *MetricsRequest) bounds() (*int64, *int64) { return &r.Start, &r.End }
+
+func (r *SamplesRequest) bounds() (*int64, *int64) { return &r.Start, &r.End }
+
+type paging struct {
+	limit      int
+	offset     int
+	descending bool
+	cursor     *domain.Cursor
+	total      bool
+	// limited is whether the limit was given rather than defaulted.
+	limited bool
+	format  responseFormat
+}
+
+// query is the store query for one page. It asks for one row more than the
+// limit to find out whether another page follows.
+func (p paging) query(selector domain.SeriesSelector, start, end int64) domain.Query {
+	return domain.Query{
+		Selector:   selector,
+		Start:      start,
+		End:        end,
+		Limit:      p.limit + 1,
+		Offset:     p.offset,
+		Descending: p.descending,
+		Cursor:     p.cursor,
+	}
+}
+
+// streamQuery is the store query of a streamed response, which is not cut
+// into pages: it has every row of the range unless a limit was given.
+func (p paging) streamQuery(selector domain.SeriesSelector, start, end int64) domain.Query {
+	query := p.query(selector, start, end)
+	query.Limit = 0
+	if p.limited {
+		query.Limit = p.limit
+	}
+	return query
+}
+
+// streamTotal counts the rows of a streamed response for its X-Total-Count
+// header when the total was asked for. On failure the error response is
+// already written.
+func (m *Metrics) streamTotal(w http.ResponseWriter, page paging, operation string, count func() (int64, error)) (*int64, bool) {
+	if !page.total {
+		return nil, true
+	}
+	total, err := count()
+	if err != nil {
+		m.writeQueryError(w, operation, err)
+		return nil, false
+	}
+	return &total, true
+}
+
+// decodeQuery checks the method and resolves a query from the URL query
+// parameters, the {limit}/{offset} route variables and the optional JSON
+// body, in that order of precedence. Limit defaults to 100 and a negative
+// offset to 0. A cursor decides the order itself. The response format comes
+// from the format parameter or the Accept header. On failure the error
+// response is already written.
+func (m *Metrics) decodeQuery(w http.ResponseWriter, r *http.Request, reqBody rangeRequest) (paging, bool) {
+
+	if r.Method != http.MethodGet {
+		m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Method Not Allowed. Only GET requests are supported", http.StatusMethodNotAllowed)
+		m.Response.WriteErrorResponseWithStatusCode(w, errors.New("method Not Allowed. Only GET requests are supported"), http.StatusMethodNotAllowed)
+		return paging{}, false
+	}
+
+	var page paging
+
+	routeParamValue := mux.Vars(r)
+
+	if limitStr, ok := routeParamValue["limit"]; ok {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil {
+			m.logger.LogEvent(util.LOG_LEVEL_ERROR, "While getting limit from URL. Err - ", err)
+			m.Response.WriteErrorResponseWithStatusCode(w, fmt.Errorf("%w; %s", ErrInvalidParameters, queryPrecedence), http.StatusBadRequest)
+			return paging{}, false
+		}
+		page.limit = limit
+	}
+
+	if offsetStr, ok := routeParamValue["offset"]; ok {
+		offset, err := strconv.Atoi(offsetStr)
+		if err != nil {
+			m.logger.LogEvent(util.LOG_LEVEL_ERROR, "While getting offset from URL. Err - ", err)
+			m.Response.WriteErrorResponseWithStatusCode(w, fmt.Errorf("%w; %s", ErrInvalidParameters, queryPrecedence), http.StatusBadRequest)
+			return paging{}, false
+		}
+		page.offset = offset
+	}
+
+	// Many clients and proxies drop the body of a GET request, so it is
+	// optional.
+	if r.Body != nil {
+		err := json.NewDecoder(r.Body).Decode(reqBody)
+		if err != nil && !errors.Is(err, io.EOF) {
+			m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while unmarshalling JSON Body. Err -", err)
+			m.Response.WriteErrorResponseWithStatusCode(w, fmt.Errorf("%w; %s", ErrInvalidRequestBody, queryPrecedence), http.StatusBadRequest)
+			return paging{}, false
+		}
+	}
+
+	params := r.URL.Query()
+	invalid := func(name, reason string) (paging, bool) {
+		m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Invalid query parameter ", name, "=", params.Get(name))
+		m.Response.WriteErrorResponseWithStatusCode(w,
+			fmt.Errorf("%w: %s=%q %s; %s", ErrInvalidQueryParameter, name, params.Get(name), reason, queryPrecedence),
+			http.StatusBadRequest)
+		return paging{}, false
+	}
+
+	start, end := reqBody.bounds()
+	for _, bound := range []struct {
+		name   string
+		target *int64
+	}{{"start", start}, {"end", end}} {
+		if value := params.Get(bound.name); value != "" {
+			ts, err := parseTimestamp(value)
+			if err != nil {
+				return invalid(bound.name, "must be Unix seconds or an RFC 3339 time")
+			}
+			*bound.target = ts
+		}
+	}
+
+	for _, count := range []struct {
+		name   string
+		target *int
+	}{{"limit", &page.limit}, {"offset", &page.offset}} {
+		if value := params.Get(count.name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return invalid(count.name, "must be an integer")
+			}
+			*count.target = n
+		}
+	}
+
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		page.descending = true
+	default:
+		return invalid("order", "must be asc or desc")
+	}
+
+	if value := params.Get("cursor"); value != "" {
+		token, err := decodeCursor(value)
+		if err != nil {
+			return invalid("cursor", "must be the next_cursor of an earlier response")
+		}
+		if params.Get("order") != "" && token.Descending != page.descending {
+			return invalid("order", "must match the order the cursor was issued in")
+		}
+		page.cursor = &token.Cursor
+		page.descending = token.Descending
+	}
+
+	if value := params.Get("total"); value != "" {
+		total, err := strconv.ParseBool(value)
+		if err != nil {
+			return invalid("total", "must be true or false")
+		}
+		page.total = total
+	}
+
+	negotiated, err := negotiateFormat(params.Get("format"), r.Header.Get("Accept"))
+	if err != nil {
+		return invalid("format", "must be json, csv or ndjson")
+	}
+	page.format = negotiated
+
+	page.limited = page.limit > 0
+	if page.limit <= 0 {
+		page.limit = 100
+	}
+	if page.offset < 0 {
+		page.offset = 0
+	}
+
+	return page, true
+}
+
+// queryParam is a query parameter that overrides a field of a request
+// body. set parses the values of the parameter into the field; on failure
+// the parameter is rejected with reason.
+type queryParam struct {
+	name   string
+	reason string
+	set    func(values []string) error
+}
+
+func timestampParam(name string, dst *int64) queryParam {
+	return queryParam{name, "must be Unix seconds or an RFC 3339 time", func(values []string) (err error) {
+		*dst, err = parseTimestamp(values[0])
+		return err
+	}}
+}
+
+func stringParam(name string, dst *string) queryParam {
+	return queryParam{name, "", func(values []string) error {
+		*dst = values[0]
+		return nil
+	}}
+}
+
+func intParam(name string, dst *int) queryParam {
+	return queryParam{name, "must be an integer", func(values []string) (err error) {
+		*dst, err = strconv.Atoi(values[0])
+		return err
+	}}
+}
+
+func floatParam(name string, dst *float64) queryParam {
+	return queryParam{name, "must be a number", func(values []string) (err error) {
+		*dst, err = strconv.ParseFloat(values[0], 64)
+		return err
+	}}
+}
+
+func optionalFloatParam(name string, dst **float64) queryParam {
+	return queryParam{name, "must be a number", func(values []string) error {
+		value, err := strconv.ParseFloat(values[0], 64)
+		*dst = &value
+		return err
+	}}
+}
+
+// listParam takes a comma separated list, or the parameter repeated.
+func listParam(name string, dst *[]string) queryParam {
+	return queryParam{name, "", func(values []string) error {
+		*dst = nil
+		for _, value := range values {
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					*dst = append(*dst, item)
+				}
+			}
+		}
+		return nil
+	}}
+}
+
+// decodeRequest checks the method and resolves a request from the optional
+// JSON body and the given query parameters, which take precedence. On
+// failure the error response is already written.
+func (m *Metrics) decodeRequest(w http.ResponseWriter, r *http.Request, reqBody any, params ...queryParam) bool {
+
+	if r.Method != http.MethodGet {
+		m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Method Not Allowed. Only GET requests are supported", http.StatusMethodNotAllowed)
+		m.Response.WriteErrorResponseWithStatusCode(w, errors.New("method Not Allowed. Only GET requests are supported"), http.StatusMethodNotAllowed)
+		return false
+	}
+
+	// Many clients and proxies drop the body of a GET request, so it is
+	// optional.
+	if r.Body != nil {
+		err := json.NewDecoder(r.Body).Decode(reqBody)
+		if err != nil && !errors.Is(err, io.EOF) {
+			m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while unmarshalling JSON Body. Err -", err)
+			m.Response.WriteErrorResponseWithStatusCode(w, fmt.Errorf("%w; %s", ErrInvalidRequestBody, bodyPrecedence), http.StatusBadRequest)
+			return false
+		}
+	}
+
+	query := r.URL.Query()
+	for _, param := range params {
+		values := query[param.name]
+		if len(values) == 0 || values[0] == "" {
+			continue
+		}
+		if err := param.set(values); err != nil {
+			m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Invalid query parameter ", param.name, "=", values[0])
+			m.Response.WriteErrorResponseWithStatusCode(w,
+				fmt.Errorf("%w: %s=%q %s; %s", ErrInvalidQueryParameter, param.name, values[0], param.reason, bodyPrecedence),
+				http.StatusBadRequest)
+			return false
+		}
+	}
+	return true
+}
+
+// parseTimestamp reads Unix seconds or an RFC 3339 time.
+func parseTimestamp(value string) (int64, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return seconds, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
+
+// timeRange applies the default window of the last 24 hours to unset bounds
+// and rejects an inverted range.
+func (m *Metrics) timeRange(w http.ResponseWriter, startTime, endTime int64) (int64, int64, bool) {
 
 	if startTime == 0 {
 		startTime = time.Now().Add(-24 * time.Hour).Unix()
@@ -78,33 +470,22 @@ func (m *Metrics) GetMetricsHandler(w http.ResponseWriter, r *http.Request) {
 	if startTime > endTime {
 		m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Given startTime is greater than endTime. startTime - ", startTime, " endTime - ", endTime)
 		m.Response.WriteErrorResponseWithStatusCode(w, ErrInvalidTimeRange, http.StatusBadRequest)
-		return
+		return 0, 0, false
 	}
 
-	if limit <= 0 {
-		limit = 100
-	}
-	if offset < 0 {
-		offset = 0
-	}
+	return startTime, endTime, true
+}
 
-	fetchedMetrics, err := m.store.GetMetrics(r.Context(), startTime, endTime, limit, offset)
-	if err != nil {
-		if err == context.Canceled {
-			m.logger.LogEvent(util.LOG_LEVEL_WARN, "Context cancelled")
-			m.Response.WriteErrorResponseWithStatusCode(w, ErrRequestCancelled, http.StatusRequestTimeout)
-			return
-		}
-		m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while GetMetrics(). Err - ", err)
+func (m *Metrics) writeQueryError(w http.ResponseWriter, operation string, err error) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		m.logger.LogEvent(util.LOG_LEVEL_WARN, "Context cancelled")
+		m.Response.WriteErrorResponseWithStatusCode(w, ErrRequestCancelled, http.StatusRequestTimeout)
+	case errors.Is(err, domain.ErrInvalidMatcher), errors.Is(err, domain.ErrInvalidLabelName), errors.Is(err, domain.ErrInvalidMetricName):
+		m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Invalid series selector. Err - ", err)
+		m.Response.WriteErrorResponseWithStatusCode(w, fmt.Errorf("%w: %v", ErrInvalidSeriesSelector, err), http.StatusBadRequest)
+	default:
+		m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while ", operation, ". Err - ", err)
 		m.Response.WriteErrorResponse(w, err)
-		return
 	}
-
-	if len(fetchedMetrics) == 0 {
-		m.logger.LogEvent(util.LOG_LEVEL_WARN, "Insufficient Metrics Data")
-		m.Response.WriteErrorResponseWithStatusCode(w, ErrNoMetricsAvailable, http.StatusNotFound)
-		return
-	}
-
-	m.Response.WriteResultResponse(w, fetchedMetrics)
 }
@@ -0,0 +1,164 @@
+package endpoints
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"metrics-app/internal/domain"
+	"metrics-app/internal/format"
+	"metrics-app/internal/util"
+)
+
+const (
+	// streamPageSize is how many rows a streamed response reads from the
+	// store, and writes to the client, at a time.
+	streamPageSize = 1000
+	// streamWriteTimeout is how long a streamed response may take to read
+	// and send each page. It stands in for the write timeout of the server,
+	// which would otherwise cut long exports.
+	streamWriteTimeout = 10 * time.Second
+)
+
+// responseFormat is how a query result is written: the JSON envelope, or
+// rows streamed as CSV or NDJSON.
+type responseFormat struct {
+	streamed bool
+	rows     format.Format
+}
+
+var errUnknownFormat = errors.New("unknown format")
+
+// negotiateFormat picks the response format from the format query parameter
+// or, without one, the Accept header. Media types other than CSV and NDJSON,
+// and a missing header, get the JSON envelope.
+func negotiateFormat(param, accept string) (responseFormat, error) {
+	switch strings.ToLower(param) {
+	case "":
+	case "json":
+		return responseFormat{}, nil
+	default:
+		f, err := format.Parse(param)
+		if err != nil {
+			return responseFormat{}, errUnknownFormat
+		}
+		return responseFormat{streamed: true, rows: f}, nil
+	}
+
+	best, bestQ := responseFormat{}, 0.0
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(mediaRange, ";")
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			if name, value, ok := strings.Cut(strings.TrimSpace(p), "="); ok && strings.EqualFold(name, "q") {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q <= bestQ {
+			continue
+		}
+
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "application/json", "application/*", "*/*":
+			best, bestQ = responseFormat{}, q
+		case "text/csv", "text/*":
+			best, bestQ = responseFormat{streamed: true, rows: format.CSV}, q
+		case "application/x-ndjson", "application/ndjson", "application/jsonl":
+			best, bestQ = responseFormat{streamed: true, rows: format.NDJSON}, q
+		}
+	}
+	return best, nil
+}
+
+// streamWriter sends the status and headers of a streamed response with its
+// first bytes, so that an error before then can still be answered with the
+// JSON envelope.
+type streamWriter struct {
+	w       http.ResponseWriter
+	format  format.Format
+	total   *int64
+	started bool
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if !s.started {
+		s.started = true
+		header := s.w.Header()
+		header.Set("Content-Type", s.format.ContentType())
+		header.Set("Cache-Control", "no-cache")
+		if s.total != nil {
+			header.Set("X-Total-Count", strconv.FormatInt(*s.total, 10))
+		}
+		s.w.WriteHeader(http.StatusOK)
+	}
+	return s.w.Write(p)
+}
+
+// flush sends the rows written so far to the client. The writer may be
+// wrapped by middleware, which http.ResponseController unwraps.
+func (s *streamWriter) flush() {
+	if s.started {
+		http.NewResponseController(s.w).Flush()
+	}
+}
+
+// extendDeadline gives the next page streamWriteTimeout to be written.
+func (s *streamWriter) extendDeadline() error {
+	err := http.NewResponseController(s.w).SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
+
+// streamRows writes the rows of query to the client as they are read from
+// the store, flushing them every streamPageSize rows. The write deadline is
+// moved on with every page, so that a stream may run for as long as the
+// client keeps reading. An empty result is a
+// 404 as in the JSON envelope. A store error after the first rows were sent
+// aborts the response, so the client cannot take it for a complete one.
+func streamRows[T any](m *Metrics, w http.ResponseWriter, r *http.Request, operation string, query domain.Query, total *int64, f format.Format,
+	each func(context.Context, domain.MetricStore, domain.Query, int, func(T) error) error,
+	newWriter func(io.Writer, format.Format) *format.Writer[T]) {
+
+	stream := &streamWriter{w: w, format: f, total: total}
+	rows := newWriter(stream, f)
+
+	written := 0
+	err := stream.extendDeadline()
+	if err == nil {
+		err = each(r.Context(), m.store, query, streamPageSize, func(row T) error {
+			if err := rows.Write(row); err != nil {
+				return err
+			}
+			if written++; written%streamPageSize == 0 {
+				if err := rows.Flush(); err != nil {
+					return err
+				}
+				stream.flush()
+				return stream.extendDeadline()
+			}
+			return nil
+		})
+	}
+	if err == nil {
+		err = rows.Flush()
+	}
+
+	switch {
+	case err != nil && !stream.started:
+		m.writeQueryError(w, operation, err)
+	case err != nil:
+		m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Aborted a streamed response after ", written, " rows while ", operation, ". Err - ", err)
+		panic(http.ErrAbortHandler)
+	case written == 0:
+		m.logger.LogEvent(util.LOG_LEVEL_WARN, "Insufficient Metrics Data")
+		m.Response.WriteErrorResponseWithStatusCode(w, ErrNoMetricsAvailable, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,43 @@
+package endpoints
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"metrics-app/internal/domain"
+)
+
+// pageToken is the decoded form of next_cursor. It carries the order of the
+// listing, so a cursor always continues in the direction it was issued in.
+type pageToken struct {
+	domain.Cursor
+	Descending bool `json:"d,omitempty"`
+}
+
+func encodeCursor(cursor domain.Cursor, descending bool) string {
+	token, _ := json.Marshal(pageToken{Cursor: cursor, Descending: descending})
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+func decodeCursor(value string) (pageToken, error) {
+	var token pageToken
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return token, err
+	}
+	err = json.Unmarshal(raw, &token)
+	return token, err
+}
+
+// nextPage trims a result that was fetched with one row more than the page
+// limit and describes what follows it.
+func nextPage[T any](items []T, page paging, position func(T) domain.Cursor) ([]T, Page) {
+	if len(items) <= page.limit {
+		return items, Page{}
+	}
+	items = items[:page.limit]
+	return items, Page{
+		NextCursor: encodeCursor(position(items[len(items)-1]), page.descending),
+		HasMore:    true,
+	}
+}
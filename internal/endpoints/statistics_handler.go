@@ -0,0 +1,48 @@
+package endpoints
+
+import (
+	"net/http"
+
+	"metrics-app/internal/domain"
+	"metrics-app/internal/util"
+)
+
+// GetStatisticsHandler summarises the cpu_load and concurrency series of a
+// MetricsRequest time range: count, min, max, mean, standard deviation and
+// percentiles per label set.
+func (m *Metrics) GetStatisticsHandler(w http.ResponseWriter, r *http.Request) {
+
+	var reqBody MetricsRequest
+
+	if !m.decodeRequest(w, r, &reqBody, timestampParam("start", &reqBody.Start), timestampParam("end", &reqBody.End)) {
+		return
+	}
+
+	startTime, endTime, ok := m.timeRange(w, reqBody.Start, reqBody.End)
+	if !ok {
+		return
+	}
+
+	result := make([]domain.SeriesStatistics, 0)
+
+	for _, name := range []string{domain.MetricCPULoad, domain.MetricConcurrency} {
+		stats, err := m.store.SummarizeSamples(r.Context(), domain.Query{
+			Selector: domain.SeriesSelector{Name: name, Matchers: reqBody.Matchers},
+			Start:    startTime,
+			End:      endTime,
+		})
+		if err != nil {
+			m.writeQueryError(w, "SummarizeSamples()", err)
+			return
+		}
+		result = append(result, stats...)
+	}
+
+	if len(result) == 0 {
+		m.logger.LogEvent(util.LOG_LEVEL_WARN, "Insufficient Metrics Data")
+		m.Response.WriteErrorResponseWithStatusCode(w, ErrNoMetricsAvailable, http.StatusNotFound)
+		return
+	}
+
+	m.Response.WriteResultResponse(w, result)
+}
@@ -0,0 +1,249 @@
+package endpoints
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"metrics-app/internal/broadcast"
+	"metrics-app/internal/domain"
+	"metrics-app/internal/util"
+)
+
+const (
+	// streamBuffer is how many metrics a stream may fall behind before it is
+	// dropped. The client then reconnects and resumes from the history of
+	// the broadcaster or, past it, from the store, see eventID.
+	streamBuffer = 256
+	// replayPage is the page size of the catch-up after a reconnect.
+	replayPage = 500
+)
+
+// streamHeartbeat keeps idle streams from being closed by proxies.
+var streamHeartbeat = 15 * time.Second
+
+// SetBroadcaster enables StreamMetricsHandler.
+func (m *Metrics) SetBroadcaster(b *broadcast.Broadcaster) {
+	m.broadcaster = b
+}
+
+// StreamMetricsHandler pushes every newly stored metric as a Server-Sent
+// Event. A client that reconnects with Last-Event-ID first receives what it
+// missed, see eventID.
+func (m *Metrics) StreamMetricsHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Method Not Allowed. Only GET requests are supported", http.StatusMethodNotAllowed)
+		m.Response.WriteErrorResponseWithStatusCode(w, errors.New("method Not Allowed. Only GET requests are supported"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var resume *eventID
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		id, err := decodeEventID(lastEventID)
+		if err != nil {
+			m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Invalid Last-Event-ID ", lastEventID)
+			m.Response.WriteErrorResponseWithStatusCode(w, ErrInvalidLastEventID, http.StatusBadRequest)
+			return
+		}
+		resume = &id
+	}
+
+	// Streams outlive the write timeout of the server.
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while clearing the write deadline. Err - ", err)
+	}
+
+	// Subscribing before the catch-up means no metric can fall between the
+	// two.
+	var (
+		sub    *broadcast.Subscription
+		missed []broadcast.Event
+		kept   bool
+	)
+	if resume != nil {
+		sub, missed, kept = m.broadcaster.SubscribeAfter(streamBuffer, resume.Epoch, resume.Seq)
+	} else {
+		sub = m.broadcaster.Subscribe(streamBuffer)
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Streaming is not supported by the connection. Err - ", err)
+		return
+	}
+
+	stream := &eventStream{w: w, epoch: m.broadcaster.Epoch()}
+	if resume != nil {
+		stream.highWater = &resume.Cursor
+	}
+
+	// replayed is set when the catch-up came from the store, whose rows
+	// the subscription may deliver again.
+	var replayed *domain.Cursor
+	switch {
+	case kept:
+		for _, event := range missed {
+			if err := stream.write(event); err != nil {
+				return
+			}
+		}
+	case resume != nil:
+		if err := stream.gap(resume.Cursor); err != nil {
+			return
+		}
+		var err error
+		if replayed, err = m.replay(stream, r, resume.Cursor); err != nil {
+			m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while replaying the stream. Err - ", err)
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case event, ok := <-sub.C:
+			if !ok {
+				m.logger.LogEvent(util.LOG_LEVEL_INFO, "Stream ended - ", sub.Err())
+				return
+			}
+			position := domain.MetricCursor(event.Metric)
+			if replayed != nil && continues(resume.Cursor, position) && !continues(*replayed, position) {
+				continue
+			}
+			if err := stream.write(event); err != nil {
+				return
+			}
+
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// eventID is the id of an event. Epoch and Seq place it in the order of
+// publication, so a reconnect within the history of the broadcaster resumes
+// exactly where the client left off, backfilled metrics included. Cursor is
+// the latest position, by timestamp and label set, that the client has
+// received; when the history no longer covers the gap, or the server has
+// restarted, the catch-up reads the store after it. Metrics stored with
+// older timestamps while the client was away are then not caught up on,
+// which a gap event tells the client.
+type eventID struct {
+	Epoch int64  `json:"e,omitempty"`
+	Seq   uint64 `json:"s,omitempty"`
+	domain.Cursor
+}
+
+func encodeEventID(id eventID) string {
+	data, _ := json.Marshal(id)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeEventID also reads the plain cursors that event ids used to be,
+// which resume from the store.
+func decodeEventID(value string) (eventID, error) {
+	var id eventID
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return id, err
+	}
+	err = json.Unmarshal(raw, &id)
+	return id, err
+}
+
+// eventStream writes the events of one client and tracks the latest
+// position it has received.
+type eventStream struct {
+	w         http.ResponseWriter
+	epoch     int64
+	highWater *domain.Cursor
+}
+
+// write sends event. Metrics replayed from the store have no sequence
+// number; their ids leave Epoch unset so that resuming from them reads the
+// store again.
+func (s *eventStream) write(event broadcast.Event) error {
+	position := domain.MetricCursor(event.Metric)
+	if s.highWater == nil || continues(*s.highWater, position) {
+		s.highWater = &position
+	}
+
+	id := eventID{Cursor: *s.highWater}
+	if event.Seq != 0 {
+		id.Epoch, id.Seq = s.epoch, event.Seq
+	}
+
+	data, err := json.Marshal(event.Metric)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.w, "id: %s\nevent: metric\ndata: %s\n\n", encodeEventID(id), data)
+	return err
+}
+
+// gap tells the client that the catch-up reads the store after resume, so
+// metrics stored with older timestamps while it was away are not sent. It
+// has no id, which leaves the client's Last-Event-ID as it was.
+func (s *eventStream) gap(resume domain.Cursor) error {
+	_, err := fmt.Fprintf(s.w, "event: gap\ndata: {\"after\":%d}\n\n", resume.Timestamp)
+	return err
+}
+
+// replay writes the stored metrics that follow resume and returns the
+// position of the last one.
+func (m *Metrics) replay(stream *eventStream, r *http.Request, resume domain.Cursor) (*domain.Cursor, error) {
+	last := resume
+	for {
+		metrics, err := m.store.QueryMetrics(r.Context(), domain.Query{
+			Start:  last.Timestamp,
+			End:    math.MaxInt64,
+			Limit:  replayPage,
+			Cursor: &last,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, metric := range metrics {
+			if err := stream.write(broadcast.Event{Metric: metric}); err != nil {
+				return nil, err
+			}
+		}
+		if len(metrics) > 0 {
+			last = domain.MetricCursor(metrics[len(metrics)-1])
+		}
+		if len(metrics) < replayPage {
+			return &last, nil
+		}
+	}
+}
+
+// continues reports whether position comes after cursor in ascending
+// order.
+func continues(cursor, position domain.Cursor) bool {
+	return domain.Query{Cursor: &cursor}.Continues(position)
+}
@@ -0,0 +1,272 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+
+	"metrics-app/internal/broadcast"
+	"metrics-app/internal/domain"
+	"metrics-app/internal/subscription"
+	"metrics-app/internal/util"
+)
+
+// Types of the messages exchanged on /metrics/subscribe.
+const (
+	SubscribeMessage    = "subscribe"
+	UnsubscribeMessage  = "unsubscribe"
+	SubscribedMessage   = "subscribed"
+	UnsubscribedMessage = "unsubscribed"
+	UpdateMessage       = "update"
+	ErrorMessage        = "error"
+)
+
+const (
+	// maxSubscriptions bounds the subscriptions of one connection.
+	maxSubscriptions = 16
+	// websocketReadLimit bounds the size of a client message.
+	websocketReadLimit = 1 << 20
+)
+
+var (
+	// subscriptionTick is how often downsampled buckets are checked.
+	subscriptionTick = time.Second
+	// websocketWriteTimeout drops clients that stop reading.
+	websocketWriteTimeout = 10 * time.Second
+)
+
+// SubscribeRequest is a client message. Where is a condition such as
+// "cpu_load > 90". Interval and Func downsample the matching metrics the
+// way GET /metrics/aggregate does; the condition then applies to the
+// aggregates.
+type SubscribeRequest struct {
+	Type     string                `json:"type"`
+	ID       string                `json:"id"`
+	Matchers []domain.LabelMatcher `json:"matchers,omitempty"`
+	Where    string                `json:"where,omitempty"`
+	Interval string                `json:"interval,omitempty"`
+	Func     string                `json:"func,omitempty"`
+}
+
+// SubscriptionUpdate is the value of every server message.
+type SubscriptionUpdate struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Metrics []domain.Metric `json:"metrics,omitempty"`
+}
+
+var (
+	upgrader = websocket.Upgrader{CheckOrigin: sameOrigin}
+
+	errInvalidUTF8 = errors.New("websocket: text message is not UTF-8")
+)
+
+// sameOrigin lets browsers connect only from pages served by this host, so
+// another site cannot open a subscription with its visitor's access. Other
+// clients send no Origin.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+type subscribeMessage struct {
+	request SubscribeRequest
+	err     error
+}
+
+// SubscribeHandler upgrades to a WebSocket on which the client manages
+// subscriptions to newly stored metrics. Every server message is an
+// APIResponse envelope around a SubscriptionUpdate.
+func (m *Metrics) SubscribeHandler(w http.ResponseWriter, r *http.Request) {
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		m.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while upgrading to a WebSocket. Err - ", err)
+		return
+	}
+	defer conn.Close()
+	// The server deadlines of the request no longer apply.
+	conn.NetConn().SetDeadline(time.Time{})
+	conn.SetReadLimit(websocketReadLimit)
+
+	feed := m.broadcaster.Subscribe(streamBuffer)
+	defer feed.Close()
+
+	messages := make(chan subscribeMessage)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			// Section 8.1 of RFC 6455 requires text to be UTF-8, which the
+			// library leaves to the application.
+			if messageType == websocket.TextMessage && !utf8.Valid(data) {
+				message := websocket.FormatCloseMessage(websocket.CloseInvalidFramePayloadData, "text is not UTF-8")
+				conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(websocketWriteTimeout))
+				readErr <- errInvalidUTF8
+				return
+			}
+			var msg subscribeMessage
+			if err := json.Unmarshal(data, &msg.request); err != nil {
+				msg.err = fmt.Errorf("%w: %v", ErrInvalidSubscription, err)
+			}
+			select {
+			case messages <- msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	send := func(update SubscriptionUpdate, err error) bool {
+		envelope := m.Response.Success(update)
+		if err != nil {
+			envelope = m.Response.Failure(err)
+			envelope.Value = update
+		}
+		data, _ := json.Marshal(envelope)
+		conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+		return conn.WriteMessage(websocket.TextMessage, data) == nil
+	}
+
+	subscriptions := make(map[string]*subscription.Subscription)
+	ticker := time.NewTicker(subscriptionTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-readErr:
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) {
+				m.logger.LogEvent(util.LOG_LEVEL_WARN, "WebSocket read failed. Err - ", err)
+			}
+			return
+
+		case msg := <-messages:
+			if msg.err == nil {
+				msg.err = m.handleSubscribeRequest(subscriptions, msg.request)
+			}
+			update := SubscriptionUpdate{Type: SubscribedMessage, ID: msg.request.ID}
+			switch {
+			case msg.err != nil:
+				update.Type = ErrorMessage
+			case msg.request.Type == UnsubscribeMessage:
+				update.Type = UnsubscribedMessage
+			}
+			if !send(update, msg.err) {
+				return
+			}
+
+		case event, ok := <-feed.C:
+			if !ok {
+				m.closeSubscriptions(conn, feed.Err(), readErr)
+				return
+			}
+			for id, sub := range subscriptions {
+				if out, ok := sub.Offer(event.Metric); ok {
+					if !send(SubscriptionUpdate{Type: UpdateMessage, ID: id, Metrics: []domain.Metric{out}}, nil) {
+						return
+					}
+				}
+			}
+
+		case now := <-ticker.C:
+			for id, sub := range subscriptions {
+				if out := sub.Flush(now.Unix()); len(out) > 0 {
+					if !send(SubscriptionUpdate{Type: UpdateMessage, ID: id, Metrics: out}, nil) {
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+// handleSubscribeRequest applies a subscribe or unsubscribe request to
+// subscriptions.
+func (m *Metrics) handleSubscribeRequest(subscriptions map[string]*subscription.Subscription, req SubscribeRequest) error {
+	if req.ID == "" {
+		return fmt.Errorf("%w: id is required", ErrInvalidSubscription)
+	}
+
+	switch req.Type {
+	case UnsubscribeMessage:
+		if _, ok := subscriptions[req.ID]; !ok {
+			return fmt.Errorf("%w: no subscription %q", ErrInvalidSubscription, req.ID)
+		}
+		delete(subscriptions, req.ID)
+		return nil
+	case SubscribeMessage:
+	default:
+		return fmt.Errorf("%w: type must be %q or %q", ErrInvalidSubscription, SubscribeMessage, UnsubscribeMessage)
+	}
+
+	if _, ok := subscriptions[req.ID]; ok {
+		return fmt.Errorf("%w: subscription %q already exists", ErrInvalidSubscription, req.ID)
+	}
+	if len(subscriptions) >= maxSubscriptions {
+		return fmt.Errorf("%w: at most %d subscriptions per connection", ErrInvalidSubscription, maxSubscriptions)
+	}
+
+	spec := subscription.Spec{
+		Selector: domain.SeriesSelector{Matchers: req.Matchers},
+		Func:     domain.AggregateFunc(req.Func),
+	}
+	if req.Where != "" {
+		condition, err := subscription.ParseCondition(req.Where)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidSubscription, err)
+		}
+		spec.Condition = &condition
+	}
+	if req.Interval != "" {
+		interval, err := parseStep(req.Interval)
+		if err != nil {
+			return fmt.Errorf("%w: interval: %v", ErrInvalidSubscription, err)
+		}
+		spec.Interval = interval
+	}
+
+	sub, err := subscription.New(spec)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSubscription, err)
+	}
+	subscriptions[req.ID] = sub
+	return nil
+}
+
+// closeSubscriptions says goodbye once the feed has ended, and waits
+// briefly for the client to acknowledge.
+func (m *Metrics) closeSubscriptions(conn *websocket.Conn, reason error, readErr <-chan error) {
+	code := websocket.CloseGoingAway
+	if errors.Is(reason, broadcast.ErrSlowConsumer) {
+		code = websocket.CloseTryAgainLater
+	}
+	m.logger.LogEvent(util.LOG_LEVEL_INFO, "Closing subscriptions - ", reason)
+
+	message := websocket.FormatCloseMessage(code, reason.Error())
+	if err := conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(websocketWriteTimeout)); err != nil {
+		return
+	}
+	select {
+	case <-readErr:
+	case <-time.After(time.Second):
+	}
+}
@@ -0,0 +1,139 @@
+package exposition
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"metrics-app/internal/domain"
+)
+
+const (
+	TextContentType        = "text/plain; version=0.0.4; charset=utf-8"
+	OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+type Type string
+
+const (
+	Gauge     Type = "gauge"
+	Counter   Type = "counter"
+	Histogram Type = "histogram"
+)
+
+// Family groups the samples that share a metric name, help text and type.
+// Name is the OpenMetrics family name, so a counter is named without its
+// _total suffix.
+type Family struct {
+	Name    string
+	Help    string
+	Type    Type
+	Samples []Sample
+}
+
+// Sample is one line of a family. Name is the full sample name including
+// suffixes such as _total or _bucket. A zero Timestamp is omitted; otherwise
+// it is in Unix seconds.
+type Sample struct {
+	Name      string
+	Labels    domain.Labels
+	Value     float64
+	Timestamp int64
+}
+
+// Negotiate picks the exposition format for the Accept header of a scrape.
+func Negotiate(accept string) string {
+	if strings.Contains(accept, "application/openmetrics-text") {
+		return OpenMetricsContentType
+	}
+	return TextContentType
+}
+
+// Write renders families in the format of contentType, which is one of the
+// content types returned by Negotiate.
+func Write(w io.Writer, contentType string, families []Family) error {
+	openMetrics := contentType == OpenMetricsContentType
+	bw := bufio.NewWriter(w)
+
+	for _, family := range families {
+		name := family.Name
+		if family.Type == Counter && !openMetrics {
+			name += "_total"
+		}
+
+		if family.Help != "" {
+			bw.WriteString("# HELP " + name + " " + escapeHelp(family.Help, openMetrics) + "\n")
+		}
+		bw.WriteString("# TYPE " + name + " " + string(family.Type) + "\n")
+
+		for _, sample := range family.Samples {
+			bw.WriteString(sample.Name)
+			writeLabels(bw, sample.Labels)
+			bw.WriteByte(' ')
+			bw.WriteString(formatValue(sample.Value))
+			if sample.Timestamp != 0 {
+				bw.WriteByte(' ')
+				if openMetrics {
+					bw.WriteString(strconv.FormatInt(sample.Timestamp, 10))
+				} else {
+					bw.WriteString(strconv.FormatInt(sample.Timestamp*1000, 10))
+				}
+			}
+			bw.WriteByte('\n')
+		}
+	}
+
+	if openMetrics {
+		bw.WriteString("# EOF\n")
+	}
+	return bw.Flush()
+}
+
+func writeLabels(bw *bufio.Writer, labels domain.Labels) {
+	if len(labels) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			bw.WriteByte(',')
+		}
+		bw.WriteString(name + `="` + labelValueReplacer.Replace(labels[name]) + `"`)
+	}
+	bw.WriteByte('}')
+}
+
+var (
+	labelValueReplacer      = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	textHelpReplacer        = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	openMetricsHelpReplacer = labelValueReplacer
+)
+
+func escapeHelp(help string, openMetrics bool) string {
+	if openMetrics {
+		return openMetricsHelpReplacer.Replace(help)
+	}
+	return textHelpReplacer.Replace(help)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,61 @@
+package exposition
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"metrics-app/internal/domain"
+)
+
+func TestNegotiate(t *testing.T) {
+	assert.Equal(t, TextContentType, Negotiate(""))
+	assert.Equal(t, TextContentType, Negotiate("text/plain;version=0.0.4;q=0.5,*/*;q=0.1"))
+	assert.Equal(t, OpenMetricsContentType, Negotiate("application/openmetrics-text;version=1.0.0,text/plain;q=0.5"))
+}
+
+func TestWrite(t *testing.T) {
+	families := []Family{
+		{
+			Name: "cpu_load",
+			Help: "CPU load in percent.",
+			Type: Gauge,
+			Samples: []Sample{
+				{Name: "cpu_load", Labels: domain.Labels{"region": "eu", "host": `we"b\1`}, Value: 45.75, Timestamp: 1722441990},
+				{Name: "cpu_load", Value: math.Inf(1)},
+			},
+		},
+		{
+			Name:    "requests",
+			Help:    "Requests served.\nPer route.",
+			Type:    Counter,
+			Samples: []Sample{{Name: "requests_total", Labels: domain.Labels{"route": "/metrics"}, Value: 3}},
+		},
+	}
+
+	var text bytes.Buffer
+	require.NoError(t, Write(&text, TextContentType, families))
+	assert.Equal(t, `# HELP cpu_load CPU load in percent.
+# TYPE cpu_load gauge
+cpu_load{host="we\"b\\1",region="eu"} 45.75 1722441990000
+cpu_load +Inf
+# HELP requests_total Requests served.\nPer route.
+# TYPE requests_total counter
+requests_total{route="/metrics"} 3
+`, text.String())
+
+	var openMetrics bytes.Buffer
+	require.NoError(t, Write(&openMetrics, OpenMetricsContentType, families))
+	assert.Equal(t, `# HELP cpu_load CPU load in percent.
+# TYPE cpu_load gauge
+cpu_load{host="we\"b\\1",region="eu"} 45.75 1722441990
+cpu_load +Inf
+# HELP requests Requests served.\nPer route.
+# TYPE requests counter
+requests_total{route="/metrics"} 3
+# EOF
+`, openMetrics.String())
+}
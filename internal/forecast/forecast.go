@@ -0,0 +1,342 @@
+package forecast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+
+	"metrics-app/internal/domain"
+)
+
+type Method string
+
+const (
+	// MethodLinear extends the least squares line through the history.
+	MethodLinear Method = "linear"
+	// MethodHoltWinters extends the level, trend and season of additive
+	// triple exponential smoothing.
+	MethodHoltWinters Method = "holt-winters"
+)
+
+var ErrInvalidConfig = errors.New("invalid forecast")
+
+// smoothingGrid are the candidate smoothing factors of Holt-Winters. The
+// combination with the smallest one-step-ahead error is used.
+var smoothingGrid = []float64{0.1, 0.3, 0.5, 0.7, 0.9}
+
+// maxReach is how far ahead, in seconds, a threshold crossing is reported:
+// a century. Anything later is taken to be never.
+const maxReach = 100 * 365 * 24 * 3600
+
+// Config describes a forecast. Durations are in seconds. History is
+// averaged into buckets of Step, and predictions are made for the Horizon
+// after the end of the history.
+type Config struct {
+	Method  Method
+	Step    int64
+	Horizon int64
+	// Season is the period of MethodHoltWinters, a multiple of Step.
+	Season int64
+	// Confidence is the probability covered by the prediction interval.
+	Confidence float64
+	// Threshold, when set, is the value whose crossing by the linear trend
+	// is reported.
+	Threshold *float64
+}
+
+func DefaultConfig() Config {
+	return Config{Method: MethodLinear, Step: 3600, Horizon: 24 * 3600, Season: 24 * 3600, Confidence: 0.95}
+}
+
+func (c Config) Validate() error {
+	if c.Step <= 0 {
+		return domain.ErrInvalidStep
+	}
+	switch c.Method {
+	case MethodLinear:
+	case MethodHoltWinters:
+		if c.Season < 2*c.Step || c.Season%c.Step != 0 {
+			return fmt.Errorf("%w: season must be a multiple of at least two steps", ErrInvalidConfig)
+		}
+	default:
+		return fmt.Errorf("%w: method must be %q or %q", ErrInvalidConfig, MethodLinear, MethodHoltWinters)
+	}
+	if c.Horizon < c.Step {
+		return fmt.Errorf("%w: horizon must be at least one step", ErrInvalidConfig)
+	}
+	if c.Horizon/c.Step >= domain.MaxAggregateBuckets {
+		return domain.ErrTooManyBuckets
+	}
+	if !(c.Confidence > 0 && c.Confidence < 1) {
+		return fmt.Errorf("%w: confidence must be between 0 and 1", ErrInvalidConfig)
+	}
+	if c.Threshold != nil && (math.IsNaN(*c.Threshold) || math.IsInf(*c.Threshold, 0)) {
+		return fmt.Errorf("%w: threshold must be a finite number", ErrInvalidConfig)
+	}
+	return nil
+}
+
+// Prediction is the forecast of one bucket with its prediction interval.
+type Prediction struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+	Lower     float64 `json:"lower"`
+	Upper     float64 `json:"upper"`
+}
+
+// Result is the forecast of one series. ThresholdAt is when the linear
+// trend of the history reaches the threshold: the end of the history if it
+// already has, and nil if it never will.
+type Result struct {
+	Name        string        `json:"name"`
+	Labels      domain.Labels `json:"labels,omitempty"`
+	Method      Method        `json:"method"`
+	Predictions []Prediction  `json:"predictions"`
+	ThresholdAt *int64        `json:"threshold_at,omitempty"`
+}
+
+// Forecast predicts every selected series from its history in [start, end].
+// Series with too little history for the method are left out: three
+// buckets for MethodLinear and two seasons for MethodHoltWinters. So are
+// series with values too large for the error of any fit to be finite.
+func Forecast(ctx context.Context, store domain.MetricStore, selector domain.SeriesSelector, start, end int64, c Config) ([]Result, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	history, err := store.AggregateSamples(ctx, domain.AggregateQuery{
+		Selector: selector,
+		Start:    start,
+		End:      end,
+		Step:     c.Step,
+		Func:     domain.AggregateAvg,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	z := math.Sqrt2 * math.Erfinv(c.Confidence)
+	results := make([]Result, 0, len(history))
+	for _, series := range history {
+		if len(series.Points) < 3 {
+			continue
+		}
+		trend := fitLine(series.Points)
+
+		result := Result{Name: series.Name, Labels: series.Labels, Method: c.Method}
+		if c.Method == MethodHoltWinters {
+			values := fillGaps(series.Points, c.Step)
+			if len(values) < int(2*c.Season/c.Step) {
+				continue
+			}
+			result.Predictions = holtWinters(values, int(c.Season/c.Step), int(c.Horizon/c.Step), z)
+		} else if finite(trend.stderr) {
+			result.Predictions = trend.predict(int(c.Horizon/c.Step), c.Step, z)
+		}
+		if result.Predictions == nil {
+			continue
+		}
+
+		last := series.Points[len(series.Points)-1].Timestamp
+		for i := range result.Predictions {
+			result.Predictions[i].Timestamp = last + int64(i+1)*c.Step
+			clamp(series.Name, &result.Predictions[i])
+		}
+		if c.Threshold != nil {
+			result.ThresholdAt = trend.reaches(*c.Threshold, last)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// clamp keeps the predictions of the built-in series within their valid
+// range.
+func clamp(name string, p *Prediction) {
+	lower, upper := math.Inf(-1), math.Inf(1)
+	switch name {
+	case domain.MetricCPULoad:
+		lower, upper = 0, 100
+	case domain.MetricConcurrency:
+		lower = 0
+	}
+	p.Value = math.Min(math.Max(p.Value, lower), upper)
+	p.Lower = math.Min(math.Max(p.Lower, lower), upper)
+	p.Upper = math.Min(math.Max(p.Upper, lower), upper)
+}
+
+// line is a least squares fit of value = intercept + slope*(t - origin).
+type line struct {
+	origin    int64
+	intercept float64
+	slope     float64
+	// n, meanX and sxx describe the fitted timestamps; stderr is the
+	// residual standard error.
+	n      int
+	meanX  float64
+	sxx    float64
+	stderr float64
+	last   int64
+}
+
+func fitLine(points []domain.Point) line {
+	l := line{origin: points[0].Timestamp, n: len(points), last: points[len(points)-1].Timestamp}
+
+	var meanY float64
+	for _, p := range points {
+		l.meanX += float64(p.Timestamp - l.origin)
+		meanY += p.Value
+	}
+	l.meanX /= float64(l.n)
+	meanY /= float64(l.n)
+
+	var sxy float64
+	for _, p := range points {
+		dx := float64(p.Timestamp-l.origin) - l.meanX
+		l.sxx += dx * dx
+		sxy += dx * (p.Value - meanY)
+	}
+	if l.sxx > 0 {
+		l.slope = sxy / l.sxx
+	}
+	l.intercept = meanY - l.slope*l.meanX
+
+	var sse float64
+	for _, p := range points {
+		residual := p.Value - l.at(p.Timestamp)
+		sse += residual * residual
+	}
+	l.stderr = math.Sqrt(sse / float64(l.n-2))
+	return l
+}
+
+func (l line) at(t int64) float64 {
+	return l.intercept + l.slope*float64(t-l.origin)
+}
+
+// predict extends the line by horizon steps with prediction intervals that
+// widen with the distance from the fitted timestamps.
+func (l line) predict(horizon int, step int64, z float64) []Prediction {
+	predictions := make([]Prediction, horizon)
+	for i := range predictions {
+		t := l.last + int64(i+1)*step
+		dx := float64(t-l.origin) - l.meanX
+		spread := l.stderr * math.Sqrt(1+1/float64(l.n)+dx*dx/math.Max(l.sxx, 1))
+		value := l.at(t)
+		predictions[i] = Prediction{Value: value, Lower: value - z*spread, Upper: value + z*spread}
+	}
+	return predictions
+}
+
+// reaches returns when the line reaches threshold from below: now if it
+// already has, nil if it is flat, falling, or too nearly flat to get there
+// within maxReach. A slope left by rounding in a flat series would
+// otherwise put the crossing past the range of int64.
+func (l line) reaches(threshold float64, now int64) *int64 {
+	current := l.at(now)
+	if current >= threshold {
+		return &now
+	}
+	if l.slope <= 0 {
+		return nil
+	}
+	seconds := math.Ceil((threshold - current) / l.slope)
+	if !(seconds <= maxReach) || seconds > float64(math.MaxInt64-now) {
+		return nil
+	}
+	at := now + int64(seconds)
+	return &at
+}
+
+// fillGaps returns the values of every bucket from the first point to the
+// last, interpolating linearly over buckets without samples.
+func fillGaps(points []domain.Point, step int64) []float64 {
+	first, last := points[0].Timestamp, points[len(points)-1].Timestamp
+	values := make([]float64, 0, (last-first)/step+1)
+	for i, p := range points {
+		if i > 0 {
+			prev := points[i-1]
+			gap := (p.Timestamp - prev.Timestamp) / step
+			for j := int64(1); j < gap; j++ {
+				values = append(values, prev.Value+(p.Value-prev.Value)*float64(j)/float64(gap))
+			}
+		}
+		values = append(values, p.Value)
+	}
+	return values
+}
+
+// holtWinters forecasts horizon buckets after values with additive triple
+// exponential smoothing. The smoothing factors are picked from
+// smoothingGrid by their one-step-ahead error, whose standard deviation
+// also sets the prediction interval. It returns nil when no factors give a
+// finite error, as with values near the range of float64.
+func holtWinters(values []float64, season, horizon int, z float64) []Prediction {
+	var best *hwModel
+	for _, alpha := range smoothingGrid {
+		for _, beta := range smoothingGrid {
+			for _, gamma := range smoothingGrid {
+				if m := fitHoltWinters(values, season, alpha, beta, gamma); finite(m.sse) && (best == nil || m.sse < best.sse) {
+					best = &m
+				}
+			}
+		}
+	}
+	if best == nil {
+		return nil
+	}
+
+	sigma := math.Sqrt(best.sse / float64(best.errors))
+	predictions := make([]Prediction, horizon)
+	for h := range predictions {
+		value := best.level + float64(h+1)*best.trend + best.seasonal[(len(values)+h)%season]
+		// The error of a forecast grows with its distance; the square root
+		// is the random walk approximation.
+		spread := sigma * math.Sqrt(float64(h+1))
+		predictions[h] = Prediction{Value: value, Lower: value - z*spread, Upper: value + z*spread}
+	}
+	return predictions
+}
+
+func finite(x float64) bool {
+	return !math.IsNaN(x) && !math.IsInf(x, 0)
+}
+
+type hwModel struct {
+	level    float64
+	trend    float64
+	seasonal []float64
+	sse      float64
+	errors   int
+}
+
+// fitHoltWinters initialises the model from the first two seasons and
+// smooths the rest of values.
+func fitHoltWinters(values []float64, season int, alpha, beta, gamma float64) hwModel {
+	var first, second float64
+	for i := 0; i < season; i++ {
+		first += values[i]
+		second += values[season+i]
+	}
+	first /= float64(season)
+	second /= float64(season)
+
+	m := hwModel{level: first, trend: (second - first) / float64(season), seasonal: make([]float64, season)}
+	for i := 0; i < season; i++ {
+		m.seasonal[i] = values[i] - first
+	}
+
+	for i := season; i < len(values); i++ {
+		s := m.seasonal[i%season]
+		predicted := m.level + m.trend + s
+		m.sse += (values[i] - predicted) * (values[i] - predicted)
+		m.errors++
+
+		level := alpha*(values[i]-s) + (1-alpha)*(m.level+m.trend)
+		m.trend = beta*(level-m.level) + (1-beta)*m.trend
+		m.level = level
+		m.seasonal[i%season] = gamma*(values[i]-level) + (1-gamma)*s
+	}
+	return m
+}
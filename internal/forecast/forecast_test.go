@@ -0,0 +1,160 @@
+package forecast
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"metrics-app/internal/domain"
+	"metrics-app/internal/repository"
+)
+
+const base int64 = 1722384000 // midnight UTC
+
+func newStore(t *testing.T, metrics []domain.Metric) domain.MetricStore {
+	store := repository.NewInMemoryStore(0)
+	require.NoError(t, store.Init())
+	_, err := store.StoreMetrics(context.Background(), metrics)
+	require.NoError(t, err)
+	return store
+}
+
+func threshold(v float64) *float64 {
+	return &v
+}
+
+func TestConfig_Validate(t *testing.T) {
+	assert.NoError(t, DefaultConfig().Validate())
+
+	for _, c := range []Config{
+		{Method: "arima", Step: 60, Horizon: 3600, Confidence: 0.95},
+		{Method: MethodLinear, Step: 60, Horizon: 30, Confidence: 0.95},
+		{Method: MethodLinear, Step: 60, Horizon: 3600, Confidence: 1},
+		{Method: MethodLinear, Step: 60, Horizon: 3600, Confidence: 0.95, Threshold: threshold(math.Inf(1))},
+		{Method: MethodHoltWinters, Step: 3600, Horizon: 3600, Season: 3600, Confidence: 0.95},
+		{Method: MethodHoltWinters, Step: 3600, Horizon: 3600, Season: 5400, Confidence: 0.95},
+	} {
+		assert.ErrorIs(t, c.Validate(), ErrInvalidConfig, c)
+	}
+	assert.ErrorIs(t, Config{Method: MethodLinear, Horizon: 3600, Confidence: 0.95}.Validate(), domain.ErrInvalidStep)
+	assert.ErrorIs(t, Config{Method: MethodLinear, Step: 1, Horizon: 86400, Confidence: 0.95}.Validate(), domain.ErrTooManyBuckets)
+}
+
+func TestForecast_Linear(t *testing.T) {
+	var metrics []domain.Metric
+	for i := int64(0); i < 60; i++ {
+		// Concurrency grows by 2 a minute, give or take 1
+		concurrency := 100 + 2*i + i%3 - 1
+		metrics = append(metrics, domain.Metric{Timestamp: base + i*60, CPULoad: 95, Concurrency: int(concurrency)})
+	}
+	store := newStore(t, metrics)
+
+	c := Config{Method: MethodLinear, Step: 60, Horizon: 600, Confidence: 0.95, Threshold: threshold(300)}
+	results, err := Forecast(context.Background(), store, domain.SeriesSelector{Name: domain.MetricConcurrency}, base, base+59*60, c)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+
+	predictions := results[0].Predictions
+	require.Len(t, predictions, 10)
+	for i, p := range predictions {
+		at := base + int64(60+i)*60
+		assert.Equal(t, at, p.Timestamp)
+		assert.InDelta(t, 100+2*float64(60+i), p.Value, 1)
+		assert.Less(t, p.Lower, p.Value)
+		assert.Greater(t, p.Upper, p.Value)
+	}
+	assert.Greater(t, predictions[9].Upper-predictions[9].Lower, predictions[0].Upper-predictions[0].Lower,
+		"The interval should widen with the horizon")
+
+	// 100 + 2/min reaches 300 after 100 minutes
+	require.NotNil(t, results[0].ThresholdAt)
+	assert.InDelta(t, base+100*60, *results[0].ThresholdAt, 60)
+
+	// A flat series never reaches a higher threshold, and cpu_load stays
+	// within 100%
+	c.Threshold = threshold(99)
+	results, err = Forecast(context.Background(), store, domain.SeriesSelector{Name: domain.MetricCPULoad}, base, base+59*60, c)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Nil(t, results[0].ThresholdAt)
+	assert.Equal(t, 95.0, results[0].Predictions[0].Value)
+
+	// It has already reached a lower one
+	c.Threshold = threshold(90)
+	results, _ = Forecast(context.Background(), store, domain.SeriesSelector{Name: domain.MetricCPULoad}, base, base+59*60, c)
+	require.NotNil(t, results[0].ThresholdAt)
+	assert.Equal(t, base+59*60, *results[0].ThresholdAt)
+}
+
+func TestLine_ReachesNearlyFlat(t *testing.T) {
+	// Float rounding leaves a tiny positive slope on a flat series
+	l := line{origin: base, intercept: 50, slope: 1e-18}
+	assert.Nil(t, l.reaches(400000, base), "A crossing beyond int64 should be never, not a negative time")
+
+	l.slope = 1e-6
+	assert.Nil(t, l.reaches(400000, base), "A crossing centuries away should be never")
+
+	l.slope = 1
+	require.NotNil(t, l.reaches(400000, base))
+	assert.Equal(t, base+399950, *l.reaches(400000, base))
+
+	var points []domain.Point
+	for i := int64(0); i < 60; i++ {
+		points = append(points, domain.Point{Timestamp: base + i*60, Value: 0.1 + 0.2 + float64(i)*1e-15})
+	}
+	assert.Nil(t, fitLine(points).reaches(400000, base+59*60))
+}
+
+func TestForecast_HoltWinters(t *testing.T) {
+	daily := func(h int64) float64 {
+		return 50 + 30*math.Sin(2*math.Pi*float64(h)/24)
+	}
+	var metrics []domain.Metric
+	for h := int64(0); h < 4*24; h++ {
+		metrics = append(metrics, domain.Metric{Timestamp: base + h*3600, CPULoad: daily(h) + float64(h)*0.1, Concurrency: 10})
+	}
+	store := newStore(t, metrics)
+
+	c := Config{Method: MethodHoltWinters, Step: 3600, Horizon: 24 * 3600, Season: 24 * 3600, Confidence: 0.9}
+	results, err := Forecast(context.Background(), store, domain.SeriesSelector{Name: domain.MetricCPULoad}, base, base+4*86400, c)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, MethodHoltWinters, results[0].Method)
+
+	predictions := results[0].Predictions
+	require.Len(t, predictions, 24)
+	for i, p := range predictions {
+		h := int64(4*24 + i)
+		assert.Equal(t, base+h*3600, p.Timestamp)
+		assert.InDelta(t, daily(h)+float64(h)*0.1, p.Value, 3, "hour %d", h)
+		assert.LessOrEqual(t, p.Lower, p.Value)
+		assert.GreaterOrEqual(t, p.Upper, p.Value)
+	}
+
+	// Less than two seasons of history is not enough
+	results, err = Forecast(context.Background(), store, domain.SeriesSelector{Name: domain.MetricCPULoad}, base, base+36*3600, c)
+	require.NoError(t, err)
+	assert.Empty(t, results)
+}
+
+func TestForecast_HugeValues(t *testing.T) {
+	// POST /samples accepts any finite value, but no fit of these has a
+	// finite error
+	store := newStore(t, nil)
+	var samples []domain.Sample
+	for h := int64(0); h < 4*24; h++ {
+		samples = append(samples, domain.Sample{Name: "big", Timestamp: base + h*3600, Value: 1e200 * math.Sin(float64(h)*1.3)})
+	}
+	_, err := store.StoreSamples(context.Background(), samples)
+	require.NoError(t, err)
+
+	for _, method := range []Method{MethodHoltWinters, MethodLinear} {
+		c := Config{Method: method, Step: 3600, Horizon: 24 * 3600, Season: 24 * 3600, Confidence: 0.9}
+		results, err := Forecast(context.Background(), store, domain.SeriesSelector{Name: "big"}, base, base+4*86400, c)
+		require.NoError(t, err, method)
+		assert.Empty(t, results, method)
+	}
+}
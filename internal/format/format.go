@@ -0,0 +1,282 @@
+package format
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"metrics-app/internal/domain"
+)
+
+// Format is a line oriented encoding of rows, written and read one row at a
+// time so that large ranges never have to be held in memory.
+type Format string
+
+const (
+	// CSV has a header row. Labels are a single column holding the
+	// canonical JSON object of the label set, empty when there are none.
+	CSV Format = "csv"
+	// NDJSON has one JSON object per line, as returned by the JSON API.
+	NDJSON Format = "ndjson"
+)
+
+// Content types of the formats.
+const (
+	ContentTypeCSV    = "text/csv; charset=utf-8"
+	ContentTypeNDJSON = "application/x-ndjson"
+)
+
+var (
+	ErrUnknownFormat = errors.New("format must be csv or ndjson")
+	ErrInvalidRow    = errors.New("invalid row")
+	// ErrInvalidHeader ends a CSV whose header cannot be used; none of its
+	// rows can be read.
+	ErrInvalidHeader = errors.New("invalid CSV header")
+)
+
+var (
+	sampleHeader = []string{"timestamp", "name", "value", "labels"}
+	metricHeader = []string{"timestamp", "cpu_load", "concurrency", "labels"}
+)
+
+// Parse returns the format called name.
+func Parse(name string) (Format, error) {
+	switch f := Format(strings.ToLower(name)); f {
+	case CSV, NDJSON:
+		return f, nil
+	case "jsonl":
+		return NDJSON, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknownFormat, name)
+}
+
+// FromPath returns the format of a file named path by its extension:
+// .csv, .ndjson or .jsonl.
+func FromPath(path string) (Format, error) {
+	return Parse(strings.TrimPrefix(filepath.Ext(path), "."))
+}
+
+// ContentType returns the HTTP content type of f.
+func (f Format) ContentType() string {
+	if f == CSV {
+		return ContentTypeCSV
+	}
+	return ContentTypeNDJSON
+}
+
+// Writer writes rows of type T in a format. Output is buffered until
+// Flush.
+type Writer[T any] struct {
+	buf     *bufio.Writer
+	csv     *csv.Writer
+	header  []string
+	wrote   bool
+	record  []string
+	columns func(row T, record []string)
+}
+
+func newWriter[T any](w io.Writer, f Format, header []string, columns func(T, []string)) *Writer[T] {
+	tw := &Writer[T]{buf: bufio.NewWriter(w), header: header, columns: columns}
+	if f == CSV {
+		tw.csv = csv.NewWriter(tw.buf)
+		tw.record = make([]string, len(header))
+	}
+	return tw
+}
+
+// NewSampleWriter writes samples: timestamp, name, value and labels.
+func NewSampleWriter(w io.Writer, f Format) *Writer[domain.Sample] {
+	return newWriter(w, f, sampleHeader, func(s domain.Sample, record []string) {
+		record[0] = strconv.FormatInt(s.Timestamp, 10)
+		record[1] = s.Name
+		record[2] = strconv.FormatFloat(s.Value, 'g', -1, 64)
+		record[3] = labelsColumn(s.Labels)
+	})
+}
+
+// NewMetricWriter writes the Metric view: timestamp, cpu_load, concurrency
+// and labels.
+func NewMetricWriter(w io.Writer, f Format) *Writer[domain.Metric] {
+	return newWriter(w, f, metricHeader, func(m domain.Metric, record []string) {
+		record[0] = strconv.FormatInt(m.Timestamp, 10)
+		record[1] = strconv.FormatFloat(m.CPULoad, 'g', -1, 64)
+		record[2] = strconv.Itoa(m.Concurrency)
+		record[3] = labelsColumn(m.Labels)
+	})
+}
+
+// WriteHeader writes the CSV header; Write does so before the first row.
+// It lets an empty result still name its columns.
+func (tw *Writer[T]) WriteHeader() error {
+	if tw.csv == nil || tw.wrote {
+		return nil
+	}
+	tw.wrote = true
+	return tw.csv.Write(tw.header)
+}
+
+func (tw *Writer[T]) Write(row T) error {
+	if tw.csv == nil {
+		data, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		tw.buf.Write(data)
+		return tw.buf.WriteByte('\n')
+	}
+
+	if err := tw.WriteHeader(); err != nil {
+		return err
+	}
+	tw.columns(row, tw.record)
+	return tw.csv.Write(tw.record)
+}
+
+// Flush writes buffered rows to the underlying writer.
+func (tw *Writer[T]) Flush() error {
+	if tw.csv != nil {
+		tw.csv.Flush()
+		if err := tw.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return tw.buf.Flush()
+}
+
+func labelsColumn(labels domain.Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	return labels.Key()
+}
+
+// SampleReader reads samples in a format. Rows that cannot be decoded are
+// reported as ErrInvalidRow with their line; reading can go on after them.
+// A CSV header without the required columns is ErrInvalidHeader, which
+// every later Read returns too. Decoded samples are not validated.
+type SampleReader struct {
+	format  Format
+	csv     *csv.Reader
+	lines   *bufio.Reader
+	columns map[string]int
+	line    int
+	err     error
+}
+
+func NewSampleReader(r io.Reader, f Format) *SampleReader {
+	sr := &SampleReader{format: f}
+	if f == CSV {
+		sr.csv = csv.NewReader(r)
+		sr.csv.FieldsPerRecord = -1
+		sr.csv.ReuseRecord = true
+	} else {
+		sr.lines = bufio.NewReader(r)
+	}
+	return sr
+}
+
+// Line returns the line of the last row read.
+func (sr *SampleReader) Line() int {
+	return sr.line
+}
+
+// Read returns the next sample, or io.EOF after the last one.
+func (sr *SampleReader) Read() (domain.Sample, error) {
+	if sr.csv != nil {
+		return sr.readCSV()
+	}
+
+	for {
+		data, err := sr.lines.ReadBytes('\n')
+		if len(data) == 0 && err != nil {
+			return domain.Sample{}, err
+		}
+		sr.line++
+		data = bytes.TrimSpace(data)
+		if len(data) == 0 {
+			continue
+		}
+
+		var s domain.Sample
+		if err := json.Unmarshal(data, &s); err != nil {
+			return domain.Sample{}, sr.invalid(err)
+		}
+		return s, nil
+	}
+}
+
+func (sr *SampleReader) readCSV() (domain.Sample, error) {
+	if sr.err != nil {
+		return domain.Sample{}, sr.err
+	}
+	if sr.columns == nil {
+		header, err := sr.csv.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return domain.Sample{}, io.EOF
+			}
+			sr.line = 1
+			sr.err = fmt.Errorf("%w on line 1: %v", ErrInvalidHeader, err)
+			return domain.Sample{}, sr.err
+		}
+		sr.line, _ = sr.csv.FieldPos(0)
+		// Columns may come in any order; labels is optional. Spreadsheets
+		// often start files with a byte order mark.
+		columns := make(map[string]int, len(header))
+		for i, name := range header {
+			columns[strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))] = i
+		}
+		for _, name := range sampleHeader[:3] {
+			if _, ok := columns[name]; !ok {
+				sr.err = fmt.Errorf("%w on line %d: no %s column", ErrInvalidHeader, sr.line, name)
+				return domain.Sample{}, sr.err
+			}
+		}
+		sr.columns = columns
+	}
+
+	record, err := sr.csv.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return domain.Sample{}, io.EOF
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			sr.line = parseErr.Line
+		}
+		return domain.Sample{}, sr.invalid(err)
+	}
+	sr.line, _ = sr.csv.FieldPos(0)
+
+	column := func(name string) string {
+		if i, ok := sr.columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	s := domain.Sample{Name: column("name")}
+	if s.Timestamp, err = strconv.ParseInt(column("timestamp"), 10, 64); err != nil {
+		return domain.Sample{}, sr.invalid(fmt.Errorf("timestamp: %w", err))
+	}
+	if s.Value, err = strconv.ParseFloat(column("value"), 64); err != nil {
+		return domain.Sample{}, sr.invalid(fmt.Errorf("value: %w", err))
+	}
+	if labels := column("labels"); labels != "" {
+		if s.Labels, err = domain.ParseLabelsKey(labels); err != nil {
+			return domain.Sample{}, sr.invalid(fmt.Errorf("labels: %w", err))
+		}
+	}
+	return s, nil
+}
+
+func (sr *SampleReader) invalid(err error) error {
+	return fmt.Errorf("%w on line %d: %v", ErrInvalidRow, sr.line, err)
+}
@@ -0,0 +1,228 @@
+package format
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"metrics-app/internal/domain"
+	"metrics-app/internal/repository"
+)
+
+const base int64 = 1722441990
+
+func newStore(t *testing.T) domain.MetricStore {
+	store := repository.NewInMemoryStore(0)
+	require.NoError(t, store.Init())
+	return store
+}
+
+func samples(n int) []domain.Sample {
+	all := make([]domain.Sample, 0, n)
+	for i := 0; i < n; i++ {
+		all = append(all, domain.Sample{
+			Name:      domain.MetricCPULoad,
+			Labels:    domain.Labels{"host": "web-1", "note": `say "hi", bye`},
+			Timestamp: base + int64(i),
+			Value:     float64(i) + 0.25,
+		})
+	}
+	return all
+}
+
+func TestParse(t *testing.T) {
+	for name, want := range map[string]Format{"csv": CSV, "NDJSON": NDJSON, "jsonl": NDJSON} {
+		f, err := Parse(name)
+		require.NoError(t, err)
+		assert.Equal(t, want, f)
+	}
+	_, err := Parse("xml")
+	assert.ErrorIs(t, err, ErrUnknownFormat)
+
+	f, err := FromPath("/tmp/export.CSV")
+	require.NoError(t, err)
+	assert.Equal(t, CSV, f)
+	assert.Equal(t, ContentTypeNDJSON, NDJSON.ContentType())
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, f := range []Format{CSV, NDJSON} {
+		t.Run(string(f), func(t *testing.T) {
+			written := append(samples(3), domain.Sample{Name: "load1", Timestamp: base, Value: 0.5})
+
+			var buf bytes.Buffer
+			sw := NewSampleWriter(&buf, f)
+			for _, s := range written {
+				require.NoError(t, sw.Write(s))
+			}
+			require.NoError(t, sw.Flush())
+
+			var read []domain.Sample
+			sr := NewSampleReader(&buf, f)
+			for {
+				s, err := sr.Read()
+				if err != nil {
+					require.ErrorIs(t, err, io.EOF)
+					break
+				}
+				read = append(read, s)
+			}
+			assert.Equal(t, written, read)
+		})
+	}
+}
+
+func TestSampleReader_CSV(t *testing.T) {
+	input := "\ufeffvalue,timestamp,name\n" +
+		"1.5,1722441990,load1\n" +
+		"oops,1722441991,load1\n" +
+		"2.5,1722441992,load1\n"
+	sr := NewSampleReader(strings.NewReader(input), CSV)
+
+	s, err := sr.Read()
+	require.NoError(t, err, "Columns may come in any order and labels is optional")
+	assert.Equal(t, domain.Sample{Name: "load1", Timestamp: base, Value: 1.5}, s)
+
+	_, err = sr.Read()
+	assert.ErrorIs(t, err, ErrInvalidRow)
+	assert.ErrorContains(t, err, "line 3")
+
+	s, err = sr.Read()
+	require.NoError(t, err, "Reading goes on after an invalid row")
+	assert.Equal(t, 2.5, s.Value)
+	assert.Equal(t, 4, sr.Line())
+
+	// A bad header ends the file rather than turning every row into one
+	sr = NewSampleReader(strings.NewReader("time,name,value\n1722441990,load1,1\n1722441991,load1,2\n"), CSV)
+	_, err = sr.Read()
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+	assert.NotErrorIs(t, err, ErrInvalidRow)
+	assert.ErrorContains(t, err, "no timestamp column")
+	_, err = sr.Read()
+	assert.ErrorIs(t, err, ErrInvalidHeader, "Later reads should not take a row for the header")
+}
+
+func TestExport(t *testing.T) {
+	store := newStore(t)
+	_, err := store.StoreSamples(context.Background(), samples(2500))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	query := domain.Query{Start: base + 100, End: base + 2199}
+	written, err := Export(context.Background(), store, query, &buf, CSV)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2100), written, "Every page should be exported")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2101)
+	assert.Equal(t, "timestamp,name,value,labels", lines[0])
+	assert.Equal(t, `1722442090,cpu_load,100.25,"{""host"":""web-1"",""note"":""say \""hi\"", bye""}"`, lines[1])
+
+	// An empty range still names its columns
+	buf.Reset()
+	written, err = Export(context.Background(), store, domain.Query{Start: 1, End: 2}, &buf, CSV)
+	require.NoError(t, err)
+	assert.Zero(t, written)
+	assert.Equal(t, "timestamp,name,value,labels\n", buf.String())
+}
+
+func TestEachMetric(t *testing.T) {
+	store := newStore(t)
+	metrics := make([]domain.Metric, 0, 25)
+	for i := 0; i < 25; i++ {
+		metrics = append(metrics, domain.Metric{Timestamp: base + int64(i), CPULoad: float64(i) + 0.5, Concurrency: i, Labels: domain.Labels{"host": "web-1"}})
+	}
+	_, err := store.StoreMetrics(context.Background(), metrics)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	mw := NewMetricWriter(&buf, CSV)
+	query := domain.Query{Start: base, End: base + 100, Descending: true, Offset: 2, Limit: 12}
+	err = EachMetric(context.Background(), store, query, 5, mw.Write)
+	require.NoError(t, err)
+	require.NoError(t, mw.Flush())
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 13, "Limit should cap the rows over every page")
+	assert.Equal(t, "timestamp,cpu_load,concurrency,labels", lines[0])
+	assert.Equal(t, `1722442012,22.5,22,"{""host"":""web-1""}"`, lines[1], "Offset should only skip rows of the first page")
+	assert.Equal(t, `1722442001,11.5,11,"{""host"":""web-1""}"`, lines[12])
+
+	buf.Reset()
+	mw = NewMetricWriter(&buf, NDJSON)
+	require.NoError(t, mw.Write(metrics[0]))
+	require.NoError(t, mw.Flush())
+	assert.JSONEq(t, `{"timestamp":1722441990,"cpu_load":0.5,"concurrency":0,"labels":{"host":"web-1"}}`, buf.String())
+}
+
+func TestImport(t *testing.T) {
+	store := newStore(t)
+	ctx := context.Background()
+	_, err := store.StoreSamples(ctx, []domain.Sample{{Name: "load1", Timestamp: base, Value: 1}})
+	require.NoError(t, err)
+
+	input := `{"name":"load1","timestamp":1722441990,"value":1}
+{"name":"load1","timestamp":1722441991,"value":2}
+
+{"name":"load1","timestamp":1722441991,"value":3}
+{"name":"load1","timestamp":-5,"value":4}
+not json
+{"name":"load1","labels":{"host":"a"},"timestamp":1722441991,"value":5}
+`
+	var rejected []int
+	opts := ImportOptions{BatchSize: 3, DryRun: true, OnReject: func(line int, err error) { rejected = append(rejected, line) }}
+
+	result, err := Import(ctx, store, strings.NewReader(input), NDJSON, opts)
+	require.NoError(t, err)
+	assert.Equal(t, ImportResult{Read: 6, Invalid: 2, Duplicates: 1, Existing: 1, Stored: 2}, result, "A dry run counts what the store already has")
+	assert.Equal(t, []int{5, 6}, rejected)
+	count, _ := store.CountSamples(ctx, domain.Query{Start: 0, End: base + 10})
+	assert.Equal(t, int64(1), count, "A dry run writes nothing")
+
+	opts.DryRun = false
+	result, err = Import(ctx, store, strings.NewReader(input), NDJSON, opts)
+	require.NoError(t, err)
+	assert.Equal(t, ImportResult{Read: 6, Invalid: 2, Duplicates: 1, Existing: 1, Stored: 2}, result)
+	count, _ = store.CountSamples(ctx, domain.Query{Start: 0, End: base + 10})
+	assert.Equal(t, int64(3), count)
+
+	// The first row of a repeated series and timestamp wins
+	stored, _ := store.QuerySamples(ctx, domain.Query{Selector: domain.SeriesSelector{Name: "load1", Matchers: []domain.LabelMatcher{{Name: "host", Type: domain.MatchEqual, Value: ""}}}, Start: base + 1, End: base + 1})
+	require.Len(t, stored, 1)
+	assert.Equal(t, 2.0, stored[0].Value)
+
+	// Across batches the store refuses the repeat
+	store = newStore(t)
+	opts.BatchSize = 1
+	result, err = Import(ctx, store, strings.NewReader(input), NDJSON, opts)
+	require.NoError(t, err)
+	assert.Equal(t, ImportResult{Read: 6, Invalid: 2, Existing: 1, Stored: 3}, result)
+	stored, _ = store.QuerySamples(ctx, domain.Query{Selector: domain.SeriesSelector{Name: "load1", Matchers: []domain.LabelMatcher{{Name: "host", Type: domain.MatchEqual, Value: ""}}}, Start: base + 1, End: base + 1})
+	require.Len(t, stored, 1)
+	assert.Equal(t, 2.0, stored[0].Value)
+}
+
+func TestImport_StoreFailure(t *testing.T) {
+	store := newStore(t)
+	require.NoError(t, store.Close())
+	failing := &failingStore{MetricStore: store}
+
+	input := "timestamp,name,value\n1722441990,load1,1\n1722441991,load1,2\n"
+	result, err := Import(context.Background(), failing, strings.NewReader(input), CSV, ImportOptions{})
+	assert.ErrorContains(t, err, "line 3")
+	assert.Equal(t, int64(2), result.Failed)
+}
+
+type failingStore struct {
+	domain.MetricStore
+}
+
+func (s *failingStore) StoreSamples(ctx context.Context, samples []domain.Sample) (domain.BatchResult, error) {
+	return domain.BatchResult{}, errors.New("disk I/O error")
+}
@@ -0,0 +1,242 @@
+package format
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"metrics-app/internal/domain"
+)
+
+// DefaultPageSize is how many rows are read from a store at a time.
+const DefaultPageSize = 1000
+
+// EachSample calls fn with the samples of query in query order, reading
+// them from store one page of pageSize at a time. Offset and Cursor pick the
+// first sample as usual; Limit, when positive, is the most samples read in
+// all.
+func EachSample(ctx context.Context, store domain.MetricStore, query domain.Query, pageSize int, fn func(domain.Sample) error) error {
+	return each(ctx, store.QuerySamples, domain.SampleCursor, query, pageSize, fn)
+}
+
+// EachMetric is the counterpart of EachSample for the Metric view.
+func EachMetric(ctx context.Context, store domain.MetricStore, query domain.Query, pageSize int, fn func(domain.Metric) error) error {
+	return each(ctx, store.QueryMetrics, domain.MetricCursor, query, pageSize, fn)
+}
+
+func each[T any](ctx context.Context, fetch func(context.Context, domain.Query) ([]T, error), position func(T) domain.Cursor,
+	query domain.Query, pageSize int, fn func(T) error) error {
+
+	remaining := query.Limit
+	for {
+		query.Limit = pageSize
+		if remaining > 0 {
+			query.Limit = min(pageSize, remaining)
+		}
+		page, err := fetch(ctx, query)
+		if err != nil {
+			return err
+		}
+		for _, row := range page {
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+		if remaining > 0 {
+			if remaining -= len(page); remaining == 0 {
+				return nil
+			}
+		}
+		if len(page) < query.Limit {
+			return nil
+		}
+		last := position(page[len(page)-1])
+		query.Cursor, query.Offset = &last, 0
+	}
+}
+
+// Export writes every sample of query to w and reports how many it wrote.
+func Export(ctx context.Context, store domain.MetricStore, query domain.Query, w io.Writer, f Format) (int64, error) {
+	sw := NewSampleWriter(w, f)
+	if err := sw.WriteHeader(); err != nil {
+		return 0, err
+	}
+
+	var written int64
+	err := EachSample(ctx, store, query, DefaultPageSize, func(s domain.Sample) error {
+		written++
+		return sw.Write(s)
+	})
+	if err != nil {
+		return written, err
+	}
+	return written, sw.Flush()
+}
+
+// ImportOptions tune Import. OnReject, when set, is called with the line and
+// the reason of every row that is not stored, duplicates aside.
+type ImportOptions struct {
+	BatchSize int
+	DryRun    bool
+	OnReject  func(line int, err error)
+}
+
+// ImportResult counts the rows of an import. Every row read is either
+// Invalid, a Duplicate of an earlier row of its batch, Existing in the
+// store, Stored, or Failed. A row repeating one of an earlier batch is
+// Existing, since that one was stored first. In a dry run, rows that would
+// be written count as Stored, and rows the store already has as Existing.
+type ImportResult struct {
+	Read       int64 `json:"read"`
+	Invalid    int64 `json:"invalid"`
+	Duplicates int64 `json:"duplicates"`
+	Existing   int64 `json:"existing"`
+	Stored     int64 `json:"stored"`
+	Failed     int64 `json:"failed"`
+}
+
+// Import reads samples from r, validates them, drops repeated series and
+// timestamps but the first, and stores the rest in batches. Only one batch
+// is held in memory: repeats within it are dropped here, and the store
+// refuses later ones. It stops at the first batch the store fails to write
+// as a whole.
+func Import(ctx context.Context, store domain.MetricStore, r io.Reader, f Format, opts ImportOptions) (ImportResult, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultPageSize
+	}
+	reject := func(line int, err error) {
+		if opts.OnReject != nil {
+			opts.OnReject(line, err)
+		}
+	}
+
+	var (
+		result ImportResult
+		batch  = make([]domain.Sample, 0, opts.BatchSize)
+		lines  = make([]int, 0, opts.BatchSize)
+		seen   = make(map[string]struct{}, opts.BatchSize)
+	)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		defer func() {
+			batch, lines = batch[:0], lines[:0]
+			clear(seen)
+		}()
+		if opts.DryRun {
+			existing, err := countExisting(ctx, store, batch)
+			if err != nil {
+				result.Failed += int64(len(batch))
+				return fmt.Errorf("checking the rows up to line %d: %w", lines[len(lines)-1], err)
+			}
+			result.Existing += existing
+			result.Stored += int64(len(batch)) - existing
+			return nil
+		}
+
+		written, err := store.StoreSamples(ctx, batch)
+		if err != nil {
+			result.Failed += int64(len(batch))
+			return fmt.Errorf("storing the rows up to line %d: %w", lines[len(lines)-1], err)
+		}
+		result.Stored += int64(written.Stored)
+		for _, rejected := range written.Rejected {
+			if errors.Is(rejected.Err, domain.ErrDuplicateMetric) {
+				result.Existing++
+				continue
+			}
+			result.Failed++
+			reject(lines[rejected.Index], rejected.Err)
+		}
+		return nil
+	}
+
+	sr := NewSampleReader(r, f)
+	for {
+		s, err := sr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, ErrInvalidRow) {
+			result.Read++
+			result.Invalid++
+			reject(sr.Line(), err)
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		result.Read++
+
+		if err := s.Validate(); err != nil {
+			result.Invalid++
+			reject(sr.Line(), err)
+			continue
+		}
+
+		key := s.Name + s.Labels.Key() + strconv.FormatInt(s.Timestamp, 10)
+		if _, ok := seen[key]; ok {
+			result.Duplicates++
+			continue
+		}
+		seen[key] = struct{}{}
+
+		batch = append(batch, s)
+		lines = append(lines, sr.Line())
+		if len(batch) == opts.BatchSize {
+			if err := flush(); err != nil {
+				return result, err
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+	}
+	return result, flush()
+}
+
+// countExisting reports how many samples of batch store already has. Each
+// series of the batch is read back over the batch's time range only.
+func countExisting(ctx context.Context, store domain.MetricStore, batch []domain.Sample) (int64, error) {
+	type span struct {
+		sample     domain.Sample
+		start, end int64
+		timestamps map[int64]struct{}
+	}
+	series := make(map[string]*span)
+	for _, s := range batch {
+		key := s.Name + s.Labels.Key()
+		sp, ok := series[key]
+		if !ok {
+			sp = &span{sample: s, start: s.Timestamp, end: s.Timestamp, timestamps: make(map[int64]struct{})}
+			series[key] = sp
+		}
+		sp.start, sp.end = min(sp.start, s.Timestamp), max(sp.end, s.Timestamp)
+		sp.timestamps[s.Timestamp] = struct{}{}
+	}
+
+	var existing int64
+	for _, sp := range series {
+		// Equal matchers also select series with more labels, which the
+		// label key comparison leaves out.
+		selector := domain.SeriesSelector{Name: sp.sample.Name}
+		for name, value := range sp.sample.Labels {
+			selector.Matchers = append(selector.Matchers, domain.LabelMatcher{Name: name, Type: domain.MatchEqual, Value: value})
+		}
+		labelsKey := sp.sample.Labels.Key()
+		query := domain.Query{Selector: selector, Start: sp.start, End: sp.end}
+		err := EachSample(ctx, store, query, DefaultPageSize, func(stored domain.Sample) error {
+			if _, ok := sp.timestamps[stored.Timestamp]; ok && stored.Labels.Key() == labelsKey {
+				existing++
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return existing, nil
+}
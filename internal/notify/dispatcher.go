@@ -0,0 +1,211 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"metrics-app/internal/alerting"
+	"metrics-app/internal/domain"
+	"metrics-app/internal/util"
+)
+
+// duePage is how many notifications one delivery pass reads at a time.
+const duePage = 100
+
+// Dispatcher posts alert notifications to receivers. Notify only writes
+// them to the outbox; Run delivers them and retries failures with
+// exponential backoff, starting at InitialBackoff and doubling up to
+// MaxBackoff. A notification is dropped after MaxAttempts or when the
+// receiver rejects it with a 4xx status other than 408 and 429.
+type Dispatcher struct {
+	Interval       time.Duration
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	MaxAttempts    int
+
+	receivers map[string]Receiver
+	outbox    Outbox
+	client    *http.Client
+	logger    *util.MetricsLogger
+	now       func() time.Time
+	wake      chan struct{}
+}
+
+func NewDispatcher(outbox Outbox, logger *util.MetricsLogger, receivers []Receiver) *Dispatcher {
+	byName := make(map[string]Receiver, len(receivers))
+	for _, r := range receivers {
+		byName[r.Name] = r
+	}
+	return &Dispatcher{
+		Interval:       time.Second,
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Minute,
+		MaxAttempts:    10,
+		receivers:      byName,
+		outbox:         outbox,
+		client:         &http.Client{Timeout: 10 * time.Second},
+		logger:         logger,
+		now:            time.Now,
+		wake:           make(chan struct{}, 1),
+	}
+}
+
+// Notify queues one notification of alerts per receiver. It implements
+// alerting.Notifier.
+func (d *Dispatcher) Notify(ctx context.Context, alerts []alerting.Alert) {
+	if len(alerts) == 0 || len(d.receivers) == 0 {
+		return
+	}
+
+	now := d.now().Unix()
+	notifications := make([]domain.Notification, 0, len(d.receivers))
+	for _, r := range d.receivers {
+		payload, err := r.Render(alerts)
+		if err != nil {
+			d.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while rendering notification for ", r.Name, ". Err - ", err)
+			continue
+		}
+		notifications = append(notifications, domain.Notification{Receiver: r.Name, Payload: payload, CreatedAt: now, NextAttempt: now})
+	}
+
+	if err := d.outbox.EnqueueNotifications(ctx, notifications); err != nil {
+		d.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while queueing notifications. Err - ", err)
+		return
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers due notifications immediately, including those left over
+// from before a restart, and then whenever Notify queues new ones or
+// Interval passes, until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context) {
+	d.logger.LogEvent(util.LOG_LEVEL_INFO, "Webhook notifications enabled for ", len(d.receivers), " receivers")
+
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+
+	for {
+		d.Deliver(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// Deliver makes one attempt at every due notification and reports how many
+// were delivered.
+func (d *Dispatcher) Deliver(ctx context.Context) (int, error) {
+	delivered := 0
+	attempted := make(map[int64]bool)
+	for {
+		due, err := d.outbox.DueNotifications(ctx, d.now().Unix(), duePage)
+		if err != nil {
+			d.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while reading the notification outbox. Err - ", err)
+			return delivered, err
+		}
+
+		progressed := false
+		for _, n := range due {
+			// A notification the receiver failed may be due again at once.
+			if attempted[n.ID] {
+				continue
+			}
+			attempted[n.ID] = true
+			progressed = true
+
+			if d.attempt(ctx, n) {
+				delivered++
+			}
+			if ctx.Err() != nil {
+				return delivered, ctx.Err()
+			}
+		}
+		if !progressed || len(due) < duePage {
+			return delivered, nil
+		}
+	}
+}
+
+// attempt posts n once and updates the outbox with the outcome.
+func (d *Dispatcher) attempt(ctx context.Context, n domain.Notification) bool {
+	r, ok := d.receivers[n.Receiver]
+	if !ok {
+		d.logger.LogEvent(util.LOG_LEVEL_WARN, "Dropping notification ", n.ID, " for unknown receiver ", n.Receiver)
+		d.outbox.DeleteNotification(ctx, n.ID)
+		return false
+	}
+
+	retry, err := d.post(ctx, r, n)
+	if err == nil {
+		if err := d.outbox.DeleteNotification(ctx, n.ID); err != nil {
+			d.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while removing delivered notification ", n.ID, ". Err - ", err)
+		}
+		return true
+	}
+
+	n.Attempts++
+	if !retry || n.Attempts >= d.MaxAttempts {
+		d.logger.LogEvent(util.LOG_LEVEL_ERROR, "Giving up notification ", n.ID, " to ", r.Name, " after ", n.Attempts, " attempts. Err - ", err)
+		d.outbox.DeleteNotification(ctx, n.ID)
+		return false
+	}
+
+	next := d.now().Add(d.backoff(n.Attempts)).Unix()
+	d.logger.LogEvent(util.LOG_LEVEL_WARN, "Notification ", n.ID, " to ", r.Name, " failed, retrying at ", next, ". Err - ", err)
+	if err := d.outbox.RescheduleNotification(ctx, n.ID, n.Attempts, next, err.Error()); err != nil {
+		d.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while rescheduling notification ", n.ID, ". Err - ", err)
+	}
+	return false
+}
+
+// backoff is the delay after the given number of failed attempts.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.InitialBackoff
+	for i := 1; i < attempts && delay < d.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, d.MaxBackoff)
+}
+
+// post sends n to r. It reports whether a failure is worth retrying.
+func (d *Dispatcher) post(ctx context.Context, r Receiver, n domain.Notification) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.URL, bytes.NewReader(n.Payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "metrics-app")
+	// Retries carry the same delivery id so receivers can drop duplicates.
+	req.Header.Set("X-Metrics-Delivery", strconv.FormatInt(n.ID, 10))
+	if r.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(r.Secret, n.Payload))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return true, fmt.Errorf("receiver responded %s", resp.Status)
+	}
+	return false, fmt.Errorf("receiver rejected the notification with %s", resp.Status)
+}
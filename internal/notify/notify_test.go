@@ -0,0 +1,219 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"metrics-app/internal/alerting"
+	"metrics-app/internal/domain"
+	"metrics-app/internal/repository"
+	"metrics-app/internal/util"
+)
+
+var firing = alerting.Alert{
+	Rule:     "HighCPU",
+	Expr:     "avg cpu_load over 5m > 85",
+	Labels:   domain.Labels{"host": "web-1", "severity": "page"},
+	State:    alerting.StateFiring,
+	Value:    91.5,
+	ActiveAt: 1722441870,
+	FiredAt:  1722441990,
+}
+
+// receiver records the requests of a test webhook endpoint and answers
+// with the queued status codes, then 200.
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	bodies   [][]byte
+	headers  []http.Header
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.bodies = append(rc.bodies, body)
+	rc.headers = append(rc.headers, r.Header.Clone())
+	if len(rc.statuses) > 0 {
+		w.WriteHeader(rc.statuses[0])
+		rc.statuses = rc.statuses[1:]
+	}
+}
+
+func (rc *receiver) requests() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return len(rc.bodies)
+}
+
+func TestParseReceivers(t *testing.T) {
+	receivers, err := ParseReceivers([]byte(`{"rules": [], "receivers": [
+		{"name": "ops", "url": "https://hooks.example.com/alerts", "secret": "s3cret"},
+		{"name": "am", "url": "http://localhost:9093/hook", "format": "alertmanager"}
+	]}`))
+	require.NoError(t, err)
+	require.Len(t, receivers, 2)
+	assert.Equal(t, FormatDefault, receivers[0].Format)
+	assert.Equal(t, FormatAlertmanager, receivers[1].Format)
+
+	for _, data := range []string{
+		`{"receivers": [{"url": "https://hooks.example.com"}]}`,
+		`{"receivers": [{"name": "a", "url": "https://a.example.com"}, {"name": "a", "url": "https://b.example.com"}]}`,
+		`{"receivers": [{"name": "a", "url": "hooks.example.com/alerts"}]}`,
+		`{"receivers": [{"name": "a", "url": "ftp://hooks.example.com"}]}`,
+		`{"receivers": [{"name": "a", "url": "https://hooks.example.com", "format": "slack"}]}`,
+	} {
+		_, err := ParseReceivers([]byte(data))
+		assert.ErrorIs(t, err, ErrInvalidReceiver, data)
+	}
+}
+
+func TestReceiver_Render(t *testing.T) {
+	resolved := firing
+	resolved.Labels = domain.Labels{"host": "web-2", "severity": "page"}
+	resolved.State = alerting.StateResolved
+	resolved.ResolvedAt = 1722442050
+
+	data, err := Receiver{Name: "ops", Format: FormatDefault}.Render([]alerting.Alert{firing})
+	require.NoError(t, err)
+	var msg Message
+	require.NoError(t, json.Unmarshal(data, &msg))
+	assert.Equal(t, Message{Version: "1", Receiver: "ops", Status: "firing", Alerts: []alerting.Alert{firing}}, msg)
+
+	data, err = Receiver{Name: "am", Format: FormatAlertmanager}.Render([]alerting.Alert{firing, resolved})
+	require.NoError(t, err)
+	var am AlertmanagerMessage
+	require.NoError(t, json.Unmarshal(data, &am))
+	assert.Equal(t, "4", am.Version)
+	assert.Equal(t, "firing", am.Status, "A group is firing while any alert is")
+	assert.Equal(t, domain.Labels{"alertname": "HighCPU", "severity": "page"}, am.CommonLabels)
+	require.Len(t, am.Alerts, 2)
+	assert.Equal(t, domain.Labels{"alertname": "HighCPU", "host": "web-1", "severity": "page"}, am.Alerts[0].Labels)
+	assert.Equal(t, "91.5", am.Alerts[0].Annotations["value"])
+	assert.Equal(t, time.Unix(1722441870, 0).UTC(), am.Alerts[0].StartsAt)
+	assert.True(t, am.Alerts[0].EndsAt.IsZero())
+	assert.Equal(t, "resolved", am.Alerts[1].Status)
+	assert.Equal(t, time.Unix(1722442050, 0).UTC(), am.Alerts[1].EndsAt)
+	assert.Len(t, am.Alerts[0].Fingerprint, 16)
+	assert.NotEqual(t, am.Alerts[0].Fingerprint, am.Alerts[1].Fingerprint)
+}
+
+func TestDispatcher_RetriesWithBackoff(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	now := time.Unix(1722441990, 0)
+	outbox := NewMemoryOutbox()
+	d := NewDispatcher(outbox, &util.MetricsLogger{}, []Receiver{{Name: "ops", URL: server.URL, Secret: "s3cret", Format: FormatDefault}})
+	d.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	d.Notify(ctx, []alerting.Alert{firing})
+
+	delivered, err := d.Deliver(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, delivered)
+	pending, _ := outbox.DueNotifications(ctx, now.Add(time.Hour).Unix(), 10)
+	require.Len(t, pending, 1)
+	assert.Equal(t, 1, pending[0].Attempts)
+	assert.Equal(t, now.Add(time.Second).Unix(), pending[0].NextAttempt)
+	assert.Contains(t, pending[0].LastError, "503")
+
+	delivered, _ = d.Deliver(ctx)
+	assert.Equal(t, 0, delivered)
+	assert.Equal(t, 1, rc.requests(), "Nothing is due before the backoff has passed")
+
+	now = now.Add(time.Second)
+	d.Deliver(ctx)
+	pending, _ = outbox.DueNotifications(ctx, now.Add(time.Hour).Unix(), 10)
+	require.Len(t, pending, 1)
+	assert.Equal(t, now.Add(2*time.Second).Unix(), pending[0].NextAttempt, "The backoff should double")
+
+	now = now.Add(2 * time.Second)
+	delivered, _ = d.Deliver(ctx)
+	assert.Equal(t, 1, delivered)
+	pending, _ = outbox.DueNotifications(ctx, now.Add(time.Hour).Unix(), 10)
+	assert.Empty(t, pending)
+
+	require.Equal(t, 3, rc.requests())
+	for i, headers := range rc.headers {
+		assert.Equal(t, rc.bodies[0], rc.bodies[i], "Retries should resend the same payload")
+		assert.Equal(t, "1", headers.Get("X-Metrics-Delivery"))
+		assert.True(t, Verify("s3cret", rc.bodies[i], headers.Get(SignatureHeader)))
+	}
+	assert.False(t, Verify("other", rc.bodies[0], rc.headers[0].Get(SignatureHeader)))
+}
+
+func TestDispatcher_GivesUp(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusBadRequest, http.StatusInternalServerError, http.StatusInternalServerError}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	now := time.Unix(1722441990, 0)
+	outbox := NewMemoryOutbox()
+	d := NewDispatcher(outbox, &util.MetricsLogger{}, []Receiver{{Name: "ops", URL: server.URL, Format: FormatDefault}})
+	d.now = func() time.Time { return now }
+	d.MaxAttempts = 2
+	ctx := context.Background()
+
+	// A 4xx response is final
+	d.Notify(ctx, []alerting.Alert{firing})
+	d.Deliver(ctx)
+	pending, _ := outbox.DueNotifications(ctx, now.Add(time.Hour).Unix(), 10)
+	assert.Empty(t, pending)
+	assert.Empty(t, rc.headers[0].Get(SignatureHeader), "Receivers without a secret are not signed")
+
+	// Server errors are retried up to MaxAttempts
+	d.Notify(ctx, []alerting.Alert{firing})
+	d.Deliver(ctx)
+	now = now.Add(time.Minute)
+	d.Deliver(ctx)
+	pending, _ = outbox.DueNotifications(ctx, now.Add(time.Hour).Unix(), 10)
+	assert.Empty(t, pending)
+	assert.Equal(t, 3, rc.requests())
+}
+
+func TestDispatcher_OutboxSurvivesRestart(t *testing.T) {
+	rc := &receiver{}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "outbox.db")
+	receivers := []Receiver{{Name: "ops", URL: server.URL, Format: FormatDefault}}
+	ctx := context.Background()
+
+	store := repository.NewSQLiteStore(path)
+	require.NoError(t, store.Init())
+	NewDispatcher(store, &util.MetricsLogger{}, receivers).Notify(ctx, []alerting.Alert{firing})
+	require.NoError(t, store.Close())
+	assert.Equal(t, 0, rc.requests())
+
+	store = repository.NewSQLiteStore(path)
+	require.NoError(t, store.Init())
+	defer store.Close()
+
+	delivered, err := NewDispatcher(store, &util.MetricsLogger{}, receivers).Deliver(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, delivered)
+
+	var msg Message
+	require.NoError(t, json.Unmarshal(rc.bodies[0], &msg))
+	assert.Equal(t, []alerting.Alert{firing}, msg.Alerts)
+
+	pending, err := store.DueNotifications(ctx, time.Now().Add(time.Hour).Unix(), 10)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+}
@@ -0,0 +1,85 @@
+package notify
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"metrics-app/internal/domain"
+)
+
+// Outbox keeps notifications until they are delivered or given up. The
+// SQLite store implements it so notifications survive a restart.
+type Outbox interface {
+	EnqueueNotifications(ctx context.Context, notifications []domain.Notification) error
+	DueNotifications(ctx context.Context, now int64, limit int) ([]domain.Notification, error)
+	RescheduleNotification(ctx context.Context, id int64, attempts int, nextAttempt int64, lastError string) error
+	DeleteNotification(ctx context.Context, id int64) error
+}
+
+// MemoryOutbox is an Outbox for stores without one. Pending notifications
+// are lost on restart.
+type MemoryOutbox struct {
+	mu            sync.Mutex
+	lastID        int64
+	notifications map[int64]domain.Notification
+}
+
+func NewMemoryOutbox() *MemoryOutbox {
+	return &MemoryOutbox{notifications: make(map[int64]domain.Notification)}
+}
+
+func (o *MemoryOutbox) EnqueueNotifications(ctx context.Context, notifications []domain.Notification) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, n := range notifications {
+		o.lastID++
+		n.ID = o.lastID
+		o.notifications[n.ID] = n
+	}
+	return nil
+}
+
+func (o *MemoryOutbox) DueNotifications(ctx context.Context, now int64, limit int) ([]domain.Notification, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var due []domain.Notification
+	for _, n := range o.notifications {
+		if n.NextAttempt <= now {
+			due = append(due, n)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].NextAttempt != due[j].NextAttempt {
+			return due[i].NextAttempt < due[j].NextAttempt
+		}
+		return due[i].ID < due[j].ID
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
+
+func (o *MemoryOutbox) RescheduleNotification(ctx context.Context, id int64, attempts int, nextAttempt int64, lastError string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if n, ok := o.notifications[id]; ok {
+		n.Attempts = attempts
+		n.NextAttempt = nextAttempt
+		n.LastError = lastError
+		o.notifications[id] = n
+	}
+	return nil
+}
+
+func (o *MemoryOutbox) DeleteNotification(ctx context.Context, id int64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	delete(o.notifications, id)
+	return nil
+}
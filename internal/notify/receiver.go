@@ -0,0 +1,203 @@
+package notify
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"metrics-app/internal/alerting"
+	"metrics-app/internal/domain"
+)
+
+// Payload formats of a receiver.
+const (
+	FormatDefault      = "default"
+	FormatAlertmanager = "alertmanager"
+)
+
+// SignatureHeader carries the hex HMAC-SHA256 of the request body, keyed
+// with the secret of the receiver, as "sha256=<hex>".
+const SignatureHeader = "X-Metrics-Signature-256"
+
+var ErrInvalidReceiver = errors.New("invalid receiver")
+
+// Receiver is a webhook endpoint alert notifications are posted to.
+type Receiver struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+	Format string `json:"format,omitempty"`
+}
+
+// receiverFile is read from the alert rules file, next to the rules:
+//
+//	{"receivers": [{"name": "ops", "url": "https://hooks.example.com/alerts", "secret": "s3cret"}]}
+type receiverFile struct {
+	Receivers []Receiver `json:"receivers"`
+}
+
+// LoadReceivers reads and validates the receivers of a rules file.
+func LoadReceivers(path string) ([]Receiver, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseReceivers(data)
+}
+
+// ParseReceivers validates receivers. Names must be unique and URLs
+// absolute http or https URLs.
+func ParseReceivers(data []byte) ([]Receiver, error) {
+	var file receiverFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidReceiver, err)
+	}
+
+	names := make(map[string]bool, len(file.Receivers))
+	for i := range file.Receivers {
+		r := &file.Receivers[i]
+		if r.Name == "" || names[r.Name] {
+			return nil, fmt.Errorf("%w: receiver %d needs a unique name", ErrInvalidReceiver, i)
+		}
+		names[r.Name] = true
+
+		u, err := url.Parse(r.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%w %q: url must be an absolute http or https URL", ErrInvalidReceiver, r.Name)
+		}
+		switch r.Format {
+		case "":
+			r.Format = FormatDefault
+		case FormatDefault, FormatAlertmanager:
+		default:
+			return nil, fmt.Errorf("%w %q: format must be %q or %q", ErrInvalidReceiver, r.Name, FormatDefault, FormatAlertmanager)
+		}
+	}
+	return file.Receivers, nil
+}
+
+// Sign returns the value of SignatureHeader for body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is the signature of body. Receivers
+// written in Go can use it to check requests.
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+// Message is the default payload: the changed alerts as listed by
+// GET /alerts.
+type Message struct {
+	Version  string           `json:"version"`
+	Receiver string           `json:"receiver"`
+	Status   string           `json:"status"`
+	Alerts   []alerting.Alert `json:"alerts"`
+}
+
+// AlertmanagerMessage follows the webhook payload of Prometheus
+// Alertmanager, version 4, so existing receivers can consume it.
+type AlertmanagerMessage struct {
+	Version           string              `json:"version"`
+	GroupKey          string              `json:"groupKey"`
+	TruncatedAlerts   int                 `json:"truncatedAlerts"`
+	Status            string              `json:"status"`
+	Receiver          string              `json:"receiver"`
+	GroupLabels       domain.Labels       `json:"groupLabels"`
+	CommonLabels      domain.Labels       `json:"commonLabels"`
+	CommonAnnotations domain.Labels       `json:"commonAnnotations"`
+	ExternalURL       string              `json:"externalURL"`
+	Alerts            []AlertmanagerAlert `json:"alerts"`
+}
+
+type AlertmanagerAlert struct {
+	Status       string        `json:"status"`
+	Labels       domain.Labels `json:"labels"`
+	Annotations  domain.Labels `json:"annotations"`
+	StartsAt     time.Time     `json:"startsAt"`
+	EndsAt       time.Time     `json:"endsAt"`
+	GeneratorURL string        `json:"generatorURL"`
+	Fingerprint  string        `json:"fingerprint"`
+}
+
+// status is "firing" while any of alerts is firing, like in Alertmanager.
+func status(alerts []alerting.Alert) string {
+	for _, alert := range alerts {
+		if alert.State == alerting.StateFiring {
+			return string(alerting.StateFiring)
+		}
+	}
+	return string(alerting.StateResolved)
+}
+
+// Render builds the payload of alerts for r.
+func (r Receiver) Render(alerts []alerting.Alert) ([]byte, error) {
+	if r.Format != FormatAlertmanager {
+		return json.Marshal(Message{Version: "1", Receiver: r.Name, Status: status(alerts), Alerts: alerts})
+	}
+
+	msg := AlertmanagerMessage{
+		Version:           "4",
+		GroupKey:          "{}",
+		Status:            status(alerts),
+		Receiver:          r.Name,
+		GroupLabels:       domain.Labels{},
+		CommonAnnotations: domain.Labels{},
+		Alerts:            make([]AlertmanagerAlert, 0, len(alerts)),
+	}
+	for i, alert := range alerts {
+		labels := domain.Labels{"alertname": alert.Rule}
+		for name, value := range alert.Labels {
+			labels[name] = value
+		}
+
+		am := AlertmanagerAlert{
+			Status: string(alert.State),
+			Labels: labels,
+			Annotations: domain.Labels{
+				"expr":  alert.Expr,
+				"value": strconv.FormatFloat(alert.Value, 'g', -1, 64),
+			},
+			StartsAt:    time.Unix(alert.ActiveAt, 0).UTC(),
+			Fingerprint: fingerprint(labels),
+		}
+		if alert.State == alerting.StateResolved {
+			am.EndsAt = time.Unix(alert.ResolvedAt, 0).UTC()
+		}
+		msg.Alerts = append(msg.Alerts, am)
+
+		if i == 0 {
+			msg.CommonLabels = labels
+			continue
+		}
+		msg.CommonLabels = intersect(msg.CommonLabels, labels)
+	}
+	return json.Marshal(msg)
+}
+
+func fingerprint(labels domain.Labels) string {
+	h := fnv.New64a()
+	h.Write([]byte(labels.Key()))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+func intersect(a, b domain.Labels) domain.Labels {
+	common := domain.Labels{}
+	for name, value := range a {
+		if b[name] == value {
+			common[name] = value
+		}
+	}
+	return common
+}
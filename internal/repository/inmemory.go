@@ -0,0 +1,539 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+
+	"metrics-app/internal/domain"
+)
+
+var ErrStoreClosed = errors.New("metric store is closed")
+
+type memSeries struct {
+	name       string
+	labels     domain.Labels
+	labelsKey  string
+	timestamps map[int64]struct{}
+	// latest is the newest sample. Eviction removes the oldest samples
+	// first, so the series is gone before its latest sample is.
+	latest memSample
+}
+
+type memSample struct {
+	series    *memSeries
+	timestamp int64
+	value     float64
+}
+
+// less orders samples the way the SQLite store does: by timestamp, then
+// label set, then metric name.
+func (a memSample) less(b memSample) bool {
+	if a.timestamp != b.timestamp {
+		return a.timestamp < b.timestamp
+	}
+	if a.series.labelsKey != b.series.labelsKey {
+		return a.series.labelsKey < b.series.labelsKey
+	}
+	return a.series.name < b.series.name
+}
+
+// InMemoryStore keeps samples in a slice ordered by timestamp. When capacity
+// is positive the store never holds more than capacity samples (a Metric
+// counts as two): after each write the samples with the oldest timestamps
+// are evicted, one timestamp and label set at a time.
+type InMemoryStore struct {
+	mu       sync.RWMutex
+	series   map[string]*memSeries
+	samples  []memSample
+	capacity int
+	closed   bool
+}
+
+func NewInMemoryStore(capacity int) *InMemoryStore {
+	if capacity < 0 {
+		capacity = 0
+	}
+	return &InMemoryStore{capacity: capacity, series: make(map[string]*memSeries)}
+}
+
+func (s *InMemoryStore) Init() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.series = make(map[string]*memSeries)
+	s.samples = make([]memSample, 0)
+	s.closed = false
+	return nil
+}
+
+func (s *InMemoryStore) StoreMetric(ctx context.Context, metric domain.Metric) error {
+	result, err := s.StoreMetrics(ctx, []domain.Metric{metric})
+	if err != nil {
+		return err
+	}
+	if len(result.Rejected) > 0 {
+		return result.Rejected[0].Err
+	}
+	return nil
+}
+
+func (s *InMemoryStore) StoreMetrics(ctx context.Context, metrics []domain.Metric) (domain.BatchResult, error) {
+	items := make([][]domain.Sample, len(metrics))
+	errs := make([]error, len(metrics))
+	for i, metric := range metrics {
+		if errs[i] = metric.Validate(); errs[i] == nil {
+			items[i] = metric.Samples()
+		}
+	}
+	return s.store(ctx, items, errs)
+}
+
+func (s *InMemoryStore) StoreSamples(ctx context.Context, samples []domain.Sample) (domain.BatchResult, error) {
+	items := make([][]domain.Sample, len(samples))
+	errs := make([]error, len(samples))
+	for i, sample := range samples {
+		if errs[i] = sample.Validate(); errs[i] == nil {
+			items[i] = []domain.Sample{sample}
+		}
+	}
+	return s.store(ctx, items, errs)
+}
+
+// store writes each item, a group of samples that is accepted or rejected as
+// a whole. Everything is checked before the first insert so the batch is
+// applied atomically, mirroring the transactional SQLite store.
+func (s *InMemoryStore) store(ctx context.Context, items [][]domain.Sample, errs []error) (domain.BatchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return domain.BatchResult{}, err
+	}
+
+	var result domain.BatchResult
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return domain.BatchResult{}, ErrStoreClosed
+	}
+
+	type pending struct {
+		key       string
+		sample    domain.Sample
+		labelsKey string
+	}
+	var accepted []pending
+	seen := make(map[string]map[int64]bool)
+
+	for i, item := range items {
+		if errs[i] != nil {
+			result.Rejected = append(result.Rejected, domain.Rejection{Index: i, Err: errs[i]})
+			continue
+		}
+
+		duplicate := false
+		for _, sample := range item {
+			labelsKey := sample.Labels.Key()
+			key := sample.Name + labelsKey
+			if series, ok := s.series[key]; ok {
+				if _, found := series.timestamps[sample.Timestamp]; found {
+					duplicate = true
+				}
+			}
+			if seen[key][sample.Timestamp] {
+				duplicate = true
+			}
+		}
+		if duplicate {
+			result.Rejected = append(result.Rejected, domain.Rejection{Index: i, Err: domain.ErrDuplicateMetric})
+			continue
+		}
+
+		for _, sample := range item {
+			labelsKey := sample.Labels.Key()
+			key := sample.Name + labelsKey
+			if seen[key] == nil {
+				seen[key] = make(map[int64]bool)
+			}
+			seen[key][sample.Timestamp] = true
+			accepted = append(accepted, pending{key: key, sample: sample, labelsKey: labelsKey})
+		}
+		result.Stored++
+	}
+
+	for _, p := range accepted {
+		series, ok := s.series[p.key]
+		if !ok {
+			series = &memSeries{
+				name:       p.sample.Name,
+				labels:     copyLabels(p.sample.Labels),
+				labelsKey:  p.labelsKey,
+				timestamps: make(map[int64]struct{}),
+			}
+			s.series[p.key] = series
+		}
+		series.timestamps[p.sample.Timestamp] = struct{}{}
+		sample := memSample{series: series, timestamp: p.sample.Timestamp, value: p.sample.Value}
+		if sample.timestamp >= series.latest.timestamp {
+			series.latest = sample
+		}
+		s.insert(sample)
+	}
+	s.evict()
+
+	return result, nil
+}
+
+func (s *InMemoryStore) GetMetrics(ctx context.Context, startTime, endTime int64, limit, offset int) ([]domain.Metric, error) {
+	return s.QueryMetrics(ctx, domain.Query{Start: startTime, End: endTime, Limit: limit, Offset: offset})
+}
+
+func (s *InMemoryStore) QueryMetrics(ctx context.Context, q domain.Query) ([]domain.Metric, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	matcher, err := q.Selector.Compile()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+
+	skip := q.Offset
+	var fetchedMetrics []domain.Metric
+
+	s.eachMetric(q, matcher, func(row domain.Metric) bool {
+		if skip > 0 {
+			skip--
+			return true
+		}
+		fetchedMetrics = append(fetchedMetrics, row)
+		return q.Limit <= 0 || len(fetchedMetrics) < q.Limit
+	})
+	return fetchedMetrics, nil
+}
+
+func (s *InMemoryStore) CountMetrics(ctx context.Context, q domain.Query) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	matcher, err := q.Selector.Compile()
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return 0, ErrStoreClosed
+	}
+
+	var count int64
+	s.eachMetric(domain.Query{Start: q.Start, End: q.End}, matcher, func(domain.Metric) bool {
+		count++
+		return true
+	})
+	return count, nil
+}
+
+// eachMetric calls fn with the rows of the Metric view that q selects, in
+// query order, until fn returns false. Offset and Limit are left to fn.
+func (s *InMemoryStore) eachMetric(q domain.Query, matcher *domain.SeriesMatcher, fn func(domain.Metric) bool) {
+	// Samples of one label set at one timestamp are adjacent, so the view is
+	// built by folding runs of cpu_load and concurrency samples.
+	from, to := s.window(cursorBounds(q))
+	runs := s.runs(from, to)
+	for n := range runs {
+		run := runs[n]
+		if q.Descending {
+			run = runs[len(runs)-1-n]
+		}
+		first := s.samples[run[0]]
+		if !q.Continues(domain.Cursor{Timestamp: first.timestamp, Labels: first.series.labelsKey}) {
+			continue
+		}
+		row := domain.Metric{Timestamp: first.timestamp, Labels: copyLabels(first.series.labels)}
+		found := false
+
+		for i := run[0]; i < run[1]; i++ {
+			switch s.samples[i].series.name {
+			case domain.MetricCPULoad:
+				row.CPULoad = s.samples[i].value
+				found = true
+			case domain.MetricConcurrency:
+				row.Concurrency = int(math.Round(s.samples[i].value))
+				found = true
+			}
+		}
+
+		if !found || !matcher.MatchesLabels(first.series.labels) {
+			continue
+		}
+		if !fn(row) {
+			return
+		}
+	}
+}
+
+func (s *InMemoryStore) QuerySamples(ctx context.Context, q domain.Query) ([]domain.Sample, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	matcher, err := q.Selector.Compile()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+
+	skip := q.Offset
+	var fetchedSamples []domain.Sample
+
+	s.eachSample(q, matcher, func(sample memSample) bool {
+		if skip > 0 {
+			skip--
+			return true
+		}
+		fetchedSamples = append(fetchedSamples, domain.Sample{
+			Name:      sample.series.name,
+			Labels:    copyLabels(sample.series.labels),
+			Timestamp: sample.timestamp,
+			Value:     sample.value,
+		})
+		return q.Limit <= 0 || len(fetchedSamples) < q.Limit
+	})
+	return fetchedSamples, nil
+}
+
+func (s *InMemoryStore) CountSamples(ctx context.Context, q domain.Query) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	matcher, err := q.Selector.Compile()
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return 0, ErrStoreClosed
+	}
+
+	var count int64
+	s.eachSample(domain.Query{Start: q.Start, End: q.End}, matcher, func(memSample) bool {
+		count++
+		return true
+	})
+	return count, nil
+}
+
+// eachSample is the counterpart of eachMetric for QuerySamples.
+func (s *InMemoryStore) eachSample(q domain.Query, matcher *domain.SeriesMatcher, fn func(memSample) bool) {
+	from, to := s.window(cursorBounds(q))
+	for n := from; n < to; n++ {
+		sample := s.samples[n]
+		if q.Descending {
+			sample = s.samples[to-1-(n-from)]
+		}
+		if !matcher.Matches(sample.series.name, sample.series.labels) {
+			continue
+		}
+		if !q.Continues(domain.Cursor{Timestamp: sample.timestamp, Labels: sample.series.labelsKey, Name: sample.series.name}) {
+			continue
+		}
+		if !fn(sample) {
+			return
+		}
+	}
+}
+
+func (s *InMemoryStore) AggregateSamples(ctx context.Context, q domain.AggregateQuery) ([]domain.Series, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	matcher, err := q.Selector.Compile()
+	if err != nil {
+		return nil, err
+	}
+
+	samples, err := s.QuerySamples(ctx, domain.Query{Selector: q.Selector, Start: q.Start, End: q.End})
+	if err != nil {
+		return nil, err
+	}
+	return domain.BucketSamples(samples, matcher, q), nil
+}
+
+func (s *InMemoryStore) SummarizeSamples(ctx context.Context, q domain.Query) ([]domain.SeriesStatistics, error) {
+	matcher, err := q.Selector.Compile()
+	if err != nil {
+		return nil, err
+	}
+
+	samples, err := s.QuerySamples(ctx, domain.Query{Selector: q.Selector, Start: q.Start, End: q.End})
+	if err != nil {
+		return nil, err
+	}
+	return domain.SummarizeSeries(samples, matcher, q), nil
+}
+
+func (s *InMemoryStore) LatestSamples(ctx context.Context, selector domain.SeriesSelector) ([]domain.Sample, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	matcher, err := selector.Compile()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+
+	var latest []domain.Sample
+	for _, series := range s.series {
+		if !matcher.Matches(series.name, series.labels) {
+			continue
+		}
+		latest = append(latest, domain.Sample{
+			Name:      series.name,
+			Labels:    copyLabels(series.labels),
+			Timestamp: series.latest.timestamp,
+			Value:     series.latest.value,
+		})
+	}
+	domain.SortSamplesBySeries(latest)
+	return latest, nil
+}
+
+func (s *InMemoryStore) DeleteBefore(ctx context.Context, ts int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, ErrStoreClosed
+	}
+
+	n := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].timestamp >= ts })
+	s.drop(n)
+	return int64(n), nil
+}
+
+func (s *InMemoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.series = nil
+	s.samples = nil
+	return nil
+}
+
+// window returns the index range of samples with startTime <= timestamp <=
+// endTime.
+func (s *InMemoryStore) window(startTime, endTime int64) (int, int) {
+	from := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].timestamp >= startTime })
+	to := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].timestamp > endTime })
+	if to < from {
+		to = from
+	}
+	return from, to
+}
+
+// cursorBounds narrows the time range of q to the timestamps at or past its
+// cursor.
+func cursorBounds(q domain.Query) (int64, int64) {
+	start, end := q.Start, q.End
+	if q.Cursor != nil {
+		if q.Descending {
+			end = min(end, q.Cursor.Timestamp)
+		} else {
+			start = max(start, q.Cursor.Timestamp)
+		}
+	}
+	return start, end
+}
+
+func (s *InMemoryStore) insert(sample memSample) {
+	i := sort.Search(len(s.samples), func(i int) bool { return !s.samples[i].less(sample) })
+	s.samples = append(s.samples, memSample{})
+	copy(s.samples[i+1:], s.samples[i:])
+	s.samples[i] = sample
+}
+
+// evict drops whole groups of samples sharing the oldest timestamp and
+// label set, so a Metric is never left with only one of its two samples.
+func (s *InMemoryStore) evict() {
+	if s.capacity <= 0 || len(s.samples) <= s.capacity {
+		return
+	}
+
+	drop := 0
+	for drop < len(s.samples) && len(s.samples)-drop > s.capacity {
+		first := s.samples[drop]
+		for drop < len(s.samples) && s.samples[drop].timestamp == first.timestamp && s.samples[drop].series.labelsKey == first.series.labelsKey {
+			drop++
+		}
+	}
+
+	s.drop(drop)
+}
+
+// runs splits samples[from:to] into the index ranges of one timestamp and
+// label set.
+func (s *InMemoryStore) runs(from, to int) [][2]int {
+	var runs [][2]int
+	for i := from; i < to; {
+		first := s.samples[i]
+		start := i
+		for i < to && s.samples[i].timestamp == first.timestamp && s.samples[i].series.labelsKey == first.series.labelsKey {
+			i++
+		}
+		runs = append(runs, [2]int{start, i})
+	}
+	return runs
+}
+
+// drop removes the first n samples.
+func (s *InMemoryStore) drop(n int) {
+	for i, sample := range s.samples[:n] {
+		delete(sample.series.timestamps, sample.timestamp)
+		if len(sample.series.timestamps) == 0 {
+			delete(s.series, sample.series.name+sample.series.labelsKey)
+		}
+		s.samples[i] = memSample{}
+	}
+	s.samples = s.samples[n:]
+}
+
+func copyLabels(labels domain.Labels) domain.Labels {
+	if len(labels) == 0 {
+		return nil
+	}
+	copied := make(domain.Labels, len(labels))
+	for name, value := range labels {
+		copied[name] = value
+	}
+	return copied
+}
@@ -2,15 +2,32 @@ package repository
 
 import (
 	"context"
+	"database/sql"
+	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"metrics-app/internal/domain"
+	"metrics-app/internal/repository/storetest"
 )
 
+func TestSQLiteStore_Conformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) domain.MetricStore {
+		return NewSQLiteStore(filepath.Join(t.TempDir(), "metrics.db"))
+	})
+}
+
+func TestInMemoryStore_Conformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) domain.MetricStore {
+		return NewInMemoryStore(0)
+	})
+}
+
 func TestSQLiteStore_Init(t *testing.T) {
 
 	testDBPath := "./test_metrics_init.db"
@@ -136,3 +153,335 @@ func TestSQLiteStore_GetMetrics(t *testing.T) {
 	assert.Len(t, retrievedMetrics, 2, "Negative offset should be treated as 0")
 	assert.Equal(t, metricsToStore[0:2], retrievedMetrics)
 }
+
+func TestSQLiteStore_StoreMetrics(t *testing.T) {
+	testDBPath := "./test_metrics_batch.db"
+	os.Remove(testDBPath)
+	defer os.Remove(testDBPath)
+
+	sqliteStore := NewSQLiteStore(testDBPath)
+	sqliteStore.Init()
+	defer sqliteStore.Close()
+
+	now := time.Now().Unix()
+	ctx := context.Background()
+
+	err := sqliteStore.StoreMetric(ctx, domain.Metric{Timestamp: now - 30, CPULoad: 5.0, Concurrency: 5})
+	assert.NoError(t, err)
+
+	batch := []domain.Metric{
+		{Timestamp: now - 20, CPULoad: 10.0, Concurrency: 100},
+		{Timestamp: now - 30, CPULoad: 20.0, Concurrency: 200},
+		{Timestamp: now - 10, CPULoad: 120.0, Concurrency: 300},
+		{Timestamp: now, CPULoad: 40.0, Concurrency: 400},
+	}
+
+	// case 1: Duplicate and invalid items are rejected, the rest is stored
+	result, err := sqliteStore.StoreMetrics(ctx, batch)
+	assert.NoError(t, err, "StoreMetrics should not fail because of rejected items")
+	assert.Equal(t, 2, result.Stored)
+	assert.Len(t, result.Rejected, 2)
+	assert.Equal(t, 1, result.Rejected[0].Index)
+	assert.ErrorIs(t, result.Rejected[0].Err, domain.ErrDuplicateMetric)
+	assert.Equal(t, 2, result.Rejected[1].Index)
+	assert.ErrorIs(t, result.Rejected[1].Err, domain.ErrInvalidCPULoad)
+
+	retrievedMetrics, err := sqliteStore.GetMetrics(ctx, now-100, now+100, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Metric{
+		{Timestamp: now - 30, CPULoad: 5.0, Concurrency: 5},
+		batch[0],
+		batch[3],
+	}, retrievedMetrics)
+
+	// case 2: Cancelled context stores nothing
+	ctxWithCancel, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = sqliteStore.StoreMetrics(ctxWithCancel, []domain.Metric{{Timestamp: now + 10, CPULoad: 1.0, Concurrency: 1}})
+	assert.Error(t, err, "StoreMetrics should return an error when context is cancelled")
+
+	retrievedMetrics, err = sqliteStore.GetMetrics(ctx, now-100, now+100, 0, 0)
+	assert.NoError(t, err)
+	assert.Len(t, retrievedMetrics, 3, "Cancelled batch should not be written")
+
+	// case 3: Duplicate through StoreMetric
+	err = sqliteStore.StoreMetric(ctx, batch[0])
+	assert.ErrorIs(t, err, domain.ErrDuplicateMetric)
+}
+
+func TestInMemoryStore_GetMetrics(t *testing.T) {
+	store := NewInMemoryStore(0)
+	store.Init()
+	defer store.Close()
+
+	now := time.Now().Unix()
+	ctx := context.Background()
+
+	// Stored out of order on purpose; reads must come back sorted.
+	metricsToStore := []domain.Metric{
+		{Timestamp: now - 30, CPULoad: 30.0, Concurrency: 300},
+		{Timestamp: now - 50, CPULoad: 10.0, Concurrency: 100},
+		{Timestamp: now, CPULoad: 60.0, Concurrency: 600},
+		{Timestamp: now - 40, CPULoad: 20.0, Concurrency: 200},
+	}
+	for _, m := range metricsToStore {
+		assert.NoError(t, store.StoreMetric(ctx, m))
+	}
+
+	// case 1: Full range is ordered by timestamp
+	retrievedMetrics, err := store.GetMetrics(ctx, now-100, now+100, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Metric{metricsToStore[1], metricsToStore[3], metricsToStore[0], metricsToStore[2]}, retrievedMetrics)
+
+	// case 2: Bounds are inclusive
+	retrievedMetrics, err = store.GetMetrics(ctx, now-40, now-30, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Metric{metricsToStore[3], metricsToStore[0]}, retrievedMetrics)
+
+	// case 3: Limit and offset
+	retrievedMetrics, err = store.GetMetrics(ctx, now-100, now+100, 2, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Metric{metricsToStore[3], metricsToStore[0]}, retrievedMetrics)
+
+	// case 4: Duplicate timestamp is rejected
+	err = store.StoreMetric(ctx, domain.Metric{Timestamp: now, CPULoad: 1.0, Concurrency: 1})
+	assert.ErrorIs(t, err, domain.ErrDuplicateMetric)
+
+	// case 5: Cancelled context
+	ctxWithCancel, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = store.GetMetrics(ctxWithCancel, now-100, now+100, 0, 0)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestInMemoryStore_Capacity(t *testing.T) {
+	// Capacity counts samples; every metric is stored as two of them.
+	store := NewInMemoryStore(6)
+	store.Init()
+	defer store.Close()
+
+	ctx := context.Background()
+
+	for i := int64(1); i <= 4; i++ {
+		assert.NoError(t, store.StoreMetric(ctx, domain.Metric{Timestamp: i * 10, CPULoad: float64(i), Concurrency: int(i)}))
+	}
+
+	retrievedMetrics, err := store.GetMetrics(ctx, 0, 100, 0, 0)
+	assert.NoError(t, err)
+	assert.Len(t, retrievedMetrics, 3, "Store should be bounded by its capacity")
+	assert.Equal(t, int64(20), retrievedMetrics[0].Timestamp, "Oldest metric should be evicted first")
+
+	result, err := store.StoreMetrics(ctx, []domain.Metric{
+		{Timestamp: 50, CPULoad: 5.0, Concurrency: 5},
+		{Timestamp: 60, CPULoad: 6.0, Concurrency: 6},
+		{Timestamp: 60, CPULoad: 7.0, Concurrency: 7},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, result.Stored)
+	assert.Len(t, result.Rejected, 1, "Duplicate inside the batch should be rejected")
+
+	retrievedMetrics, err = store.GetMetrics(ctx, 0, 100, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{40, 50, 60}, []int64{retrievedMetrics[0].Timestamp, retrievedMetrics[1].Timestamp, retrievedMetrics[2].Timestamp})
+}
+
+func TestSQLiteStore_MigratesLegacyTable(t *testing.T) {
+	testDBPath := filepath.Join(t.TempDir(), "legacy.db")
+
+	legacyDB, err := sql.Open("sqlite3", testDBPath)
+	assert.NoError(t, err)
+	_, err = legacyDB.Exec(`CREATE TABLE metrics (timestamp INTEGER PRIMARY KEY, cpu_load REAL, concurrency INTEGER);
+		INSERT INTO metrics VALUES (1722441990, 45.75, 100), (1722442000, 46.1, 102);`)
+	assert.NoError(t, err)
+	legacyDB.Close()
+
+	sqliteStore := NewSQLiteStore(testDBPath)
+	assert.NoError(t, sqliteStore.Init(), "Init should migrate the legacy table")
+	defer sqliteStore.Close()
+
+	retrievedMetrics, err := sqliteStore.GetMetrics(context.Background(), 0, 1722442000, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Metric{
+		{Timestamp: 1722441990, CPULoad: 45.75, Concurrency: 100},
+		{Timestamp: 1722442000, CPULoad: 46.1, Concurrency: 102},
+	}, retrievedMetrics)
+
+	sqliteStore.Close()
+	assert.NoError(t, sqliteStore.Init(), "Init should be repeatable after the migration")
+}
+
+func TestSQLiteStore_ReadOnly(t *testing.T) {
+	ctx := context.Background()
+	testDBPath := filepath.Join(t.TempDir(), "metrics.db")
+
+	writable := NewSQLiteStore(testDBPath)
+	require.NoError(t, writable.Init())
+	_, err := writable.StoreSamples(ctx, []domain.Sample{{Name: "load1", Timestamp: 1722441990, Value: 1}})
+	require.NoError(t, err)
+	require.NoError(t, writable.Close())
+
+	readOnly := NewReadOnlySQLiteStore(testDBPath)
+	require.NoError(t, readOnly.Init())
+	samples, err := readOnly.QuerySamples(ctx, domain.Query{Start: 0, End: 1722441990})
+	require.NoError(t, err)
+	assert.Len(t, samples, 1)
+	_, err = readOnly.StoreSamples(ctx, []domain.Sample{{Name: "load1", Timestamp: 1722441991, Value: 2}})
+	assert.Error(t, err, "A read-only store should refuse writes")
+	readOnly.Close()
+
+	// A legacy database is left as it is rather than migrated
+	legacyDBPath := filepath.Join(t.TempDir(), "legacy.db")
+	legacyDB, err := sql.Open("sqlite3", legacyDBPath)
+	require.NoError(t, err)
+	_, err = legacyDB.Exec(`CREATE TABLE metrics (timestamp INTEGER PRIMARY KEY, cpu_load REAL, concurrency INTEGER);`)
+	require.NoError(t, err)
+	legacyDB.Close()
+
+	readOnly = NewReadOnlySQLiteStore(legacyDBPath)
+	assert.ErrorIs(t, readOnly.Init(), ErrOutdatedSchema)
+	readOnly.Close()
+
+	legacyDB, err = sql.Open("sqlite3", legacyDBPath)
+	require.NoError(t, err)
+	defer legacyDB.Close()
+	var tables int
+	require.NoError(t, legacyDB.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'").Scan(&tables))
+	assert.Equal(t, 1, tables, "Only the legacy table should exist")
+}
+
+func TestSQLiteStore_Vacuum(t *testing.T) {
+	testDBPath := filepath.Join(t.TempDir(), "vacuum.db")
+
+	// A file created before incremental vacuum was enabled.
+	legacyDB, err := sql.Open("sqlite3", testDBPath)
+	require.NoError(t, err)
+	_, err = legacyDB.Exec("CREATE TABLE unrelated (id INTEGER PRIMARY KEY)")
+	require.NoError(t, err)
+	legacyDB.Close()
+
+	sqliteStore := NewSQLiteStore(testDBPath)
+	require.NoError(t, sqliteStore.Init())
+	defer sqliteStore.Close()
+
+	pragma := func(name string) int {
+		var value int
+		require.NoError(t, sqliteStore.db.QueryRow("PRAGMA "+name).Scan(&value))
+		return value
+	}
+	assert.Equal(t, 0, pragma("auto_vacuum"), "An existing file keeps its vacuum mode until vacuumed")
+
+	ctx := context.Background()
+	fill := func() {
+		metrics := make([]domain.Metric, 2000)
+		for i := range metrics {
+			metrics[i] = domain.Metric{Timestamp: int64(1722441990 + i), CPULoad: 50, Concurrency: i, Labels: domain.Labels{"host": "padding-to-use-more-pages"}}
+		}
+		_, err := sqliteStore.StoreMetrics(ctx, metrics)
+		require.NoError(t, err)
+		deleted, err := sqliteStore.DeleteBefore(ctx, 1722441990+2000)
+		require.NoError(t, err)
+		require.Equal(t, int64(4000), deleted)
+	}
+
+	fill()
+	require.NoError(t, sqliteStore.Vacuum(ctx))
+	assert.Equal(t, 2, pragma("auto_vacuum"), "A full vacuum should switch the file to incremental mode")
+	assert.Equal(t, 0, pragma("freelist_count"))
+
+	fill()
+	assert.Greater(t, pragma("freelist_count"), 0, "Deleted samples should leave free pages behind")
+	require.NoError(t, sqliteStore.Vacuum(ctx))
+	assert.Equal(t, 0, pragma("freelist_count"), "Incremental vacuum should release every free page")
+}
+
+func TestSQLiteStore_Rollups(t *testing.T) {
+	sqliteStore := NewSQLiteStore(filepath.Join(t.TempDir(), "rollups.db"))
+	require.NoError(t, sqliteStore.Init())
+	defer sqliteStore.Close()
+
+	ctx := context.Background()
+	const hour int64 = 1722441600 // 2024-07-31T16:00:00Z
+
+	// Two hours of metrics every ten seconds; cpu_load is the minute within
+	// the hour so every 1m bucket has a distinct average.
+	var metrics []domain.Metric
+	for ts := hour; ts < hour+7200; ts += 10 {
+		metrics = append(metrics, domain.Metric{Timestamp: ts, CPULoad: float64((ts - hour) % 3600 / 60), Concurrency: 10})
+	}
+	_, err := sqliteStore.StoreMetrics(ctx, metrics)
+	require.NoError(t, err)
+
+	written, err := sqliteStore.RollUp(ctx, hour+5430)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2*90+2*1), written, "Only complete buckets should be rolled up")
+
+	written, err = sqliteStore.RollUp(ctx, hour+5430)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), written, "Rolling up again should be a no-op")
+
+	retrieved, err := sqliteStore.GetMetrics(ctx, hour, hour+100, 0, 0)
+	require.NoError(t, err)
+	assert.Len(t, retrieved, 11, "Raw samples should be used while they cover the range")
+
+	_, err = sqliteStore.DeleteBefore(ctx, hour+5400)
+	require.NoError(t, err)
+
+	retrieved, err = sqliteStore.GetMetrics(ctx, hour, hour+5399, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, retrieved, 90, "Purged raw samples should be served from the 1m tier")
+	assert.Equal(t, domain.Metric{Timestamp: hour + 120, CPULoad: 2, Concurrency: 10}, retrieved[2])
+
+	retrieved, err = sqliteStore.GetMetrics(ctx, hour+5340, hour+5460, 0, 0)
+	require.NoError(t, err)
+	assert.Len(t, retrieved, 1+7, "The range should continue from raw samples after the watermark")
+
+	// A late sample in a rolled-up bucket updates the aggregates.
+	require.NoError(t, sqliteStore.StoreMetric(ctx, domain.Metric{Timestamp: hour + 125, CPULoad: 2, Concurrency: 70}))
+	retrieved, err = sqliteStore.GetMetrics(ctx, hour+120, hour+120, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []domain.Metric{{Timestamp: hour + 120, CPULoad: 2, Concurrency: 19}}, retrieved)
+
+	_, err = sqliteStore.DeleteRollupsBefore(ctx, domain.RollupTiers[0], hour+3600)
+	require.NoError(t, err)
+
+	retrieved, err = sqliteStore.GetMetrics(ctx, hour, hour+7199, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, retrieved, 1+30+180, "The 1h tier should serve the oldest part of the range")
+	assert.Equal(t, hour, retrieved[0].Timestamp)
+	assert.InDelta(t, (29.5*360+2)/361, retrieved[0].CPULoad, 1e-9, "The late sample should be folded into the 1h tier too")
+	assert.Equal(t, hour+3600, retrieved[1].Timestamp)
+	assert.Equal(t, hour+5400, retrieved[31].Timestamp)
+
+	retrieved, err = sqliteStore.GetMetrics(ctx, hour, hour+7199, 2, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{hour + 3600, hour + 3660}, []int64{retrieved[0].Timestamp, retrieved[1].Timestamp}, "Pagination should span the tiers")
+}
+
+func TestSQLiteStore_BroadSelector(t *testing.T) {
+	ctx := context.Background()
+	store := NewSQLiteStore(filepath.Join(t.TempDir(), "metrics.db"))
+	require.NoError(t, store.Init())
+	defer store.Close()
+
+	// More series than SQLite allows host parameters in one statement
+	const hosts = 33000
+	samples := make([]domain.Sample, 0, hosts)
+	for i := 0; i < hosts; i++ {
+		samples = append(samples, domain.Sample{Name: domain.MetricCPULoad, Labels: domain.Labels{"host": fmt.Sprintf("web-%05d", i)}, Timestamp: 1722441990, Value: 1})
+	}
+	_, err := store.StoreSamples(ctx, samples)
+	require.NoError(t, err)
+
+	query := domain.Query{
+		Selector: domain.SeriesSelector{Matchers: []domain.LabelMatcher{{Name: "host", Type: domain.MatchRegexp, Value: "web-.*"}}},
+		Start:    1722441990,
+		End:      1722441990,
+	}
+	count, err := store.CountSamples(ctx, query)
+	require.NoError(t, err)
+	assert.Equal(t, int64(hosts), count)
+
+	metrics, err := store.QueryMetrics(ctx, query)
+	require.NoError(t, err)
+	assert.Len(t, metrics, hosts)
+}
@@ -3,27 +3,80 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"strings"
 
 	"metrics-app/internal/domain"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
+const (
+	insertSeriesSQL = "INSERT INTO series(name, labels) VALUES(?, ?) ON CONFLICT(name, labels) DO NOTHING"
+	selectSeriesSQL = "SELECT id FROM series WHERE name = ? AND labels = ?"
+	insertSampleSQL = "INSERT INTO samples(series_id, timestamp, value) VALUES(?, ?, ?)"
+)
+
+// schemaSQL stores every value as a sample of a series. The metrics view
+// pivots the cpu_load and concurrency series of each label set back into
+// the original metric shape. The rollup tiers follow the same layout, and
+// the notification outbox comes last.
+var schemaSQL = append(append([]string{
+	`CREATE TABLE IF NOT EXISTS series (
+		id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		labels TEXT NOT NULL,
+		UNIQUE(name, labels)
+	);`,
+	`CREATE TABLE IF NOT EXISTS samples (
+		series_id INTEGER NOT NULL REFERENCES series(id),
+		timestamp INTEGER NOT NULL,
+		value REAL NOT NULL,
+		PRIMARY KEY (series_id, timestamp)
+	) WITHOUT ROWID;`,
+	`CREATE INDEX IF NOT EXISTS samples_timestamp ON samples(timestamp);`,
+	`CREATE VIEW IF NOT EXISTS metrics AS
+	SELECT sa.timestamp AS timestamp,
+		se.labels AS labels,
+		MAX(CASE WHEN se.name = 'cpu_load' THEN sa.value END) AS cpu_load,
+		MAX(CASE WHEN se.name = 'concurrency' THEN sa.value END) AS concurrency
+	FROM samples sa JOIN series se ON se.id = sa.series_id
+	WHERE se.name IN ('cpu_load', 'concurrency')
+	GROUP BY se.labels, sa.timestamp;`,
+}, rollupSchemaSQL()...), outboxSchemaSQL...)
+
+// ErrOutdatedSchema is returned by a read-only store whose database has not
+// been migrated to series samples; it cannot be migrated without writing.
+var ErrOutdatedSchema = errors.New("database has an outdated schema; open it for writing once to migrate it")
+
 type SQLiteStore struct {
-	db     *sql.DB
-	dbPath string
+	db       *sql.DB
+	dbPath   string
+	readOnly bool
 }
 
 func NewSQLiteStore(path string) *SQLiteStore {
 	return &SQLiteStore{dbPath: path}
 }
 
+// NewReadOnlySQLiteStore opens an existing database without changing it:
+// Init creates and migrates nothing, and every write fails.
+func NewReadOnlySQLiteStore(path string) *SQLiteStore {
+	return &SQLiteStore{dbPath: path, readOnly: true}
+}
+
 func (s *SQLiteStore) Init() error {
 	var err error
 
-	s.db, err = sql.Open("sqlite3", s.dbPath)
+	dataSource := s.dbPath
+	if s.readOnly {
+		dataSource = "file:" + s.dbPath + "?mode=ro"
+	}
+	s.db, err = sql.Open("sqlite3", dataSource)
 	if err != nil {
 		return fmt.Errorf("error opening database: %w", err)
 	}
@@ -32,51 +85,278 @@ func (s *SQLiteStore) Init() error {
 		return fmt.Errorf("error connecting to database: %w", err)
 	}
 
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS metrics (
-		timestamp INTEGER PRIMARY KEY,
-		cpu_load REAL,
-		concurrency INTEGER
-	);`
+	if s.readOnly {
+		return s.checkSchema()
+	}
 
-	_, err = s.db.Exec(createTableSQL)
-	if err != nil {
-		return fmt.Errorf("error creating table: %w", err)
+	// Incremental vacuum only takes effect on a database created after the
+	// pragma; older files are converted by the first full Vacuum.
+	if _, err = s.db.Exec("PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+		return fmt.Errorf("error configuring database: %w", err)
+	}
+
+	if err = s.migrateLegacyTable(); err != nil {
+		return fmt.Errorf("error migrating metrics table: %w", err)
+	}
+
+	for _, stmt := range schemaSQL {
+		if _, err = s.db.Exec(stmt); err != nil {
+			return fmt.Errorf("error creating table: %w", err)
+		}
 	}
 
 	log.Println("SQLiteStore initialized.")
 	return nil
 }
 
+// checkSchema makes sure a read-only database has the series and samples
+// tables, and not the legacy metrics table.
+func (s *SQLiteStore) checkSchema() error {
+	var current, legacy int
+	err := s.db.QueryRow(`SELECT
+		COUNT(CASE WHEN name IN ('series', 'samples') THEN 1 END),
+		COUNT(CASE WHEN name = 'metrics' THEN 1 END)
+		FROM sqlite_master WHERE type = 'table'`).Scan(&current, &legacy)
+	if err != nil {
+		return fmt.Errorf("error reading schema: %w", err)
+	}
+	if current != 2 || legacy != 0 {
+		return ErrOutdatedSchema
+	}
+	return nil
+}
+
+// migrateLegacyTable moves rows of the original single-series metrics table
+// into the samples table. The table is dropped so that the compatibility
+// view can take its name.
+func (s *SQLiteStore) migrateLegacyTable() error {
+	var legacy int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'metrics'").Scan(&legacy)
+	if err != nil || legacy == 0 {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range schemaSQL[:3] {
+		if _, err = tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	emptyLabels := domain.Labels(nil).Key()
+	for _, column := range []string{domain.MetricCPULoad, domain.MetricConcurrency} {
+		if _, err = tx.Exec(insertSeriesSQL, column, emptyLabels); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT OR IGNORE INTO samples(series_id, timestamp, value)
+			SELECT (SELECT id FROM series WHERE name = ? AND labels = ?), timestamp, `+column+`
+			FROM metrics WHERE `+column+` IS NOT NULL`, column, emptyLabels)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err = tx.Exec("DROP TABLE metrics"); err != nil {
+		return err
+	}
+
+	log.Println("Migrated legacy metrics table to series samples.")
+	return tx.Commit()
+}
+
 func (s *SQLiteStore) StoreMetric(ctx context.Context, metric domain.Metric) error {
-	stmt, err := s.db.PrepareContext(ctx, "INSERT INTO metrics(timestamp, cpu_load, concurrency) VALUES(?, ?, ?)")
+	result, err := s.StoreMetrics(ctx, []domain.Metric{metric})
+	if err != nil {
+		return err
+	}
+	if len(result.Rejected) > 0 {
+		return result.Rejected[0].Err
+	}
+	return nil
+}
+
+func (s *SQLiteStore) StoreMetrics(ctx context.Context, metrics []domain.Metric) (domain.BatchResult, error) {
+	var result domain.BatchResult
+
+	err := s.withSampleWriter(ctx, func(w *sampleWriter) error {
+		for i, metric := range metrics {
+			if err := metric.Validate(); err != nil {
+				result.Rejected = append(result.Rejected, domain.Rejection{Index: i, Err: err})
+				continue
+			}
+
+			// Both samples of a metric are written under a savepoint so a
+			// rejected metric never leaves half of itself behind.
+			if _, err := w.tx.ExecContext(ctx, "SAVEPOINT metric"); err != nil {
+				return err
+			}
+			err := w.write(ctx, metric.Samples()...)
+			if err == nil {
+				_, err = w.tx.ExecContext(ctx, "RELEASE metric")
+				if err != nil {
+					return err
+				}
+				result.Stored++
+				continue
+			}
+			if _, rbErr := w.tx.ExecContext(ctx, "ROLLBACK TO metric"); rbErr != nil {
+				return rbErr
+			}
+			w.forgetSeries()
+			if !errors.Is(err, domain.ErrDuplicateMetric) {
+				return fmt.Errorf("error inserting metric at index %d: %w", i, err)
+			}
+			if _, err := w.tx.ExecContext(ctx, "RELEASE metric"); err != nil {
+				return err
+			}
+			result.Rejected = append(result.Rejected, domain.Rejection{Index: i, Err: err})
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("error preparing insert statement: %w", err)
+		return domain.BatchResult{}, err
 	}
-	defer stmt.Close()
+	return result, nil
+}
+
+func (s *SQLiteStore) StoreSamples(ctx context.Context, samples []domain.Sample) (domain.BatchResult, error) {
+	var result domain.BatchResult
+
+	err := s.withSampleWriter(ctx, func(w *sampleWriter) error {
+		for i, sample := range samples {
+			if err := sample.Validate(); err != nil {
+				result.Rejected = append(result.Rejected, domain.Rejection{Index: i, Err: err})
+				continue
+			}
+
+			err := w.write(ctx, sample)
+			if err != nil {
+				// A constraint violation only rolls back the failing
+				// statement, so the rest of the batch can still be committed.
+				if errors.Is(err, domain.ErrDuplicateMetric) {
+					result.Rejected = append(result.Rejected, domain.Rejection{Index: i, Err: err})
+					continue
+				}
+				return fmt.Errorf("error inserting sample at index %d: %w", i, err)
+			}
+			result.Stored++
+		}
+		return nil
+	})
+	if err != nil {
+		return domain.BatchResult{}, err
+	}
+	return result, nil
+}
+
+// sampleWriter inserts samples inside a transaction with statements that are
+// prepared once per batch.
+type sampleWriter struct {
+	tx           *sql.Tx
+	insertSeries *sql.Stmt
+	selectSeries *sql.Stmt
+	insertSample *sql.Stmt
+	seriesIDs    map[string]int64
+}
 
-	_, err = stmt.ExecContext(ctx, metric.Timestamp, metric.CPULoad, metric.Concurrency)
+func (s *SQLiteStore) withSampleWriter(ctx context.Context, fn func(w *sampleWriter) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("error inserting metric: %w", err)
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	w := &sampleWriter{tx: tx, seriesIDs: make(map[string]int64)}
+
+	for _, p := range []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&w.insertSeries, insertSeriesSQL},
+		{&w.selectSeries, selectSeriesSQL},
+		{&w.insertSample, insertSampleSQL},
+	} {
+		*p.stmt, err = tx.PrepareContext(ctx, p.query)
+		if err != nil {
+			return fmt.Errorf("error preparing insert statement: %w", err)
+		}
+		defer (*p.stmt).Close()
+	}
+
+	if err = fn(w); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
 	}
 	return nil
 }
 
-func (s *SQLiteStore) GetMetrics(ctx context.Context, startTime, endTime int64, limit, offset int) ([]domain.Metric, error) {
-	query := "SELECT timestamp, cpu_load, concurrency FROM metrics WHERE timestamp >= ? AND timestamp <= ? ORDER BY timestamp ASC"
-	args := []interface{}{startTime, endTime}
+func (w *sampleWriter) write(ctx context.Context, samples ...domain.Sample) error {
+	for _, sample := range samples {
+		seriesID, err := w.seriesID(ctx, sample.Name, sample.Labels.Key())
+		if err != nil {
+			return err
+		}
+		if _, err = w.insertSample.ExecContext(ctx, seriesID, sample.Timestamp, sample.Value); err != nil {
+			return insertError(err)
+		}
+	}
+	return nil
+}
 
-	if limit <= 0 {
-		limit = -1
+func (w *sampleWriter) seriesID(ctx context.Context, name, labels string) (int64, error) {
+	cacheKey := name + labels
+	if id, ok := w.seriesIDs[cacheKey]; ok {
+		return id, nil
 	}
-	query += " LIMIT ?"
-	args = append(args, limit)
 
-	if offset < 0 {
-		offset = 0
+	if _, err := w.insertSeries.ExecContext(ctx, name, labels); err != nil {
+		return 0, fmt.Errorf("error inserting series: %w", err)
 	}
-	query += " OFFSET ?"
-	args = append(args, offset)
+
+	var id int64
+	if err := w.selectSeries.QueryRowContext(ctx, name, labels).Scan(&id); err != nil {
+		return 0, fmt.Errorf("error resolving series: %w", err)
+	}
+	w.seriesIDs[cacheKey] = id
+	return id, nil
+}
+
+// forgetSeries drops cached series ids, which may refer to rows that were
+// undone by a rollback.
+func (w *sampleWriter) forgetSeries() {
+	w.seriesIDs = make(map[string]int64)
+}
+
+// insertError maps SQLite key violations onto domain.ErrDuplicateMetric.
+func insertError(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) &&
+		(sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey || sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique) {
+		return fmt.Errorf("%w: %v", domain.ErrDuplicateMetric, err)
+	}
+	return err
+}
+
+func (s *SQLiteStore) GetMetrics(ctx context.Context, startTime, endTime int64, limit, offset int) ([]domain.Metric, error) {
+	return s.QueryMetrics(ctx, domain.Query{Start: startTime, End: endTime, Limit: limit, Offset: offset})
+}
+
+func (s *SQLiteStore) QueryMetrics(ctx context.Context, q domain.Query) ([]domain.Metric, error) {
+	query, args, ok, err := s.metricsQuery(ctx, q)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	query += orderBy(q.Descending, "timestamp", "labels")
+	query, args = paginate(query, args, q.Limit, q.Offset)
 
 	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
@@ -87,12 +367,23 @@ func (s *SQLiteStore) GetMetrics(ctx context.Context, startTime, endTime int64,
 	var fetchedMetrics []domain.Metric
 
 	for rows.Next() {
-		var m domain.Metric
+		var (
+			m           domain.Metric
+			labels      string
+			cpuLoad     sql.NullFloat64
+			concurrency sql.NullFloat64
+		)
 
-		if err := rows.Scan(&m.Timestamp, &m.CPULoad, &m.Concurrency); err != nil {
+		if err := rows.Scan(&m.Timestamp, &labels, &cpuLoad, &concurrency); err != nil {
 			log.Printf("Error scanning row: %v", err)
 			continue
 		}
+		if m.Labels, err = domain.ParseLabelsKey(labels); err != nil {
+			log.Printf("Error decoding labels %q: %v", labels, err)
+			continue
+		}
+		m.CPULoad = cpuLoad.Float64
+		m.Concurrency = int(math.Round(concurrency.Float64))
 		fetchedMetrics = append(fetchedMetrics, m)
 	}
 
@@ -102,6 +393,611 @@ func (s *SQLiteStore) GetMetrics(ctx context.Context, startTime, endTime int64,
 	return fetchedMetrics, nil
 }
 
+func (s *SQLiteStore) CountMetrics(ctx context.Context, q domain.Query) (int64, error) {
+	query, args, ok, err := s.metricsQuery(ctx, domain.Query{Selector: q.Selector, Start: q.Start, End: q.End})
+	if err != nil || !ok {
+		return 0, err
+	}
+	return s.count(ctx, query, args)
+}
+
+// metricsQuery builds the unordered SELECT of the Metric view rows that q
+// selects. ok is false when no label set can match.
+func (s *SQLiteStore) metricsQuery(ctx context.Context, q domain.Query) (query string, args []interface{}, ok bool, err error) {
+	matcher, err := q.Selector.Compile()
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	var labelSets []string
+	if len(q.Selector.Matchers) > 0 {
+		labelSets, err = s.matchingLabelSets(ctx, matcher)
+		if err != nil {
+			return "", nil, false, err
+		}
+		if len(labelSets) == 0 {
+			return "", nil, false, nil
+		}
+	}
+
+	// Sources are picked from the requested range, not from the cursor, so
+	// every page of a query reads the same tiers.
+	sources, err := s.metricSources(ctx, q.Start, q.End)
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	var selects []string
+	for _, source := range sources {
+		sel := "SELECT timestamp, labels, cpu_load, concurrency FROM " + source.view + " WHERE timestamp >= ? AND timestamp <= ?"
+		args = append(args, source.start, source.end)
+		if len(labelSets) > 0 {
+			sel, args = inList(sel, args, "labels", labelSets)
+		}
+		sel, args = keyset(sel, args, q, "timestamp", "labels")
+		selects = append(selects, sel)
+	}
+	return strings.Join(selects, " UNION ALL "), args, true, nil
+}
+
+func (s *SQLiteStore) QuerySamples(ctx context.Context, q domain.Query) ([]domain.Sample, error) {
+	query, args, ok, err := s.samplesQuery(ctx, q)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	query += orderBy(q.Descending, "sa.timestamp", "se.labels", "se.name")
+	query, args = paginate(query, args, q.Limit, q.Offset)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying database: %w", err)
+	}
+	defer rows.Close()
+
+	var fetchedSamples []domain.Sample
+
+	for rows.Next() {
+		var (
+			sample domain.Sample
+			labels string
+		)
+
+		if err := rows.Scan(&sample.Timestamp, &sample.Name, &labels, &sample.Value); err != nil {
+			log.Printf("Error scanning row: %v", err)
+			continue
+		}
+		if sample.Labels, err = domain.ParseLabelsKey(labels); err != nil {
+			log.Printf("Error decoding labels %q: %v", labels, err)
+			continue
+		}
+		fetchedSamples = append(fetchedSamples, sample)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during rows iteration: %w", err)
+	}
+	return fetchedSamples, nil
+}
+
+func (s *SQLiteStore) CountSamples(ctx context.Context, q domain.Query) (int64, error) {
+	query, args, ok, err := s.samplesQuery(ctx, domain.Query{Selector: q.Selector, Start: q.Start, End: q.End})
+	if err != nil || !ok {
+		return 0, err
+	}
+	return s.count(ctx, query, args)
+}
+
+// samplesQuery builds the unordered SELECT of the samples that q selects.
+// ok is false when no series can match.
+func (s *SQLiteStore) samplesQuery(ctx context.Context, q domain.Query) (query string, args []interface{}, ok bool, err error) {
+	matcher, err := q.Selector.Compile()
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	query = `SELECT sa.timestamp, se.name, se.labels, sa.value
+		FROM samples sa JOIN series se ON se.id = sa.series_id
+		WHERE sa.timestamp >= ? AND sa.timestamp <= ?`
+	args = []interface{}{q.Start, q.End}
+
+	if matcher.Filtered() {
+		matched, err := s.matchingSeries(ctx, matcher)
+		if err != nil {
+			return "", nil, false, err
+		}
+		if query, args, ok = seriesFilter(query, args, "sa.series_id", matcher, matched); !ok {
+			return "", nil, false, nil
+		}
+	}
+
+	query, args = keyset(query, args, q, "sa.timestamp", "se.labels", "se.name")
+	return query, args, true, nil
+}
+
+func (s *SQLiteStore) count(ctx context.Context, query string, args []interface{}) (int64, error) {
+	var count int64
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM ("+query+")", args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("error counting rows: %w", err)
+	}
+	return count, nil
+}
+
+type seriesInfo struct {
+	name   string
+	labels domain.Labels
+}
+
+func (s *SQLiteStore) AggregateSamples(ctx context.Context, q domain.AggregateQuery) ([]domain.Series, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	matcher, err := q.Selector.Compile()
+	if err != nil {
+		return nil, err
+	}
+
+	matched, err := s.matchingSeries(ctx, matcher)
+	if err != nil {
+		return nil, err
+	}
+
+	quantile, isPercentile := q.Func.Quantile()
+
+	var query string
+	if isPercentile {
+		// SQLite has no percentile aggregate, so values are streamed in
+		// bucket order and reduced below.
+		query = "SELECT series_id, (timestamp / ?) * ? AS bucket, value FROM samples WHERE timestamp >= ? AND timestamp <= ?"
+	} else {
+		query = "SELECT series_id, (timestamp / ?) * ? AS bucket, " + strings.ToUpper(string(q.Func)) + "(value) FROM samples WHERE timestamp >= ? AND timestamp <= ?"
+	}
+	args := []interface{}{q.Step, q.Step, q.Start, q.End}
+
+	var ok bool
+	if query, args, ok = seriesFilter(query, args, "series_id", matcher, matched); !ok {
+		return nil, nil
+	}
+
+	if isPercentile {
+		query += " ORDER BY series_id, bucket, value"
+	} else {
+		query += " GROUP BY series_id, bucket ORDER BY series_id, bucket"
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying database: %w", err)
+	}
+	defer rows.Close()
+
+	var (
+		result  []domain.Series
+		current *domain.Series
+		lastID  int64 = -1
+		bucket  int64
+		values  []float64
+	)
+
+	flush := func() {
+		if len(values) > 0 {
+			current.Points = append(current.Points, domain.Point{Timestamp: bucket, Value: domain.Quantile(values, quantile)})
+			values = values[:0]
+		}
+	}
+
+	for rows.Next() {
+		var (
+			seriesID  int64
+			rowBucket int64
+			value     float64
+		)
+		if err := rows.Scan(&seriesID, &rowBucket, &value); err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+
+		info, known := matched[seriesID]
+		if !known {
+			// The series was created after the index was read.
+			continue
+		}
+
+		if seriesID != lastID || rowBucket != bucket {
+			if isPercentile && current != nil {
+				flush()
+			}
+			if seriesID != lastID {
+				result = append(result, domain.Series{Name: info.name, Labels: info.labels})
+				current = &result[len(result)-1]
+				lastID = seriesID
+			}
+			bucket = rowBucket
+		}
+
+		if isPercentile {
+			values = append(values, value)
+		} else {
+			current.Points = append(current.Points, domain.Point{Timestamp: rowBucket, Value: value})
+		}
+	}
+	if isPercentile && current != nil {
+		flush()
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during rows iteration: %w", err)
+	}
+
+	domain.SortSeries(result)
+	return result, nil
+}
+
+func (s *SQLiteStore) SummarizeSamples(ctx context.Context, q domain.Query) ([]domain.SeriesStatistics, error) {
+	matcher, err := q.Selector.Compile()
+	if err != nil {
+		return nil, err
+	}
+
+	matched, err := s.matchingSeries(ctx, matcher)
+	if err != nil {
+		return nil, err
+	}
+
+	where := " FROM samples WHERE timestamp >= ? AND timestamp <= ?"
+	args := []interface{}{q.Start, q.End}
+
+	var ok bool
+	if where, args, ok = seriesFilter(where, args, "series_id", matcher, matched); !ok {
+		return nil, nil
+	}
+
+	// Both reads share a transaction so the percentile ranks agree with
+	// the counts.
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Moments are aggregated by SQLite. The standard deviation is taken
+	// in Go from the second read, around the mean of the first: the mean
+	// of the squares less the squared mean cancels for large values with
+	// little spread.
+	rows, err := tx.QueryContext(ctx, "SELECT series_id, COUNT(*), MIN(value), MAX(value), AVG(value)"+where+" GROUP BY series_id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying database: %w", err)
+	}
+	defer rows.Close()
+
+	stats := make(map[int64]*domain.SeriesStatistics)
+	for rows.Next() {
+		var (
+			seriesID int64
+			st       domain.Statistics
+		)
+		if err := rows.Scan(&seriesID, &st.Count, &st.Min, &st.Max, &st.Mean); err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		info, known := matched[seriesID]
+		if !known {
+			// The series was created after the index was read.
+			continue
+		}
+		stats[seriesID] = &domain.SeriesStatistics{Name: info.name, Labels: info.labels, Statistics: st}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during rows iteration: %w", err)
+	}
+	rows.Close()
+
+	// SQLite has no percentile aggregate, so values are streamed in order
+	// and only the ranks the percentiles need are kept.
+	valueRows, err := tx.QueryContext(ctx, "SELECT series_id, value"+where+" ORDER BY series_id, value", args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying database: %w", err)
+	}
+	defer valueRows.Close()
+
+	var (
+		current *domain.SeriesStatistics
+		stream  *domain.QuantileStream
+		squares float64
+	)
+	finish := func() {
+		current.SetPercentiles(stream.Quantile)
+		current.StdDev = math.Sqrt(squares / float64(current.Count))
+	}
+	for valueRows.Next() {
+		var (
+			seriesID int64
+			value    float64
+		)
+		if err := valueRows.Scan(&seriesID, &value); err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		st, known := stats[seriesID]
+		if !known {
+			continue
+		}
+		if st != current {
+			if current != nil {
+				finish()
+			}
+			current, stream, squares = st, domain.NewQuantileStream(st.Count), 0
+		}
+		stream.Observe(value)
+		squares += (value - st.Mean) * (value - st.Mean)
+	}
+	if current != nil {
+		finish()
+	}
+	if err = valueRows.Err(); err != nil {
+		return nil, fmt.Errorf("error during rows iteration: %w", err)
+	}
+
+	result := make([]domain.SeriesStatistics, 0, len(stats))
+	for _, st := range stats {
+		result = append(result, *st)
+	}
+	domain.SortSeriesStatistics(result)
+	return result, nil
+}
+
+func (s *SQLiteStore) LatestSamples(ctx context.Context, selector domain.SeriesSelector) ([]domain.Sample, error) {
+	matcher, err := selector.Compile()
+	if err != nil {
+		return nil, err
+	}
+
+	matched, err := s.matchingSeries(ctx, matcher)
+	if err != nil {
+		return nil, err
+	}
+
+	// MAX(timestamp) per series is answered from the primary key.
+	query := `SELECT sa.series_id, sa.timestamp, sa.value
+		FROM series se JOIN samples sa ON sa.series_id = se.id
+		WHERE sa.timestamp = (SELECT MAX(timestamp) FROM samples WHERE series_id = se.id)`
+	var (
+		args []interface{}
+		ok   bool
+	)
+	if query, args, ok = seriesFilter(query, args, "se.id", matcher, matched); !ok {
+		return nil, nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying database: %w", err)
+	}
+	defer rows.Close()
+
+	var latest []domain.Sample
+	for rows.Next() {
+		var (
+			seriesID int64
+			sample   domain.Sample
+		)
+		if err := rows.Scan(&seriesID, &sample.Timestamp, &sample.Value); err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		info, known := matched[seriesID]
+		if !known {
+			// The series was created after the index was read.
+			continue
+		}
+		sample.Name, sample.Labels = info.name, info.labels
+		latest = append(latest, sample)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during rows iteration: %w", err)
+	}
+
+	domain.SortSamplesBySeries(latest)
+	return latest, nil
+}
+
+func (s *SQLiteStore) DeleteBefore(ctx context.Context, ts int64) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM samples WHERE timestamp < ?", ts)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting samples: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error counting deleted samples: %w", err)
+	}
+
+	if deleted > 0 {
+		if _, err = tx.ExecContext(ctx, emptySeriesSQL()); err != nil {
+			return 0, fmt.Errorf("error deleting empty series: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing transaction: %w", err)
+	}
+	return deleted, nil
+}
+
+// Vacuum returns the pages freed by deleted samples to the file system. A
+// database still using auto_vacuum NONE is rebuilt with a full VACUUM, which
+// also switches it to incremental vacuuming for later calls.
+func (s *SQLiteStore) Vacuum(ctx context.Context) error {
+	// The pragma and the VACUUM that applies it must share a connection.
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("error opening connection: %w", err)
+	}
+	defer conn.Close()
+
+	var mode int
+	if err = conn.QueryRowContext(ctx, "PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		return fmt.Errorf("error reading auto_vacuum: %w", err)
+	}
+
+	const incremental = 2
+	if mode != incremental {
+		if _, err = conn.ExecContext(ctx, "PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+			return fmt.Errorf("error configuring database: %w", err)
+		}
+		if _, err = conn.ExecContext(ctx, "VACUUM"); err != nil {
+			return fmt.Errorf("error vacuuming database: %w", err)
+		}
+		return nil
+	}
+
+	// incremental_vacuum frees one page per result row, so the rows have to
+	// be drained.
+	rows, err := conn.QueryContext(ctx, "PRAGMA incremental_vacuum")
+	if err != nil {
+		return fmt.Errorf("error vacuuming database: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("error vacuuming database: %w", err)
+	}
+	return nil
+}
+
+// matchingSeries resolves a selector against the series index. Regular
+// expression matchers are evaluated in Go, so only ids are sent back to SQL.
+func (s *SQLiteStore) matchingSeries(ctx context.Context, matcher *domain.SeriesMatcher) (map[int64]seriesInfo, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, name, labels FROM series")
+	if err != nil {
+		return nil, fmt.Errorf("error querying series: %w", err)
+	}
+	defer rows.Close()
+
+	matched := make(map[int64]seriesInfo)
+	for rows.Next() {
+		var (
+			id     int64
+			name   string
+			labels string
+		)
+		if err := rows.Scan(&id, &name, &labels); err != nil {
+			return nil, fmt.Errorf("error scanning series: %w", err)
+		}
+		decoded, err := domain.ParseLabelsKey(labels)
+		if err != nil {
+			continue
+		}
+		if matcher.Matches(name, decoded) {
+			matched[id] = seriesInfo{name: name, labels: decoded}
+		}
+	}
+	return matched, rows.Err()
+}
+
+// seriesFilter appends the id restriction for matched series to a query.
+// It reports false when no series can match.
+func seriesFilter(query string, args []interface{}, column string, matcher *domain.SeriesMatcher, matched map[int64]seriesInfo) (string, []interface{}, bool) {
+	if !matcher.Filtered() {
+		return query, args, true
+	}
+	if len(matched) == 0 {
+		return query, args, false
+	}
+	ids := make([]int64, 0, len(matched))
+	for id := range matched {
+		ids = append(ids, id)
+	}
+	query, args = inList(query, args, column, ids)
+	return query, args, true
+}
+
+// inList restricts column to values. They are bound as one JSON array,
+// since a broad selector on a large fleet can match more series than SQLite
+// allows host parameters.
+func inList[T any](query string, args []interface{}, column string, values []T) (string, []interface{}) {
+	list, _ := json.Marshal(values)
+	return query + " AND " + column + " IN (SELECT value FROM json_each(?))", append(args, string(list))
+}
+
+// matchingLabelSets returns the label keys of the Metric view that satisfy
+// the label matchers.
+func (s *SQLiteStore) matchingLabelSets(ctx context.Context, matcher *domain.SeriesMatcher) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT DISTINCT labels FROM series WHERE name IN (?, ?)", domain.MetricCPULoad, domain.MetricConcurrency)
+	if err != nil {
+		return nil, fmt.Errorf("error querying series: %w", err)
+	}
+	defer rows.Close()
+
+	var labelSets []string
+	for rows.Next() {
+		var labels string
+		if err := rows.Scan(&labels); err != nil {
+			return nil, fmt.Errorf("error scanning series: %w", err)
+		}
+		decoded, err := domain.ParseLabelsKey(labels)
+		if err != nil {
+			continue
+		}
+		if matcher.MatchesLabels(decoded) {
+			labelSets = append(labelSets, labels)
+		}
+	}
+	return labelSets, rows.Err()
+}
+
+// orderBy sorts by columns, all ascending or all descending.
+func orderBy(descending bool, columns ...string) string {
+	direction := " ASC"
+	if descending {
+		direction = " DESC"
+	}
+	return " ORDER BY " + strings.Join(columns, direction+", ") + direction
+}
+
+// keyset restricts query to the rows that follow the cursor of q. columns
+// are the order columns in the order of the fields of domain.Cursor.
+func keyset(query string, args []interface{}, q domain.Query, columns ...string) (string, []interface{}) {
+	if q.Cursor == nil {
+		return query, args
+	}
+
+	op := ">"
+	if q.Descending {
+		op = "<"
+	}
+	position := []interface{}{q.Cursor.Timestamp, q.Cursor.Labels, q.Cursor.Name}[:len(columns)]
+
+	// The bound on the timestamp alone lets SQLite seek the timestamp index
+	// instead of comparing row values from the start of the range.
+	query += fmt.Sprintf(" AND %s %s= ? AND (%s) %s (%s)",
+		columns[0], op, strings.Join(columns, ", "), op, placeholders(len(columns)))
+	args = append(args, q.Cursor.Timestamp)
+	return query, append(args, position...)
+}
+
+func paginate(query string, args []interface{}, limit, offset int) (string, []interface{}) {
+	if limit <= 0 {
+		limit = -1
+	}
+	query += " LIMIT ?"
+	args = append(args, limit)
+
+	if offset < 0 {
+		offset = 0
+	}
+	query += " OFFSET ?"
+	args = append(args, offset)
+
+	return query, args
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
 func (s *SQLiteStore) Close() error {
 	if s.db != nil {
 		return s.db.Close()
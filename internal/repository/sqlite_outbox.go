@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"metrics-app/internal/domain"
+)
+
+// outboxSchemaSQL keeps webhook notifications until they are delivered, so
+// they survive a restart of the API server.
+var outboxSchemaSQL = []string{
+	`CREATE TABLE IF NOT EXISTS notification_outbox (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		receiver TEXT NOT NULL,
+		payload BLOB NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL,
+		next_attempt INTEGER NOT NULL,
+		last_error TEXT NOT NULL DEFAULT ''
+	);`,
+	`CREATE INDEX IF NOT EXISTS notification_outbox_next_attempt ON notification_outbox(next_attempt);`,
+}
+
+// EnqueueNotifications adds notifications to the outbox in one transaction.
+// Their IDs are assigned by the store.
+func (s *SQLiteStore) EnqueueNotifications(ctx context.Context, notifications []domain.Notification) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO notification_outbox(receiver, payload, attempts, created_at, next_attempt, last_error)
+		VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("error preparing statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, n := range notifications {
+		if _, err = stmt.ExecContext(ctx, n.Receiver, n.Payload, n.Attempts, n.CreatedAt, n.NextAttempt, n.LastError); err != nil {
+			return fmt.Errorf("error inserting notification: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
+
+// DueNotifications returns up to limit notifications whose next attempt is
+// at or before now, oldest first.
+func (s *SQLiteStore) DueNotifications(ctx context.Context, now int64, limit int) ([]domain.Notification, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, receiver, payload, attempts, created_at, next_attempt, last_error
+		FROM notification_outbox WHERE next_attempt <= ? ORDER BY next_attempt, id LIMIT ?`, now, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error querying database: %w", err)
+	}
+	defer rows.Close()
+
+	var notifications []domain.Notification
+	for rows.Next() {
+		var n domain.Notification
+		if err := rows.Scan(&n.ID, &n.Receiver, &n.Payload, &n.Attempts, &n.CreatedAt, &n.NextAttempt, &n.LastError); err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		notifications = append(notifications, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return notifications, nil
+}
+
+// RescheduleNotification records a failed attempt.
+func (s *SQLiteStore) RescheduleNotification(ctx context.Context, id int64, attempts int, nextAttempt int64, lastError string) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE notification_outbox SET attempts = ?, next_attempt = ?, last_error = ? WHERE id = ?",
+		attempts, nextAttempt, lastError, id)
+	if err != nil {
+		return fmt.Errorf("error updating notification: %w", err)
+	}
+	return nil
+}
+
+// DeleteNotification removes a notification that was delivered or given up.
+func (s *SQLiteStore) DeleteNotification(ctx context.Context, id int64) error {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM notification_outbox WHERE id = ?", id); err != nil {
+		return fmt.Errorf("error deleting notification: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"metrics-app/internal/domain"
+)
+
+// Every rollup tier has a table of per-bucket aggregates, a view pivoting it
+// into the metric shape and a trigger. Buckets before the watermark of a
+// tier have been rolled up; the trigger folds samples that are written into
+// such a bucket afterwards into the existing aggregates.
+func rollupSchemaSQL() []string {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS rollup_state (
+			tier TEXT PRIMARY KEY,
+			watermark INTEGER NOT NULL
+		);`,
+	}
+
+	for _, tier := range domain.RollupTiers {
+		stmts = append(stmts,
+			fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+				series_id INTEGER NOT NULL REFERENCES series(id),
+				timestamp INTEGER NOT NULL,
+				min_value REAL NOT NULL,
+				max_value REAL NOT NULL,
+				sum_value REAL NOT NULL,
+				count INTEGER NOT NULL,
+				PRIMARY KEY (series_id, timestamp)
+			) WITHOUT ROWID;`, rollupTable(tier)),
+			fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %[1]s_timestamp ON %[1]s(timestamp);`, rollupTable(tier)),
+			fmt.Sprintf(`CREATE VIEW IF NOT EXISTS %s AS
+			SELECT r.timestamp AS timestamp,
+				se.labels AS labels,
+				MAX(CASE WHEN se.name = 'cpu_load' THEN r.sum_value / r.count END) AS cpu_load,
+				MAX(CASE WHEN se.name = 'concurrency' THEN r.sum_value / r.count END) AS concurrency
+			FROM %s r JOIN series se ON se.id = r.series_id
+			WHERE se.name IN ('cpu_load', 'concurrency')
+			GROUP BY se.labels, r.timestamp;`, rollupView(tier), rollupTable(tier)),
+			fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS samples_%[1]s AFTER INSERT ON samples
+			WHEN NEW.timestamp < (SELECT watermark FROM rollup_state WHERE tier = '%[2]s')
+			BEGIN
+				INSERT INTO %[1]s(series_id, timestamp, min_value, max_value, sum_value, count)
+				VALUES (NEW.series_id, NEW.timestamp - NEW.timestamp %% %[3]d, NEW.value, NEW.value, NEW.value, 1)
+				ON CONFLICT(series_id, timestamp) DO UPDATE SET
+					min_value = MIN(min_value, excluded.min_value),
+					max_value = MAX(max_value, excluded.max_value),
+					sum_value = sum_value + excluded.sum_value,
+					count = count + 1;
+			END;`, rollupTable(tier), tier.Name, tier.Resolution),
+		)
+	}
+	return stmts
+}
+
+func rollupTable(tier domain.RollupTier) string {
+	return "rollups_" + tier.Name
+}
+
+func rollupView(tier domain.RollupTier) string {
+	return "metrics_" + tier.Name
+}
+
+// emptySeriesSQL deletes series that no longer have raw samples or rollups.
+func emptySeriesSQL() string {
+	conditions := []string{"NOT EXISTS (SELECT 1 FROM samples WHERE samples.series_id = series.id)"}
+	for _, tier := range domain.RollupTiers {
+		table := rollupTable(tier)
+		conditions = append(conditions, "NOT EXISTS (SELECT 1 FROM "+table+" WHERE "+table+".series_id = series.id)")
+	}
+	return "DELETE FROM series WHERE " + strings.Join(conditions, " AND ")
+}
+
+// RollUp aggregates every complete bucket that ends at or before until into
+// each tier, the finest from the raw samples and every other tier from the
+// tier before it. It reports the number of rollup rows written.
+func (s *SQLiteStore) RollUp(ctx context.Context, until int64) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var (
+		written int64
+		source  = "samples"
+		reduce  = "MIN(value), MAX(value), SUM(value), COUNT(*)"
+		limit   = until
+	)
+
+	for _, tier := range domain.RollupTiers {
+		from, rolled, err := rollupWatermark(ctx, tx, tier)
+		if err != nil {
+			return 0, err
+		}
+		if !rolled {
+			var earliest sql.NullInt64
+			if err = tx.QueryRowContext(ctx, "SELECT MIN(timestamp) FROM "+source).Scan(&earliest); err != nil {
+				return 0, fmt.Errorf("error reading %s: %w", source, err)
+			}
+			if !earliest.Valid {
+				break
+			}
+			from = earliest.Int64 - earliest.Int64%tier.Resolution
+		}
+
+		to := limit - limit%tier.Resolution
+		if to > from {
+			result, err := tx.ExecContext(ctx, "INSERT INTO "+rollupTable(tier)+"(series_id, timestamp, min_value, max_value, sum_value, count) "+
+				"SELECT series_id, timestamp - timestamp % ?, "+reduce+" FROM "+source+" WHERE timestamp >= ? AND timestamp < ? GROUP BY 1, 2",
+				tier.Resolution, from, to)
+			if err != nil {
+				return 0, fmt.Errorf("error rolling up tier %s: %w", tier.Name, err)
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return 0, fmt.Errorf("error counting rollups: %w", err)
+			}
+			written += n
+
+			_, err = tx.ExecContext(ctx, "INSERT INTO rollup_state(tier, watermark) VALUES(?, ?) ON CONFLICT(tier) DO UPDATE SET watermark = excluded.watermark", tier.Name, to)
+			if err != nil {
+				return 0, fmt.Errorf("error updating watermark of tier %s: %w", tier.Name, err)
+			}
+			from = to
+		}
+
+		// The next tier may only cover buckets this tier has completed.
+		source = rollupTable(tier)
+		reduce = "MIN(min_value), MAX(max_value), SUM(sum_value), SUM(count)"
+		limit = from
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing transaction: %w", err)
+	}
+	return written, nil
+}
+
+// DeleteRollupsBefore removes the buckets of tier that start before ts.
+func (s *SQLiteStore) DeleteRollupsBefore(ctx context.Context, tier domain.RollupTier, ts int64) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM "+rollupTable(tier)+" WHERE timestamp < ?", ts)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting rollups: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error counting deleted rollups: %w", err)
+	}
+
+	if deleted > 0 {
+		if _, err = tx.ExecContext(ctx, emptySeriesSQL()); err != nil {
+			return 0, fmt.Errorf("error deleting empty series: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing transaction: %w", err)
+	}
+	return deleted, nil
+}
+
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// rollupWatermark returns the end of the last bucket rolled up into tier.
+func rollupWatermark(ctx context.Context, q queryer, tier domain.RollupTier) (int64, bool, error) {
+	var watermark int64
+	err := q.QueryRowContext(ctx, "SELECT watermark FROM rollup_state WHERE tier = ?", tier.Name).Scan(&watermark)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("error reading watermark of tier %s: %w", tier.Name, err)
+	}
+	return watermark, true, nil
+}
+
+// metricSource is a view of the metric shape serving start <= timestamp <=
+// end.
+type metricSource struct {
+	view  string
+	start int64
+	end   int64
+}
+
+// metricSources picks the finest resolution whose oldest data still covers
+// start. When raw samples do not reach back that far, the range is served
+// from the chosen tier up to its watermark and continued from the finer
+// tiers and finally the raw samples.
+func (s *SQLiteStore) metricSources(ctx context.Context, start, end int64) ([]metricSource, error) {
+	raw := []metricSource{{view: "metrics", start: start, end: end}}
+
+	rawEarliest, rawOK, err := s.earliest(ctx, "samples")
+	if err != nil || (rawOK && rawEarliest <= start) {
+		return raw, err
+	}
+
+	chosen := -1
+	for i, tier := range domain.RollupTiers {
+		earliest, ok, err := s.earliest(ctx, rollupTable(tier))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if earliest <= start {
+			chosen = i
+			break
+		}
+		// Nothing covers start, so fall back to whatever reaches furthest.
+		if !rawOK || earliest < rawEarliest {
+			chosen, rawEarliest, rawOK = i, earliest, true
+		}
+	}
+	if chosen < 0 {
+		return raw, nil
+	}
+
+	var sources []metricSource
+	from := start
+	for i := chosen; i >= 0; i-- {
+		tier := domain.RollupTiers[i]
+		watermark, rolled, err := rollupWatermark(ctx, s.db, tier)
+		if err != nil {
+			return nil, err
+		}
+		if !rolled || watermark <= from {
+			continue
+		}
+		if watermark > end {
+			return append(sources, metricSource{view: rollupView(tier), start: from, end: end}), nil
+		}
+		sources = append(sources, metricSource{view: rollupView(tier), start: from, end: watermark - 1})
+		from = watermark
+	}
+	return append(sources, metricSource{view: "metrics", start: from, end: end}), nil
+}
+
+func (s *SQLiteStore) earliest(ctx context.Context, table string) (int64, bool, error) {
+	var earliest sql.NullInt64
+	if err := s.db.QueryRowContext(ctx, "SELECT MIN(timestamp) FROM "+table).Scan(&earliest); err != nil {
+		return 0, false, fmt.Errorf("error reading %s: %w", table, err)
+	}
+	return earliest.Int64, earliest.Valid, nil
+}
@@ -0,0 +1,699 @@
+// Package storetest holds a conformance suite that every domain.MetricStore
+// implementation is expected to pass.
+package storetest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"metrics-app/internal/domain"
+)
+
+// Factory returns a new, uninitialized and empty store. Run calls Init on it
+// and closes it when the sub-test finishes.
+type Factory func(t *testing.T) domain.MetricStore
+
+const base int64 = 1722441990
+
+// Run executes the conformance suite against stores produced by newStore.
+func Run(t *testing.T, newStore Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, store domain.MetricStore)
+	}{
+		{"StoreAndGet", testStoreAndGet},
+		{"Ordering", testOrdering},
+		{"InclusiveTimeBounds", testInclusiveTimeBounds},
+		{"LimitOffset", testLimitOffset},
+		{"DescendingOrder", testDescendingOrder},
+		{"CursorPagination", testCursorPagination},
+		{"DuplicateTimestamps", testDuplicateTimestamps},
+		{"InvalidMetrics", testInvalidMetrics},
+		{"BatchWrite", testBatchWrite},
+		{"LabelledMetrics", testLabelledMetrics},
+		{"Samples", testSamples},
+		{"SeriesSelectors", testSeriesSelectors},
+		{"Aggregation", testAggregation},
+		{"Statistics", testStatistics},
+		{"LatestSamples", testLatestSamples},
+		{"DeleteBefore", testDeleteBefore},
+		{"ContextCancellation", testContextCancellation},
+		{"Close", testClose},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newStore(t)
+			require.NoError(t, store.Init(), "Init should not return an error")
+			t.Cleanup(func() { store.Close() })
+
+			tc.test(t, store)
+		})
+	}
+}
+
+func seed(t *testing.T, store domain.MetricStore, metrics ...domain.Metric) {
+	t.Helper()
+	for _, m := range metrics {
+		require.NoError(t, store.StoreMetric(context.Background(), m))
+	}
+}
+
+// series returns n metrics ten seconds apart starting at base.
+func series(n int) []domain.Metric {
+	metrics := make([]domain.Metric, n)
+	for i := range metrics {
+		metrics[i] = domain.Metric{Timestamp: base + int64(i)*10, CPULoad: float64(i) * 10, Concurrency: i * 100}
+	}
+	return metrics
+}
+
+func testStoreAndGet(t *testing.T, store domain.MetricStore) {
+	metric := domain.Metric{Timestamp: base, CPULoad: 75.5, Concurrency: 250000}
+	seed(t, store, metric)
+
+	retrievedMetrics, err := store.GetMetrics(context.Background(), base, base, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Metric{metric}, retrievedMetrics, "Retrieved metric should match stored metric")
+}
+
+func testOrdering(t *testing.T, store domain.MetricStore) {
+	metrics := series(5)
+	seed(t, store, metrics[3], metrics[0], metrics[4], metrics[2], metrics[1])
+
+	retrievedMetrics, err := store.GetMetrics(context.Background(), base, base+100, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, metrics, retrievedMetrics, "Metrics should be ordered by ascending timestamp")
+}
+
+func testInclusiveTimeBounds(t *testing.T, store domain.MetricStore) {
+	metrics := series(6)
+	seed(t, store, metrics...)
+	ctx := context.Background()
+
+	retrievedMetrics, err := store.GetMetrics(ctx, metrics[1].Timestamp, metrics[4].Timestamp, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, metrics[1:5], retrievedMetrics, "Both bounds should be inclusive")
+
+	retrievedMetrics, err = store.GetMetrics(ctx, metrics[1].Timestamp+1, metrics[4].Timestamp-1, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, metrics[2:4], retrievedMetrics, "Metrics just outside the bounds should be excluded")
+
+	retrievedMetrics, err = store.GetMetrics(ctx, metrics[5].Timestamp+1, metrics[5].Timestamp+100, 0, 0)
+	assert.NoError(t, err)
+	assert.Len(t, retrievedMetrics, 0, "Range after the data should be empty")
+
+	retrievedMetrics, err = store.GetMetrics(ctx, metrics[4].Timestamp, metrics[1].Timestamp, 0, 0)
+	assert.NoError(t, err)
+	assert.Len(t, retrievedMetrics, 0, "Inverted range should be empty")
+}
+
+func testLimitOffset(t *testing.T, store domain.MetricStore) {
+	metrics := series(6)
+	seed(t, store, metrics...)
+	ctx := context.Background()
+
+	tests := []struct {
+		name          string
+		limit, offset int
+		expected      []domain.Metric
+	}{
+		{"zero limit returns everything", 0, 0, metrics},
+		{"negative limit returns everything", -1, 0, metrics},
+		{"first page", 2, 0, metrics[0:2]},
+		{"middle page", 2, 2, metrics[2:4]},
+		{"last partial page", 4, 4, metrics[4:6]},
+		{"offset without limit", 0, 3, metrics[3:6]},
+		{"negative offset is treated as zero", 2, -5, metrics[0:2]},
+		{"offset at the end", 2, 6, nil},
+		{"offset beyond the end", 2, 100, nil},
+	}
+
+	for _, tc := range tests {
+		retrievedMetrics, err := store.GetMetrics(ctx, base, base+1000, tc.limit, tc.offset)
+		assert.NoError(t, err, tc.name)
+		if tc.expected == nil {
+			assert.Len(t, retrievedMetrics, 0, tc.name)
+			continue
+		}
+		assert.Equal(t, tc.expected, retrievedMetrics, tc.name)
+	}
+}
+
+func testDescendingOrder(t *testing.T, store domain.MetricStore) {
+	hostA := domain.Labels{"host": "a"}
+	hostB := domain.Labels{"host": "b"}
+	seed(t, store,
+		domain.Metric{Timestamp: base, CPULoad: 1, Concurrency: 1, Labels: hostA},
+		domain.Metric{Timestamp: base, CPULoad: 2, Concurrency: 2, Labels: hostB},
+		domain.Metric{Timestamp: base + 10, CPULoad: 3, Concurrency: 3, Labels: hostA},
+	)
+	ctx := context.Background()
+
+	metrics, err := store.QueryMetrics(ctx, domain.Query{Start: base, End: base + 10, Descending: true})
+	require.NoError(t, err)
+	assert.Equal(t, []domain.Metric{
+		{Timestamp: base + 10, CPULoad: 3, Concurrency: 3, Labels: hostA},
+		{Timestamp: base, CPULoad: 2, Concurrency: 2, Labels: hostB},
+		{Timestamp: base, CPULoad: 1, Concurrency: 1, Labels: hostA},
+	}, metrics, "Descending should reverse the timestamp and label set order")
+
+	metrics, err = store.QueryMetrics(ctx, domain.Query{Start: base, End: base + 10, Limit: 1, Offset: 1, Descending: true})
+	require.NoError(t, err)
+	assert.Equal(t, []domain.Metric{{Timestamp: base, CPULoad: 2, Concurrency: 2, Labels: hostB}}, metrics, "Paging should apply after ordering")
+
+	samples, err := store.QuerySamples(ctx, domain.Query{Start: base, End: base, Descending: true})
+	require.NoError(t, err)
+	var order []string
+	for _, sample := range samples {
+		order = append(order, sample.Labels["host"]+"/"+sample.Name)
+	}
+	assert.Equal(t, []string{"b/cpu_load", "b/concurrency", "a/cpu_load", "a/concurrency"}, order)
+}
+
+func testCursorPagination(t *testing.T, store domain.MetricStore) {
+	hostA := domain.Labels{"host": "a"}
+	hostB := domain.Labels{"host": "b"}
+	metrics := []domain.Metric{
+		{Timestamp: base, CPULoad: 1, Concurrency: 1, Labels: hostA},
+		{Timestamp: base, CPULoad: 2, Concurrency: 2, Labels: hostB},
+		{Timestamp: base + 10, CPULoad: 3, Concurrency: 3, Labels: hostB},
+		{Timestamp: base + 20, CPULoad: 4, Concurrency: 4, Labels: hostA},
+	}
+	seed(t, store, metrics...)
+	ctx := context.Background()
+	query := domain.Query{Start: base - 100, End: base + 100, Limit: 2}
+
+	page, err := store.QueryMetrics(ctx, query)
+	require.NoError(t, err)
+	require.Equal(t, metrics[:2], page)
+
+	// A row written before the cursor shifts offsets but not the keyset.
+	seed(t, store, domain.Metric{Timestamp: base - 10, CPULoad: 5, Concurrency: 5})
+
+	cursor := domain.MetricCursor(page[1])
+	query.Cursor = &cursor
+	page, err = store.QueryMetrics(ctx, query)
+	require.NoError(t, err)
+	assert.Equal(t, metrics[2:4], page, "The next page should start right after the cursor")
+
+	cursor = domain.MetricCursor(page[1])
+	page, err = store.QueryMetrics(ctx, query)
+	require.NoError(t, err)
+	assert.Len(t, page, 0, "Nothing should follow the last row")
+
+	cursor = domain.MetricCursor(metrics[2])
+	page, err = store.QueryMetrics(ctx, domain.Query{Start: base - 100, End: base + 100, Limit: 2, Descending: true, Cursor: &cursor})
+	require.NoError(t, err)
+	assert.Equal(t, []domain.Metric{metrics[1], metrics[0]}, page, "A descending cursor should page towards older rows")
+
+	count, err := store.CountMetrics(ctx, query)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), count, "CountMetrics should ignore the cursor and limit")
+
+	count, err = store.CountMetrics(ctx, domain.Query{Selector: domain.SeriesSelector{Matchers: []domain.LabelMatcher{{Name: "host", Type: domain.MatchEqual, Value: "b"}}}, Start: base - 100, End: base + 100})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), count, "CountMetrics should apply the label matchers")
+
+	sampleCursor := domain.Cursor{Timestamp: base, Labels: hostB.Key(), Name: domain.MetricConcurrency}
+	samples, err := store.QuerySamples(ctx, domain.Query{Start: base - 100, End: base + 100, Limit: 2, Cursor: &sampleCursor})
+	require.NoError(t, err)
+	require.Len(t, samples, 2)
+	assert.Equal(t, domain.Sample{Name: domain.MetricCPULoad, Labels: hostB, Timestamp: base, Value: 2}, samples[0], "Samples should continue with the name after the cursor")
+	assert.Equal(t, base+10, samples[1].Timestamp)
+
+	count, err = store.CountSamples(ctx, domain.Query{Selector: domain.SeriesSelector{Name: domain.MetricCPULoad}, Start: base - 100, End: base + 100, Cursor: &sampleCursor})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), count)
+}
+
+func testDuplicateTimestamps(t *testing.T, store domain.MetricStore) {
+	original := domain.Metric{Timestamp: base, CPULoad: 10, Concurrency: 10}
+	seed(t, store, original)
+	ctx := context.Background()
+
+	err := store.StoreMetric(ctx, domain.Metric{Timestamp: base, CPULoad: 20, Concurrency: 20})
+	assert.ErrorIs(t, err, domain.ErrDuplicateMetric, "Duplicate timestamp should be rejected")
+
+	result, err := store.StoreMetrics(ctx, []domain.Metric{
+		{Timestamp: base, CPULoad: 30, Concurrency: 30},
+		{Timestamp: base + 10, CPULoad: 40, Concurrency: 40},
+		{Timestamp: base + 10, CPULoad: 50, Concurrency: 50},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.Stored)
+	if assert.Len(t, result.Rejected, 2) {
+		assert.Equal(t, 0, result.Rejected[0].Index)
+		assert.ErrorIs(t, result.Rejected[0].Err, domain.ErrDuplicateMetric)
+		assert.Equal(t, 2, result.Rejected[1].Index, "Duplicate inside the batch should be rejected")
+		assert.ErrorIs(t, result.Rejected[1].Err, domain.ErrDuplicateMetric)
+	}
+
+	retrievedMetrics, err := store.GetMetrics(ctx, base, base+100, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Metric{original, {Timestamp: base + 10, CPULoad: 40, Concurrency: 40}}, retrievedMetrics,
+		"First write for a timestamp should win")
+}
+
+func testInvalidMetrics(t *testing.T, store domain.MetricStore) {
+	ctx := context.Background()
+
+	assert.ErrorIs(t, store.StoreMetric(ctx, domain.Metric{Timestamp: 0, CPULoad: 1}), domain.ErrInvalidTimestamp)
+	assert.ErrorIs(t, store.StoreMetric(ctx, domain.Metric{Timestamp: base, CPULoad: 101}), domain.ErrInvalidCPULoad)
+	assert.ErrorIs(t, store.StoreMetric(ctx, domain.Metric{Timestamp: base, Concurrency: -1}), domain.ErrInvalidConcurrency)
+
+	retrievedMetrics, err := store.GetMetrics(ctx, 0, base+100, 0, 0)
+	assert.NoError(t, err)
+	assert.Len(t, retrievedMetrics, 0, "Invalid metrics should not be stored")
+}
+
+func testBatchWrite(t *testing.T, store domain.MetricStore) {
+	metrics := series(4)
+	ctx := context.Background()
+
+	result, err := store.StoreMetrics(ctx, metrics)
+	assert.NoError(t, err)
+	assert.Equal(t, len(metrics), result.Stored)
+	assert.Empty(t, result.Rejected)
+
+	result, err = store.StoreMetrics(ctx, nil)
+	assert.NoError(t, err, "Empty batch should be accepted")
+	assert.Equal(t, 0, result.Stored)
+
+	retrievedMetrics, err := store.GetMetrics(ctx, base, base+100, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, metrics, retrievedMetrics)
+}
+
+func testLabelledMetrics(t *testing.T, store domain.MetricStore) {
+	web1 := domain.Metric{Timestamp: base, CPULoad: 10, Concurrency: 1, Labels: domain.Labels{"host": "web-1"}}
+	web2 := domain.Metric{Timestamp: base, CPULoad: 20, Concurrency: 2, Labels: domain.Labels{"host": "web-2"}}
+	unlabelled := domain.Metric{Timestamp: base, CPULoad: 30, Concurrency: 3}
+	seed(t, store, web2, unlabelled, web1)
+	ctx := context.Background()
+
+	err := store.StoreMetric(ctx, domain.Metric{Timestamp: base, CPULoad: 40, Concurrency: 4, Labels: domain.Labels{"host": "web-1"}})
+	assert.ErrorIs(t, err, domain.ErrDuplicateMetric, "Same series and timestamp should be rejected")
+
+	retrievedMetrics, err := store.GetMetrics(ctx, base, base, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Metric{web1, web2, unlabelled}, retrievedMetrics,
+		"Series sharing a timestamp should be ordered by label set")
+
+	retrievedMetrics, err = store.QueryMetrics(ctx, domain.Query{
+		Selector: domain.SeriesSelector{Matchers: []domain.LabelMatcher{{Name: "host", Type: domain.MatchEqual, Value: "web-2"}}},
+		Start:    base,
+		End:      base,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Metric{web2}, retrievedMetrics)
+
+	retrievedMetrics, err = store.QueryMetrics(ctx, domain.Query{
+		Selector: domain.SeriesSelector{Matchers: []domain.LabelMatcher{{Name: "host", Type: domain.MatchEqual, Value: ""}}},
+		Start:    base,
+		End:      base,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Metric{unlabelled}, retrievedMetrics, "A missing label should match the empty string")
+
+	retrievedMetrics, err = store.QueryMetrics(ctx, domain.Query{Start: base, End: base, Limit: 1, Offset: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Metric{web2}, retrievedMetrics, "Limit and offset should count view rows")
+}
+
+func testSamples(t *testing.T, store domain.MetricStore) {
+	samples := []domain.Sample{
+		{Name: "mem_used_bytes", Labels: domain.Labels{"host": "web-1"}, Timestamp: base + 10, Value: 2048},
+		{Name: "load1", Labels: domain.Labels{"host": "web-1"}, Timestamp: base, Value: 0.5},
+		{Name: "mem_used_bytes", Labels: domain.Labels{"host": "web-1"}, Timestamp: base, Value: 1024},
+		{Name: "load1", Labels: domain.Labels{"host": "web-2"}, Timestamp: base, Value: 1.5},
+	}
+	ctx := context.Background()
+
+	result, err := store.StoreSamples(ctx, samples)
+	assert.NoError(t, err)
+	assert.Equal(t, len(samples), result.Stored)
+
+	result, err = store.StoreSamples(ctx, []domain.Sample{
+		{Name: "load1", Labels: domain.Labels{"host": "web-1"}, Timestamp: base, Value: 9},
+		{Name: "bad name", Timestamp: base, Value: 1},
+		{Name: "load1", Labels: domain.Labels{"bad-label": "x"}, Timestamp: base, Value: 1},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.Stored)
+	if assert.Len(t, result.Rejected, 3) {
+		assert.ErrorIs(t, result.Rejected[0].Err, domain.ErrDuplicateMetric)
+		assert.ErrorIs(t, result.Rejected[1].Err, domain.ErrInvalidMetricName)
+		assert.ErrorIs(t, result.Rejected[2].Err, domain.ErrInvalidLabelName)
+	}
+
+	retrievedSamples, err := store.QuerySamples(ctx, domain.Query{Start: base, End: base + 10})
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Sample{samples[1], samples[2], samples[3], samples[0]}, retrievedSamples,
+		"Samples should be ordered by timestamp, label set and name")
+
+	retrievedSamples, err = store.QuerySamples(ctx, domain.Query{Selector: domain.SeriesSelector{Name: "mem_used_bytes"}, Start: base, End: base + 10})
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Sample{samples[2], samples[0]}, retrievedSamples)
+
+	retrievedSamples, err = store.QuerySamples(ctx, domain.Query{Start: base, End: base + 10, Limit: 2, Offset: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Sample{samples[2], samples[3]}, retrievedSamples)
+
+	retrievedMetrics, err := store.GetMetrics(ctx, base, base+10, 0, 0)
+	assert.NoError(t, err)
+	assert.Len(t, retrievedMetrics, 0, "Samples of other names should not appear in the Metric view")
+
+	_, err = store.StoreSamples(ctx, []domain.Sample{{Name: domain.MetricCPULoad, Labels: domain.Labels{"host": "db"}, Timestamp: base, Value: 55}})
+	assert.NoError(t, err)
+	retrievedMetrics, err = store.GetMetrics(ctx, base, base+10, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Metric{{Timestamp: base, CPULoad: 55, Labels: domain.Labels{"host": "db"}}}, retrievedMetrics,
+		"cpu_load samples should be visible through the Metric view")
+}
+
+func testSeriesSelectors(t *testing.T, store domain.MetricStore) {
+	ctx := context.Background()
+	_, err := store.StoreSamples(ctx, []domain.Sample{
+		{Name: "requests", Labels: domain.Labels{"host": "web-1", "region": "eu"}, Timestamp: base, Value: 1},
+		{Name: "requests", Labels: domain.Labels{"host": "web-2", "region": "us"}, Timestamp: base, Value: 2},
+		{Name: "requests", Labels: domain.Labels{"host": "db-1", "region": "eu"}, Timestamp: base, Value: 3},
+		{Name: "errors", Labels: domain.Labels{"host": "web-1", "region": "eu"}, Timestamp: base, Value: 4},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		selector domain.SeriesSelector
+		expected []float64
+	}{
+		{"name only", domain.SeriesSelector{Name: "requests"}, []float64{3, 1, 2}},
+		{"equal", domain.SeriesSelector{Matchers: []domain.LabelMatcher{{Name: "host", Type: domain.MatchEqual, Value: "web-1"}}}, []float64{4, 1}},
+		{"not equal", domain.SeriesSelector{Name: "requests", Matchers: []domain.LabelMatcher{{Name: "region", Type: domain.MatchNotEqual, Value: "eu"}}}, []float64{2}},
+		{"regexp is anchored", domain.SeriesSelector{Name: "requests", Matchers: []domain.LabelMatcher{{Name: "host", Type: domain.MatchRegexp, Value: "web"}}}, nil},
+		{"regexp", domain.SeriesSelector{Name: "requests", Matchers: []domain.LabelMatcher{{Name: "host", Type: domain.MatchRegexp, Value: "web-.*"}}}, []float64{1, 2}},
+		{"not regexp", domain.SeriesSelector{Name: "requests", Matchers: []domain.LabelMatcher{{Name: "host", Type: domain.MatchNotRegexp, Value: "web-.*"}}}, []float64{3}},
+		{"several matchers", domain.SeriesSelector{Matchers: []domain.LabelMatcher{
+			{Name: "region", Type: domain.MatchEqual, Value: "eu"},
+			{Name: "host", Type: domain.MatchRegexp, Value: "web-.*"},
+		}}, []float64{4, 1}},
+		{"unknown name", domain.SeriesSelector{Name: "missing"}, nil},
+	}
+
+	for _, tc := range tests {
+		retrievedSamples, err := store.QuerySamples(ctx, domain.Query{Selector: tc.selector, Start: base, End: base})
+		assert.NoError(t, err, tc.name)
+		var values []float64
+		for _, sample := range retrievedSamples {
+			values = append(values, sample.Value)
+		}
+		assert.Equal(t, tc.expected, values, tc.name)
+	}
+
+	_, err = store.QuerySamples(ctx, domain.Query{
+		Selector: domain.SeriesSelector{Matchers: []domain.LabelMatcher{{Name: "host", Type: domain.MatchRegexp, Value: "("}}},
+		Start:    base,
+		End:      base,
+	})
+	assert.ErrorIs(t, err, domain.ErrInvalidMatcher, "Invalid regular expression should be reported")
+}
+
+func testAggregation(t *testing.T, store domain.MetricStore) {
+	const step = 60
+	b0 := base - base%step
+	hostA := domain.Labels{"host": "a"}
+	hostB := domain.Labels{"host": "b"}
+
+	var samples []domain.Sample
+	for i := int64(0); i < 12; i++ {
+		samples = append(samples, domain.Sample{Name: domain.MetricCPULoad, Labels: hostA, Timestamp: b0 + i*10, Value: float64(i + 1)})
+	}
+	samples = append(samples,
+		domain.Sample{Name: domain.MetricCPULoad, Labels: hostB, Timestamp: b0 + 5, Value: 100},
+		domain.Sample{Name: domain.MetricConcurrency, Labels: hostA, Timestamp: b0, Value: 7},
+	)
+	ctx := context.Background()
+	_, err := store.StoreSamples(ctx, samples)
+	require.NoError(t, err)
+
+	tests := []struct {
+		fn       domain.AggregateFunc
+		expected []float64
+	}{
+		{domain.AggregateAvg, []float64{3.5, 9.5}},
+		{domain.AggregateMin, []float64{1, 7}},
+		{domain.AggregateMax, []float64{6, 12}},
+		{domain.AggregateSum, []float64{21, 57}},
+		{domain.AggregateCount, []float64{6, 6}},
+		{domain.AggregateP50, []float64{3.5, 9.5}},
+		{domain.AggregateP95, []float64{5.75, 11.75}},
+	}
+
+	for _, tc := range tests {
+		series, err := store.AggregateSamples(ctx, domain.AggregateQuery{
+			Selector: domain.SeriesSelector{Name: domain.MetricCPULoad},
+			Start:    b0,
+			End:      b0 + 2*step,
+			Step:     step,
+			Func:     tc.fn,
+		})
+		assert.NoError(t, err, string(tc.fn))
+		if !assert.Len(t, series, 2, string(tc.fn)) {
+			continue
+		}
+		assert.Equal(t, hostA, series[0].Labels, "Series should be ordered by label set")
+		if assert.Len(t, series[0].Points, 2, string(tc.fn)) {
+			assert.Equal(t, b0, series[0].Points[0].Timestamp, "Buckets should be labelled with their start")
+			assert.Equal(t, b0+step, series[0].Points[1].Timestamp)
+			assert.InDelta(t, tc.expected[0], series[0].Points[0].Value, 1e-9, string(tc.fn))
+			assert.InDelta(t, tc.expected[1], series[0].Points[1].Value, 1e-9, string(tc.fn))
+		}
+		if assert.Len(t, series[1].Points, 1, "Empty buckets should be omitted") {
+			assert.Equal(t, b0, series[1].Points[0].Timestamp)
+		}
+	}
+
+	series, err := store.AggregateSamples(ctx, domain.AggregateQuery{Start: b0 + 15, End: b0 + 25, Step: step, Func: domain.AggregateCount})
+	assert.NoError(t, err)
+	if assert.Len(t, series, 1, "Only samples inside the range should be aggregated") {
+		assert.Equal(t, []domain.Point{{Timestamp: b0, Value: 1}}, series[0].Points)
+	}
+
+	series, err = store.AggregateSamples(ctx, domain.AggregateQuery{
+		Selector: domain.SeriesSelector{Matchers: []domain.LabelMatcher{{Name: "host", Type: domain.MatchEqual, Value: "a"}}},
+		Start:    b0,
+		End:      b0,
+		Step:     step,
+		Func:     domain.AggregateMax,
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, series, 2) {
+		assert.Equal(t, domain.MetricConcurrency, series[0].Name, "Series should be ordered by name first")
+		assert.Equal(t, domain.MetricCPULoad, series[1].Name)
+	}
+
+	series, err = store.AggregateSamples(ctx, domain.AggregateQuery{Start: b0 + 1000, End: b0 + 2000, Step: step, Func: domain.AggregateAvg})
+	assert.NoError(t, err)
+	assert.Len(t, series, 0)
+
+	_, err = store.AggregateSamples(ctx, domain.AggregateQuery{Start: b0, End: b0 + step, Step: step, Func: "median"})
+	assert.ErrorIs(t, err, domain.ErrInvalidAggregateFunc)
+
+	_, err = store.AggregateSamples(ctx, domain.AggregateQuery{Start: b0, End: b0 + step, Step: 0, Func: domain.AggregateAvg})
+	assert.ErrorIs(t, err, domain.ErrInvalidStep)
+}
+
+func testStatistics(t *testing.T, store domain.MetricStore) {
+	hostA := domain.Labels{"host": "a"}
+	hostB := domain.Labels{"host": "b"}
+
+	var samples []domain.Sample
+	// Values are written out of order so percentiles cannot rely on the
+	// insertion order.
+	for _, v := range []float64{7, 3, 10, 1, 5, 9, 2, 8, 4, 6} {
+		samples = append(samples, domain.Sample{Name: domain.MetricCPULoad, Labels: hostA, Timestamp: base + int64(v), Value: v})
+	}
+	samples = append(samples,
+		domain.Sample{Name: domain.MetricCPULoad, Labels: hostB, Timestamp: base + 1, Value: 42},
+		domain.Sample{Name: domain.MetricConcurrency, Labels: hostA, Timestamp: base + 1, Value: 3},
+	)
+	ctx := context.Background()
+	_, err := store.StoreSamples(ctx, samples)
+	require.NoError(t, err)
+
+	stats, err := store.SummarizeSamples(ctx, domain.Query{
+		Selector: domain.SeriesSelector{Name: domain.MetricCPULoad},
+		Start:    base,
+		End:      base + 100,
+	})
+	require.NoError(t, err)
+	require.Len(t, stats, 2)
+	assert.Equal(t, hostA, stats[0].Labels, "Statistics should be ordered by label set")
+
+	st := stats[0].Statistics
+	assert.Equal(t, int64(10), st.Count)
+	assert.Equal(t, 1.0, st.Min)
+	assert.Equal(t, 10.0, st.Max)
+	assert.InDelta(t, 5.5, st.Mean, 1e-9)
+	assert.InDelta(t, 2.8722813, st.StdDev, 1e-6, "StdDev should be the population standard deviation")
+	assert.InDelta(t, 5.5, st.P50, 1e-9)
+	assert.InDelta(t, 9.1, st.P90, 1e-9)
+	assert.InDelta(t, 9.55, st.P95, 1e-9)
+	assert.InDelta(t, 9.91, st.P99, 1e-9)
+
+	single := stats[1].Statistics
+	assert.Equal(t, domain.Statistics{Count: 1, Min: 42, Max: 42, Mean: 42, P50: 42, P90: 42, P95: 42, P99: 42}, single)
+
+	stats, err = store.SummarizeSamples(ctx, domain.Query{Start: base + 2, End: base + 4})
+	require.NoError(t, err)
+	if assert.Len(t, stats, 1, "Only samples inside the range should be summarised") {
+		assert.Equal(t, int64(3), stats[0].Count)
+		assert.Equal(t, 3.0, stats[0].P50)
+	}
+
+	stats, err = store.SummarizeSamples(ctx, domain.Query{
+		Selector: domain.SeriesSelector{Matchers: []domain.LabelMatcher{{Name: "host", Type: domain.MatchEqual, Value: "a"}}},
+		Start:    base,
+		End:      base + 100,
+	})
+	require.NoError(t, err)
+	if assert.Len(t, stats, 2) {
+		assert.Equal(t, domain.MetricConcurrency, stats[0].Name, "Statistics should be ordered by name first")
+		assert.Equal(t, domain.MetricCPULoad, stats[1].Name)
+	}
+
+	stats, err = store.SummarizeSamples(ctx, domain.Query{Start: base + 1000, End: base + 2000})
+	assert.NoError(t, err)
+	assert.Len(t, stats, 0)
+
+	// Large values with little spread, as of memory in bytes, must not lose
+	// the spread to rounding
+	var large []domain.Sample
+	for i := int64(0); i < 10; i++ {
+		large = append(large, domain.Sample{Name: "memory_used_bytes", Timestamp: base + 3000 + i, Value: 1e9 + float64(i%2)})
+	}
+	_, err = store.StoreSamples(ctx, large)
+	require.NoError(t, err)
+	stats, err = store.SummarizeSamples(ctx, domain.Query{Selector: domain.SeriesSelector{Name: "memory_used_bytes"}, Start: base + 3000, End: base + 3100})
+	require.NoError(t, err)
+	if assert.Len(t, stats, 1) {
+		assert.InDelta(t, 0.5, stats[0].StdDev, 1e-6)
+	}
+
+	_, err = store.SummarizeSamples(ctx, domain.Query{
+		Selector: domain.SeriesSelector{Matchers: []domain.LabelMatcher{{Name: "host", Type: domain.MatchRegexp, Value: "("}}},
+	})
+	assert.ErrorIs(t, err, domain.ErrInvalidMatcher)
+}
+
+func testLatestSamples(t *testing.T, store domain.MetricStore) {
+	ctx := context.Background()
+	hostA := domain.Labels{"host": "a"}
+	hostB := domain.Labels{"host": "b"}
+
+	_, err := store.StoreSamples(ctx, []domain.Sample{
+		{Name: domain.MetricCPULoad, Labels: hostA, Timestamp: base + 20, Value: 3},
+		{Name: domain.MetricCPULoad, Labels: hostA, Timestamp: base + 30, Value: 4},
+		// Written out of order: the newest sample is not the last one.
+		{Name: domain.MetricCPULoad, Labels: hostA, Timestamp: base + 10, Value: 2},
+		{Name: domain.MetricCPULoad, Labels: hostB, Timestamp: base, Value: 9},
+		{Name: "load1", Labels: hostA, Timestamp: base + 5, Value: 0.5},
+	})
+	require.NoError(t, err)
+
+	latest, err := store.LatestSamples(ctx, domain.SeriesSelector{})
+	require.NoError(t, err)
+	assert.Equal(t, []domain.Sample{
+		{Name: domain.MetricCPULoad, Labels: hostA, Timestamp: base + 30, Value: 4},
+		{Name: domain.MetricCPULoad, Labels: hostB, Timestamp: base, Value: 9},
+		{Name: "load1", Labels: hostA, Timestamp: base + 5, Value: 0.5},
+	}, latest, "Latest samples should be ordered by name and label set")
+
+	latest, err = store.LatestSamples(ctx, domain.SeriesSelector{
+		Name:     domain.MetricCPULoad,
+		Matchers: []domain.LabelMatcher{{Name: "host", Type: domain.MatchEqual, Value: "b"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []domain.Sample{{Name: domain.MetricCPULoad, Labels: hostB, Timestamp: base, Value: 9}}, latest)
+
+	latest, err = store.LatestSamples(ctx, domain.SeriesSelector{Name: "missing"})
+	require.NoError(t, err)
+	assert.Len(t, latest, 0)
+}
+
+func testDeleteBefore(t *testing.T, store domain.MetricStore) {
+	ctx := context.Background()
+	seed(t, store, series(5)...)
+	_, err := store.StoreSamples(ctx, []domain.Sample{
+		{Name: "load1", Labels: domain.Labels{"host": "a"}, Timestamp: base + 5, Value: 0.5},
+	})
+	require.NoError(t, err)
+
+	deleted, err := store.DeleteBefore(ctx, base+30)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), deleted, "Every sample before the cutoff should be deleted")
+
+	remaining, err := store.GetMetrics(ctx, base-1000, base+1000, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, series(5)[3:], remaining, "Samples at the cutoff should be kept")
+
+	samples, err := store.QuerySamples(ctx, domain.Query{Selector: domain.SeriesSelector{Name: "load1"}, Start: base - 1000, End: base + 1000})
+	require.NoError(t, err)
+	assert.Len(t, samples, 0)
+
+	deleted, err = store.DeleteBefore(ctx, base+30)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), deleted)
+
+	seed(t, store, domain.Metric{Timestamp: base, CPULoad: 1, Concurrency: 1})
+	restored, err := store.GetMetrics(ctx, base, base, 0, 0)
+	require.NoError(t, err)
+	assert.Len(t, restored, 1, "A purged timestamp should be writable again")
+}
+
+func testContextCancellation(t *testing.T, store domain.MetricStore) {
+	seed(t, store, series(3)...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	retrievedMetrics, err := store.GetMetrics(ctx, base, base+100, 0, 0)
+	assert.ErrorIs(t, err, context.Canceled, "GetMetrics should honour a cancelled context")
+	assert.Len(t, retrievedMetrics, 0)
+
+	err = store.StoreMetric(ctx, domain.Metric{Timestamp: base + 100, CPULoad: 1, Concurrency: 1})
+	assert.ErrorIs(t, err, context.Canceled, "StoreMetric should honour a cancelled context")
+
+	_, err = store.StoreMetrics(ctx, []domain.Metric{{Timestamp: base + 200, CPULoad: 1, Concurrency: 1}})
+	assert.ErrorIs(t, err, context.Canceled, "StoreMetrics should honour a cancelled context")
+
+	_, err = store.DeleteBefore(ctx, base+1000)
+	assert.ErrorIs(t, err, context.Canceled, "DeleteBefore should honour a cancelled context")
+
+	retrievedMetrics, err = store.GetMetrics(context.Background(), base, base+1000, 0, 0)
+	assert.NoError(t, err)
+	assert.Len(t, retrievedMetrics, 3, "Nothing should be written with a cancelled context")
+}
+
+func testClose(t *testing.T, store domain.MetricStore) {
+	seed(t, store, series(1)...)
+	ctx := context.Background()
+
+	assert.NoError(t, store.Close(), "Close should not return an error")
+	assert.NoError(t, store.Close(), "Close should be idempotent")
+
+	_, err := store.GetMetrics(ctx, base, base+100, 0, 0)
+	assert.Error(t, err, "GetMetrics should fail after Close")
+
+	err = store.StoreMetric(ctx, domain.Metric{Timestamp: base + 10, CPULoad: 1, Concurrency: 1})
+	assert.Error(t, err, "StoreMetric should fail after Close")
+
+	_, err = store.StoreMetrics(ctx, []domain.Metric{{Timestamp: base + 20, CPULoad: 1, Concurrency: 1}})
+	assert.Error(t, err, "StoreMetrics should fail after Close")
+
+	_, err = store.DeleteBefore(ctx, base+100)
+	assert.Error(t, err, "DeleteBefore should fail after Close")
+}
@@ -0,0 +1,87 @@
+package retention
+
+import (
+	"context"
+	"time"
+
+	"metrics-app/internal/domain"
+	"metrics-app/internal/util"
+)
+
+// Vacuumer is implemented by stores that can return the space of deleted
+// samples to the file system.
+type Vacuumer interface {
+	Vacuum(ctx context.Context) error
+}
+
+// Purger deletes samples older than the retention period every interval.
+// When the store is a Vacuumer it is vacuumed at most once per
+// VacuumInterval, and only after samples were deleted.
+type Purger struct {
+	Retention      time.Duration
+	Interval       time.Duration
+	VacuumInterval time.Duration
+
+	store  domain.MetricStore
+	logger *util.MetricsLogger
+	now    func() time.Time
+
+	lastVacuum         time.Time
+	deletedSinceVacuum int64
+}
+
+func NewPurger(store domain.MetricStore, logger *util.MetricsLogger, retention, interval, vacuumInterval time.Duration) *Purger {
+	return &Purger{
+		Retention:      retention,
+		Interval:       interval,
+		VacuumInterval: vacuumInterval,
+		store:          store,
+		logger:         logger,
+		now:            time.Now,
+	}
+}
+
+// Run purges once immediately and then every Interval until ctx is done.
+func (p *Purger) Run(ctx context.Context) {
+	p.logger.LogEvent(util.LOG_LEVEL_INFO, "Retention enabled. Keeping ", p.Retention, ", purging every ", p.Interval)
+	p.lastVacuum = p.now()
+
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	for {
+		p.Purge(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Purge runs a single retention pass and reports how many samples were
+// deleted.
+func (p *Purger) Purge(ctx context.Context) (int64, error) {
+	cutoff := p.now().Add(-p.Retention).Unix()
+
+	deleted, err := p.store.DeleteBefore(ctx, cutoff)
+	if err != nil {
+		p.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while purging samples before ", cutoff, ". Err - ", err)
+		return 0, err
+	}
+	p.logger.LogEvent(util.LOG_LEVEL_INFO, "Purged ", deleted, " samples older than ", time.Unix(cutoff, 0).UTC().Format(time.RFC3339))
+
+	p.deletedSinceVacuum += deleted
+	if vacuumer, ok := p.store.(Vacuumer); ok && p.deletedSinceVacuum > 0 && p.now().Sub(p.lastVacuum) >= p.VacuumInterval {
+		if err := vacuumer.Vacuum(ctx); err != nil {
+			p.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while vacuuming the store. Err - ", err)
+			return deleted, nil
+		}
+		p.logger.LogEvent(util.LOG_LEVEL_INFO, "Vacuumed the store after purging ", p.deletedSinceVacuum, " samples")
+		p.lastVacuum = p.now()
+		p.deletedSinceVacuum = 0
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,87 @@
+package retention
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"metrics-app/internal/domain"
+	"metrics-app/internal/repository"
+	"metrics-app/internal/util"
+)
+
+type vacuumingStore struct {
+	domain.MetricStore
+	vacuums int
+}
+
+func (s *vacuumingStore) Vacuum(ctx context.Context) error {
+	s.vacuums++
+	return nil
+}
+
+func TestPurger_Purge(t *testing.T) {
+	now := time.Unix(1722441990, 0)
+
+	inMemoryStore := repository.NewInMemoryStore(0)
+	require.NoError(t, inMemoryStore.Init())
+	store := &vacuumingStore{MetricStore: inMemoryStore}
+
+	ctx := context.Background()
+	_, err := store.StoreMetrics(ctx, []domain.Metric{
+		{Timestamp: now.Add(-3 * time.Hour).Unix(), CPULoad: 10, Concurrency: 1},
+		{Timestamp: now.Add(-2 * time.Hour).Unix(), CPULoad: 20, Concurrency: 2},
+		{Timestamp: now.Add(-30 * time.Minute).Unix(), CPULoad: 30, Concurrency: 3},
+	})
+	require.NoError(t, err)
+
+	purger := NewPurger(store, &util.MetricsLogger{}, time.Hour, time.Minute, 24*time.Hour)
+	purger.now = func() time.Time { return now }
+	purger.lastVacuum = now
+
+	deleted, err := purger.Purge(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), deleted, "Samples older than the retention period should be deleted")
+	assert.Equal(t, 0, store.vacuums, "The store should not be vacuumed before VacuumInterval")
+
+	remaining, err := store.GetMetrics(ctx, 0, now.Unix(), 0, 0)
+	require.NoError(t, err)
+	assert.Len(t, remaining, 1)
+
+	now = now.Add(24 * time.Hour)
+	deleted, err = purger.Purge(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), deleted)
+	assert.Equal(t, 1, store.vacuums, "The store should be vacuumed once VacuumInterval has passed")
+
+	now = now.Add(48 * time.Hour)
+	_, err = purger.Purge(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, store.vacuums, "Nothing to reclaim without deleted samples")
+}
+
+func TestPurger_RunStopsWithContext(t *testing.T) {
+	store := repository.NewInMemoryStore(0)
+	require.NoError(t, store.Init())
+
+	purger := NewPurger(store, &util.MetricsLogger{}, time.Hour, time.Millisecond, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		purger.Run(ctx)
+		close(done)
+	}()
+
+	time.Sleep(5 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run should return once the context is cancelled")
+	}
+}
@@ -0,0 +1,88 @@
+package rollup
+
+import (
+	"context"
+	"time"
+
+	"metrics-app/internal/domain"
+	"metrics-app/internal/util"
+)
+
+// Roller is implemented by stores that keep the domain.RollupTiers.
+type Roller interface {
+	// RollUp aggregates every complete bucket that ends at or before until
+	// and reports the number of rollup rows written.
+	RollUp(ctx context.Context, until int64) (int64, error)
+	DeleteRollupsBefore(ctx context.Context, tier domain.RollupTier, ts int64) (int64, error)
+}
+
+// Worker rolls up completed buckets every Interval and deletes buckets older
+// than the retention of their tier. Tiers missing from Retention are kept
+// forever.
+type Worker struct {
+	Interval  time.Duration
+	Retention map[string]time.Duration
+
+	roller Roller
+	logger *util.MetricsLogger
+	now    func() time.Time
+}
+
+func NewWorker(roller Roller, logger *util.MetricsLogger, interval time.Duration, retention map[string]time.Duration) *Worker {
+	return &Worker{
+		Interval:  interval,
+		Retention: retention,
+		roller:    roller,
+		logger:    logger,
+		now:       time.Now,
+	}
+}
+
+// Run rolls up once immediately and then every Interval until ctx is done.
+func (w *Worker) Run(ctx context.Context) {
+	w.logger.LogEvent(util.LOG_LEVEL_INFO, "Rollups enabled. Rolling up every ", w.Interval)
+
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		w.Pass(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Pass runs a single rollup and retention pass.
+func (w *Worker) Pass(ctx context.Context) error {
+	now := w.now()
+
+	written, err := w.roller.RollUp(ctx, now.Unix())
+	if err != nil {
+		w.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while rolling up samples. Err - ", err)
+		return err
+	}
+	if written > 0 {
+		w.logger.LogEvent(util.LOG_LEVEL_DEBUG, "Rolled up ", written, " buckets")
+	}
+
+	for _, tier := range domain.RollupTiers {
+		retention, ok := w.Retention[tier.Name]
+		if !ok || retention <= 0 {
+			continue
+		}
+		cutoff := now.Add(-retention).Unix()
+		deleted, err := w.roller.DeleteRollupsBefore(ctx, tier, cutoff)
+		if err != nil {
+			w.logger.LogEvent(util.LOG_LEVEL_ERROR, "Occured while purging ", tier.Name, " rollups. Err - ", err)
+			return err
+		}
+		if deleted > 0 {
+			w.logger.LogEvent(util.LOG_LEVEL_INFO, "Purged ", deleted, " ", tier.Name, " rollups older than ", time.Unix(cutoff, 0).UTC().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
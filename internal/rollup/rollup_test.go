@@ -0,0 +1,74 @@
+package rollup
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"metrics-app/internal/domain"
+	"metrics-app/internal/repository"
+	"metrics-app/internal/util"
+)
+
+func TestWorker_Pass(t *testing.T) {
+	store := repository.NewSQLiteStore(filepath.Join(t.TempDir(), "rollup.db"))
+	require.NoError(t, store.Init())
+	defer store.Close()
+
+	const hour int64 = 1722441600
+	now := time.Unix(hour+3*3600, 0)
+
+	var metrics []domain.Metric
+	for ts := hour; ts < now.Unix(); ts += 30 {
+		metrics = append(metrics, domain.Metric{Timestamp: ts, CPULoad: 50, Concurrency: 5})
+	}
+	ctx := context.Background()
+	_, err := store.StoreMetrics(ctx, metrics)
+	require.NoError(t, err)
+
+	worker := NewWorker(store, &util.MetricsLogger{}, time.Minute, map[string]time.Duration{"1m": 90 * time.Minute})
+	worker.now = func() time.Time { return now }
+
+	require.NoError(t, worker.Pass(ctx))
+
+	_, err = store.DeleteBefore(ctx, now.Unix())
+	require.NoError(t, err)
+
+	retrieved, err := store.GetMetrics(ctx, hour, now.Unix(), 0, 0)
+	require.NoError(t, err)
+	if assert.Len(t, retrieved, 3, "Purged 1m buckets should be served from the 1h tier") {
+		assert.Equal(t, domain.Metric{Timestamp: hour, CPULoad: 50, Concurrency: 5}, retrieved[0])
+	}
+
+	retrieved, err = store.GetMetrics(ctx, hour+2*3600, now.Unix(), 0, 0)
+	require.NoError(t, err)
+	assert.Len(t, retrieved, 60, "Ranges the 1m tier still covers should use it")
+}
+
+func TestWorker_RunStopsWithContext(t *testing.T) {
+	store := repository.NewSQLiteStore(filepath.Join(t.TempDir(), "rollup.db"))
+	require.NoError(t, store.Init())
+	defer store.Close()
+
+	worker := NewWorker(store, &util.MetricsLogger{}, time.Millisecond, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		worker.Run(ctx)
+		close(done)
+	}()
+
+	time.Sleep(5 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run should return once the context is cancelled")
+	}
+}
@@ -1,38 +1,85 @@
 package router
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 
+	"metrics-app/internal/alerting"
+	"metrics-app/internal/broadcast"
 	"metrics-app/internal/domain"
 	"metrics-app/internal/endpoints"
+	"metrics-app/internal/telemetry"
 	"metrics-app/internal/util"
 )
 
-func NewRouter(metricStore domain.MetricStore, webSlogger *util.MetricsLogger) *mux.Router {
+// NewRouter builds the public API. When tel is not nil, requests and store
+// operations are recorded in it. When broadcaster is not nil, stored
+// metrics are published to it and streamed on /metrics/stream and
+// /metrics/subscribe. When alerts is not nil, its alerts are listed on
+// /alerts.
+func NewRouter(metricStore domain.MetricStore, webSlogger *util.MetricsLogger, tel *telemetry.Telemetry, broadcaster *broadcast.Broadcaster, alerts *alerting.Engine) *mux.Router {
 	r := mux.NewRouter()
 
-	addRoutes(r, metricStore, webSlogger)
+	if tel != nil {
+		metricStore = tel.InstrumentStore(metricStore)
+	}
+	if broadcaster != nil {
+		metricStore = broadcaster.WrapStore(metricStore)
+	}
+
+	addRoutes(r, metricStore, webSlogger, broadcaster, alerts)
 
-	r.Use(loggingMiddleware(webSlogger))
+	r.Use(loggingMiddleware(webSlogger, tel))
 
 	return r
 }
 
-func addRoutes(r *mux.Router, metricStore domain.MetricStore, webSlogger *util.MetricsLogger) {
+// NewInternalRouter serves the self-instrumentation of the API server. It
+// is meant for a listener that is not exposed with the public API.
+func NewInternalRouter(tel *telemetry.Telemetry) *mux.Router {
+	r := mux.NewRouter()
+	r.Handle("/internal/metrics", tel.Registry.Handler()).Methods("GET")
+	return r
+}
+
+func addRoutes(r *mux.Router, metricStore domain.MetricStore, webSlogger *util.MetricsLogger, broadcaster *broadcast.Broadcaster, alerts *alerting.Engine) {
 
 	metricsHandler := &endpoints.Metrics{}
 	metricsHandler.Init(metricStore, webSlogger)
 
+	if broadcaster != nil {
+		metricsHandler.SetBroadcaster(broadcaster)
+		r.HandleFunc("/metrics/stream", metricsHandler.StreamMetricsHandler).Methods("GET")
+		r.HandleFunc("/metrics/subscribe", metricsHandler.SubscribeHandler).Methods("GET")
+	}
+	if alerts != nil {
+		metricsHandler.SetAlerting(alerts)
+		r.HandleFunc("/alerts", metricsHandler.GetAlertsHandler).Methods("GET")
+	}
+
+	r.HandleFunc("/metrics", metricsHandler.StoreMetricsHandler).Methods("POST")
+	r.HandleFunc("/metrics", metricsHandler.GetMetricsHandler).Methods("GET")
+	r.HandleFunc("/metrics/aggregate", metricsHandler.GetAggregateHandler).Methods("GET")
+	r.HandleFunc("/metrics/stats", metricsHandler.GetStatisticsHandler).Methods("GET")
+	r.HandleFunc("/metrics/anomalies", metricsHandler.GetAnomaliesHandler).Methods("GET")
+	r.HandleFunc("/metrics/forecast", metricsHandler.GetForecastHandler).Methods("GET")
+	r.HandleFunc("/metrics/prometheus", metricsHandler.GetPrometheusHandler).Methods("GET")
 	r.HandleFunc("/metrics/{limit}/{offset}", metricsHandler.GetMetricsHandler).Methods("GET")
+	r.HandleFunc("/samples", metricsHandler.StoreSamplesHandler).Methods("POST")
+	r.HandleFunc("/samples", metricsHandler.GetSamplesHandler).Methods("GET")
+	r.HandleFunc("/samples/{limit}/{offset}", metricsHandler.GetSamplesHandler).Methods("GET")
 }
 
 func NewServer(addr string, handler http.Handler) *http.Server {
@@ -45,15 +92,38 @@ func NewServer(addr string, handler http.Handler) *http.Server {
 	}
 }
 
-func Run(metricStore domain.MetricStore, webSlogger *util.MetricsLogger) {
-	appRouter := NewRouter(metricStore, webSlogger)
+// Run serves the API until SIGINT or SIGTERM and returns once the server
+// has shut down, so the caller can stop background work and close the
+// store. The self-instrumentation is served on internalAddr unless it is
+// empty. alerts may be nil when alerting is disabled.
+func Run(metricStore domain.MetricStore, webSlogger *util.MetricsLogger, tel *telemetry.Telemetry, alerts *alerting.Engine, internalAddr string) {
+	broadcaster := broadcast.New()
+	appRouter := NewRouter(metricStore, webSlogger, tel, broadcaster, alerts)
 
 	server := NewServer(":8080", appRouter)
+	// Streams never end on their own, so Shutdown ends them to let their
+	// connections drain.
+	server.RegisterOnShutdown(broadcaster.Close)
+
+	var internalServer *http.Server
+	if internalAddr != "" && tel != nil {
+		internalServer = NewServer(internalAddr, NewInternalRouter(tel))
+		go func() {
+			log.Printf("Serving internal metrics on %s", internalServer.Addr)
+			if err := internalServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("Internal server stopped with error: %s", err.Error())
+			}
+		}()
+	}
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 
+	stopped := make(chan struct{})
+
 	go func() {
+		defer close(stopped)
+
 		<-quit
 		println()
 		log.Println("Shutting down server...")
@@ -66,11 +136,23 @@ func Run(metricStore domain.MetricStore, webSlogger *util.MetricsLogger) {
 			log.Println("Server stopped gracefully.")
 		}
 
-		os.Exit(0)
+		// Shutdown does not track hijacked WebSockets; they end once the
+		// broadcaster has closed their subscriptions.
+		if err := waitForSubscribers(broadcaster, 5*time.Second); err != nil {
+			log.Printf("Subscriptions did not end in time: %s", err.Error())
+		}
+
+		if internalServer != nil {
+			gracefulShutdown(internalServer, 5*time.Second)
+		}
 	}()
 
 	log.Printf("Listening on %s", server.Addr)
-	log.Fatal(server.ListenAndServe())
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	<-stopped
 }
 
 func gracefulShutdown(server *http.Server, maximumTime time.Duration) error {
@@ -80,11 +162,73 @@ func gracefulShutdown(server *http.Server, maximumTime time.Duration) error {
 	return server.Shutdown(ctx)
 }
 
-func loggingMiddleware(logger *util.MetricsLogger) mux.MiddlewareFunc {
+func waitForSubscribers(broadcaster *broadcast.Broadcaster, maximumTime time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), maximumTime)
+	defer cancel()
+
+	return broadcaster.Wait(ctx)
+}
+
+func loggingMiddleware(logger *util.MetricsLogger, tel *telemetry.Telemetry) mux.MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			logger.LogEvent(util.LOG_LEVEL_INFO, fmt.Sprintf("Request: %s %s", r.Method, r.RequestURI))
-			next.ServeHTTP(w, r)
+			if tel == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// The route template keeps the label set bounded, unlike the
+			// request path with its {limit}/{offset} values.
+			route := "unknown"
+			if current := mux.CurrentRoute(r); current != nil {
+				if template, err := current.GetPathTemplate(); err == nil {
+					route = template
+				}
+			}
+
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			start := time.Now()
+			next.ServeHTTP(recorder, r)
+
+			tel.RequestDuration.Observe(time.Since(start).Seconds(), route, r.Method)
+			tel.Requests.Inc(route, r.Method, strconv.Itoa(recorder.status))
 		})
 	}
 }
+
+// statusRecorder remembers the status code a handler responded with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if !s.wroteHeader {
+		s.status = status
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	return s.ResponseWriter.Write(b)
+}
+
+// Hijack hands the connection over to a WebSocket upgrade, which answers
+// the request itself with 101 Switching Protocols.
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(s.ResponseWriter).Hijack()
+	if err == nil && !s.wroteHeader {
+		s.status = http.StatusSwitchingProtocols
+		s.wroteHeader = true
+	}
+	return conn, rw, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -0,0 +1,152 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"metrics-app/internal/broadcast"
+	"metrics-app/internal/domain"
+	"metrics-app/internal/repository"
+	"metrics-app/internal/telemetry"
+	"metrics-app/internal/util"
+)
+
+func TestRouter_RecordsTelemetry(t *testing.T) {
+	store := repository.NewInMemoryStore(0)
+	require.NoError(t, store.Init())
+
+	tel := telemetry.New()
+	appRouter := NewRouter(store, &util.MetricsLogger{}, tel, nil, nil)
+
+	for _, body := range []string{`{"timestamp": 1722441990, "cpu_load": 10, "concurrency": 1}`, `{"timestamp": 0}`} {
+		rr := httptest.NewRecorder()
+		appRouter.ServeHTTP(rr, httptest.NewRequest("POST", "/metrics", bytes.NewBufferString(body)))
+	}
+	rr := httptest.NewRecorder()
+	appRouter.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics/10/0", bytes.NewBufferString(`{"start": 1722441990, "end": 1722441990}`)))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	NewInternalRouter(tel).ServeHTTP(rr, httptest.NewRequest("GET", "/internal/metrics", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	body := rr.Body.String()
+	assert.Contains(t, body, `metrics_app_http_requests_total{code="200",method="POST",route="/metrics"} 1`)
+	assert.Contains(t, body, `metrics_app_http_requests_total{code="400",method="POST",route="/metrics"} 1`)
+	assert.Contains(t, body, `metrics_app_http_requests_total{code="200",method="GET",route="/metrics/{limit}/{offset}"} 1`, "Routes should be labelled by template")
+	assert.Contains(t, body, `metrics_app_http_request_duration_seconds_count{method="POST",route="/metrics"} 2`)
+	assert.Contains(t, body, `metrics_app_store_operation_duration_seconds_count{operation="QueryMetrics"} 1`)
+}
+
+func TestRouter_SubscribeWithTelemetry(t *testing.T) {
+	store := repository.NewInMemoryStore(0)
+	require.NoError(t, store.Init())
+
+	// As in cmd/api, where telemetry wraps every response writer
+	tel := telemetry.New()
+	appRouter := NewRouter(store, &util.MetricsLogger{}, tel, broadcast.New(), nil)
+	server := httptest.NewUnstartedServer(appRouter)
+	server.Config = NewServer("", appRouter)
+	server.Start()
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/metrics/subscribe", nil)
+	require.NoError(t, err, "The upgrade should get through the telemetry middleware")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type": "subscribe", "id": "all"}`)))
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"type":"subscribed"`)
+
+	resp, err := http.Post(server.URL+"/metrics", "application/json", bytes.NewBufferString(`{"timestamp": 1722441990, "cpu_load": 10, "concurrency": 1}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	_, data, err = conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"cpu_load":10`)
+	require.NoError(t, conn.Close())
+
+	assert.Eventually(t, func() bool {
+		rr := httptest.NewRecorder()
+		NewInternalRouter(tel).ServeHTTP(rr, httptest.NewRequest("GET", "/internal/metrics", nil))
+		return strings.Contains(rr.Body.String(), `metrics_app_http_requests_total{code="101",method="GET",route="/metrics/subscribe"} 1`)
+	}, 5*time.Second, 10*time.Millisecond, "The upgrade should be recorded as 101")
+}
+
+func TestRouter_ShutdownEndsStreams(t *testing.T) {
+	store := repository.NewInMemoryStore(0)
+	require.NoError(t, store.Init())
+
+	broadcaster := broadcast.New()
+	server := NewServer("", NewRouter(store, &util.MetricsLogger{}, nil, broadcaster, nil))
+	server.RegisterOnShutdown(broadcaster.Close)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/metrics/stream")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Eventually(t, func() bool { return broadcaster.Subscribers() == 1 }, time.Second, time.Millisecond)
+
+	start := time.Now()
+	require.NoError(t, gracefulShutdown(server, 5*time.Second))
+	assert.Less(t, time.Since(start), time.Second, "Shutdown should not wait for open streams")
+
+	_, err = io.ReadAll(resp.Body)
+	assert.NoError(t, err, "The stream should end cleanly")
+}
+
+func TestRouter_StreamsOutliveWriteTimeout(t *testing.T) {
+	store := repository.NewInMemoryStore(0)
+	require.NoError(t, store.Init())
+	metrics := make([]domain.Metric, 0, 3000)
+	for i := 0; i < 3000; i++ {
+		metrics = append(metrics, domain.Metric{Timestamp: 1722441990 + int64(i), CPULoad: 0.5, Concurrency: i})
+	}
+	_, err := store.StoreMetrics(context.Background(), metrics)
+	require.NoError(t, err)
+
+	appRouter := NewRouter(&slowStore{MetricStore: store, delay: 150 * time.Millisecond}, &util.MetricsLogger{}, nil, nil, nil)
+	server := httptest.NewUnstartedServer(appRouter)
+	server.Config = NewServer("", appRouter)
+	// Every page is read well within the write timeout, but not the stream.
+	server.Config.WriteTimeout = 300 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	resp, err := http.Get(fmt.Sprintf("%s/metrics?start=%d&end=%d&format=csv", server.URL, 1722441990, 1722441990+2999))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err, "The stream should not be cut by the write timeout")
+	assert.Equal(t, 3001, bytes.Count(body, []byte("\n")))
+}
+
+// slowStore takes delay to read every page of metrics.
+type slowStore struct {
+	domain.MetricStore
+	delay time.Duration
+}
+
+func (s *slowStore) QueryMetrics(ctx context.Context, query domain.Query) ([]domain.Metric, error) {
+	time.Sleep(s.delay)
+	return s.MetricStore.QueryMetrics(ctx, query)
+}
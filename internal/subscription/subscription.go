@@ -0,0 +1,182 @@
+package subscription
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"metrics-app/internal/domain"
+)
+
+var ErrInvalidCondition = errors.New(`condition must look like "cpu_load > 90"`)
+
+// conditionOps are ordered so that two-character operators match first.
+var conditionOps = []string{">=", "<=", "==", "!=", ">", "<"}
+
+// Condition compares one field of a metric with a threshold, e.g.
+// cpu_load > 90.
+type Condition struct {
+	Field string
+	Op    string
+	Value float64
+}
+
+// ParseCondition reads "<field> <op> <number>" where field is cpu_load or
+// concurrency and op one of >, >=, <, <=, == and !=.
+func ParseCondition(expr string) (Condition, error) {
+	for _, op := range conditionOps {
+		field, threshold, found := strings.Cut(expr, op)
+		if !found {
+			continue
+		}
+		c := Condition{Field: strings.TrimSpace(field), Op: op}
+		if c.Field != domain.MetricCPULoad && c.Field != domain.MetricConcurrency {
+			return Condition{}, fmt.Errorf("%w: unknown field %q", ErrInvalidCondition, c.Field)
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(threshold), 64)
+		if err != nil || math.IsNaN(value) {
+			return Condition{}, fmt.Errorf("%w: invalid threshold %q", ErrInvalidCondition, strings.TrimSpace(threshold))
+		}
+		c.Value = value
+		return c, nil
+	}
+	return Condition{}, fmt.Errorf("%w: no operator in %q", ErrInvalidCondition, expr)
+}
+
+func (c Condition) Matches(m domain.Metric) bool {
+	if c.Field == domain.MetricConcurrency {
+		return c.Compare(float64(m.Concurrency))
+	}
+	return c.Compare(m.CPULoad)
+}
+
+// Compare applies the operator to value and the threshold.
+func (c Condition) Compare(value float64) bool {
+	switch c.Op {
+	case ">":
+		return value > c.Value
+	case ">=":
+		return value >= c.Value
+	case "<":
+		return value < c.Value
+	case "<=":
+		return value <= c.Value
+	case "==":
+		return value == c.Value
+	case "!=":
+		return value != c.Value
+	}
+	return false
+}
+
+func (c Condition) String() string {
+	return c.Field + " " + c.Op + " " + strconv.FormatFloat(c.Value, 'g', -1, 64)
+}
+
+// Spec describes what a subscriber wants to receive. Only the label
+// matchers of Selector apply. With an Interval in seconds, metrics are
+// downsampled per label set with Func before Condition is checked.
+type Spec struct {
+	Selector  domain.SeriesSelector
+	Condition *Condition
+	Interval  int64
+	Func      domain.AggregateFunc
+}
+
+// Subscription applies a Spec to live metrics. It is not safe for
+// concurrent use.
+type Subscription struct {
+	spec    Spec
+	matcher *domain.SeriesMatcher
+	buckets map[bucketKey]*bucket
+}
+
+type bucketKey struct {
+	start  int64
+	labels string
+}
+
+type bucket struct {
+	labels      domain.Labels
+	cpuLoad     []float64
+	concurrency []float64
+}
+
+func New(spec Spec) (*Subscription, error) {
+	matcher, err := spec.Selector.Compile()
+	if err != nil {
+		return nil, err
+	}
+	if spec.Interval < 0 {
+		return nil, domain.ErrInvalidStep
+	}
+	if spec.Interval > 0 {
+		if spec.Func == "" {
+			spec.Func = domain.AggregateAvg
+		}
+		if err := spec.Func.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &Subscription{spec: spec, matcher: matcher, buckets: make(map[bucketKey]*bucket)}, nil
+}
+
+// Offer takes a newly stored metric. Without an interval the metric is
+// returned when it matches. With one it is added to the bucket of its label
+// set and interval, and Flush reports the bucket once it has ended.
+func (s *Subscription) Offer(m domain.Metric) (domain.Metric, bool) {
+	if !s.matcher.MatchesLabels(m.Labels) {
+		return domain.Metric{}, false
+	}
+	if s.spec.Interval == 0 {
+		return m, s.spec.Condition == nil || s.spec.Condition.Matches(m)
+	}
+
+	key := bucketKey{start: m.Timestamp - m.Timestamp%s.spec.Interval, labels: m.Labels.Key()}
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{labels: m.Labels}
+		s.buckets[key] = b
+	}
+	b.cpuLoad = append(b.cpuLoad, m.CPULoad)
+	b.concurrency = append(b.concurrency, float64(m.Concurrency))
+	return domain.Metric{}, false
+}
+
+// Flush reduces and forgets the buckets that end at or before now, in order
+// of bucket start and label set. Buckets failing the condition are dropped.
+// A metric that arrives for a flushed bucket starts a new partial one.
+func (s *Subscription) Flush(now int64) []domain.Metric {
+	var ended []bucketKey
+	for key := range s.buckets {
+		if key.start+s.spec.Interval <= now {
+			ended = append(ended, key)
+		}
+	}
+	sort.Slice(ended, func(i, j int) bool {
+		if ended[i].start != ended[j].start {
+			return ended[i].start < ended[j].start
+		}
+		return ended[i].labels < ended[j].labels
+	})
+
+	var metrics []domain.Metric
+	for _, key := range ended {
+		b := s.buckets[key]
+		delete(s.buckets, key)
+
+		m := domain.Metric{
+			Timestamp:   key.start,
+			CPULoad:     domain.Aggregate(s.spec.Func, b.cpuLoad),
+			Concurrency: int(math.Round(domain.Aggregate(s.spec.Func, b.concurrency))),
+			Labels:      b.labels,
+		}
+		if s.spec.Condition == nil || s.spec.Condition.Matches(m) {
+			metrics = append(metrics, m)
+		}
+	}
+	return metrics
+}
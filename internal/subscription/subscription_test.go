@@ -0,0 +1,79 @@
+package subscription
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"metrics-app/internal/domain"
+)
+
+func TestParseCondition(t *testing.T) {
+	c, err := ParseCondition("cpu_load > 90")
+	require.NoError(t, err)
+	assert.Equal(t, Condition{Field: "cpu_load", Op: ">", Value: 90}, c)
+
+	c, err = ParseCondition("concurrency<=1e3")
+	require.NoError(t, err)
+	assert.Equal(t, Condition{Field: "concurrency", Op: "<=", Value: 1000}, c)
+	assert.Equal(t, "concurrency <= 1000", c.String())
+
+	for _, expr := range []string{"cpu_load", "memory > 1", "cpu_load > high", "cpu_load => 1", "cpu_load > NaN"} {
+		_, err := ParseCondition(expr)
+		assert.ErrorIs(t, err, ErrInvalidCondition, expr)
+	}
+}
+
+func TestSubscription_Raw(t *testing.T) {
+	condition, err := ParseCondition("cpu_load >= 90")
+	require.NoError(t, err)
+	sub, err := New(Spec{
+		Selector:  domain.SeriesSelector{Matchers: []domain.LabelMatcher{{Name: "host", Type: domain.MatchEqual, Value: "web-1"}}},
+		Condition: &condition,
+	})
+	require.NoError(t, err)
+
+	web1 := domain.Labels{"host": "web-1"}
+	hot := domain.Metric{Timestamp: 100, CPULoad: 95, Concurrency: 1, Labels: web1}
+
+	m, ok := sub.Offer(hot)
+	assert.True(t, ok)
+	assert.Equal(t, hot, m)
+
+	_, ok = sub.Offer(domain.Metric{Timestamp: 110, CPULoad: 50, Concurrency: 1, Labels: web1})
+	assert.False(t, ok, "Metrics below the threshold should be filtered")
+
+	_, ok = sub.Offer(domain.Metric{Timestamp: 120, CPULoad: 99, Concurrency: 1, Labels: domain.Labels{"host": "web-2"}})
+	assert.False(t, ok, "Metrics of other label sets should be filtered")
+
+	assert.Empty(t, sub.Flush(1000), "Raw subscriptions have no buckets")
+}
+
+func TestSubscription_Downsampled(t *testing.T) {
+	condition, err := ParseCondition("cpu_load > 50")
+	require.NoError(t, err)
+	sub, err := New(Spec{Condition: &condition, Interval: 60, Func: domain.AggregateMax})
+	require.NoError(t, err)
+
+	a := domain.Labels{"host": "a"}
+	b := domain.Labels{"host": "b"}
+	for _, m := range []domain.Metric{
+		{Timestamp: 60, CPULoad: 40, Concurrency: 1, Labels: a},
+		{Timestamp: 90, CPULoad: 70, Concurrency: 3, Labels: a},
+		{Timestamp: 61, CPULoad: 10, Concurrency: 1, Labels: b},
+		{Timestamp: 125, CPULoad: 80, Concurrency: 2, Labels: a},
+	} {
+		_, ok := sub.Offer(m)
+		assert.False(t, ok, "Downsampled metrics are only reported by Flush")
+	}
+
+	assert.Empty(t, sub.Flush(119), "Buckets should not be flushed before they end")
+	assert.Equal(t, []domain.Metric{{Timestamp: 60, CPULoad: 70, Concurrency: 3, Labels: a}}, sub.Flush(120),
+		"The bucket of host b should be dropped by the condition")
+	assert.Empty(t, sub.Flush(120), "Flushed buckets should be forgotten")
+	assert.Equal(t, []domain.Metric{{Timestamp: 120, CPULoad: 80, Concurrency: 2, Labels: a}}, sub.Flush(180))
+
+	_, err = New(Spec{Interval: 60, Func: "median"})
+	assert.ErrorIs(t, err, domain.ErrInvalidAggregateFunc)
+}
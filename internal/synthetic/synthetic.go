@@ -0,0 +1,271 @@
+package synthetic
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+
+	"metrics-app/internal/domain"
+)
+
+// Profile is a pattern of load that can be combined with others.
+type Profile string
+
+const (
+	// ProfileDiurnal follows the time of day: busiest around 14:00 UTC and
+	// quietest around 02:00, shifted by up to two hours per host.
+	ProfileDiurnal Profile = "diurnal"
+	// ProfileBurst adds short spikes of load and concurrency, about every
+	// six hours.
+	ProfileBurst Profile = "burst"
+	// ProfileStep shifts the level of load and concurrency for good, about
+	// once a day, as after a deploy.
+	ProfileStep Profile = "step"
+	// ProfileLeak ramps the load up until a restart resets it, every 6 to 24
+	// hours.
+	ProfileLeak Profile = "leak"
+	// ProfileOutage leaves gaps of 10 to 60 minutes without metrics, about
+	// once a day.
+	ProfileOutage Profile = "outage"
+)
+
+var profiles = []Profile{ProfileDiurnal, ProfileBurst, ProfileStep, ProfileLeak, ProfileOutage}
+
+const (
+	hour = 3600
+	day  = 24 * hour
+
+	// MaxHosts bounds the number of simulated hosts.
+	MaxHosts = 1000
+)
+
+var ErrInvalidConfig = errors.New("invalid synthetic load")
+
+// Config describes the load to generate: metrics of Hosts hosts every Step
+// seconds in [Start, End). The same Config, Seed included, generates the
+// same metrics.
+type Config struct {
+	Profiles []Profile
+	Hosts    int
+	Start    int64
+	End      int64
+	Step     int64
+	Seed     int64
+}
+
+// ParseProfiles reads a comma separated list of profiles, e.g.
+// "diurnal,burst".
+func ParseProfiles(s string) ([]Profile, error) {
+	var parsed []Profile
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		p := Profile(name)
+		if !p.valid() {
+			return nil, fmt.Errorf("%w: unknown profile %q", ErrInvalidConfig, name)
+		}
+		parsed = append(parsed, p)
+	}
+	return parsed, nil
+}
+
+func (p Profile) valid() bool {
+	for _, known := range profiles {
+		if p == known {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Config) Validate() error {
+	for _, p := range c.Profiles {
+		if !p.valid() {
+			return fmt.Errorf("%w: unknown profile %q", ErrInvalidConfig, p)
+		}
+	}
+	if c.Hosts < 1 || c.Hosts > MaxHosts {
+		return fmt.Errorf("%w: hosts must be between 1 and %d", ErrInvalidConfig, MaxHosts)
+	}
+	if c.Step <= 0 {
+		return domain.ErrInvalidStep
+	}
+	if c.Start <= 0 || c.End <= c.Start {
+		return fmt.Errorf("%w: start must be a positive unix time before end", ErrInvalidConfig)
+	}
+	return nil
+}
+
+func (c Config) has(p Profile) bool {
+	for _, q := range c.Profiles {
+		if q == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Generate calls emit with the metrics of every host that is not in an
+// outage, one timestamp at a time, in time order. It stops at the first
+// error of emit.
+func Generate(c Config, emit func(metrics []domain.Metric) error) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	hosts := make([]*host, c.Hosts)
+	for i := range hosts {
+		hosts[i] = newHost(c, i)
+	}
+
+	metrics := make([]domain.Metric, 0, c.Hosts)
+	for ts := c.Start; ts < c.End; ts += c.Step {
+		metrics = metrics[:0]
+		for _, h := range hosts {
+			if m, ok := h.at(c, ts); ok {
+				metrics = append(metrics, m)
+			}
+		}
+		if len(metrics) == 0 {
+			continue
+		}
+		if err := emit(metrics); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type window struct {
+	start, end int64
+}
+
+type shift struct {
+	at          int64
+	load        float64
+	concurrency float64
+}
+
+// host is one simulated host. Its events are drawn up front, so they do not
+// depend on Step.
+type host struct {
+	labels      domain.Labels
+	noise       *rand.Rand
+	load        float64
+	concurrency float64
+	phase       float64
+	bursts      schedule
+	outages     schedule
+	shifts      []shift
+	leakPeriod  int64
+	leakOffset  int64
+
+	// shifted counts the shifts that have happened; loadShift and
+	// concurrencyShift are their sum and product.
+	shifted          int
+	loadShift        float64
+	concurrencyShift float64
+}
+
+func newHost(c Config, i int) *host {
+	// Every host has its own streams, so adding hosts does not change the
+	// others.
+	events := rand.New(rand.NewSource(c.Seed + int64(i)*7919))
+	h := &host{
+		labels:      domain.Labels{"host": fmt.Sprintf("sim-%02d", i+1)},
+		noise:       rand.New(rand.NewSource(c.Seed + int64(i)*7919 + 1)),
+		load:        20 + 30*events.Float64(),
+		concurrency: 100 + 400*events.Float64(),
+		phase:       4*events.Float64() - 2,
+		leakPeriod:  int64(6*hour + events.Int63n(18*hour)),
+
+		concurrencyShift: 1,
+	}
+	h.leakOffset = events.Int63n(h.leakPeriod)
+
+	if c.has(ProfileBurst) {
+		h.bursts.windows = windows(events, c.Start, c.End, 6*hour, 5*60, 20*60)
+	}
+	if c.has(ProfileOutage) {
+		h.outages.windows = windows(events, c.Start, c.End, day, 10*60, 60*60)
+	}
+	if c.has(ProfileStep) {
+		for _, w := range windows(events, c.Start, c.End, day, 0, 0) {
+			h.shifts = append(h.shifts, shift{at: w.start, load: 30*events.Float64() - 15, concurrency: 0.7 + 0.8*events.Float64()})
+		}
+	}
+	return h
+}
+
+// windows draws the events of a Poisson process with the given mean gap in
+// [start, end), each lasting between minLength and maxLength seconds.
+func windows(r *rand.Rand, start, end int64, meanGap float64, minLength, maxLength int64) []window {
+	var drawn []window
+	t := start
+	for {
+		t += int64(r.ExpFloat64() * meanGap)
+		if t >= end {
+			return drawn
+		}
+		length := minLength
+		if maxLength > minLength {
+			length += r.Int63n(maxLength - minLength)
+		}
+		drawn = append(drawn, window{start: t, end: t + length})
+		t += length
+	}
+}
+
+// schedule is a list of windows in time order, read with timestamps that
+// only grow.
+type schedule struct {
+	windows []window
+	next    int
+}
+
+func (s *schedule) contains(ts int64) bool {
+	for s.next < len(s.windows) && s.windows[s.next].end <= ts {
+		s.next++
+	}
+	return s.next < len(s.windows) && s.windows[s.next].start <= ts
+}
+
+func (h *host) at(c Config, ts int64) (domain.Metric, bool) {
+	if h.outages.contains(ts) {
+		return domain.Metric{}, false
+	}
+
+	for ; h.shifted < len(h.shifts) && h.shifts[h.shifted].at <= ts; h.shifted++ {
+		h.loadShift += h.shifts[h.shifted].load
+		h.concurrencyShift *= h.shifts[h.shifted].concurrency
+	}
+	load := h.load + h.loadShift
+	concurrency := h.concurrency * h.concurrencyShift
+	if c.has(ProfileDiurnal) {
+		hourOfDay := float64(ts%day)/hour + h.phase
+		wave := math.Sin(2 * math.Pi * (hourOfDay - 8) / 24)
+		load += 25 * wave
+		concurrency *= 1 + 0.6*wave
+	}
+	if c.has(ProfileLeak) {
+		load += 35 * float64((ts+h.leakOffset)%h.leakPeriod) / float64(h.leakPeriod)
+	}
+	if h.bursts.contains(ts) {
+		load += 40
+		concurrency *= 3
+	}
+
+	load += 2 * h.noise.NormFloat64()
+	concurrency *= 1 + 0.05*h.noise.NormFloat64()
+
+	return domain.Metric{
+		Timestamp:   ts,
+		CPULoad:     math.Round(math.Min(math.Max(load, 0), 100)*100) / 100,
+		Concurrency: int(math.Max(math.Round(concurrency), 0)),
+		Labels:      h.labels,
+	}, true
+}
@@ -0,0 +1,113 @@
+package synthetic
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"metrics-app/internal/domain"
+)
+
+const base int64 = 1722384000 // midnight UTC
+
+func generate(t *testing.T, c Config) []domain.Metric {
+	var all []domain.Metric
+	require.NoError(t, Generate(c, func(metrics []domain.Metric) error {
+		all = append(all, metrics...)
+		return nil
+	}))
+	return all
+}
+
+func TestParseProfiles(t *testing.T) {
+	profiles, err := ParseProfiles("diurnal, burst,,leak")
+	require.NoError(t, err)
+	assert.Equal(t, []Profile{ProfileDiurnal, ProfileBurst, ProfileLeak}, profiles)
+
+	_, err = ParseProfiles("diurnal,weekly")
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+}
+
+func TestConfig_Validate(t *testing.T) {
+	valid := Config{Hosts: 1, Start: base, End: base + 60, Step: 10}
+	assert.NoError(t, valid.Validate())
+
+	for _, c := range []Config{
+		{Profiles: []Profile{"weekly"}, Hosts: 1, Start: base, End: base + 60, Step: 10},
+		{Hosts: 0, Start: base, End: base + 60, Step: 10},
+		{Hosts: MaxHosts + 1, Start: base, End: base + 60, Step: 10},
+		{Hosts: 1, Start: base, End: base, Step: 10},
+	} {
+		assert.ErrorIs(t, c.Validate(), ErrInvalidConfig, c)
+	}
+	assert.ErrorIs(t, Config{Hosts: 1, Start: base, End: base + 60}.Validate(), domain.ErrInvalidStep)
+}
+
+func TestGenerate_Reproducible(t *testing.T) {
+	c := Config{Profiles: profiles, Hosts: 3, Start: base, End: base + 2*day, Step: 60, Seed: 42}
+	first := generate(t, c)
+	assert.Equal(t, first, generate(t, c), "The same seed should generate the same load")
+
+	for _, m := range first {
+		require.NoError(t, m.Validate())
+	}
+	hosts := make(map[string]bool)
+	for _, m := range first {
+		hosts[m.Labels["host"]] = true
+	}
+	assert.Equal(t, map[string]bool{"sim-01": true, "sim-02": true, "sim-03": true}, hosts)
+
+	c.Seed = 43
+	assert.NotEqual(t, first, generate(t, c))
+
+	// Adding a host leaves the others alone
+	c.Seed, c.Hosts = 42, 4
+	var withoutFourth []domain.Metric
+	for _, m := range generate(t, c) {
+		if m.Labels["host"] != "sim-04" {
+			withoutFourth = append(withoutFourth, m)
+		}
+	}
+	assert.Equal(t, first, withoutFourth)
+}
+
+func TestGenerate_Profiles(t *testing.T) {
+	mean := func(metrics []domain.Metric, from, to int64) float64 {
+		var sum float64
+		n := 0
+		for _, m := range metrics {
+			if hourOfDay := m.Timestamp % day / hour; hourOfDay >= from && hourOfDay < to {
+				sum += m.CPULoad
+				n++
+			}
+		}
+		return sum / float64(n)
+	}
+
+	c := Config{Profiles: []Profile{ProfileDiurnal}, Hosts: 1, Start: base, End: base + 3*day, Step: 300, Seed: 7}
+	diurnal := generate(t, c)
+	assert.Len(t, diurnal, 3*day/300, "Every step has a metric without outages")
+	assert.Greater(t, mean(diurnal, 12, 16), mean(diurnal, 0, 4)+20, "Afternoons should be busier than nights")
+
+	c.Profiles = []Profile{ProfileBurst}
+	c.Step = 60
+	var peak float64
+	flat := generate(t, c)
+	for _, m := range flat {
+		peak = max(peak, m.CPULoad)
+	}
+	assert.Greater(t, peak, mean(flat, 0, 24)+30, "Bursts should stand out")
+
+	c.Profiles = []Profile{ProfileOutage}
+	c.End = base + 10*day
+	outages := generate(t, c)
+	assert.Less(t, len(outages), 10*day/60, "Outages should leave gaps")
+	gaps := 0
+	for i := 1; i < len(outages); i++ {
+		if outages[i].Timestamp-outages[i-1].Timestamp > 60 {
+			gaps++
+		}
+	}
+	assert.Greater(t, gaps, 2)
+}
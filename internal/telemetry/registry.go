@@ -0,0 +1,230 @@
+package telemetry
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"metrics-app/internal/domain"
+	"metrics-app/internal/exposition"
+)
+
+// DefaultBuckets are latency histogram buckets in seconds.
+var DefaultBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type collector interface {
+	collect() exposition.Family
+}
+
+// Registry holds the metrics the service reports about itself.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Gather snapshots every registered metric, ordered by name.
+func (r *Registry) Gather() []exposition.Family {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	families := make([]exposition.Family, 0, len(collectors))
+	for _, c := range collectors {
+		families = append(families, c.collect())
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].Name < families[j].Name })
+	return families
+}
+
+// Handler serves Gather in the Prometheus or OpenMetrics format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		contentType := exposition.Negotiate(req.Header.Get("Accept"))
+		w.Header().Set("Content-Type", contentType)
+		exposition.Write(w, contentType, r.Gather())
+	})
+}
+
+// labelSet pairs label names with the values of one series.
+func labelSet(names, values []string) domain.Labels {
+	labels := make(domain.Labels, len(names))
+	for i, name := range names {
+		if i < len(values) {
+			labels[name] = values[i]
+		} else {
+			labels[name] = ""
+		}
+	}
+	return labels
+}
+
+func sortSamples(samples []exposition.Sample) {
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Labels.Key() < samples[j].Labels.Key() })
+}
+
+// CounterVec counts events per label set.
+type CounterVec struct {
+	name       string
+	help       string
+	labelNames []string
+
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels domain.Labels
+	value  float64
+}
+
+// NewCounterVec registers a counter. name is given without the _total
+// suffix.
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labelNames: labelNames, values: make(map[string]*counterValue)}
+	r.register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	labels := labelSet(c.labelNames, labelValues)
+	key := labels.Key()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.values[key]
+	if !ok {
+		v = &counterValue{labels: labels}
+		c.values[key] = v
+	}
+	v.value++
+}
+
+func (c *CounterVec) collect() exposition.Family {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	family := exposition.Family{Name: c.name, Help: c.help, Type: exposition.Counter}
+	for _, v := range c.values {
+		family.Samples = append(family.Samples, exposition.Sample{Name: c.name + "_total", Labels: v.labels, Value: v.value})
+	}
+	sortSamples(family.Samples)
+	return family
+}
+
+// HistogramVec observes values per label set into fixed buckets.
+type HistogramVec struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	labels domain.Labels
+	// counts holds the observations per bucket; the last entry is +Inf.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogramVec registers a histogram with ascending upper bounds.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labelNames: labelNames, buckets: buckets, series: make(map[string]*histogram)}
+	r.register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	labels := labelSet(h.labelNames, labelValues)
+	key := labels.Key()
+	bucket := sort.SearchFloat64s(h.buckets, value)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{labels: labels, counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	s.counts[bucket]++
+	s.sum += value
+	s.count++
+}
+
+func (h *HistogramVec) collect() exposition.Family {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	family := exposition.Family{Name: h.name, Help: h.help, Type: exposition.Histogram}
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, count := range s.counts {
+			cumulative += count
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			labels := make(domain.Labels, len(s.labels)+1)
+			for name, value := range s.labels {
+				labels[name] = value
+			}
+			labels["le"] = formatBound(le)
+			family.Samples = append(family.Samples, exposition.Sample{Name: h.name + "_bucket", Labels: labels, Value: float64(cumulative)})
+		}
+		family.Samples = append(family.Samples,
+			exposition.Sample{Name: h.name + "_sum", Labels: s.labels, Value: s.sum},
+			exposition.Sample{Name: h.name + "_count", Labels: s.labels, Value: float64(s.count)},
+		)
+	}
+	return family
+}
+
+func formatBound(le float64) string {
+	if math.IsInf(le, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(le, 'g', -1, 64)
+}
+
+// GaugeFunc reports the value of fn at every scrape.
+type GaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, fn: fn}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeFunc) collect() exposition.Family {
+	return exposition.Family{
+		Name:    g.name,
+		Help:    g.help,
+		Type:    exposition.Gauge,
+		Samples: []exposition.Sample{{Name: g.name, Value: g.fn()}},
+	}
+}
@@ -0,0 +1,118 @@
+package telemetry
+
+import (
+	"context"
+	"time"
+
+	"metrics-app/internal/domain"
+	"metrics-app/internal/util"
+)
+
+// Telemetry bundles the metrics the API server records about itself.
+type Telemetry struct {
+	Registry        *Registry
+	Requests        *CounterVec
+	RequestDuration *HistogramVec
+	StoreDuration   *HistogramVec
+}
+
+func New() *Telemetry {
+	registry := &Registry{}
+	return &Telemetry{
+		Registry: registry,
+		Requests: registry.NewCounterVec("metrics_app_http_requests",
+			"HTTP requests served, by route, method and status code.", "route", "method", "code"),
+		RequestDuration: registry.NewHistogramVec("metrics_app_http_request_duration_seconds",
+			"Time to serve HTTP requests, by route and method.", DefaultBuckets, "route", "method"),
+		StoreDuration: registry.NewHistogramVec("metrics_app_store_operation_duration_seconds",
+			"Time spent in metric store operations.", DefaultBuckets, "operation"),
+	}
+}
+
+// WatchLogger reports the fill level of the log buffer of logger.
+func (t *Telemetry) WatchLogger(logger *util.MetricsLogger) {
+	t.Registry.NewGaugeFunc("metrics_app_log_buffer_length", "Log events waiting to be written.", func() float64 {
+		length, _ := logger.BufferFill()
+		return float64(length)
+	})
+	t.Registry.NewGaugeFunc("metrics_app_log_buffer_capacity", "Log events the buffer holds before logging blocks.", func() float64 {
+		_, capacity := logger.BufferFill()
+		return float64(capacity)
+	})
+}
+
+// InstrumentStore times the read and write operations of store. Optional
+// interfaces of store are not forwarded, so background jobs should keep
+// using the store itself.
+func (t *Telemetry) InstrumentStore(store domain.MetricStore) domain.MetricStore {
+	return &instrumentedStore{MetricStore: store, duration: t.StoreDuration}
+}
+
+type instrumentedStore struct {
+	domain.MetricStore
+	duration *HistogramVec
+}
+
+func (s *instrumentedStore) observe(operation string, start time.Time) {
+	s.duration.Observe(time.Since(start).Seconds(), operation)
+}
+
+func (s *instrumentedStore) StoreMetric(ctx context.Context, metric domain.Metric) error {
+	defer s.observe("StoreMetric", time.Now())
+	return s.MetricStore.StoreMetric(ctx, metric)
+}
+
+func (s *instrumentedStore) StoreMetrics(ctx context.Context, metrics []domain.Metric) (domain.BatchResult, error) {
+	defer s.observe("StoreMetrics", time.Now())
+	return s.MetricStore.StoreMetrics(ctx, metrics)
+}
+
+func (s *instrumentedStore) StoreSamples(ctx context.Context, samples []domain.Sample) (domain.BatchResult, error) {
+	defer s.observe("StoreSamples", time.Now())
+	return s.MetricStore.StoreSamples(ctx, samples)
+}
+
+func (s *instrumentedStore) GetMetrics(ctx context.Context, startTime, endTime int64, limit, offset int) ([]domain.Metric, error) {
+	defer s.observe("GetMetrics", time.Now())
+	return s.MetricStore.GetMetrics(ctx, startTime, endTime, limit, offset)
+}
+
+func (s *instrumentedStore) QueryMetrics(ctx context.Context, query domain.Query) ([]domain.Metric, error) {
+	defer s.observe("QueryMetrics", time.Now())
+	return s.MetricStore.QueryMetrics(ctx, query)
+}
+
+func (s *instrumentedStore) CountMetrics(ctx context.Context, query domain.Query) (int64, error) {
+	defer s.observe("CountMetrics", time.Now())
+	return s.MetricStore.CountMetrics(ctx, query)
+}
+
+func (s *instrumentedStore) QuerySamples(ctx context.Context, query domain.Query) ([]domain.Sample, error) {
+	defer s.observe("QuerySamples", time.Now())
+	return s.MetricStore.QuerySamples(ctx, query)
+}
+
+func (s *instrumentedStore) CountSamples(ctx context.Context, query domain.Query) (int64, error) {
+	defer s.observe("CountSamples", time.Now())
+	return s.MetricStore.CountSamples(ctx, query)
+}
+
+func (s *instrumentedStore) AggregateSamples(ctx context.Context, query domain.AggregateQuery) ([]domain.Series, error) {
+	defer s.observe("AggregateSamples", time.Now())
+	return s.MetricStore.AggregateSamples(ctx, query)
+}
+
+func (s *instrumentedStore) SummarizeSamples(ctx context.Context, query domain.Query) ([]domain.SeriesStatistics, error) {
+	defer s.observe("SummarizeSamples", time.Now())
+	return s.MetricStore.SummarizeSamples(ctx, query)
+}
+
+func (s *instrumentedStore) LatestSamples(ctx context.Context, selector domain.SeriesSelector) ([]domain.Sample, error) {
+	defer s.observe("LatestSamples", time.Now())
+	return s.MetricStore.LatestSamples(ctx, selector)
+}
+
+func (s *instrumentedStore) DeleteBefore(ctx context.Context, ts int64) (int64, error) {
+	defer s.observe("DeleteBefore", time.Now())
+	return s.MetricStore.DeleteBefore(ctx, ts)
+}
@@ -0,0 +1,83 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"metrics-app/internal/domain"
+	"metrics-app/internal/exposition"
+	"metrics-app/internal/repository"
+)
+
+func TestRegistry_Gather(t *testing.T) {
+	registry := &Registry{}
+	requests := registry.NewCounterVec("requests", "Requests.", "code")
+	latency := registry.NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "route")
+	registry.NewGaugeFunc("backlog", "Backlog.", func() float64 { return 7 })
+
+	requests.Inc("200")
+	requests.Inc("200")
+	requests.Inc("500")
+	latency.Observe(0.05, "/a")
+	latency.Observe(0.1, "/a")
+	latency.Observe(3, "/a")
+
+	var out bytes.Buffer
+	require.NoError(t, exposition.Write(&out, exposition.TextContentType, registry.Gather()))
+	assert.Equal(t, `# HELP backlog Backlog.
+# TYPE backlog gauge
+backlog 7
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1",route="/a"} 2
+latency_seconds_bucket{le="1",route="/a"} 2
+latency_seconds_bucket{le="+Inf",route="/a"} 3
+latency_seconds_sum{route="/a"} 3.15
+latency_seconds_count{route="/a"} 3
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{code="200"} 2
+requests_total{code="500"} 1
+`, out.String())
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	registry := &Registry{}
+	registry.NewGaugeFunc("backlog", "Backlog.", func() float64 { return 1 })
+
+	req := httptest.NewRequest("GET", "/internal/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text")
+	rr := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, exposition.OpenMetricsContentType, rr.Header().Get("Content-Type"))
+	assert.Contains(t, rr.Body.String(), "backlog 1\n# EOF\n")
+}
+
+func TestInstrumentStore(t *testing.T) {
+	tel := New()
+	inMemoryStore := repository.NewInMemoryStore(0)
+	require.NoError(t, inMemoryStore.Init())
+	store := tel.InstrumentStore(inMemoryStore)
+
+	ctx := context.Background()
+	require.NoError(t, store.StoreMetric(ctx, domain.Metric{Timestamp: 1722441990, CPULoad: 1, Concurrency: 1}))
+	retrieved, err := store.GetMetrics(ctx, 0, 1722441990, 0, 0)
+	require.NoError(t, err)
+	assert.Len(t, retrieved, 1, "Calls should reach the wrapped store")
+
+	counts := make(map[string]float64)
+	for _, sample := range tel.StoreDuration.collect().Samples {
+		if sample.Name == "metrics_app_store_operation_duration_seconds_count" {
+			counts[sample.Labels["operation"]] = sample.Value
+		}
+	}
+	assert.Equal(t, map[string]float64{"StoreMetric": 1, "GetMetrics": 1}, counts)
+}
@@ -153,6 +153,12 @@ func (m *MetricsLogger) LogEvent(v ...interface{}) error {
 	return nil
 }
 
+// BufferFill reports how many log events are waiting to be written and how
+// many the buffer holds. LogEvent blocks once the buffer is full.
+func (m *MetricsLogger) BufferFill() (int, int) {
+	return len(m.logBuffer), cap(m.logBuffer)
+}
+
 func (m *MetricsLogger) DeInit() {
 
 	if !m.loggerInitialized {